@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"math/rand"
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/rs/zerolog/log"
@@ -20,6 +21,42 @@ type JsonUsersRandomResponse struct {
 	UserIDs []int `json:"user_ids"`
 }
 
+type JsonUsersAttributesRequest struct {
+	AfterUserID int `json:"after_user_id"`
+	Limit       int `json:"limit"`
+}
+
+type JsonUserAttributes struct {
+	UserID     int            `json:"user_id"`
+	Attributes map[string]any `json:"attributes"`
+}
+
+type JsonUsersAttributesResponse struct {
+	Users []JsonUserAttributes `json:"users"`
+}
+
+// users are 1000 to 1299, just like the random ones
+const (
+	firstUserID = 1000
+	usersCount  = 300
+)
+
+var countries = []string{"RU", "KZ", "BY", "AM"}
+
+// userAttributes makes up attributes of the user. They only depend on the id,
+// so rules evaluated on them give the same users every time
+func userAttributes(userID int) map[string]any {
+	n := userID - firstUserID
+	signupDate := time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC).AddDate(0, 0, n*2)
+
+	return map[string]any{
+		"country":     countries[n%len(countries)],
+		"signup_date": signupDate.Format("2006-01-02"),
+		"age":         18 + n%50,
+		"premium":     n%10 == 0,
+	}
+}
+
 func UsersRandomHandler(w http.ResponseWriter, r *http.Request) {
 	var j JsonUsersRandomRequest
 	if err := json.NewDecoder(r.Body).Decode(&j); err != nil {
@@ -61,6 +98,33 @@ func UsersRandomHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
+func UsersAttributesHandler(w http.ResponseWriter, r *http.Request) {
+	var j JsonUsersAttributesRequest
+	if err := json.NewDecoder(r.Body).Decode(&j); err != nil {
+		log.Error().Err(err).Msg("")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("{\"status_code\": 400, \"error_message\": \"Error while unmarshalling request JSON\"}"))
+		return
+	}
+
+	users := make([]JsonUserAttributes, 0, j.Limit)
+	for userID := max(j.AfterUserID+1, firstUserID); userID < firstUserID+usersCount && len(users) < j.Limit; userID++ {
+		users = append(users, JsonUserAttributes{userID, userAttributes(userID)})
+	}
+
+	response := JsonUsersAttributesResponse{users}
+	b, err := json.Marshal(response)
+	if err != nil {
+		log.Error().Err(err).Msg("")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("{\"status_code\": 500, \"error_message\": \"Internal server error\"}"))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
 func main() {
 	mux := chi.NewMux()
 
@@ -68,6 +132,7 @@ func main() {
 		w.Write([]byte("{\"status\": \"OK\"}"))
 	})
 	mux.Get("/api/v1/users/random", UsersRandomHandler)
+	mux.Get("/api/v1/users/attributes", UsersAttributesHandler)
 
 	log.Info().Msg("Listening at :80")
 	if err := http.ListenAndServe(":80", mux); err != nil {
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"net/http"
 
@@ -10,16 +10,49 @@ import (
 	v1 "github.com/QiZD90/dynamic-customer-segmentation/internal/controller/http/v1"
 	"github.com/QiZD90/dynamic-customer-segmentation/internal/filestorage"
 	"github.com/QiZD90/dynamic-customer-segmentation/internal/filestorage/ondisk"
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/repository"
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/repository/memory"
 	"github.com/QiZD90/dynamic-customer-segmentation/internal/repository/postgres"
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/repository/sqlite"
 	"github.com/QiZD90/dynamic-customer-segmentation/internal/service"
 	"github.com/QiZD90/dynamic-customer-segmentation/internal/timeprovider/realtimeprovider"
 	"github.com/QiZD90/dynamic-customer-segmentation/internal/userservice/usermicroservice"
-	"github.com/golang-migrate/migrate/v4"
-	_ "github.com/golang-migrate/migrate/v4/database/postgres"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
 	"github.com/rs/zerolog/log"
 )
 
+// newRepository creates repository of the configured backend and migrates it if it's needed
+func newRepository(cfg *config.Config) (repository.Repository, error) {
+	switch cfg.Repository.Backend {
+	case config.MemoryRepositoryBackend:
+		log.Warn().Msg("Using in-memory repository, all data will be lost on exit")
+		return memory.New(realtimeprovider.New()), nil
+	case config.SqliteRepositoryBackend:
+		repo, err := sqlite.New(cfg.Sqlite.Path, realtimeprovider.New())
+		if err != nil {
+			return nil, fmt.Errorf("error while opening sqlite database: %w", err)
+		}
+
+		log.Info().Msg("Starting migrations...")
+		if err := repo.Migrate("file://migrations/sqlite"); err != nil {
+			return nil, err
+		}
+
+		return repo, nil
+	default:
+		repo, err := postgres.New(cfg.Postgres.Addr, realtimeprovider.New())
+		if err != nil {
+			return nil, fmt.Errorf("error while connecting to postgres: %w", err)
+		}
+
+		log.Info().Msg("Starting migrations...")
+		if err := repo.Migrate("file://migrations/postgres"); err != nil {
+			return nil, err
+		}
+
+		return repo, nil
+	}
+}
+
 // @title Dynamic Customer Segmentation
 // @version 1.0
 // @description Microservice for managing analytics segments
@@ -37,9 +70,9 @@ func main() {
 	}
 
 	// Create repository
-	repo, err := postgres.New(cfg.Postgres.Addr, realtimeprovider.New())
+	repo, err := newRepository(cfg)
 	if err != nil {
-		log.Fatal().Err(err).Msg("error while connecting to postgres")
+		log.Fatal().Err(err).Msg("error while creating repository")
 	}
 
 	// Create filestorage
@@ -54,30 +87,25 @@ func main() {
 		log.Fatal().Err(err).Msg("error while connecting to usermicroservice")
 	}
 
-	// Migrate up to date
-	log.Info().Msg("Starting migrations...")
-	m, err := migrate.New("file://migrations", cfg.Postgres.Addr)
-	if err != nil {
-		log.Fatal().Err(err).Msg("")
-	}
+	// Instantiate service
+	s := service.New(repo, fstorage, userService, realtimeprovider.New())
+	s.AddChangeHook(logChanges)
 
-	if err := m.Up(); err != nil {
-		if errors.Is(err, migrate.ErrNoChange) {
-			log.Info().Msg("Already up to date")
-		} else {
-			log.Fatal().Err(err).Msg("")
-		}
+	// Start recording expired memberships
+	if cfg.Service.ExpirationSweepInterval > 0 {
+		go runExpirationSweeper(context.Background(), s, cfg.Service.ExpirationSweepInterval)
 	}
 
-	if src_err, db_err := m.Close(); src_err != nil || db_err != nil {
-		log.Fatal().AnErr("src_err", src_err).AnErr("db_err", db_err).Msg("")
+	// Start refreshing dynamic segments
+	if cfg.Service.DynamicSegmentRefreshInterval > 0 {
+		go runDynamicSegmentRefresher(context.Background(), s, cfg.Service.DynamicSegmentRefreshInterval)
 	}
 
-	// Instantiate service
-	s := service.New(repo, fstorage, userService)
-
 	// Get mux
-	mux := v1.NewMux(s)
+	var mux http.Handler = v1.NewMux(s)
+	if cfg.Server.RequestTimeout > 0 {
+		mux = v1.RequestTimeout(cfg.Server.RequestTimeout)(mux)
+	}
 
 	// Start the server
 	addr := fmt.Sprintf("%s:%s", cfg.Server.Host, cfg.Server.Port)
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/entity"
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/service"
+	"github.com/rs/zerolog/log"
+)
+
+// runExpirationSweeper records expired memberships every `interval` until the context is cancelled.
+// Replicas may run it at the same time, every expiration is recorded once
+func runExpirationSweeper(ctx context.Context, s service.Service, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		count, err := s.ExpireMemberships(ctx)
+		if err != nil {
+			log.Error().Err(err).Msg("error while recording expired memberships")
+			continue
+		}
+
+		if count > 0 {
+			log.Info().Int("count", count).Msg("Recorded expired memberships")
+		}
+	}
+}
+
+// runDynamicSegmentRefresher refreshes dynamic segments by their rules every `interval` until the context is cancelled
+func runDynamicSegmentRefresher(ctx context.Context, s service.Service, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		results, err := s.RefreshDynamicSegments(ctx)
+		if err != nil {
+			log.Error().Err(err).Msg("error while refreshing dynamic segments")
+			continue
+		}
+
+		for _, result := range results {
+			if result.AddedCount > 0 || result.RemovedCount > 0 {
+				log.Info().
+					Str("segment", result.Slug).
+					Int("added", result.AddedCount).
+					Int("removed", result.RemovedCount).
+					Msg("Refreshed dynamic segment")
+			}
+		}
+	}
+}
+
+// logChanges is a change hook that logs every change of user memberships
+func logChanges(ctx context.Context, operations []entity.Operation) {
+	for _, o := range operations {
+		log.Debug().
+			Int("user_id", o.UserID).
+			Str("segment", o.SegmentSlug).
+			Str("type", string(o.Type)).
+			Time("time", o.Time).
+			Msg("Membership changed")
+	}
+}
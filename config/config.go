@@ -1,13 +1,25 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"time"
+
 	"github.com/caarlos0/env"
 )
 
+const (
+	PostgresRepositoryBackend = "postgres"
+	SqliteRepositoryBackend   = "sqlite"
+	MemoryRepositoryBackend   = "memory"
+)
+
 type Config struct {
 	Service     ServiceConfig
 	Server      ServerConfig
+	Repository  RepositoryConfig
 	Postgres    PostgresConfig
+	Sqlite      SqliteConfig
 	OnDisk      OnDiskConfig
 	UserService UserServiceConfig
 	//AWS      AWSConfig
@@ -16,13 +28,31 @@ type Config struct {
 type ServerConfig struct {
 	Host string `env:"HTTP_HOST,required"`
 	Port string `env:"HTTP_PORT,required"`
+
+	// RequestTimeout limits the time of every request, 0 means no limit
+	RequestTimeout time.Duration `env:"HTTP_REQUEST_TIMEOUT" envDefault:"0s"`
 }
 
 type ServiceConfig struct {
+	// ExpirationSweepInterval is how often expired memberships are recorded as expired, 0 turns it off
+	ExpirationSweepInterval time.Duration `env:"EXPIRATION_SWEEP_INTERVAL" envDefault:"1m"`
+
+	// DynamicSegmentRefreshInterval is how often dynamic segments are refreshed by their rules, 0 turns it off
+	DynamicSegmentRefreshInterval time.Duration `env:"DYNAMIC_SEGMENT_REFRESH_INTERVAL" envDefault:"1h"`
+}
+
+type RepositoryConfig struct {
+	// Backend is one of "postgres", "sqlite" or "memory"
+	Backend string `env:"REPOSITORY_BACKEND" envDefault:"postgres"`
 }
 
 type PostgresConfig struct {
-	Addr string `env:"POSTGRES_URL,required"`
+	// Addr is required only if postgres repository backend is used
+	Addr string `env:"POSTGRES_URL"`
+}
+
+type SqliteConfig struct {
+	Path string `env:"SQLITE_PATH" envDefault:"segmentation.db"`
 }
 
 type OnDiskConfig struct {
@@ -45,10 +75,18 @@ func Parse() (*Config, error) {
 		return nil, err
 	}
 
+	if err := env.Parse(&cfg.Repository); err != nil {
+		return nil, err
+	}
+
 	if err := env.Parse(&cfg.Postgres); err != nil {
 		return nil, err
 	}
 
+	if err := env.Parse(&cfg.Sqlite); err != nil {
+		return nil, err
+	}
+
 	if err := env.Parse(&cfg.OnDisk); err != nil {
 		return nil, err
 	}
@@ -61,5 +99,15 @@ func Parse() (*Config, error) {
 		return nil, err
 	}
 
+	switch cfg.Repository.Backend {
+	case PostgresRepositoryBackend:
+		if cfg.Postgres.Addr == "" {
+			return nil, errors.New("POSTGRES_URL is required for postgres repository backend")
+		}
+	case SqliteRepositoryBackend, MemoryRepositoryBackend:
+	default:
+		return nil, fmt.Errorf("unknown repository backend %q", cfg.Repository.Backend)
+	}
+
 	return &cfg, nil
 }
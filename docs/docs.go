@@ -19,16 +19,16 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
-        "/api/v1/segment/create": {
+        "/api/v1/experiment/create": {
             "post": {
-                "description": "Create new segment with given slug. If there is already active segment with this slug,\nor if there was a segment with this slug but it has been deleted, responds with an error and 400 status code",
+                "description": "Creates an experiment with given slug and its variant segments. Variants are plain segments\nin the exclusion group named after the experiment, so a user can be in at most one of them.\nThere must be at least two variants with distinct slugs and positive weights that sum up to 100.\nThe experiment isn't started, so it doesn't enroll users until ` + "`" + `/experiment/start` + "`" + `.\nIf there is already an experiment with this slug, or if any of the variant slugs is taken by a segment,\nresponds with an error and 400 status code",
                 "consumes": [
                     "application/json"
                 ],
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Create new segment",
+                "summary": "Create new experiment",
                 "parameters": [
                     {
                         "description": "input",
@@ -36,7 +36,7 @@ const docTemplate = `{
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_http_v1.JsonCreateSegmentRequest"
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonCreateExperimentRequest"
                         }
                     }
                 ],
@@ -62,16 +62,16 @@ const docTemplate = `{
                 }
             }
         },
-        "/api/v1/segment/create/enroll": {
+        "/api/v1/experiment/enroll": {
             "post": {
-                "description": "Creates new segment with given slug. If there is already active segment with this slug,\nor if there was a segment with this slug but it has been deleted, responds with an error and 400 status code\nGet a percent of randomly selected users from user DB service and tries to add the newly created segment to them.",
+                "description": "Get a percent of randomly selected users from user DB service and adds every one of them to the variant\ntheir bucket in the experiment falls into, so users are split by the weights of the variants and the same user\nalways gets the same variant. Users that already have the variant are counted in ` + "`" + `skipped_count` + "`" + `,\nusers that are in another variant are counted in ` + "`" + `excluded_count` + "`" + `. Memberships expire at ` + "`" + `expires_at` + "`" + `, if it's set,\notherwise after ` + "`" + `default_ttl` + "`" + ` of the variant, if it's set. If there is no experiment like this, if it isn't running,\nif any of its variants was deleted or if ` + "`" + `expires_at` + "`" + ` is in the past, responds with an error and 400 status code",
                 "consumes": [
                     "application/json"
                 ],
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Creates new segment and adds it to randomly selected users",
+                "summary": "Adds variants of a running experiment to randomly selected users",
                 "parameters": [
                     {
                         "description": "input",
@@ -79,15 +79,15 @@ const docTemplate = `{
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_http_v1.JsonSegmentCreateAndEnroll"
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonExperimentEnroll"
                         }
                     }
                 ],
                 "responses": {
                     "200": {
-                        "description": "IDs of users that were selected",
+                        "description": "IDs of users that were selected and how many of them got every variant",
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_http_v1.JsonUserIDs"
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonExperimentEnrollment"
                         }
                     },
                     "400": {
@@ -105,16 +105,16 @@ const docTemplate = `{
                 }
             }
         },
-        "/api/v1/segment/delete": {
+        "/api/v1/experiment/start": {
             "post": {
-                "description": "Marks a segment by this slug as deleted. If there is no segment like this, or if was already deleted,\nresponds with an error and 400 status code",
+                "description": "Records the start of the experiment, from then on it enrolls users. If there is no experiment like this,\nor if it was started before, responds with an error and 400 status code",
                 "consumes": [
                     "application/json"
                 ],
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Delete a segment",
+                "summary": "Start an experiment",
                 "parameters": [
                     {
                         "description": "input",
@@ -122,7 +122,7 @@ const docTemplate = `{
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_http_v1.JsonDeleteSegmentRequest"
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonExperimentRequest"
                         }
                     }
                 ],
@@ -148,50 +148,82 @@ const docTemplate = `{
                 }
             }
         },
-        "/api/v1/segments": {
-            "get": {
-                "description": "Get all segments (even deleted)",
+        "/api/v1/experiment/stop": {
+            "post": {
+                "description": "Records the stop of the experiment, from then on it doesn't enroll users. Users keep the variants they got.\nIf there is no experiment like this, if it isn't started or if it was stopped before,\nresponds with an error and 400 status code",
+                "consumes": [
+                    "application/json"
+                ],
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Get all segments",
+                "summary": "Stop an experiment",
+                "parameters": [
+                    {
+                        "description": "input",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonExperimentRequest"
+                        }
+                    }
+                ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_http_v1.JsonSegments"
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonStatus"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
                         }
                     }
                 }
             }
         },
-        "/api/v1/segments/active": {
+        "/api/v1/experiments": {
             "get": {
-                "description": "Get all active (not deleted) segments",
+                "description": "Get every experiment with its variants and the times it was created, started and stopped, oldest first",
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Get all active segments",
+                "summary": "Get all experiments",
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_http_v1.JsonSegments"
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonExperiments"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
                         }
                     }
                 }
             }
         },
-        "/api/v1/user/csv": {
-            "get": {
-                "description": "Generate CSV report file on user's segment history and uploads it to service's configured file storage service.\nNote thah ` + "`" + `month` + "`" + ` param in date is an integer that ranges from 1 (january) to 12 (december)\nAlso note that the specified range includes the \"from\" date but excludes the \"to\" date",
+        "/api/v1/segment/create": {
+            "post": {
+                "description": "Create new segment with given slug and optional metadata (description, owner, tags and attributes).\n` + "`" + `default_ttl` + "`" + ` (ISO-8601 like ` + "`" + `P30D` + "`" + ` or Go like ` + "`" + `720h` + "`" + ` duration) sets the expiration of memberships\nthat are added without an explicit one. ` + "`" + `parent` + "`" + ` is the slug of an active segment this one is nested in:\nmembers of the segment are inherited members of the parent and its ancestors.\n` + "`" + `expression` + "`" + ` makes the segment composite: users are in it while a boolean expression over other segments\n(` + "`" + `AND` + "`" + `, ` + "`" + `OR` + "`" + `, ` + "`" + `NOT` + "`" + ` and parentheses, like ` + "`" + `VOICE_MESSAGES AND NOT PERFORMANCE_VAS` + "`" + `) holds for them.\nIt must reference only active segments, must not depend on the segment itself and must not match users\nthat are in none of its segments. ` + "`" + `rule` + "`" + ` makes the segment dynamic: users are added to it and removed from it\nas their attributes in user DB service start or stop matching a rule like ` + "`" + `country = \"RU\" AND signup_date \u003e 2023-01-01` + "`" + `\n(` + "`" + `=` + "`" + `, ` + "`" + `!=` + "`" + `, ` + "`" + `\u003c` + "`" + `, ` + "`" + `\u003c=` + "`" + `, ` + "`" + `\u003e` + "`" + `, ` + "`" + `\u003e=` + "`" + ` with strings in double quotes, numbers, dates and booleans, ` + "`" + `AND` + "`" + `, ` + "`" + `OR` + "`" + `, ` + "`" + `NOT` + "`" + `\nand parentheses). Users that match it are added right away, then on every refresh.\nA segment can't be both composite and dynamic. ` + "`" + `exclusion_group` + "`" + ` puts the segment in a named group of mutually\nexclusive segments: a user can be in at most one of them, composite and dynamic segments can't be in one.\n` + "`" + `bucket_percent` + "`" + ` makes the segment bucketed: user is in it if the hash of ` + "`" + `bucket_salt` + "`" + ` (the slug by default)\nand user id falls into the first ` + "`" + `bucket_percent` + "`" + ` of 100 buckets. Bucketed memberships aren't stored, any user id\ngets the same answer every time, and raising the percent only adds users. Bucketed segments can't be composite,\ndynamic or in an exclusion group. If there is already active segment with this slug,\nor if there was a segment with this slug but it has been deleted, responds with an error and 400 status code",
                 "consumes": [
                     "application/json"
                 ],
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Generate CSV report on user's segment history",
+                "summary": "Create new segment",
                 "parameters": [
                     {
                         "description": "input",
@@ -199,7 +231,7 @@ const docTemplate = `{
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_http_v1.JsonUserCSVRequest"
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonCreateSegmentRequest"
                         }
                     }
                 ],
@@ -207,7 +239,7 @@ const docTemplate = `{
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_http_v1.JsonLink"
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonStatus"
                         }
                     },
                     "400": {
@@ -225,15 +257,16 @@ const docTemplate = `{
                 }
             }
         },
-        "/api/v1/user/segments": {
-            "get": {
+        "/api/v1/segment/create/enroll": {
+            "post": {
+                "description": "Creates new segment with given slug. If there is already active segment with this slug,\nor if there was a segment with this slug but it has been deleted, responds with an error and 400 status code\nGet a percent of randomly selected users from user DB service and tries to add the newly created segment to them.\nTheir memberships expire after ` + "`" + `default_ttl` + "`" + ` of the segment, if it's set. Composite, dynamic and bucketed segments can't be enrolled into.\nSampled users that are in another segment of the exclusion group of the segment are replaced by sampling again,\nthose that join another segment of the group meanwhile don't get it and are counted in ` + "`" + `excluded_count` + "`" + `.",
                 "consumes": [
                     "application/json"
                 ],
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Get user's active segments",
+                "summary": "Creates new segment and adds it to randomly selected users",
                 "parameters": [
                     {
                         "description": "input",
@@ -241,15 +274,15 @@ const docTemplate = `{
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_http_v1.JsonUserSegmentsHandlerRequest"
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonSegmentCreateAndEnroll"
                         }
                     }
                 ],
                 "responses": {
                     "200": {
-                        "description": "OK",
+                        "description": "IDs of users that were selected and how many of them got the segment",
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_http_v1.JsonUserSegments"
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonEnrollment"
                         }
                     },
                     "400": {
@@ -267,16 +300,16 @@ const docTemplate = `{
                 }
             }
         },
-        "/api/v1/user/update": {
+        "/api/v1/segment/delete": {
             "post": {
-                "description": "Tries to add and remove segments from user. If any of the specified segments are not active\nor if any of the lists contains same segment twice or if both list contain the same segment\nresponds with an error and 400 status code.\nYou can specify expiry date for segments. This field is ignored in segments in remove list.\nIf you try add a segment to a user that already has it or you try to remove it from a user\nthat doesn't have it then that segment is skipped. Note, that if you try to modify expiry\ndate of an active segment, the correct way to do it is to remove it and then add a new one.",
+                "description": "Marks a segment by this slug as deleted. If there is no segment like this, or if was already deleted,\nresponds with an error and 400 status code. ` + "`" + `children` + "`" + ` tells what happens to active child segments:\n` + "`" + `restrict` + "`" + ` (default) refuses to delete a segment that has them, ` + "`" + `cascade` + "`" + ` deletes them and their descendants too\nand ` + "`" + `detach` + "`" + ` makes them top-level segments. Segments referenced by expressions of active composite segments\naren't deleted unless ` + "`" + `force` + "`" + ` is set, then they count as having no members in these expressions",
                 "consumes": [
                     "application/json"
                 ],
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Add and remove segments from user",
+                "summary": "Delete a segment",
                 "parameters": [
                     {
                         "description": "input",
@@ -284,7 +317,7 @@ const docTemplate = `{
                         "in": "body",
                         "required": true,
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_http_v1.JsonUserUpdateRequest"
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonDeleteSegmentRequest"
                         }
                     }
                 ],
@@ -310,87 +343,1196 @@ const docTemplate = `{
                 }
             }
         },
-        "/csv/{fname}": {
-            "get": {
-                "description": "Get static CSV file stored on disk",
-                "summary": "Get CSV file",
-                "responses": {}
+        "/api/v1/segment/enroll": {
+            "post": {
+                "description": "Get a percent of randomly selected users from user DB service and tries to add the active segment to them.\nUsers are selected regardless of who already has the segment, those that had it are counted in ` + "`" + `skipped_count` + "`" + `.\nTheir memberships expire at ` + "`" + `expires_at` + "`" + ` if it's set, otherwise after ` + "`" + `default_ttl` + "`" + ` of the segment, if it's set.\nSampled users that are in another segment of the exclusion group of the segment are replaced by sampling again,\nthose that join another segment of the group meanwhile don't get it and are counted in ` + "`" + `excluded_count` + "`" + `.\nIf there is no segment like this, if it was deleted, if it's composite, dynamic or bucketed,\nor if ` + "`" + `expires_at` + "`" + ` is in the past, responds with an error and 400 status code",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Adds existing segment to randomly selected users",
+                "parameters": [
+                    {
+                        "description": "input",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonSegmentEnroll"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "IDs of users that were selected and how many of them got the segment",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonEnrollment"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
+                        }
+                    }
+                }
             }
         },
-        "/health": {
+        "/api/v1/segment/members": {
             "get": {
+                "description": "Get ids of users that are in the segment (or were in it at ` + "`" + `as_of` + "`" + `) page by page, sorted by id.\nDeleted segments and old slugs can be looked up too. Members of composite segments are computed from the members\nof the segments their expressions reference, members of bucketed segments are the users of user DB service\nwhose buckets are in the current percent. To get the next page pass ` + "`" + `next_cursor` + "`" + ` of the response\nas ` + "`" + `cursor` + "`" + `, every page is built for the ` + "`" + `as_of` + "`" + ` of the first one. The last page has no ` + "`" + `next_cursor` + "`" + `",
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Health check",
+                "summary": "Get users that are in the segment",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "slug of the segment",
+                        "name": "slug",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "moment at which users must have been in the segment (RFC 3339), now by default",
+                        "name": "as_of",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "next_cursor from the previous page",
+                        "name": "cursor",
+                        "in": "query"
+                    },
+                    {
+                        "maximum": 10000,
+                        "minimum": 1,
+                        "type": "integer",
+                        "default": 1000,
+                        "description": "page size",
+                        "name": "limit",
+                        "in": "query"
+                    }
+                ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_http_v1.JsonStatus"
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonSegmentMembers"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
                         }
                     }
                 }
             }
-        }
-    },
-    "definitions": {
-        "github_com_QiZD90_dynamic-customer-segmentation_internal_entity.Segment": {
-            "type": "object",
-            "properties": {
-                "created_at": {
-                    "type": "string"
-                },
-                "deleted_at": {
-                    "type": "string"
-                },
-                "slug": {
-                    "type": "string"
-                }
-            }
-        },
-        "github_com_QiZD90_dynamic-customer-segmentation_internal_entity.SegmentExpiration": {
-            "type": "object",
-            "properties": {
-                "expires_at": {
-                    "type": "string"
-                },
-                "slug": {
-                    "type": "string"
-                }
-            }
         },
-        "github_com_QiZD90_dynamic-customer-segmentation_internal_entity.UserSegment": {
-            "type": "object",
-            "properties": {
-                "added_at": {
-                    "type": "string"
-                },
-                "deleted_at": {
-                    "type": "string"
-                },
-                "expires_at": {
-                    "type": "string"
-                },
-                "slug": {
-                    "type": "string"
+        "/api/v1/segment/members/stream": {
+            "get": {
+                "description": "Streams ids of all users that are in the segment (or were in it at ` + "`" + `as_of` + "`" + `) as plain text, one id per line,\nsorted by id. Members of composite and bucketed segments are computed the same way as in /api/v1/segment/members.\nMeant for segments that are too large to be fetched page by page. Errors that occur after\nthe first id was sent can't be reported, so the response is cut short instead",
+                "produces": [
+                    "text/plain"
+                ],
+                "summary": "Stream all users that are in the segment",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "slug of the segment",
+                        "name": "slug",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "moment at which users must have been in the segment (RFC 3339), now by default",
+                        "name": "as_of",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
+                        }
+                    }
                 }
             }
         },
-        "internal_controller_http_v1.JsonCreateSegmentRequest": {
-            "type": "object",
-            "properties": {
-                "slug": {
-                    "type": "string"
+        "/api/v1/segment/rename": {
+            "post": {
+                "description": "Changes the slug of an active segment keeping its memberships and history. The old slug stays\nas an alias of the segment and can still be used in every request. If the new slug is taken\nby another segment or alias, or if there is no active segment like this, responds with an error and 400 status code",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Rename a segment",
+                "parameters": [
+                    {
+                        "description": "input",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonRenameSegmentRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonStatus"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
+                        }
+                    }
                 }
             }
         },
-        "internal_controller_http_v1.JsonDate": {
-            "type": "object",
-            "properties": {
-                "month": {
-                    "type": "integer"
-                },
+        "/api/v1/segment/restore": {
+            "post": {
+                "description": "Clears deletion of a segment by this slug. If ` + "`" + `restore_memberships` + "`" + ` is set, memberships that were removed\nby the deletion and haven't expired since then are re-activated. Children deleted along with the segment\nhave to be restored separately, a segment whose parent is deleted is restored as a top-level one. If there is no segment like this,\nor if it isn't deleted, responds with an error and 400 status code",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Restore a deleted segment",
+                "parameters": [
+                    {
+                        "description": "input",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonRestoreSegmentRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Number of re-activated memberships",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonRestore"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/segment/update": {
+            "post": {
+                "description": "Changes description, owner, tags, attributes, default TTL, parent and expression of an active segment. Omitted fields are left unchanged,\ntags and attributes are replaced as a whole, empty ` + "`" + `default_ttl` + "`" + ` removes it, empty ` + "`" + `parent` + "`" + ` makes the segment top-level.\nThe new default TTL only applies to memberships added after the change. The parent can't be the segment itself\nor one of its descendants. Only composite segments have an expression to change, it's checked the same way\nas on creation and can't make the segment depend on itself through other composite segments.\nOnly dynamic segments have a rule to change, the segment is refreshed with the new rule right away.\nEmpty ` + "`" + `exclusion_group` + "`" + ` takes the segment out of its group. A segment can't be put in a group if any of its members\nis in another segment of the group. Variants of experiments can't change their exclusion group.\nOnly bucketed segments have a bucket percent to change.\nIf there is no segment like this, or if it was deleted,\nresponds with an error and 400 status code",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Update segment's metadata",
+                "parameters": [
+                    {
+                        "description": "input",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonUpdateSegmentRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonStatus"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/segments": {
+            "get": {
+                "description": "Get all segments (even deleted) page by page. Segments can be filtered by owner, tags (segment must have all of them),\nattributes (segment must have all of them with equal values), slug and creation and deletion time.\nTime ranges include the start and exclude the end. To get the next page pass ` + "`" + `next_cursor` + "`" + ` of the response\nas ` + "`" + `cursor` + "`" + ` along with the same sort field and order, the last page has no ` + "`" + `next_cursor` + "`" + `",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get all segments",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "owner of the segments",
+                        "name": "owner",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "exclusion group of the segments",
+                        "name": "exclusion_group",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "only bucketed segments",
+                        "name": "bucketed",
+                        "in": "query"
+                    },
+                    {
+                        "type": "array",
+                        "items": {
+                            "type": "string"
+                        },
+                        "collectionFormat": "multi",
+                        "description": "tag that segments must have",
+                        "name": "tag",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "JSON object with attributes that segments must have",
+                        "name": "attributes",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "current or previous slug of the segment",
+                        "name": "slug",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "prefix of the slug, case-sensitive",
+                        "name": "slug_prefix",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "substring of the slug, case-sensitive",
+                        "name": "slug_contains",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "segments created at or after this time (RFC 3339)",
+                        "name": "created_from",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "segments created before this time (RFC 3339)",
+                        "name": "created_to",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "segments deleted at or after this time (RFC 3339)",
+                        "name": "deleted_from",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "segments deleted before this time (RFC 3339)",
+                        "name": "deleted_to",
+                        "in": "query"
+                    },
+                    {
+                        "enum": [
+                            "created_at",
+                            "slug"
+                        ],
+                        "type": "string",
+                        "default": "created_at",
+                        "description": "sort field",
+                        "name": "sort",
+                        "in": "query"
+                    },
+                    {
+                        "enum": [
+                            "asc",
+                            "desc"
+                        ],
+                        "type": "string",
+                        "default": "asc",
+                        "description": "sort order",
+                        "name": "order",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "next_cursor from the previous page",
+                        "name": "cursor",
+                        "in": "query"
+                    },
+                    {
+                        "maximum": 1000,
+                        "minimum": 1,
+                        "type": "integer",
+                        "description": "page size, 100 if only cursor is given; without limit and cursor all segments are returned",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "include the number of users in every segment",
+                        "name": "with_member_counts",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonSegments"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/segments/active": {
+            "get": {
+                "description": "Get active (not deleted) segments page by page. Segments can be filtered by owner, tags (segment must have all of them),\nattributes (segment must have all of them with equal values), slug and creation and deletion time.\nTime ranges include the start and exclude the end. To get the next page pass ` + "`" + `next_cursor` + "`" + ` of the response\nas ` + "`" + `cursor` + "`" + ` along with the same sort field and order, the last page has no ` + "`" + `next_cursor` + "`" + `",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get all active segments",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "owner of the segments",
+                        "name": "owner",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "exclusion group of the segments",
+                        "name": "exclusion_group",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "only bucketed segments",
+                        "name": "bucketed",
+                        "in": "query"
+                    },
+                    {
+                        "type": "array",
+                        "items": {
+                            "type": "string"
+                        },
+                        "collectionFormat": "multi",
+                        "description": "tag that segments must have",
+                        "name": "tag",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "JSON object with attributes that segments must have",
+                        "name": "attributes",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "current or previous slug of the segment",
+                        "name": "slug",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "prefix of the slug, case-sensitive",
+                        "name": "slug_prefix",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "substring of the slug, case-sensitive",
+                        "name": "slug_contains",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "segments created at or after this time (RFC 3339)",
+                        "name": "created_from",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "segments created before this time (RFC 3339)",
+                        "name": "created_to",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "segments deleted at or after this time (RFC 3339)",
+                        "name": "deleted_from",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "segments deleted before this time (RFC 3339)",
+                        "name": "deleted_to",
+                        "in": "query"
+                    },
+                    {
+                        "enum": [
+                            "created_at",
+                            "slug"
+                        ],
+                        "type": "string",
+                        "default": "created_at",
+                        "description": "sort field",
+                        "name": "sort",
+                        "in": "query"
+                    },
+                    {
+                        "enum": [
+                            "asc",
+                            "desc"
+                        ],
+                        "type": "string",
+                        "default": "asc",
+                        "description": "sort order",
+                        "name": "order",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "next_cursor from the previous page",
+                        "name": "cursor",
+                        "in": "query"
+                    },
+                    {
+                        "maximum": 1000,
+                        "minimum": 1,
+                        "type": "integer",
+                        "description": "page size, 100 if only cursor is given; without limit and cursor all segments are returned",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "include the number of users in every segment",
+                        "name": "with_member_counts",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonSegments"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/segments/refresh": {
+            "post": {
+                "description": "Evaluates the rule of every active dynamic segment for every user of user DB service, adds the segment\nto users that match it and removes it from the ones that don't anymore. Changes are recorded in the history.\nSegments are also refreshed periodically, if ` + "`" + `DYNAMIC_SEGMENT_REFRESH_INTERVAL` + "`" + ` is set",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Refresh dynamic segments",
+                "responses": {
+                    "200": {
+                        "description": "how many users were added to and removed from every segment",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonRefresh"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/segments/{slug}/stats": {
+            "get": {
+                "description": "Get the number of users that are in the segment now and the number of users added, removed\nand expired on every day of the window. Days are in UTC, the window includes ` + "`" + `from` + "`" + ` and excludes ` + "`" + `to` + "`" + `\nand can't be longer than 366 days. Deleted segments and old slugs can be looked up too",
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get statistics of the segment",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "slug of the segment",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "first day of the window (YYYY-MM-DD)",
+                        "name": "from",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "day after the last day of the window (YYYY-MM-DD)",
+                        "name": "to",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonSegmentStats"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/user/csv": {
+            "get": {
+                "description": "Generate CSV report file on user's segment history and uploads it to service's configured file storage service.\nNote thah ` + "`" + `month` + "`" + ` param in date is an integer that ranges from 1 (january) to 12 (december)\nAlso note that the specified range includes the \"from\" date but excludes the \"to\" date",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Generate CSV report on user's segment history",
+                "parameters": [
+                    {
+                        "description": "input",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonUserCSVRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonLink"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/user/erase": {
+            "post": {
+                "description": "Deletes every membership of the user, the history of the memberships and all stored CSV reports\nabout the user. Only a tombstone with the time of the erasure and the number of deleted records is kept",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Erase all data of the user",
+                "parameters": [
+                    {
+                        "description": "input",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonUserEraseRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonErasure"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/user/expiration": {
+            "post": {
+                "description": "Extends, shortens or clears expiry dates of segments that user already has.\nOmitted ` + "`" + `expires_at` + "`" + ` and ` + "`" + `expires_in` + "`" + ` make the segment permanent, ` + "`" + `expires_in` + "`" + ` is resolved\nthe same way as in /api/v1/user/update. Segments that user doesn't have\nare skipped. If any of the segments is not active, is listed twice or its expiry date\nis not in the future or not after the start of a scheduled membership, responds with an error\nand 400 status code and changes nothing. ` + "`" + `starts_at` + "`" + ` is ignored.\nEvery change is recorded in user's history as ` + "`" + `expiration_changed` + "`" + `. Composite, dynamic and bucketed segments have no expiry dates to change.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Change expiry dates of user's segments",
+                "parameters": [
+                    {
+                        "description": "input",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonUserExpirationRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonUserExpiration"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/user/segments": {
+            "get": {
+                "description": "Bucketed segments whose percent user's bucket is in are returned with ` + "`" + `bucketed` + "`" + ` flag set, they are added\nat the creation of the segment and have no expiry date.\nComposite segments whose expressions hold for user's memberships are returned with ` + "`" + `composite` + "`" + ` flag set,\nthey are added at the latest start of the memberships in the segments the expression references and have no expiry date.\nVariants of experiments are returned with the slug of their experiment in ` + "`" + `experiment` + "`" + `.\nIf ` + "`" + `with_inherited` + "`" + ` is set, parents and further ancestors of these segments are returned too, with ` + "`" + `inherited` + "`" + ` flag\nset unless user is in them explicitly. An inherited segment is added at the earliest and expires at the latest\nof the memberships it's inherited from",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get user's active segments",
+                "parameters": [
+                    {
+                        "description": "input",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonUserSegmentsHandlerRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonUserSegments"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
+                        }
+                    }
+                }
+            }
+        },
+        "/api/v1/user/update": {
+            "post": {
+                "description": "Tries to add and remove segments from user. If any of the specified segments are not active\nor if any of the lists contains same segment twice or if both list contain the same segment\nresponds with an error and 400 status code.\nYou can specify expiry date for segments, either absolute ` + "`" + `expires_at` + "`" + ` or relative ` + "`" + `expires_in` + "`" + `\n(ISO-8601 like ` + "`" + `P7D` + "`" + ` or Go like ` + "`" + `168h` + "`" + ` duration, resolved against server time and echoed back\nas ` + "`" + `expires_at` + "`" + ` in the response). Segments without them expire after ` + "`" + `default_ttl` + "`" + ` of the segment,\nif it's set. ` + "`" + `starts_at` + "`" + ` schedules the membership to start later, relative expirations are counted\nfrom it. These fields are ignored in segments in remove list, removing a membership\nthat hasn't started yet cancels it.\nIf you try add a segment to a user that already has it or you try to remove it from a user\nthat doesn't have it then that segment is skipped. To change expiry date of a segment\nthat user already has, use /api/v1/user/expiration. Composite, dynamic and bucketed segments can't be added or removed.\nIf user would end up in several segments of the same exclusion group, responds with an error and 400 status code\nand changes nothing. To move user to another segment of the group, remove the current one in the same request.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Add and remove segments from user",
+                "parameters": [
+                    {
+                        "description": "input",
+                        "name": "input",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonUserUpdateRequest"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonUserUpdate"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonError"
+                        }
+                    }
+                }
+            }
+        },
+        "/csv/{fname}": {
+            "get": {
+                "description": "Get static CSV file stored on disk",
+                "summary": "Get CSV file",
+                "responses": {}
+            }
+        },
+        "/health": {
+            "get": {
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Health check",
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_http_v1.JsonStatus"
+                        }
+                    }
+                }
+            }
+        }
+    },
+    "definitions": {
+        "github_com_QiZD90_dynamic-customer-segmentation_internal_entity.ChildrenPolicy": {
+            "type": "string",
+            "enum": [
+                "restrict",
+                "cascade",
+                "detach"
+            ],
+            "x-enum-comments": {
+                "ChildrenCascade": "children and their descendants are deleted too",
+                "ChildrenDetach": "children become top-level segments",
+                "ChildrenRestrict": "segment with children can't be deleted"
+            },
+            "x-enum-varnames": [
+                "ChildrenRestrict",
+                "ChildrenCascade",
+                "ChildrenDetach"
+            ]
+        },
+        "github_com_QiZD90_dynamic-customer-segmentation_internal_entity.Experiment": {
+            "type": "object",
+            "properties": {
+                "created_at": {
+                    "type": "string"
+                },
+                "slug": {
+                    "type": "string"
+                },
+                "started_at": {
+                    "description": "nil until the experiment is started",
+                    "type": "string"
+                },
+                "stopped_at": {
+                    "description": "nil until the experiment is stopped",
+                    "type": "string"
+                },
+                "variants": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/github_com_QiZD90_dynamic-customer-segmentation_internal_entity.ExperimentVariant"
+                    }
+                }
+            }
+        },
+        "github_com_QiZD90_dynamic-customer-segmentation_internal_entity.ExperimentVariant": {
+            "type": "object",
+            "properties": {
+                "slug": {
+                    "type": "string"
+                },
+                "weight": {
+                    "description": "percent of enrolled users, weights of an experiment sum up to 100",
+                    "type": "integer"
+                }
+            }
+        },
+        "github_com_QiZD90_dynamic-customer-segmentation_internal_entity.RefreshResult": {
+            "type": "object",
+            "properties": {
+                "added_count": {
+                    "description": "users that now match the rule and got the segment added",
+                    "type": "integer"
+                },
+                "removed_count": {
+                    "description": "users that no longer match the rule and were removed from the segment",
+                    "type": "integer"
+                },
+                "slug": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_QiZD90_dynamic-customer-segmentation_internal_entity.Segment": {
+            "type": "object",
+            "properties": {
+                "aliases": {
+                    "description": "previous slugs of the segment, oldest first",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "attributes": {
+                    "type": "object",
+                    "additionalProperties": {}
+                },
+                "bucket_percent": {
+                    "type": "integer"
+                },
+                "bucket_salt": {
+                    "description": "BucketSalt makes the segment bucketed: a user is in it if the hash of the salt and the user id falls\ninto the first ` + "`" + `BucketPercent` + "`" + ` of 100 buckets. Memberships of bucketed segments are computed rather than stored,\nso any user id gets the same answer without being enrolled, and raising the percent only adds users",
+                    "type": "string"
+                },
+                "created_at": {
+                    "type": "string"
+                },
+                "default_ttl": {
+                    "description": "DefaultTTL is an ISO-8601 (` + "`" + `P30D` + "`" + `) or Go (` + "`" + `720h` + "`" + `) duration after which memberships added\nwithout an explicit expiration expire. Empty means that they don't expire",
+                    "type": "string"
+                },
+                "deleted_at": {
+                    "type": "string"
+                },
+                "description": {
+                    "type": "string"
+                },
+                "exclusion_group": {
+                    "description": "ExclusionGroup is the name of the exclusion group of the segment, empty if it isn't in one.\nSegments of the same group are mutually exclusive: a user can be in at most one of them at a time",
+                    "type": "string"
+                },
+                "expression": {
+                    "description": "Expression makes the segment composite: users are in it while this boolean expression over other segments,\nsuch as ` + "`" + `VOICE_MESSAGES AND NOT PERFORMANCE_VAS` + "`" + `, holds for their memberships. Memberships of composite\nsegments are computed rather than stored, so users can't be added to or removed from them directly",
+                    "type": "string"
+                },
+                "member_count": {
+                    "description": "MemberCount is the number of users in the segment now. Only filled on request",
+                    "type": "integer"
+                },
+                "owner": {
+                    "type": "string"
+                },
+                "parent": {
+                    "description": "Parent is the slug of the parent segment, empty for top-level segments.\nMembers of the segment are inherited members of its parent and of the parent's ancestors",
+                    "type": "string"
+                },
+                "rule": {
+                    "description": "Rule makes the segment dynamic: users are in it while this rule over their attributes from the user service,\nsuch as ` + "`" + `country = \"RU\" AND signup_date \u003e 2023-01-01` + "`" + `, holds. Memberships of dynamic segments are stored\nand changed by refreshes of the segment, so users can't be added to or removed from them directly",
+                    "type": "string"
+                },
+                "slug": {
+                    "type": "string"
+                },
+                "tags": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "github_com_QiZD90_dynamic-customer-segmentation_internal_entity.SegmentDayStats": {
+            "type": "object",
+            "properties": {
+                "added": {
+                    "description": "users added, including restored by restoring the segment",
+                    "type": "integer"
+                },
+                "date": {
+                    "type": "string"
+                },
+                "expired": {
+                    "description": "memberships that reached their expiration date",
+                    "type": "integer"
+                },
+                "removed": {
+                    "description": "users removed, including removed by deleting the segment",
+                    "type": "integer"
+                }
+            }
+        },
+        "github_com_QiZD90_dynamic-customer-segmentation_internal_entity.SegmentExpiration": {
+            "type": "object",
+            "properties": {
+                "expires_at": {
+                    "type": "string"
+                },
+                "expires_in": {
+                    "description": "ExpiresIn is the expiration relative to the start of the membership, an ISO-8601 (` + "`" + `P7D` + "`" + `) or Go (` + "`" + `168h` + "`" + `) duration.\nThe service resolves it to ` + "`" + `ExpiresAt` + "`" + `, so only one of them may be set. Repositories ignore it",
+                    "type": "string"
+                },
+                "slug": {
+                    "type": "string"
+                },
+                "starts_at": {
+                    "description": "StartsAt schedules the membership to start in the future. Nil or past time means that it starts now",
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_QiZD90_dynamic-customer-segmentation_internal_entity.UserSegment": {
+            "type": "object",
+            "properties": {
+                "added_at": {
+                    "type": "string"
+                },
+                "bucketed": {
+                    "description": "Bucketed is set if the segment is bucketed and user's bucket is in its percent.\nThen ` + "`" + `AddedAt` + "`" + ` is the creation time of the segment and ` + "`" + `ExpiresAt` + "`" + ` is nil",
+                    "type": "boolean"
+                },
+                "composite": {
+                    "description": "Composite is set if the segment is composite and user is in it because its expression holds.\nThen ` + "`" + `AddedAt` + "`" + ` is the latest start of the memberships it's computed from and ` + "`" + `ExpiresAt` + "`" + ` is nil",
+                    "type": "boolean"
+                },
+                "experiment": {
+                    "description": "Experiment is the slug of the experiment if the segment is one of its variants",
+                    "type": "string"
+                },
+                "expires_at": {
+                    "type": "string"
+                },
+                "inherited": {
+                    "description": "Inherited is set if the user isn't in the segment itself but in one of its descendants.\nThen ` + "`" + `AddedAt` + "`" + ` is the earliest start and ` + "`" + `ExpiresAt` + "`" + ` is the latest expiry of these memberships",
+                    "type": "boolean"
+                },
+                "removed_at": {
+                    "type": "string"
+                },
+                "slug": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_QiZD90_dynamic-customer-segmentation_internal_entity.VariantEnrollment": {
+            "type": "object",
+            "properties": {
+                "enrolled_count": {
+                    "description": "users that got the segment added",
+                    "type": "integer"
+                },
+                "excluded_count": {
+                    "description": "users that are already in another segment of the exclusion group",
+                    "type": "integer"
+                },
+                "skipped_count": {
+                    "description": "users that already had the segment active",
+                    "type": "integer"
+                },
+                "slug": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_controller_http_v1.JsonCreateExperimentRequest": {
+            "type": "object",
+            "properties": {
+                "slug": {
+                    "type": "string"
+                },
+                "variants": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/github_com_QiZD90_dynamic-customer-segmentation_internal_entity.ExperimentVariant"
+                    }
+                }
+            }
+        },
+        "internal_controller_http_v1.JsonCreateSegmentRequest": {
+            "type": "object",
+            "properties": {
+                "attributes": {
+                    "type": "object",
+                    "additionalProperties": {}
+                },
+                "bucket_percent": {
+                    "type": "integer"
+                },
+                "bucket_salt": {
+                    "description": "BucketSalt makes the segment bucketed: a user is in it if the hash of the salt and the user id falls\ninto the first ` + "`" + `BucketPercent` + "`" + ` of 100 buckets. Memberships of bucketed segments are computed rather than stored,\nso any user id gets the same answer without being enrolled, and raising the percent only adds users",
+                    "type": "string"
+                },
+                "default_ttl": {
+                    "description": "DefaultTTL is an ISO-8601 (` + "`" + `P30D` + "`" + `) or Go (` + "`" + `720h` + "`" + `) duration after which memberships added\nwithout an explicit expiration expire. Empty means that they don't expire",
+                    "type": "string"
+                },
+                "description": {
+                    "type": "string"
+                },
+                "exclusion_group": {
+                    "description": "ExclusionGroup is the name of the exclusion group of the segment, empty if it isn't in one.\nSegments of the same group are mutually exclusive: a user can be in at most one of them at a time",
+                    "type": "string"
+                },
+                "expression": {
+                    "description": "Expression makes the segment composite: users are in it while this boolean expression over other segments,\nsuch as ` + "`" + `VOICE_MESSAGES AND NOT PERFORMANCE_VAS` + "`" + `, holds for their memberships. Memberships of composite\nsegments are computed rather than stored, so users can't be added to or removed from them directly",
+                    "type": "string"
+                },
+                "owner": {
+                    "type": "string"
+                },
+                "parent": {
+                    "description": "Parent is the slug of the parent segment, empty for top-level segments.\nMembers of the segment are inherited members of its parent and of the parent's ancestors",
+                    "type": "string"
+                },
+                "rule": {
+                    "description": "Rule makes the segment dynamic: users are in it while this rule over their attributes from the user service,\nsuch as ` + "`" + `country = \"RU\" AND signup_date \u003e 2023-01-01` + "`" + `, holds. Memberships of dynamic segments are stored\nand changed by refreshes of the segment, so users can't be added to or removed from them directly",
+                    "type": "string"
+                },
+                "slug": {
+                    "type": "string"
+                },
+                "tags": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "internal_controller_http_v1.JsonDate": {
+            "type": "object",
+            "properties": {
+                "month": {
+                    "type": "integer"
+                },
                 "year": {
                     "type": "integer"
                 }
@@ -399,11 +1541,70 @@ const docTemplate = `{
         "internal_controller_http_v1.JsonDeleteSegmentRequest": {
             "type": "object",
             "properties": {
+                "children": {
+                    "enum": [
+                        "restrict",
+                        "cascade",
+                        "detach"
+                    ],
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/github_com_QiZD90_dynamic-customer-segmentation_internal_entity.ChildrenPolicy"
+                        }
+                    ]
+                },
+                "force": {
+                    "description": "delete even if composite segments reference it",
+                    "type": "boolean"
+                },
                 "slug": {
                     "type": "string"
                 }
             }
         },
+        "internal_controller_http_v1.JsonEnrollment": {
+            "type": "object",
+            "properties": {
+                "enrolled_count": {
+                    "description": "users that got the segment added",
+                    "type": "integer"
+                },
+                "excluded_count": {
+                    "description": "users that are already in another segment of the exclusion group",
+                    "type": "integer"
+                },
+                "skipped_count": {
+                    "description": "users that already had the segment active",
+                    "type": "integer"
+                },
+                "user_ids": {
+                    "type": "array",
+                    "items": {
+                        "type": "integer"
+                    }
+                }
+            }
+        },
+        "internal_controller_http_v1.JsonErasure": {
+            "type": "object",
+            "properties": {
+                "erased_at": {
+                    "type": "string"
+                },
+                "files_count": {
+                    "type": "integer"
+                },
+                "memberships_count": {
+                    "type": "integer"
+                },
+                "operations_count": {
+                    "type": "integer"
+                },
+                "user_id": {
+                    "type": "integer"
+                }
+            }
+        },
         "internal_controller_http_v1.JsonError": {
             "type": "object",
             "properties": {
@@ -415,6 +1616,56 @@ const docTemplate = `{
                 }
             }
         },
+        "internal_controller_http_v1.JsonExperimentEnroll": {
+            "type": "object",
+            "properties": {
+                "expires_at": {
+                    "type": "string"
+                },
+                "percent": {
+                    "type": "integer"
+                },
+                "slug": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_controller_http_v1.JsonExperimentEnrollment": {
+            "type": "object",
+            "properties": {
+                "user_ids": {
+                    "type": "array",
+                    "items": {
+                        "type": "integer"
+                    }
+                },
+                "variants": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/github_com_QiZD90_dynamic-customer-segmentation_internal_entity.VariantEnrollment"
+                    }
+                }
+            }
+        },
+        "internal_controller_http_v1.JsonExperimentRequest": {
+            "type": "object",
+            "properties": {
+                "slug": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_controller_http_v1.JsonExperiments": {
+            "type": "object",
+            "properties": {
+                "experiments": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/github_com_QiZD90_dynamic-customer-segmentation_internal_entity.Experiment"
+                    }
+                }
+            }
+        },
         "internal_controller_http_v1.JsonLink": {
             "type": "object",
             "properties": {
@@ -423,9 +1674,107 @@ const docTemplate = `{
                 }
             }
         },
+        "internal_controller_http_v1.JsonRefresh": {
+            "type": "object",
+            "properties": {
+                "segments": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/github_com_QiZD90_dynamic-customer-segmentation_internal_entity.RefreshResult"
+                    }
+                }
+            }
+        },
+        "internal_controller_http_v1.JsonRenameSegmentRequest": {
+            "type": "object",
+            "properties": {
+                "new_slug": {
+                    "type": "string"
+                },
+                "slug": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_controller_http_v1.JsonRestore": {
+            "type": "object",
+            "properties": {
+                "restored_count": {
+                    "type": "integer"
+                }
+            }
+        },
+        "internal_controller_http_v1.JsonRestoreSegmentRequest": {
+            "type": "object",
+            "properties": {
+                "restore_memberships": {
+                    "type": "boolean"
+                },
+                "slug": {
+                    "type": "string"
+                }
+            }
+        },
         "internal_controller_http_v1.JsonSegmentCreateAndEnroll": {
             "type": "object",
             "properties": {
+                "attributes": {
+                    "type": "object",
+                    "additionalProperties": {}
+                },
+                "bucket_percent": {
+                    "type": "integer"
+                },
+                "bucket_salt": {
+                    "description": "BucketSalt makes the segment bucketed: a user is in it if the hash of the salt and the user id falls\ninto the first ` + "`" + `BucketPercent` + "`" + ` of 100 buckets. Memberships of bucketed segments are computed rather than stored,\nso any user id gets the same answer without being enrolled, and raising the percent only adds users",
+                    "type": "string"
+                },
+                "default_ttl": {
+                    "description": "DefaultTTL is an ISO-8601 (` + "`" + `P30D` + "`" + `) or Go (` + "`" + `720h` + "`" + `) duration after which memberships added\nwithout an explicit expiration expire. Empty means that they don't expire",
+                    "type": "string"
+                },
+                "description": {
+                    "type": "string"
+                },
+                "exclusion_group": {
+                    "description": "ExclusionGroup is the name of the exclusion group of the segment, empty if it isn't in one.\nSegments of the same group are mutually exclusive: a user can be in at most one of them at a time",
+                    "type": "string"
+                },
+                "expression": {
+                    "description": "Expression makes the segment composite: users are in it while this boolean expression over other segments,\nsuch as ` + "`" + `VOICE_MESSAGES AND NOT PERFORMANCE_VAS` + "`" + `, holds for their memberships. Memberships of composite\nsegments are computed rather than stored, so users can't be added to or removed from them directly",
+                    "type": "string"
+                },
+                "owner": {
+                    "type": "string"
+                },
+                "parent": {
+                    "description": "Parent is the slug of the parent segment, empty for top-level segments.\nMembers of the segment are inherited members of its parent and of the parent's ancestors",
+                    "type": "string"
+                },
+                "percent": {
+                    "type": "integer"
+                },
+                "rule": {
+                    "description": "Rule makes the segment dynamic: users are in it while this rule over their attributes from the user service,\nsuch as ` + "`" + `country = \"RU\" AND signup_date \u003e 2023-01-01` + "`" + `, holds. Memberships of dynamic segments are stored\nand changed by refreshes of the segment, so users can't be added to or removed from them directly",
+                    "type": "string"
+                },
+                "slug": {
+                    "type": "string"
+                },
+                "tags": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "internal_controller_http_v1.JsonSegmentEnroll": {
+            "type": "object",
+            "properties": {
+                "expires_at": {
+                    "type": "string"
+                },
                 "percent": {
                     "type": "integer"
                 },
@@ -434,9 +1783,54 @@ const docTemplate = `{
                 }
             }
         },
+        "internal_controller_http_v1.JsonSegmentMembers": {
+            "type": "object",
+            "properties": {
+                "as_of": {
+                    "type": "string"
+                },
+                "next_cursor": {
+                    "type": "string"
+                },
+                "user_ids": {
+                    "type": "array",
+                    "items": {
+                        "type": "integer"
+                    }
+                }
+            }
+        },
+        "internal_controller_http_v1.JsonSegmentStats": {
+            "type": "object",
+            "properties": {
+                "active_count": {
+                    "description": "users in the segment now",
+                    "type": "integer"
+                },
+                "days": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/github_com_QiZD90_dynamic-customer-segmentation_internal_entity.SegmentDayStats"
+                    }
+                },
+                "from": {
+                    "description": "From and To are the bounds of the window, midnights in UTC. From is included and To is excluded",
+                    "type": "string"
+                },
+                "slug": {
+                    "type": "string"
+                },
+                "to": {
+                    "type": "string"
+                }
+            }
+        },
         "internal_controller_http_v1.JsonSegments": {
             "type": "object",
             "properties": {
+                "next_cursor": {
+                    "type": "string"
+                },
                 "segments": {
                     "type": "array",
                     "items": {
@@ -453,6 +1847,54 @@ const docTemplate = `{
                 }
             }
         },
+        "internal_controller_http_v1.JsonUpdateSegmentRequest": {
+            "type": "object",
+            "properties": {
+                "attributes": {
+                    "type": "object",
+                    "additionalProperties": {}
+                },
+                "bucket_percent": {
+                    "description": "only bucketed segments have one to change",
+                    "type": "integer"
+                },
+                "default_ttl": {
+                    "description": "empty string removes the default TTL",
+                    "type": "string"
+                },
+                "description": {
+                    "type": "string"
+                },
+                "exclusion_group": {
+                    "description": "empty string takes the segment out of its group",
+                    "type": "string"
+                },
+                "expression": {
+                    "description": "only composite segments have one to change",
+                    "type": "string"
+                },
+                "owner": {
+                    "type": "string"
+                },
+                "parent": {
+                    "description": "empty string makes the segment top-level",
+                    "type": "string"
+                },
+                "rule": {
+                    "description": "only dynamic segments have one to change",
+                    "type": "string"
+                },
+                "slug": {
+                    "type": "string"
+                },
+                "tags": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
         "internal_controller_http_v1.JsonUserCSVRequest": {
             "type": "object",
             "properties": {
@@ -467,14 +1909,39 @@ const docTemplate = `{
                 }
             }
         },
-        "internal_controller_http_v1.JsonUserIDs": {
+        "internal_controller_http_v1.JsonUserEraseRequest": {
             "type": "object",
             "properties": {
-                "user_ids": {
+                "user_id": {
+                    "type": "integer"
+                }
+            }
+        },
+        "internal_controller_http_v1.JsonUserExpiration": {
+            "type": "object",
+            "properties": {
+                "segments": {
                     "type": "array",
                     "items": {
-                        "type": "integer"
+                        "$ref": "#/definitions/github_com_QiZD90_dynamic-customer-segmentation_internal_entity.SegmentExpiration"
+                    }
+                },
+                "status": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_controller_http_v1.JsonUserExpirationRequest": {
+            "type": "object",
+            "properties": {
+                "segments": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/github_com_QiZD90_dynamic-customer-segmentation_internal_entity.SegmentExpiration"
                     }
+                },
+                "user_id": {
+                    "type": "integer"
                 }
             }
         },
@@ -494,6 +1961,23 @@ const docTemplate = `{
             "properties": {
                 "user_id": {
                     "type": "integer"
+                },
+                "with_inherited": {
+                    "type": "boolean"
+                }
+            }
+        },
+        "internal_controller_http_v1.JsonUserUpdate": {
+            "type": "object",
+            "properties": {
+                "add_segments": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/github_com_QiZD90_dynamic-customer-segmentation_internal_entity.SegmentExpiration"
+                    }
+                },
+                "status": {
+                    "type": "string"
                 }
             }
         },
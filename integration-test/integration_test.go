@@ -2,6 +2,7 @@ package integrationtest
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
@@ -9,10 +10,12 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -47,11 +50,26 @@ func purgeDB(db *sql.DB) {
 	}
 	defer tx.Rollback()
 
+	_, err = tx.Exec("DELETE FROM erasures")
+	if err != nil {
+		log.Fatal().Msg("purgeDB() - failed to delete from erasures")
+	}
+
+	_, err = tx.Exec("DELETE FROM operations")
+	if err != nil {
+		log.Fatal().Msg("purgeDB() - failed to delete from operations")
+	}
+
 	_, err = tx.Exec("DELETE FROM users_segments")
 	if err != nil {
 		log.Fatal().Msg("purgeDB() - failed to delete from users segments")
 	}
 
+	_, err = tx.Exec("DELETE FROM segment_aliases")
+	if err != nil {
+		log.Fatal().Msg("purgeDB() - failed to delete from segment aliases")
+	}
+
 	_, err = tx.Exec("DELETE FROM segments")
 	if err != nil {
 		log.Fatal().Msg("purgeDB() - failed to delete from segments")
@@ -77,7 +95,7 @@ func TestMain(m *testing.M) {
 
 	// Migrate up to date
 	log.Info().Msg("Starting migrations...")
-	migration, err := migrate.New("file://../migrations", pgURL)
+	migration, err := migrate.New("file://../migrations/postgres", pgURL)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to load migrations")
 	}
@@ -110,7 +128,7 @@ func TestMain(m *testing.M) {
 	}
 
 	// Create the service
-	s = service.New(repo, fstorage, userService)
+	s = service.New(repo, fstorage, userService, timeProvider)
 
 	// Create the mux and start the server
 	mux := v1.NewMux(s)
@@ -217,7 +235,7 @@ func TestDeleteSegment(t *testing.T) {
 	url := server.URL + "/api/v1/segment/delete"
 
 	// Create segment to be deleted
-	assert.NoError(t, s.CreateSegment("AVITO_TEST_SEGMENT"))
+	assert.NoError(t, s.CreateSegment(context.Background(), "AVITO_TEST_SEGMENT", entity.SegmentMetadata{}))
 
 	// First request; should be successfull
 	{
@@ -308,11 +326,11 @@ func TestGetSegmentsAndGetActiveSegments(t *testing.T) {
 	defer timeProvider.SetTime(timeBase)
 
 	// Create and delete segments
-	assert.NoError(t, s.CreateSegment("AVITO_TEST_SEGMENT"))
-	assert.NoError(t, s.CreateSegment("AVITO_DELETED_SEGMENT"))
+	assert.NoError(t, s.CreateSegment(context.Background(), "AVITO_TEST_SEGMENT", entity.SegmentMetadata{}))
+	assert.NoError(t, s.CreateSegment(context.Background(), "AVITO_DELETED_SEGMENT", entity.SegmentMetadata{}))
 	timeProvider.SetTime(hourAfterTimeBase)
-	assert.NoError(t, s.CreateSegment("AVITO_VOICE_MESSAGES"))
-	assert.NoError(t, s.DeleteSegment("AVITO_DELETED_SEGMENT"))
+	assert.NoError(t, s.CreateSegment(context.Background(), "AVITO_VOICE_MESSAGES", entity.SegmentMetadata{}))
+	assert.NoError(t, s.DeleteSegment(context.Background(), "AVITO_DELETED_SEGMENT", entity.ChildrenRestrict, false))
 
 	// First request
 	{
@@ -369,8 +387,8 @@ func TestGetSegmentsAndGetActiveSegments(t *testing.T) {
 
 	// Delete all segments
 	timeProvider.SetTime(twoHoursAfterTimeBase)
-	s.DeleteSegment("AVITO_TEST_SEGMENT")
-	s.DeleteSegment("AVITO_VOICE_MESSAGES")
+	s.DeleteSegment(context.Background(), "AVITO_TEST_SEGMENT", entity.ChildrenRestrict, false)
+	s.DeleteSegment(context.Background(), "AVITO_VOICE_MESSAGES", entity.ChildrenRestrict, false)
 
 	// Second request
 	{
@@ -429,18 +447,21 @@ func TestCSV(t *testing.T) {
 
 	addAndDelete := func(slug string, userID int, timeAdd time.Time, timeDelete time.Time) {
 		timeProvider.SetTime(timeAdd)
-		assert.NoError(t, s.CreateSegment(slug))
-		assert.NoError(t, s.UpdateUserSegments(userID, []entity.SegmentExpiration{{Slug: slug}}, []entity.SegmentExpiration{}))
+		assert.NoError(t, s.CreateSegment(context.Background(), slug, entity.SegmentMetadata{}))
+		_, err := s.UpdateUserSegments(context.Background(), userID, []entity.SegmentExpiration{{Slug: slug}}, []entity.SegmentExpiration{})
+		assert.NoError(t, err)
 		timeProvider.SetTime(timeDelete)
-		assert.NoError(t, s.DeleteSegment(slug))
+		assert.NoError(t, s.DeleteSegment(context.Background(), slug, entity.ChildrenRestrict, false))
 	}
 
 	addAndRemove := func(slug string, userID int, timeAdd time.Time, timeDelete time.Time) {
 		timeProvider.SetTime(timeAdd)
-		assert.NoError(t, s.CreateSegment(slug))
-		assert.NoError(t, s.UpdateUserSegments(userID, []entity.SegmentExpiration{{Slug: slug}}, []entity.SegmentExpiration{}))
+		assert.NoError(t, s.CreateSegment(context.Background(), slug, entity.SegmentMetadata{}))
+		_, err := s.UpdateUserSegments(context.Background(), userID, []entity.SegmentExpiration{{Slug: slug}}, []entity.SegmentExpiration{})
+		assert.NoError(t, err)
 		timeProvider.SetTime(timeDelete)
-		assert.NoError(t, s.UpdateUserSegments(userID, []entity.SegmentExpiration{}, []entity.SegmentExpiration{{Slug: slug}}))
+		_, err = s.UpdateUserSegments(context.Background(), userID, []entity.SegmentExpiration{}, []entity.SegmentExpiration{{Slug: slug}})
+		assert.NoError(t, err)
 	}
 
 	generateCSVString := func(userID int, operations []entity.Operation) string {
@@ -727,13 +748,14 @@ func TestCreateAndEnroll(t *testing.T) {
 		assert.NoError(t, err, "TestCreateAndEnroll() - http.Post()")
 		defer r.Body.Close()
 
-		var got v1.JsonUserIDs
+		var got v1.JsonEnrollment
 
 		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
 			t.Fatalf("TestCreateAndEnroll() - failed to unmarshall json")
 		}
 
 		assert.Equal(t, http.StatusOK, r.StatusCode)
+		assert.Equal(t, entity.EnrollmentResult{EnrolledCount: len(got.UserIDs)}, got.EnrollmentResult)
 		userIDs = got.UserIDs
 	}
 
@@ -766,3 +788,824 @@ func TestCreateAndEnroll(t *testing.T) {
 		assert.True(t, reflect.DeepEqual(expected, got), "expected: %s; got: %s", expected, got)
 	}
 }
+
+func TestSegmentMetadata(t *testing.T) {
+	defer purgeDB(db)
+
+	// Create segments with metadata
+	{
+		b := []byte(`{"slug": "AVITO_VOICE_MESSAGES", "description": "Voice messages", "owner": "messenger", "tags": ["beta"], "attributes": {"platform": "ios"}}`)
+		r, err := http.Post(server.URL+"/api/v1/segment/create", "application/json", bytes.NewReader(b))
+		assert.NoError(t, err, "TestSegmentMetadata() - http.Post()")
+		defer r.Body.Close()
+
+		assert.Equal(t, http.StatusOK, r.StatusCode)
+	}
+	assert.NoError(t, s.CreateSegment(context.Background(), "AVITO_DISCOUNT_30", entity.SegmentMetadata{Owner: "marketing"}))
+
+	// Update metadata
+	{
+		b := []byte(`{"slug": "AVITO_VOICE_MESSAGES", "tags": ["beta", "voice"]}`)
+		r, err := http.Post(server.URL+"/api/v1/segment/update", "application/json", bytes.NewReader(b))
+		assert.NoError(t, err, "TestSegmentMetadata() - http.Post()")
+		defer r.Body.Close()
+
+		assert.Equal(t, http.StatusOK, r.StatusCode)
+	}
+
+	// Filter segments
+	{
+		r, err := http.Get(server.URL + "/api/v1/segments/active?tag=voice&attributes=" + url.QueryEscape(`{"platform": "ios"}`))
+		assert.NoError(t, err, "TestSegmentMetadata() - http.Get()")
+		defer r.Body.Close()
+
+		expected := v1.JsonSegments{
+			Segments: []entity.Segment{{
+				Slug: "AVITO_VOICE_MESSAGES",
+				SegmentMetadata: entity.SegmentMetadata{
+					Description: "Voice messages",
+					Owner:       "messenger",
+					Tags:        []string{"beta", "voice"},
+					Attributes:  map[string]any{"platform": "ios"},
+				},
+				CreatedAt: timeBase,
+			}},
+		}
+		var got v1.JsonSegments
+
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Fatalf("TestSegmentMetadata() - failed to unmarshall json")
+		}
+
+		assert.Equal(t, http.StatusOK, r.StatusCode)
+		assert.Equal(t, expected, got)
+	}
+
+	// Invalid attributes filter
+	{
+		r, err := http.Get(server.URL + "/api/v1/segments?attributes=" + url.QueryEscape("not json"))
+		assert.NoError(t, err, "TestSegmentMetadata() - http.Get()")
+		defer r.Body.Close()
+
+		assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+	}
+}
+
+func TestListSegments(t *testing.T) {
+	defer purgeDB(db)
+
+	for _, slug := range []string{"AVITO_SALE_30", "AVITO_SALE_50", "AVITO_VOICE_MESSAGES"} {
+		assert.NoError(t, s.CreateSegment(context.Background(), slug, entity.SegmentMetadata{}))
+	}
+
+	// Walk through the pages of segments with matching prefix
+	var slugs []string
+	cursor := ""
+	for {
+		query := url.Values{"slug_prefix": {"AVITO_SALE"}, "sort": {"slug"}, "order": {"desc"}, "limit": {"1"}}
+		if cursor != "" {
+			query.Set("cursor", cursor)
+		}
+
+		r, err := http.Get(server.URL + "/api/v1/segments?" + query.Encode())
+		assert.NoError(t, err, "TestListSegments() - http.Get()")
+		defer r.Body.Close()
+
+		var got v1.JsonSegments
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Fatalf("TestListSegments() - failed to unmarshall json")
+		}
+
+		assert.Equal(t, http.StatusOK, r.StatusCode)
+		for _, segment := range got.Segments {
+			slugs = append(slugs, segment.Slug)
+		}
+
+		if got.NextCursor == "" {
+			break
+		}
+		cursor = got.NextCursor
+	}
+	assert.Equal(t, []string{"AVITO_SALE_50", "AVITO_SALE_30"}, slugs)
+
+	// Invalid parameters
+	for _, query := range []string{"limit=0", "sort=owner", "order=up", "created_from=yesterday", "cursor=garbage"} {
+		r, err := http.Get(server.URL + "/api/v1/segments?" + query)
+		assert.NoError(t, err, "TestListSegments() - http.Get()")
+		defer r.Body.Close()
+
+		assert.Equal(t, http.StatusBadRequest, r.StatusCode, query)
+	}
+}
+
+func TestRenameSegment(t *testing.T) {
+	defer purgeDB(db)
+
+	assert.NoError(t, s.CreateSegment(context.Background(), "AVITO_OLD_SEGMENT", entity.SegmentMetadata{}))
+	_, err := s.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_OLD_SEGMENT"}}, nil)
+	assert.NoError(t, err)
+
+	// Rename the segment
+	{
+		b := []byte(`{"slug": "AVITO_OLD_SEGMENT", "new_slug": "AVITO_NEW_SEGMENT"}`)
+		r, err := http.Post(server.URL+"/api/v1/segment/rename", "application/json", bytes.NewReader(b))
+		assert.NoError(t, err, "TestRenameSegment() - http.Post()")
+		defer r.Body.Close()
+
+		assert.Equal(t, http.StatusOK, r.StatusCode)
+	}
+
+	// Old slug is taken by the alias
+	{
+		b := []byte(`{"slug": "AVITO_OLD_SEGMENT"}`)
+		r, err := http.Post(server.URL+"/api/v1/segment/create", "application/json", bytes.NewReader(b))
+		assert.NoError(t, err, "TestRenameSegment() - http.Post()")
+		defer r.Body.Close()
+
+		assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+	}
+
+	// Old slug still works
+	_, err = s.UpdateUserSegments(context.Background(), 1000, nil, []entity.SegmentExpiration{{Slug: "AVITO_OLD_SEGMENT"}})
+	assert.NoError(t, err)
+
+	segments, err := s.GetAllSegments(context.Background(), entity.SegmentFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Segment{
+		{Slug: "AVITO_NEW_SEGMENT", Aliases: []string{"AVITO_OLD_SEGMENT"}, CreatedAt: timeBase},
+	}, segments)
+
+	userSegments, err := s.GetActiveUserSegments(context.Background(), 1000, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.UserSegment{}, userSegments)
+}
+
+func TestRestoreSegment(t *testing.T) {
+	defer purgeDB(db)
+	defer timeProvider.SetTime(timeBase)
+
+	assert.NoError(t, s.CreateSegment(context.Background(), "AVITO_TEST_SEGMENT", entity.SegmentMetadata{}))
+	_, err := s.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_TEST_SEGMENT"}}, nil)
+	assert.NoError(t, err)
+	timeProvider.SetTime(timeBase.Add(time.Hour))
+	assert.NoError(t, s.DeleteSegment(context.Background(), "AVITO_TEST_SEGMENT", entity.ChildrenRestrict, false))
+
+	// Restore the segment with its memberships
+	{
+		b := []byte(`{"slug": "AVITO_TEST_SEGMENT", "restore_memberships": true}`)
+		r, err := http.Post(server.URL+"/api/v1/segment/restore", "application/json", bytes.NewReader(b))
+		assert.NoError(t, err, "TestRestoreSegment() - http.Post()")
+		defer r.Body.Close()
+
+		var got v1.JsonRestore
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Fatalf("TestRestoreSegment() - failed to unmarshall json")
+		}
+
+		assert.Equal(t, http.StatusOK, r.StatusCode)
+		assert.Equal(t, v1.JsonRestore{RestoredCount: 1}, got)
+	}
+
+	// Segment is active again
+	{
+		b := []byte(`{"slug": "AVITO_TEST_SEGMENT"}`)
+		r, err := http.Post(server.URL+"/api/v1/segment/restore", "application/json", bytes.NewReader(b))
+		assert.NoError(t, err, "TestRestoreSegment() - http.Post()")
+		defer r.Body.Close()
+
+		assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+	}
+
+	segments, err := s.GetActiveUserSegments(context.Background(), 1000, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.UserSegment{{Slug: "AVITO_TEST_SEGMENT", AddedAt: timeBase}}, segments)
+}
+
+func TestEraseUser(t *testing.T) {
+	defer purgeDB(db)
+
+	assert.NoError(t, s.CreateSegment(context.Background(), "AVITO_TEST_SEGMENT", entity.SegmentMetadata{}))
+	_, err := s.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_TEST_SEGMENT"}}, nil)
+	assert.NoError(t, err)
+	_, err = s.DumpHistoryCSV(context.Background(), 1000, timeBase, timeBase.Add(time.Hour))
+	assert.NoError(t, err)
+
+	// Erase the user
+	{
+		b := []byte(`{"user_id": 1000}`)
+		r, err := http.Post(server.URL+"/api/v1/user/erase", "application/json", bytes.NewReader(b))
+		assert.NoError(t, err, "TestEraseUser() - http.Post()")
+		defer r.Body.Close()
+
+		expected := v1.JsonErasure{Erasure: entity.Erasure{
+			UserID:           1000,
+			ErasedAt:         timeBase,
+			MembershipsCount: 1,
+			OperationsCount:  1,
+			FilesCount:       1,
+		}}
+		var got v1.JsonErasure
+
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Fatalf("TestEraseUser() - failed to unmarshall json")
+		}
+
+		assert.Equal(t, http.StatusOK, r.StatusCode)
+		assert.Equal(t, expected, got)
+	}
+
+	// Tombstone is left
+	var cnt int
+	assert.NoError(t, db.QueryRow("SELECT COUNT(*) FROM erasures WHERE user_id=1000").Scan(&cnt))
+	assert.Equal(t, 1, cnt)
+
+	segments, err := s.GetActiveUserSegments(context.Background(), 1000, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.UserSegment{}, segments)
+}
+
+func TestSegmentMembers(t *testing.T) {
+	defer purgeDB(db)
+
+	assert.NoError(t, s.CreateSegment(context.Background(), "AVITO_TEST_SEGMENT", entity.SegmentMetadata{}))
+	for _, userID := range []int{1002, 1000, 1001} {
+		_, err := s.UpdateUserSegments(context.Background(), userID, []entity.SegmentExpiration{{Slug: "AVITO_TEST_SEGMENT"}}, nil)
+		assert.NoError(t, err)
+	}
+
+	// Get the members page by page
+	{
+		r, err := http.Get(server.URL + "/api/v1/segment/members?slug=AVITO_TEST_SEGMENT&limit=2")
+		assert.NoError(t, err, "TestSegmentMembers() - http.Get()")
+		defer r.Body.Close()
+
+		var first v1.JsonSegmentMembers
+		if err := json.NewDecoder(r.Body).Decode(&first); err != nil {
+			t.Fatalf("TestSegmentMembers() - failed to unmarshall json")
+		}
+
+		assert.Equal(t, http.StatusOK, r.StatusCode)
+		assert.Equal(t, []int{1000, 1001}, first.UserIDs)
+		assert.True(t, timeBase.Equal(first.AsOf))
+
+		r, err = http.Get(server.URL + "/api/v1/segment/members?slug=AVITO_TEST_SEGMENT&limit=2&cursor=" + url.QueryEscape(first.NextCursor))
+		assert.NoError(t, err, "TestSegmentMembers() - http.Get()")
+		defer r.Body.Close()
+
+		var second v1.JsonSegmentMembers
+		if err := json.NewDecoder(r.Body).Decode(&second); err != nil {
+			t.Fatalf("TestSegmentMembers() - failed to unmarshall json")
+		}
+
+		assert.Equal(t, http.StatusOK, r.StatusCode)
+		assert.Equal(t, []int{1002}, second.UserIDs)
+		assert.Empty(t, second.NextCursor)
+	}
+
+	// Stream the members
+	{
+		r, err := http.Get(server.URL + "/api/v1/segment/members/stream?slug=AVITO_TEST_SEGMENT")
+		assert.NoError(t, err, "TestSegmentMembers() - http.Get()")
+		defer r.Body.Close()
+
+		b, err := io.ReadAll(r.Body)
+		assert.NoError(t, err, "TestSegmentMembers() - io.ReadAll()")
+
+		assert.Equal(t, http.StatusOK, r.StatusCode)
+		assert.Equal(t, "1000\n1001\n1002\n", string(b))
+	}
+
+	// Members before the segment was created
+	{
+		r, err := http.Get(server.URL + "/api/v1/segment/members?slug=AVITO_TEST_SEGMENT&as_of=" + url.QueryEscape(timeBase.Add(-time.Hour).Format(time.RFC3339)))
+		assert.NoError(t, err, "TestSegmentMembers() - http.Get()")
+		defer r.Body.Close()
+
+		var got v1.JsonSegmentMembers
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Fatalf("TestSegmentMembers() - failed to unmarshall json")
+		}
+
+		assert.Equal(t, http.StatusOK, r.StatusCode)
+		assert.Equal(t, []int{}, got.UserIDs)
+	}
+
+	// Unknown segment
+	for _, path := range []string{"/api/v1/segment/members", "/api/v1/segment/members/stream"} {
+		r, err := http.Get(server.URL + path + "?slug=AVITO_NONEXISTENT")
+		assert.NoError(t, err, "TestSegmentMembers() - http.Get()")
+		defer r.Body.Close()
+
+		assert.Equal(t, http.StatusBadRequest, r.StatusCode, path)
+	}
+}
+
+func TestSegmentStats(t *testing.T) {
+	defer purgeDB(db)
+
+	assert.NoError(t, s.CreateSegment(context.Background(), "AVITO_TEST_SEGMENT", entity.SegmentMetadata{}))
+	for _, userID := range []int{1000, 1001} {
+		_, err := s.UpdateUserSegments(context.Background(), userID, []entity.SegmentExpiration{{Slug: "AVITO_TEST_SEGMENT"}}, nil)
+		assert.NoError(t, err)
+	}
+
+	// Get the stats
+	{
+		r, err := http.Get(server.URL + "/api/v1/segments/AVITO_TEST_SEGMENT/stats?from=2000-11-14&to=2000-11-16")
+		assert.NoError(t, err, "TestSegmentStats() - http.Get()")
+		defer r.Body.Close()
+
+		day := time.Date(2000, time.November, 14, 0, 0, 0, 0, time.UTC)
+		expected := v1.JsonSegmentStats{SegmentStats: entity.SegmentStats{
+			Slug:        "AVITO_TEST_SEGMENT",
+			ActiveCount: 2,
+			From:        day,
+			To:          day.AddDate(0, 0, 2),
+			Days: []entity.SegmentDayStats{
+				{Date: day},
+				{Date: day.AddDate(0, 0, 1), Added: 2},
+			},
+		}}
+		var got v1.JsonSegmentStats
+
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Fatalf("TestSegmentStats() - failed to unmarshall json")
+		}
+
+		assert.Equal(t, http.StatusOK, r.StatusCode)
+		assert.Equal(t, expected, got)
+	}
+
+	// Member counts in the list of segments
+	{
+		r, err := http.Get(server.URL + "/api/v1/segments/active?with_member_counts=true")
+		assert.NoError(t, err, "TestSegmentStats() - http.Get()")
+		defer r.Body.Close()
+
+		var got v1.JsonSegments
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Fatalf("TestSegmentStats() - failed to unmarshall json")
+		}
+
+		assert.Equal(t, http.StatusOK, r.StatusCode)
+		if assert.Len(t, got.Segments, 1) && assert.NotNil(t, got.Segments[0].MemberCount) {
+			assert.Equal(t, 2, *got.Segments[0].MemberCount)
+		}
+	}
+
+	// Invalid window
+	for _, query := range []string{"from=2000-11-16&to=2000-11-14", "from=2000-11-14", "from=2000-01-01&to=2002-01-01"} {
+		r, err := http.Get(server.URL + "/api/v1/segments/AVITO_TEST_SEGMENT/stats?" + query)
+		assert.NoError(t, err, "TestSegmentStats() - http.Get()")
+		defer r.Body.Close()
+
+		assert.Equal(t, http.StatusBadRequest, r.StatusCode, query)
+	}
+
+	// Unknown segment
+	{
+		r, err := http.Get(server.URL + "/api/v1/segments/AVITO_NONEXISTENT/stats?from=2000-11-14&to=2000-11-16")
+		assert.NoError(t, err, "TestSegmentStats() - http.Get()")
+		defer r.Body.Close()
+
+		assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+	}
+}
+
+func TestExpireMemberships(t *testing.T) {
+	defer purgeDB(db)
+
+	expiresAt := timeBase.Add(-time.Hour)
+	assert.NoError(t, s.CreateSegment(context.Background(), "AVITO_TEST_SEGMENT", entity.SegmentMetadata{}))
+	for userID := 1000; userID < 1100; userID++ {
+		_, err := s.UpdateUserSegments(context.Background(), userID, []entity.SegmentExpiration{{Slug: "AVITO_TEST_SEGMENT", ExpiresAt: &expiresAt}}, nil)
+		assert.NoError(t, err)
+	}
+
+	// Two replicas sweep at once, every expiration is recorded and reported once
+	var mu sync.Mutex
+	reported := make(map[int]int)
+	counts := make([]int, 2)
+	var wg sync.WaitGroup
+	for i := range counts {
+		replica := service.New(postgres.NewWithExistingConnection(db, timeProvider), nil, nil, timeProvider)
+		replica.AddChangeHook(func(ctx context.Context, operations []entity.Operation) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			for _, o := range operations {
+				assert.Equal(t, entity.ExpiredOperationType, o.Type)
+				reported[o.UserID]++
+			}
+		})
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			count, err := replica.ExpireMemberships(context.Background())
+			assert.NoError(t, err)
+			counts[i] = count
+		}(i)
+	}
+	wg.Wait()
+
+	// the replica that lost the race may have found nothing left
+	count, err := s.ExpireMemberships(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 100, counts[0]+counts[1]+count)
+	assert.Len(t, reported, 100-count)
+	for userID, times := range reported {
+		assert.Equal(t, 1, times, userID)
+	}
+
+	var logged int
+	assert.NoError(t, db.QueryRow("SELECT COUNT(*) FROM operations WHERE type='expired'").Scan(&logged))
+	assert.Equal(t, 100, logged)
+}
+
+func TestUserSegmentExpirations(t *testing.T) {
+	defer purgeDB(db)
+
+	expiresAt := timeBase.Add(time.Hour)
+	assert.NoError(t, s.CreateSegment(context.Background(), "AVITO_TEST_SEGMENT", entity.SegmentMetadata{}))
+	_, err := s.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_TEST_SEGMENT", ExpiresAt: &expiresAt}}, nil)
+	assert.NoError(t, err)
+
+	// Extend the segment
+	{
+		b := []byte(`{"user_id": 1000, "segments": [{"slug": "AVITO_TEST_SEGMENT", "expires_at": "2000-11-20T15:00:00Z"}]}`)
+		r, err := http.Post(server.URL+"/api/v1/user/expiration", "application/json", bytes.NewReader(b))
+		assert.NoError(t, err, "TestUserSegmentExpirations() - http.Post()")
+		defer r.Body.Close()
+
+		assert.Equal(t, http.StatusOK, r.StatusCode)
+	}
+
+	extended := time.Date(2000, time.November, 20, 15, 0, 0, 0, time.UTC)
+	segments, err := s.GetActiveUserSegments(context.Background(), 1000, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.UserSegment{{Slug: "AVITO_TEST_SEGMENT", AddedAt: timeBase, ExpiresAt: &extended}}, segments)
+
+	// Invalid requests
+	for _, body := range []string{
+		`{"user_id": 1000, "segments": [{"slug": "AVITO_TEST_SEGMENT", "expires_at": "2000-11-14T15:00:00Z"}]}`,
+		`{"user_id": 1000, "segments": [{"slug": "AVITO_TEST_SEGMENT"}, {"slug": "AVITO_TEST_SEGMENT"}]}`,
+		`{"user_id": 1000, "segments": [{"slug": "AVITO_NONEXISTENT"}]}`,
+	} {
+		r, err := http.Post(server.URL+"/api/v1/user/expiration", "application/json", strings.NewReader(body))
+		assert.NoError(t, err, "TestUserSegmentExpirations() - http.Post()")
+		defer r.Body.Close()
+
+		assert.Equal(t, http.StatusBadRequest, r.StatusCode, body)
+	}
+}
+
+func TestRelativeExpirations(t *testing.T) {
+	defer purgeDB(db)
+
+	assert.NoError(t, s.CreateSegment(context.Background(), "AVITO_TEST_SEGMENT", entity.SegmentMetadata{}))
+
+	// Add with a relative expiration
+	{
+		b := []byte(`{"user_id": 1000, "add_segments": [{"slug": "AVITO_TEST_SEGMENT", "expires_in": "P7D"}], "remove_segments": []}`)
+		r, err := http.Post(server.URL+"/api/v1/user/update", "application/json", bytes.NewReader(b))
+		assert.NoError(t, err, "TestRelativeExpirations() - http.Post()")
+		defer r.Body.Close()
+
+		expiresAt := timeBase.Add(7 * 24 * time.Hour)
+		expected := v1.JsonUserUpdate{
+			Status:      "OK",
+			AddSegments: []entity.SegmentExpiration{{Slug: "AVITO_TEST_SEGMENT", ExpiresAt: &expiresAt, ExpiresIn: "P7D"}},
+		}
+		var got v1.JsonUserUpdate
+
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Fatalf("TestRelativeExpirations() - failed to unmarshall json")
+		}
+
+		assert.Equal(t, http.StatusOK, r.StatusCode)
+		assert.Equal(t, expected, got)
+	}
+
+	// Extend with a Go duration
+	{
+		b := []byte(`{"user_id": 1000, "segments": [{"slug": "AVITO_TEST_SEGMENT", "expires_in": "240h"}]}`)
+		r, err := http.Post(server.URL+"/api/v1/user/expiration", "application/json", bytes.NewReader(b))
+		assert.NoError(t, err, "TestRelativeExpirations() - http.Post()")
+		defer r.Body.Close()
+
+		expiresAt := timeBase.Add(240 * time.Hour)
+		expected := v1.JsonUserExpiration{
+			Status:   "OK",
+			Segments: []entity.SegmentExpiration{{Slug: "AVITO_TEST_SEGMENT", ExpiresAt: &expiresAt, ExpiresIn: "240h"}},
+		}
+		var got v1.JsonUserExpiration
+
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Fatalf("TestRelativeExpirations() - failed to unmarshall json")
+		}
+
+		assert.Equal(t, http.StatusOK, r.StatusCode)
+		assert.Equal(t, expected, got)
+	}
+
+	expiresAt := timeBase.Add(240 * time.Hour)
+	segments, err := s.GetActiveUserSegments(context.Background(), 1000, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.UserSegment{{Slug: "AVITO_TEST_SEGMENT", AddedAt: timeBase, ExpiresAt: &expiresAt}}, segments)
+
+	// Invalid requests
+	for _, body := range []string{
+		`{"user_id": 1000, "segments": [{"slug": "AVITO_TEST_SEGMENT", "expires_at": "2000-11-20T15:00:00Z", "expires_in": "P1D"}]}`,
+		`{"user_id": 1000, "segments": [{"slug": "AVITO_TEST_SEGMENT", "expires_in": "P1M"}]}`,
+		`{"user_id": 1000, "segments": [{"slug": "AVITO_TEST_SEGMENT", "expires_in": "-1h"}]}`,
+		`{"user_id": 1000, "segments": [{"slug": "AVITO_TEST_SEGMENT", "expires_in": "tomorrow"}]}`,
+	} {
+		r, err := http.Post(server.URL+"/api/v1/user/expiration", "application/json", strings.NewReader(body))
+		assert.NoError(t, err, "TestRelativeExpirations() - http.Post()")
+		defer r.Body.Close()
+
+		assert.Equal(t, http.StatusBadRequest, r.StatusCode, body)
+	}
+}
+
+func TestDefaultTTL(t *testing.T) {
+	defer purgeDB(db)
+
+	// Create segments
+	for body, status := range map[string]int{
+		`{"slug": "AVITO_PROMO", "default_ttl": "P30D"}`:   http.StatusOK,
+		`{"slug": "AVITO_MONTHLY", "default_ttl": "P1M"}`:  http.StatusBadRequest,
+		`{"slug": "AVITO_NEGATIVE", "default_ttl": "-1h"}`: http.StatusBadRequest,
+	} {
+		r, err := http.Post(server.URL+"/api/v1/segment/create", "application/json", strings.NewReader(body))
+		assert.NoError(t, err, "TestDefaultTTL() - http.Post()")
+		defer r.Body.Close()
+
+		assert.Equal(t, status, r.StatusCode, body)
+	}
+
+	// Add with and without an explicit expiration
+	expiresAt := timeBase.Add(time.Hour)
+	_, err := s.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_PROMO"}}, nil)
+	assert.NoError(t, err)
+	_, err = s.UpdateUserSegments(context.Background(), 1001, []entity.SegmentExpiration{{Slug: "AVITO_PROMO", ExpiresAt: &expiresAt}}, nil)
+	assert.NoError(t, err)
+
+	monthLater := timeBase.Add(30 * 24 * time.Hour)
+	segments, err := s.GetActiveUserSegments(context.Background(), 1000, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.UserSegment{{Slug: "AVITO_PROMO", AddedAt: timeBase, ExpiresAt: &monthLater}}, segments)
+
+	segments, err = s.GetActiveUserSegments(context.Background(), 1001, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.UserSegment{{Slug: "AVITO_PROMO", AddedAt: timeBase, ExpiresAt: &expiresAt}}, segments)
+
+	// Change the default
+	{
+		b := []byte(`{"slug": "AVITO_PROMO", "default_ttl": "PT0S"}`)
+		r, err := http.Post(server.URL+"/api/v1/segment/update", "application/json", bytes.NewReader(b))
+		assert.NoError(t, err, "TestDefaultTTL() - http.Post()")
+		defer r.Body.Close()
+
+		assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+	}
+	{
+		b := []byte(`{"slug": "AVITO_PROMO", "default_ttl": "168h"}`)
+		r, err := http.Post(server.URL+"/api/v1/segment/update", "application/json", bytes.NewReader(b))
+		assert.NoError(t, err, "TestDefaultTTL() - http.Post()")
+		defer r.Body.Close()
+
+		assert.Equal(t, http.StatusOK, r.StatusCode)
+	}
+
+	all, err := s.GetAllSegments(context.Background(), entity.SegmentFilter{})
+	assert.NoError(t, err)
+	assert.Len(t, all, 1)
+	assert.Equal(t, "168h", all[0].DefaultTTL)
+}
+
+func TestScheduledMemberships(t *testing.T) {
+	defer purgeDB(db)
+	defer timeProvider.SetTime(timeBase)
+
+	assert.NoError(t, s.CreateSegment(context.Background(), "AVITO_TEST_SEGMENT", entity.SegmentMetadata{}))
+
+	// Schedule the segment a day later
+	{
+		b := []byte(`{"user_id": 1000, "add_segments": [{"slug": "AVITO_TEST_SEGMENT", "starts_at": "2000-11-16T15:00:00Z", "expires_in": "P7D"}]}`)
+		r, err := http.Post(server.URL+"/api/v1/user/update", "application/json", bytes.NewReader(b))
+		assert.NoError(t, err, "TestScheduledMemberships() - http.Post()")
+		defer r.Body.Close()
+
+		assert.Equal(t, http.StatusOK, r.StatusCode)
+	}
+
+	// It can't expire before it starts
+	{
+		b := []byte(`{"user_id": 1000, "segments": [{"slug": "AVITO_TEST_SEGMENT", "expires_at": "2000-11-16T14:00:00Z"}]}`)
+		r, err := http.Post(server.URL+"/api/v1/user/expiration", "application/json", bytes.NewReader(b))
+		assert.NoError(t, err, "TestScheduledMemberships() - http.Post()")
+		defer r.Body.Close()
+
+		assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+	}
+
+	segments, err := s.GetActiveUserSegments(context.Background(), 1000, false)
+	assert.NoError(t, err)
+	assert.Empty(t, segments)
+
+	// It becomes active at the start
+	startsAt := time.Date(2000, time.November, 16, 15, 0, 0, 0, time.UTC)
+	expiresAt := startsAt.Add(7 * 24 * time.Hour)
+	timeProvider.SetTime(startsAt)
+
+	segments, err = s.GetActiveUserSegments(context.Background(), 1000, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.UserSegment{{Slug: "AVITO_TEST_SEGMENT", AddedAt: startsAt, ExpiresAt: &expiresAt}}, segments)
+}
+
+func TestSegmentHierarchy(t *testing.T) {
+	defer purgeDB(db)
+
+	// Create segments
+	for _, body := range []string{
+		`{"slug": "AVITO_PROMO_SUMMER"}`,
+		`{"slug": "AVITO_PROMO_SUMMER_EU", "parent": "AVITO_PROMO_SUMMER"}`,
+	} {
+		r, err := http.Post(server.URL+"/api/v1/segment/create", "application/json", strings.NewReader(body))
+		assert.NoError(t, err, "TestSegmentHierarchy() - http.Post()")
+		defer r.Body.Close()
+
+		assert.Equal(t, http.StatusOK, r.StatusCode, body)
+	}
+
+	_, err := s.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_PROMO_SUMMER_EU"}}, nil)
+	assert.NoError(t, err)
+
+	// Get segments with inherited ones
+	{
+		request, err := http.NewRequest("GET", server.URL+"/api/v1/user/segments", strings.NewReader(`{"user_id": 1000, "with_inherited": true}`))
+		assert.NoError(t, err, "TestSegmentHierarchy() - http.NewRequest()")
+
+		r, err := http.DefaultClient.Do(request)
+		assert.NoError(t, err, "TestSegmentHierarchy() - http.Do()")
+		defer r.Body.Close()
+
+		var got v1.JsonUserSegments
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Fatalf("TestSegmentHierarchy() - failed to unmarshall json")
+		}
+
+		assert.Equal(t, []entity.UserSegment{
+			{Slug: "AVITO_PROMO_SUMMER_EU", AddedAt: timeBase},
+			{Slug: "AVITO_PROMO_SUMMER", AddedAt: timeBase, Inherited: true},
+		}, got.Segments)
+	}
+
+	// Delete the parent, requests are sent in order
+	for _, tc := range []struct {
+		body   string
+		status int
+	}{
+		{`{"slug": "AVITO_PROMO_SUMMER"}`, http.StatusBadRequest},
+		{`{"slug": "AVITO_PROMO_SUMMER", "children": "orphan"}`, http.StatusBadRequest},
+		{`{"slug": "AVITO_PROMO_SUMMER", "children": "detach"}`, http.StatusOK},
+	} {
+		r, err := http.Post(server.URL+"/api/v1/segment/delete", "application/json", strings.NewReader(tc.body))
+		assert.NoError(t, err, "TestSegmentHierarchy() - http.Post()")
+		defer r.Body.Close()
+
+		assert.Equal(t, tc.status, r.StatusCode, tc.body)
+	}
+
+	segments, err := s.GetActiveUserSegments(context.Background(), 1000, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.UserSegment{{Slug: "AVITO_PROMO_SUMMER_EU", AddedAt: timeBase}}, segments)
+}
+
+func TestCompositeSegments(t *testing.T) {
+	defer purgeDB(db)
+
+	// Create segments, requests are sent in order
+	for _, tc := range []struct {
+		body   string
+		status int
+	}{
+		{`{"slug": "AVITO_VOICE_MESSAGES"}`, http.StatusOK},
+		{`{"slug": "AVITO_PERFORMANCE_VAS"}`, http.StatusOK},
+		{`{"slug": "AVITO_VOICE_NO_VAS", "expression": "AVITO_VOICE_MESSAGES AND NOT AVITO_PERFORMANCE_VAS"}`, http.StatusOK},
+		{`{"slug": "AVITO_NOT_VAS", "expression": "NOT AVITO_PERFORMANCE_VAS"}`, http.StatusBadRequest},
+		{`{"slug": "AVITO_BROKEN", "expression": "AVITO_VOICE_MESSAGES AND"}`, http.StatusBadRequest},
+		{`{"slug": "AVITO_MISSING", "expression": "AVITO_NONEXISTENT"}`, http.StatusBadRequest},
+	} {
+		r, err := http.Post(server.URL+"/api/v1/segment/create", "application/json", strings.NewReader(tc.body))
+		assert.NoError(t, err, "TestCompositeSegments() - http.Post()")
+		defer r.Body.Close()
+
+		assert.Equal(t, tc.status, r.StatusCode, tc.body)
+	}
+
+	for _, userID := range []int{1000, 1001} {
+		_, err := s.UpdateUserSegments(context.Background(), userID, []entity.SegmentExpiration{{Slug: "AVITO_VOICE_MESSAGES"}}, nil)
+		assert.NoError(t, err)
+	}
+	_, err := s.UpdateUserSegments(context.Background(), 1001, []entity.SegmentExpiration{{Slug: "AVITO_PERFORMANCE_VAS"}}, nil)
+	assert.NoError(t, err)
+
+	// Memberships of the composite segment can't be changed directly
+	{
+		r, err := http.Post(server.URL+"/api/v1/user/update", "application/json", strings.NewReader(`{"user_id": 1002, "add_segments": [{"slug": "AVITO_VOICE_NO_VAS"}]}`))
+		assert.NoError(t, err, "TestCompositeSegments() - http.Post()")
+		defer r.Body.Close()
+
+		assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+	}
+
+	segments, err := s.GetActiveUserSegments(context.Background(), 1000, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.UserSegment{
+		{Slug: "AVITO_VOICE_MESSAGES", AddedAt: timeBase},
+		{Slug: "AVITO_VOICE_NO_VAS", AddedAt: timeBase, Composite: true},
+	}, segments)
+
+	// Stream the members of the composite segment
+	{
+		r, err := http.Get(server.URL + "/api/v1/segment/members/stream?slug=AVITO_VOICE_NO_VAS")
+		assert.NoError(t, err, "TestCompositeSegments() - http.Get()")
+		defer r.Body.Close()
+
+		b, err := io.ReadAll(r.Body)
+		assert.NoError(t, err, "TestCompositeSegments() - io.ReadAll()")
+
+		assert.Equal(t, http.StatusOK, r.StatusCode)
+		assert.Equal(t, "1000\n", string(b))
+	}
+
+	// Delete a referenced segment, requests are sent in order
+	for _, tc := range []struct {
+		body   string
+		status int
+	}{
+		{`{"slug": "AVITO_PERFORMANCE_VAS"}`, http.StatusBadRequest},
+		{`{"slug": "AVITO_PERFORMANCE_VAS", "force": true}`, http.StatusOK},
+	} {
+		r, err := http.Post(server.URL+"/api/v1/segment/delete", "application/json", strings.NewReader(tc.body))
+		assert.NoError(t, err, "TestCompositeSegments() - http.Post()")
+		defer r.Body.Close()
+
+		assert.Equal(t, tc.status, r.StatusCode, tc.body)
+	}
+}
+
+func TestDynamicSegments(t *testing.T) {
+	defer purgeDB(db)
+
+	// Create segments, requests are sent in order
+	for _, tc := range []struct {
+		body   string
+		status int
+	}{
+		{`{"slug": "AVITO_PREMIUM", "rule": "premium = true"}`, http.StatusOK},
+		{`{"slug": "AVITO_BROKEN", "rule": "premium > true"}`, http.StatusBadRequest},
+		{`{"slug": "AVITO_BOTH", "rule": "premium = true", "expression": "AVITO_PREMIUM"}`, http.StatusBadRequest},
+	} {
+		r, err := http.Post(server.URL+"/api/v1/segment/create", "application/json", strings.NewReader(tc.body))
+		assert.NoError(t, err, "TestDynamicSegments() - http.Post()")
+		defer r.Body.Close()
+
+		assert.Equal(t, tc.status, r.StatusCode, tc.body)
+	}
+
+	// Every tenth user of the mock user service is premium
+	segments, err := s.GetActiveUserSegments(context.Background(), 1010, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.UserSegment{{Slug: "AVITO_PREMIUM", AddedAt: timeBase}}, segments)
+
+	segments, err = s.GetActiveUserSegments(context.Background(), 1011, false)
+	assert.NoError(t, err)
+	assert.Empty(t, segments)
+
+	// Memberships of the dynamic segment can't be changed directly
+	{
+		r, err := http.Post(server.URL+"/api/v1/user/update", "application/json", strings.NewReader(`{"user_id": 1011, "add_segments": [{"slug": "AVITO_PREMIUM"}]}`))
+		assert.NoError(t, err, "TestDynamicSegments() - http.Post()")
+		defer r.Body.Close()
+
+		assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+	}
+
+	// Nothing has changed since the creation
+	{
+		r, err := http.Post(server.URL+"/api/v1/segments/refresh", "application/json", nil)
+		assert.NoError(t, err, "TestDynamicSegments() - http.Post()")
+		defer r.Body.Close()
+
+		b, err := io.ReadAll(r.Body)
+		assert.NoError(t, err, "TestDynamicSegments() - io.ReadAll()")
+
+		assert.Equal(t, http.StatusOK, r.StatusCode)
+		assert.JSONEq(t, `{"segments": [{"slug": "AVITO_PREMIUM", "added_count": 0, "removed_count": 0}]}`, string(b))
+	}
+}
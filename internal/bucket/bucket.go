@@ -0,0 +1,26 @@
+package bucket
+
+import (
+	"hash/fnv"
+	"strconv"
+)
+
+// Count is the number of buckets, so a percent of users is a number of buckets
+const Count = 100
+
+// Of returns the bucket of the user in a segment with this salt, from 0 to `Count`-1.
+// It's the FNV-1a hash of the salt and the decimal user id, so it never changes for the same pair
+// and different salts split users independently
+func Of(salt string, userID int) int {
+	h := fnv.New64a()
+	h.Write([]byte(salt))
+	h.Write([]byte{0}) // keeps `ab`+`1` and `a`+`b1` apart
+	h.Write([]byte(strconv.Itoa(userID)))
+	return int(h.Sum64() % Count)
+}
+
+// Contains reports whether the user is in the first `percent` buckets of a segment with this salt.
+// Users in it stay in it when the percent is raised
+func Contains(salt string, percent int, userID int) bool {
+	return Of(salt, userID) < percent
+}
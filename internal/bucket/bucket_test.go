@@ -0,0 +1,62 @@
+package bucket
+
+import "testing"
+
+func TestOf(t *testing.T) {
+	for userID := 1000; userID < 1300; userID++ {
+		b := Of("AVITO_SEGMENT", userID)
+		if b < 0 || b >= Count {
+			t.Fatalf("Of -- user %d -- bucket %d is out of range", userID, b)
+		}
+
+		if again := Of("AVITO_SEGMENT", userID); again != b {
+			t.Errorf("Of -- user %d -- want the same bucket %d, got: %d", userID, b, again)
+		}
+	}
+
+	// salt is separated from the id, so concatenations that look the same don't collide by construction
+	same := 0
+	for userID := 0; userID < 100; userID++ {
+		if Of("A1", userID) == Of("A", 10+userID) {
+			same++
+		}
+	}
+	if same > 10 {
+		t.Errorf("Of -- %d of 100 users got the same bucket with different salts", same)
+	}
+}
+
+func TestContains(t *testing.T) {
+	testCases := []struct {
+		testName string
+		percent  int
+		min, max int // expected number of members out of 10000 users
+	}{
+		{testName: "nobody", percent: 0, min: 0, max: 0},
+		{testName: "ten percent", percent: 10, min: 900, max: 1100},
+		{testName: "half", percent: 50, min: 4800, max: 5200},
+		{testName: "everybody", percent: 100, min: 10000, max: 10000},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			got := 0
+			for userID := 0; userID < 10000; userID++ {
+				if Contains("AVITO_SEGMENT", tc.percent, userID) {
+					got++
+				}
+			}
+
+			if got < tc.min || got > tc.max {
+				t.Errorf("Contains -- %s -- want from %d to %d members, got: %d", tc.testName, tc.min, tc.max, got)
+			}
+		})
+	}
+
+	// raising the percent only adds users
+	for userID := 0; userID < 10000; userID++ {
+		if Contains("AVITO_SEGMENT", 10, userID) && !Contains("AVITO_SEGMENT", 30, userID) {
+			t.Fatalf("Contains -- user %d left the segment when the percent was raised", userID)
+		}
+	}
+}
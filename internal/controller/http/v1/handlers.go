@@ -1,12 +1,15 @@
 package v1
 
 import (
+	"bufio"
 	"encoding/json"
 	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/QiZD90/dynamic-customer-segmentation/internal/service"
+	"github.com/go-chi/chi"
 	"github.com/rs/zerolog/log"
 )
 
@@ -65,45 +68,153 @@ func (routes *Routes) CSVOnDiskHandlerWrapper(fs http.Handler) http.Handler {
 	})
 }
 
-// GET /segments/active
-// @Summary Get all active segments
-// @Description Get all active (not deleted) segments
-// @Produce json
-// @Success 200 {object} v1.JsonSegments
-// @Router /api/v1/segments/active [get]
-func (routes *Routes) SegmentsActiveHandler(w http.ResponseWriter, r *http.Request) {
-	segments, err := routes.s.GetAllActiveSegments()
+// listSegments responds with a page of segments described by query parameters
+func (routes *Routes) listSegments(w http.ResponseWriter, r *http.Request, onlyActive bool) {
+	filter, err := parseSegmentFilter(r)
 	if err != nil {
 		log.Error().Err(err).Msg("")
-		internalServerError(w)
+		respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, err.Error()})
+
+		return
+	}
+	filter.OnlyActive = onlyActive
+
+	page, err := parseSegmentPage(r)
+	if err != nil {
+		log.Error().Err(err).Msg("")
+		respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, err.Error()})
+
+		return
+	}
+
+	result, err := routes.s.ListSegments(r.Context(), filter, page)
+	if err != nil {
+		log.Error().Err(err).Msg("")
+
+		if errors.Is(err, service.ErrInvalidCursor) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Invalid cursor"})
+		} else {
+			internalServerError(w)
+		}
 
 		return
 	}
 
-	respondWithJson(w, http.StatusOK, &JsonSegments{segments})
+	respondWithJson(w, http.StatusOK, &JsonSegments{Segments: result.Segments, NextCursor: result.NextCursor})
 }
 
 // GET /segments/active
+// @Summary Get all active segments
+// @Description Get active (not deleted) segments page by page. Segments can be filtered by owner, tags (segment must have all of them),
+// @Description attributes (segment must have all of them with equal values), slug and creation and deletion time.
+// @Description Time ranges include the start and exclude the end. To get the next page pass `next_cursor` of the response
+// @Description as `cursor` along with the same sort field and order, the last page has no `next_cursor`
+// @Produce json
+// @Param owner query string false "owner of the segments"
+// @Param exclusion_group query string false "exclusion group of the segments"
+// @Param bucketed query bool false "only bucketed segments"
+// @Param tag query []string false "tag that segments must have" collectionFormat(multi)
+// @Param attributes query string false "JSON object with attributes that segments must have"
+// @Param slug query string false "current or previous slug of the segment"
+// @Param slug_prefix query string false "prefix of the slug, case-sensitive"
+// @Param slug_contains query string false "substring of the slug, case-sensitive"
+// @Param created_from query string false "segments created at or after this time (RFC 3339)"
+// @Param created_to query string false "segments created before this time (RFC 3339)"
+// @Param deleted_from query string false "segments deleted at or after this time (RFC 3339)"
+// @Param deleted_to query string false "segments deleted before this time (RFC 3339)"
+// @Param sort query string false "sort field" Enums(created_at, slug) default(created_at)
+// @Param order query string false "sort order" Enums(asc, desc) default(asc)
+// @Param cursor query string false "next_cursor from the previous page"
+// @Param limit query int false "page size, 100 if only cursor is given; without limit and cursor all segments are returned" minimum(1) maximum(1000)
+// @Param with_member_counts query bool false "include the number of users in every segment"
+// @Success 200 {object} v1.JsonSegments
+// @Failure 400 {object} v1.JsonError
+// @Failure 500 {object} v1.JsonError
+// @Router /api/v1/segments/active [get]
+func (routes *Routes) SegmentsActiveHandler(w http.ResponseWriter, r *http.Request) {
+	routes.listSegments(w, r, true)
+}
+
+// GET /segments
 // @Summary Get all segments
-// @Description Get all segments (even deleted)
+// @Description Get all segments (even deleted) page by page. Segments can be filtered by owner, tags (segment must have all of them),
+// @Description attributes (segment must have all of them with equal values), slug and creation and deletion time.
+// @Description Time ranges include the start and exclude the end. To get the next page pass `next_cursor` of the response
+// @Description as `cursor` along with the same sort field and order, the last page has no `next_cursor`
 // @Produce json
+// @Param owner query string false "owner of the segments"
+// @Param exclusion_group query string false "exclusion group of the segments"
+// @Param bucketed query bool false "only bucketed segments"
+// @Param tag query []string false "tag that segments must have" collectionFormat(multi)
+// @Param attributes query string false "JSON object with attributes that segments must have"
+// @Param slug query string false "current or previous slug of the segment"
+// @Param slug_prefix query string false "prefix of the slug, case-sensitive"
+// @Param slug_contains query string false "substring of the slug, case-sensitive"
+// @Param created_from query string false "segments created at or after this time (RFC 3339)"
+// @Param created_to query string false "segments created before this time (RFC 3339)"
+// @Param deleted_from query string false "segments deleted at or after this time (RFC 3339)"
+// @Param deleted_to query string false "segments deleted before this time (RFC 3339)"
+// @Param sort query string false "sort field" Enums(created_at, slug) default(created_at)
+// @Param order query string false "sort order" Enums(asc, desc) default(asc)
+// @Param cursor query string false "next_cursor from the previous page"
+// @Param limit query int false "page size, 100 if only cursor is given; without limit and cursor all segments are returned" minimum(1) maximum(1000)
+// @Param with_member_counts query bool false "include the number of users in every segment"
 // @Success 200 {object} v1.JsonSegments
+// @Failure 400 {object} v1.JsonError
+// @Failure 500 {object} v1.JsonError
 // @Router /api/v1/segments [get]
 func (routes *Routes) SegmentsHandler(w http.ResponseWriter, r *http.Request) {
-	segments, err := routes.s.GetAllSegments()
-	if err != nil {
-		log.Error().Err(err).Msg("")
-		internalServerError(w)
+	routes.listSegments(w, r, false)
+}
 
-		return
-	}
+// invalidDefaultTTLMessage explains what is wrong with a default TTL of a segment
+const invalidDefaultTTLMessage = "default_ttl must be a positive ISO-8601 or Go duration"
 
-	respondWithJson(w, http.StatusOK, &JsonSegments{segments})
-}
+// parentNotFoundMessage explains what is wrong with a parent of a segment
+const parentNotFoundMessage = "Parent segment wasn't found or is deleted"
+
+const (
+	invalidExpressionMessage = "Expression is malformed or matches users that are in none of its segments"
+	referenceNotFoundMessage = "Segment referenced by the expression wasn't found or is deleted"
+	expressionCycleMessage   = "Expression of the segment can't depend on the segment itself"
+	segmentCompositeMessage  = "Memberships of composite segments are computed and can't be changed directly"
+)
+
+const (
+	invalidRuleMessage    = "Rule is malformed or the segment is composite"
+	segmentDynamicMessage = "Memberships of dynamic segments are only changed by their rules"
+)
+
+const (
+	invalidExclusionGroupMessage = "Composite, dynamic and bucketed segments can't be in an exclusion group"
+	exclusionConflictMessage     = "User would be in several segments of the same exclusion group"
+)
+
+const (
+	invalidBucketMessage   = "bucket_percent must be from 0 to 100, bucketed segments can't be composite, dynamic or in an exclusion group"
+	segmentBucketedMessage = "Memberships of bucketed segments are decided by the hash of user id"
+	notBucketedMessage     = "Segment isn't bucketed, so it has no bucket percent"
+)
 
 // POST /segment/create
 // @Summary Create new segment
-// @Description Create new segment with given slug. If there is already active segment with this slug,
+// @Description Create new segment with given slug and optional metadata (description, owner, tags and attributes).
+// @Description `default_ttl` (ISO-8601 like `P30D` or Go like `720h` duration) sets the expiration of memberships
+// @Description that are added without an explicit one. `parent` is the slug of an active segment this one is nested in:
+// @Description members of the segment are inherited members of the parent and its ancestors.
+// @Description `expression` makes the segment composite: users are in it while a boolean expression over other segments
+// @Description (`AND`, `OR`, `NOT` and parentheses, like `VOICE_MESSAGES AND NOT PERFORMANCE_VAS`) holds for them.
+// @Description It must reference only active segments, must not depend on the segment itself and must not match users
+// @Description that are in none of its segments. `rule` makes the segment dynamic: users are added to it and removed from it
+// @Description as their attributes in user DB service start or stop matching a rule like `country = "RU" AND signup_date > 2023-01-01`
+// @Description (`=`, `!=`, `<`, `<=`, `>`, `>=` with strings in double quotes, numbers, dates and booleans, `AND`, `OR`, `NOT`
+// @Description and parentheses). Users that match it are added right away, then on every refresh.
+// @Description A segment can't be both composite and dynamic. `exclusion_group` puts the segment in a named group of mutually
+// @Description exclusive segments: a user can be in at most one of them, composite and dynamic segments can't be in one.
+// @Description `bucket_percent` makes the segment bucketed: user is in it if the hash of `bucket_salt` (the slug by default)
+// @Description and user id falls into the first `bucket_percent` of 100 buckets. Bucketed memberships aren't stored, any user id
+// @Description gets the same answer every time, and raising the percent only adds users. Bucketed segments can't be composite,
+// @Description dynamic or in an exclusion group. If there is already active segment with this slug,
 // @Description or if there was a segment with this slug but it has been deleted, responds with an error and 400 status code
 // @Accept json
 // @Produce json
@@ -121,11 +232,27 @@ func (routes *Routes) SegmentCreateHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	if err := routes.s.CreateSegment(j.Slug); err != nil {
+	if err := routes.s.CreateSegment(r.Context(), j.Slug, j.SegmentMetadata); err != nil {
 		log.Error().Err(err).Msg("")
 
 		if errors.Is(err, service.ErrSegmentAlreadyExists) {
 			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Segment already exists"})
+		} else if errors.Is(err, service.ErrInvalidDefaultTTL) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, invalidDefaultTTLMessage})
+		} else if errors.Is(err, service.ErrParentNotFound) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, parentNotFoundMessage})
+		} else if errors.Is(err, service.ErrInvalidExpression) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, invalidExpressionMessage})
+		} else if errors.Is(err, service.ErrReferenceNotFound) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, referenceNotFoundMessage})
+		} else if errors.Is(err, service.ErrExpressionCycle) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, expressionCycleMessage})
+		} else if errors.Is(err, service.ErrInvalidRule) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, invalidRuleMessage})
+		} else if errors.Is(err, service.ErrInvalidExclusionGroup) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, invalidExclusionGroupMessage})
+		} else if errors.Is(err, service.ErrInvalidBucket) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, invalidBucketMessage})
 		} else {
 			internalServerError(w)
 		}
@@ -141,10 +268,13 @@ func (routes *Routes) SegmentCreateHandler(w http.ResponseWriter, r *http.Reques
 // @Description Creates new segment with given slug. If there is already active segment with this slug,
 // @Description or if there was a segment with this slug but it has been deleted, responds with an error and 400 status code
 // @Description Get a percent of randomly selected users from user DB service and tries to add the newly created segment to them.
+// @Description Their memberships expire after `default_ttl` of the segment, if it's set. Composite, dynamic and bucketed segments can't be enrolled into.
+// @Description Sampled users that are in another segment of the exclusion group of the segment are replaced by sampling again,
+// @Description those that join another segment of the group meanwhile don't get it and are counted in `excluded_count`.
 // @Accept json
 // @Produce json
 // @Param input body v1.JsonSegmentCreateAndEnroll true "input"
-// @Success 200 {object} v1.JsonUserIDs "IDs of users that were selected"
+// @Success 200 {object} v1.JsonEnrollment "IDs of users that were selected and how many of them got the segment"
 // @Failure 400 {object} v1.JsonError
 // @Failure 500 {object} v1.JsonError
 // @Router /api/v1/segment/create/enroll [post]
@@ -163,7 +293,7 @@ func (routes *Routes) SegmentCreateEnrollHandler(w http.ResponseWriter, r *http.
 		return
 	}
 
-	userIDs, err := routes.s.CreateSegmentAndEnrollPercent(j.Slug, j.Percent)
+	userIDs, result, err := routes.s.CreateSegmentAndEnrollPercent(r.Context(), j.Slug, j.SegmentMetadata, j.Percent)
 	if err != nil {
 		log.Error().Err(err).Msg("")
 
@@ -171,6 +301,195 @@ func (routes *Routes) SegmentCreateEnrollHandler(w http.ResponseWriter, r *http.
 			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Segment already exists"})
 		} else if errors.Is(err, service.ErrSegmentNotFound) {
 			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Segment wasn't found"})
+		} else if errors.Is(err, service.ErrSegmentAlreadyDeleted) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Segment is already deleted"})
+		} else if errors.Is(err, service.ErrInvalidDefaultTTL) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, invalidDefaultTTLMessage})
+		} else if errors.Is(err, service.ErrParentNotFound) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, parentNotFoundMessage})
+		} else if errors.Is(err, service.ErrSegmentComposite) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, segmentCompositeMessage})
+		} else if errors.Is(err, service.ErrSegmentDynamic) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, segmentDynamicMessage})
+		} else if errors.Is(err, service.ErrSegmentBucketed) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, segmentBucketedMessage})
+		} else {
+			internalServerError(w)
+		}
+
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, &JsonEnrollment{UserIDs: userIDs, EnrollmentResult: result})
+}
+
+// POST /segment/enroll
+// @Summary Adds existing segment to randomly selected users
+// @Description Get a percent of randomly selected users from user DB service and tries to add the active segment to them.
+// @Description Users are selected regardless of who already has the segment, those that had it are counted in `skipped_count`.
+// @Description Their memberships expire at `expires_at` if it's set, otherwise after `default_ttl` of the segment, if it's set.
+// @Description Sampled users that are in another segment of the exclusion group of the segment are replaced by sampling again,
+// @Description those that join another segment of the group meanwhile don't get it and are counted in `excluded_count`.
+// @Description If there is no segment like this, if it was deleted, if it's composite, dynamic or bucketed,
+// @Description or if `expires_at` is in the past, responds with an error and 400 status code
+// @Accept json
+// @Produce json
+// @Param input body v1.JsonSegmentEnroll true "input"
+// @Success 200 {object} v1.JsonEnrollment "IDs of users that were selected and how many of them got the segment"
+// @Failure 400 {object} v1.JsonError
+// @Failure 500 {object} v1.JsonError
+// @Router /api/v1/segment/enroll [post]
+func (routes *Routes) SegmentEnrollHandler(w http.ResponseWriter, r *http.Request) {
+	var j JsonSegmentEnroll
+	if err := json.NewDecoder(r.Body).Decode(&j); err != nil {
+		log.Error().Err(err).Msg("")
+		respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Error while unmarshalling request JSON"})
+
+		return
+	}
+
+	if j.Percent < 0 || j.Percent > 100 {
+		respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Invalid percent value"})
+
+		return
+	}
+
+	userIDs, result, err := routes.s.EnrollPercent(r.Context(), j.Slug, j.Percent, j.ExpiresAt)
+	if err != nil {
+		log.Error().Err(err).Msg("")
+
+		if errors.Is(err, service.ErrSegmentNotFound) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Segment wasn't found"})
+		} else if errors.Is(err, service.ErrSegmentAlreadyDeleted) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Segment is already deleted"})
+		} else if errors.Is(err, service.ErrExpirationInPast) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Expiry date is in the past"})
+		} else if errors.Is(err, service.ErrSegmentComposite) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, segmentCompositeMessage})
+		} else if errors.Is(err, service.ErrSegmentDynamic) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, segmentDynamicMessage})
+		} else if errors.Is(err, service.ErrSegmentBucketed) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, segmentBucketedMessage})
+		} else {
+			internalServerError(w)
+		}
+
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, &JsonEnrollment{UserIDs: userIDs, EnrollmentResult: result})
+}
+
+// POST /segment/update
+// @Summary Update segment's metadata
+// @Description Changes description, owner, tags, attributes, default TTL, parent and expression of an active segment. Omitted fields are left unchanged,
+// @Description tags and attributes are replaced as a whole, empty `default_ttl` removes it, empty `parent` makes the segment top-level.
+// @Description The new default TTL only applies to memberships added after the change. The parent can't be the segment itself
+// @Description or one of its descendants. Only composite segments have an expression to change, it's checked the same way
+// @Description as on creation and can't make the segment depend on itself through other composite segments.
+// @Description Only dynamic segments have a rule to change, the segment is refreshed with the new rule right away.
+// @Description Empty `exclusion_group` takes the segment out of its group. A segment can't be put in a group if any of its members
+// @Description is in another segment of the group. Variants of experiments can't change their exclusion group.
+// @Description Only bucketed segments have a bucket percent to change.
+// @Description If there is no segment like this, or if it was deleted,
+// @Description responds with an error and 400 status code
+// @Accept json
+// @Produce json
+// @Param input body v1.JsonUpdateSegmentRequest true "input"
+// @Success 200 {object} v1.JsonStatus
+// @Failure 400 {object} v1.JsonError
+// @Failure 500 {object} v1.JsonError
+// @Router /api/v1/segment/update [post]
+func (routes *Routes) SegmentUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	var j JsonUpdateSegmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&j); err != nil {
+		log.Error().Err(err).Msg("")
+		respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Error while unmarshalling request JSON"})
+
+		return
+	}
+
+	if err := routes.s.UpdateSegment(r.Context(), j.Slug, j.SegmentMetadataUpdate); err != nil {
+		log.Error().Err(err).Msg("")
+
+		if errors.Is(err, service.ErrSegmentNotFound) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Segment wasn't found"})
+		} else if errors.Is(err, service.ErrSegmentAlreadyDeleted) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Segment is already deleted"})
+		} else if errors.Is(err, service.ErrInvalidDefaultTTL) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, invalidDefaultTTLMessage})
+		} else if errors.Is(err, service.ErrParentNotFound) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, parentNotFoundMessage})
+		} else if errors.Is(err, service.ErrSegmentCycle) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Segment can't be nested in itself or its descendants"})
+		} else if errors.Is(err, service.ErrNotComposite) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Segment isn't composite, so it has no expression"})
+		} else if errors.Is(err, service.ErrInvalidExpression) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, invalidExpressionMessage})
+		} else if errors.Is(err, service.ErrReferenceNotFound) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, referenceNotFoundMessage})
+		} else if errors.Is(err, service.ErrExpressionCycle) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, expressionCycleMessage})
+		} else if errors.Is(err, service.ErrNotDynamic) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Segment isn't dynamic, so it has no rule"})
+		} else if errors.Is(err, service.ErrInvalidRule) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, invalidRuleMessage})
+		} else if errors.Is(err, service.ErrInvalidExclusionGroup) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, invalidExclusionGroupMessage})
+		} else if errors.Is(err, service.ErrInvalidBucket) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, invalidBucketMessage})
+		} else if errors.Is(err, service.ErrNotBucketed) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, notBucketedMessage})
+		} else if errors.Is(err, service.ErrExclusionConflict) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, exclusionConflictMessage})
+		} else if errors.Is(err, service.ErrSegmentInExperiment) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Variant of an experiment can't leave the exclusion group of the experiment"})
+		} else {
+			internalServerError(w)
+		}
+
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, &JsonStatus{"OK"})
+}
+
+// POST /segment/rename
+// @Summary Rename a segment
+// @Description Changes the slug of an active segment keeping its memberships and history. The old slug stays
+// @Description as an alias of the segment and can still be used in every request. If the new slug is taken
+// @Description by another segment or alias, or if there is no active segment like this, responds with an error and 400 status code
+// @Accept json
+// @Produce json
+// @Param input body v1.JsonRenameSegmentRequest true "input"
+// @Success 200 {object} v1.JsonStatus
+// @Failure 400 {object} v1.JsonError
+// @Failure 500 {object} v1.JsonError
+// @Router /api/v1/segment/rename [post]
+func (routes *Routes) SegmentRenameHandler(w http.ResponseWriter, r *http.Request) {
+	var j JsonRenameSegmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&j); err != nil {
+		log.Error().Err(err).Msg("")
+		respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Error while unmarshalling request JSON"})
+
+		return
+	}
+
+	if j.NewSlug == "" {
+		respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "New slug is empty"})
+
+		return
+	}
+
+	if err := routes.s.RenameSegment(r.Context(), j.Slug, j.NewSlug); err != nil {
+		log.Error().Err(err).Msg("")
+
+		if errors.Is(err, service.ErrSegmentAlreadyExists) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Segment already exists"})
+		} else if errors.Is(err, service.ErrSegmentNotFound) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Segment wasn't found"})
+		} else if errors.Is(err, service.ErrSegmentAlreadyDeleted) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Segment is already deleted"})
 		} else {
 			internalServerError(w)
 		}
@@ -178,13 +497,16 @@ func (routes *Routes) SegmentCreateEnrollHandler(w http.ResponseWriter, r *http.
 		return
 	}
 
-	respondWithJson(w, http.StatusOK, &JsonUserIDs{UserIDs: userIDs})
+	respondWithJson(w, http.StatusOK, &JsonStatus{"OK"})
 }
 
 // POST /segment/delete
 // @Summary Delete a segment
 // @Description Marks a segment by this slug as deleted. If there is no segment like this, or if was already deleted,
-// @Description responds with an error and 400 status code
+// @Description responds with an error and 400 status code. `children` tells what happens to active child segments:
+// @Description `restrict` (default) refuses to delete a segment that has them, `cascade` deletes them and their descendants too
+// @Description and `detach` makes them top-level segments. Segments referenced by expressions of active composite segments
+// @Description aren't deleted unless `force` is set, then they count as having no members in these expressions
 // @Accept json
 // @Produce json
 // @Param input body v1.JsonDeleteSegmentRequest true "input"
@@ -201,13 +523,19 @@ func (routes *Routes) SegmentDeleteHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	if err := routes.s.DeleteSegment(j.Slug); err != nil {
+	if err := routes.s.DeleteSegment(r.Context(), j.Slug, j.Children, j.Force); err != nil {
 		log.Error().Err(err).Msg("")
 
 		if errors.Is(err, service.ErrSegmentNotFound) {
 			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Segment wasn't found"})
 		} else if errors.Is(err, service.ErrSegmentAlreadyDeleted) {
 			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Segment is already deleted"})
+		} else if errors.Is(err, service.ErrInvalidChildrenPolicy) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "children must be one of restrict, cascade or detach"})
+		} else if errors.Is(err, service.ErrSegmentHasChildren) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Segment has active children, choose what to do with them"})
+		} else if errors.Is(err, service.ErrSegmentReferenced) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Segment is referenced by composite segments, set force to delete it anyway"})
 		} else {
 			internalServerError(w)
 		}
@@ -218,19 +546,69 @@ func (routes *Routes) SegmentDeleteHandler(w http.ResponseWriter, r *http.Reques
 	respondWithJson(w, http.StatusOK, &JsonStatus{"OK"})
 }
 
+// POST /segment/restore
+// @Summary Restore a deleted segment
+// @Description Clears deletion of a segment by this slug. If `restore_memberships` is set, memberships that were removed
+// @Description by the deletion and haven't expired since then are re-activated. Children deleted along with the segment
+// @Description have to be restored separately, a segment whose parent is deleted is restored as a top-level one. If there is no segment like this,
+// @Description or if it isn't deleted, responds with an error and 400 status code
+// @Accept json
+// @Produce json
+// @Param input body v1.JsonRestoreSegmentRequest true "input"
+// @Success 200 {object} v1.JsonRestore "Number of re-activated memberships"
+// @Failure 400 {object} v1.JsonError
+// @Failure 500 {object} v1.JsonError
+// @Router /api/v1/segment/restore [post]
+func (routes *Routes) SegmentRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	var j JsonRestoreSegmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&j); err != nil {
+		log.Error().Err(err).Msg("")
+		respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Error while unmarshalling request JSON"})
+
+		return
+	}
+
+	restored, err := routes.s.RestoreSegment(r.Context(), j.Slug, j.RestoreMemberships)
+	if err != nil {
+		log.Error().Err(err).Msg("")
+
+		if errors.Is(err, service.ErrSegmentNotFound) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Segment wasn't found"})
+		} else if errors.Is(err, service.ErrSegmentNotDeleted) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Segment isn't deleted"})
+		} else {
+			internalServerError(w)
+		}
+
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, &JsonRestore{restored})
+}
+
+// invalidExpirationMessage explains what is wrong with an expiration of a segment
+const invalidExpirationMessage = "Either expires_at or expires_in may be set, expires_in must be a positive ISO-8601 or Go duration"
+
 // POST /user/update
 // @Summary Add and remove segments from user
 // @Description Tries to add and remove segments from user. If any of the specified segments are not active
 // @Description or if any of the lists contains same segment twice or if both list contain the same segment
 // @Description responds with an error and 400 status code.
-// @Description You can specify expiry date for segments. This field is ignored in segments in remove list.
+// @Description You can specify expiry date for segments, either absolute `expires_at` or relative `expires_in`
+// @Description (ISO-8601 like `P7D` or Go like `168h` duration, resolved against server time and echoed back
+// @Description as `expires_at` in the response). Segments without them expire after `default_ttl` of the segment,
+// @Description if it's set. `starts_at` schedules the membership to start later, relative expirations are counted
+// @Description from it. These fields are ignored in segments in remove list, removing a membership
+// @Description that hasn't started yet cancels it.
 // @Description If you try add a segment to a user that already has it or you try to remove it from a user
-// @Description that doesn't have it then that segment is skipped. Note, that if you try to modify expiry
-// @Description date of an active segment, the correct way to do it is to remove it and then add a new one.
+// @Description that doesn't have it then that segment is skipped. To change expiry date of a segment
+// @Description that user already has, use /api/v1/user/expiration. Composite, dynamic and bucketed segments can't be added or removed.
+// @Description If user would end up in several segments of the same exclusion group, responds with an error and 400 status code
+// @Description and changes nothing. To move user to another segment of the group, remove the current one in the same request.
 // @Accept json
 // @Produce json
 // @Param input body v1.JsonUserUpdateRequest true "input"
-// @Success 200 {object} v1.JsonStatus
+// @Success 200 {object} v1.JsonUserUpdate
 // @Failure 400 {object} v1.JsonError
 // @Failure 500 {object} v1.JsonError
 // @Router /api/v1/user/update [post]
@@ -242,15 +620,26 @@ func (routes *Routes) UserUpdateHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	if err := routes.s.UpdateUserSegments(j.UserID, j.AddSegments, j.RemoveSegments); err != nil {
+	addSegments, err := routes.s.UpdateUserSegments(r.Context(), j.UserID, j.AddSegments, j.RemoveSegments)
+	if err != nil {
 		log.Error().Err(err).Msg("")
 
 		if errors.Is(err, service.ErrInvalidSegmentList) {
 			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Supplied segment lists are invalid"})
+		} else if errors.Is(err, service.ErrInvalidExpiration) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, invalidExpirationMessage})
 		} else if errors.Is(err, service.ErrSegmentNotFound) {
 			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Segment wasn't found"})
 		} else if errors.Is(err, service.ErrSegmentAlreadyDeleted) {
 			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Segment is already deleted"})
+		} else if errors.Is(err, service.ErrSegmentComposite) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, segmentCompositeMessage})
+		} else if errors.Is(err, service.ErrSegmentDynamic) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, segmentDynamicMessage})
+		} else if errors.Is(err, service.ErrSegmentBucketed) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, segmentBucketedMessage})
+		} else if errors.Is(err, service.ErrExclusionConflict) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, exclusionConflictMessage})
 		} else {
 			internalServerError(w)
 		}
@@ -258,11 +647,75 @@ func (routes *Routes) UserUpdateHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	respondWithJson(w, http.StatusOK, &JsonStatus{"OK"})
+	respondWithJson(w, http.StatusOK, &JsonUserUpdate{Status: "OK", AddSegments: addSegments})
+}
+
+// POST /user/expiration
+// @Summary Change expiry dates of user's segments
+// @Description Extends, shortens or clears expiry dates of segments that user already has.
+// @Description Omitted `expires_at` and `expires_in` make the segment permanent, `expires_in` is resolved
+// @Description the same way as in /api/v1/user/update. Segments that user doesn't have
+// @Description are skipped. If any of the segments is not active, is listed twice or its expiry date
+// @Description is not in the future or not after the start of a scheduled membership, responds with an error
+// @Description and 400 status code and changes nothing. `starts_at` is ignored.
+// @Description Every change is recorded in user's history as `expiration_changed`. Composite, dynamic and bucketed segments have no expiry dates to change.
+// @Accept json
+// @Produce json
+// @Param input body v1.JsonUserExpirationRequest true "input"
+// @Success 200 {object} v1.JsonUserExpiration
+// @Failure 400 {object} v1.JsonError
+// @Failure 500 {object} v1.JsonError
+// @Router /api/v1/user/expiration [post]
+func (routes *Routes) UserExpirationHandler(w http.ResponseWriter, r *http.Request) {
+	var j JsonUserExpirationRequest
+	if err := json.NewDecoder(r.Body).Decode(&j); err != nil {
+		log.Error().Err(err).Msg("")
+		respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Error while unmarshalling request JSON"})
+		return
+	}
+
+	segments, err := routes.s.UpdateUserSegmentExpirations(r.Context(), j.UserID, j.Segments)
+	if err != nil {
+		log.Error().Err(err).Msg("")
+
+		if errors.Is(err, service.ErrInvalidSegmentList) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Supplied segment list is invalid"})
+		} else if errors.Is(err, service.ErrInvalidExpiration) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, invalidExpirationMessage})
+		} else if errors.Is(err, service.ErrExpirationInPast) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Expiry date is in the past"})
+		} else if errors.Is(err, service.ErrExpirationBeforeStart) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Expiry date is before the start of the membership"})
+		} else if errors.Is(err, service.ErrSegmentNotFound) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Segment wasn't found"})
+		} else if errors.Is(err, service.ErrSegmentAlreadyDeleted) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Segment is already deleted"})
+		} else if errors.Is(err, service.ErrSegmentComposite) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, segmentCompositeMessage})
+		} else if errors.Is(err, service.ErrSegmentDynamic) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, segmentDynamicMessage})
+		} else if errors.Is(err, service.ErrSegmentBucketed) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, segmentBucketedMessage})
+		} else {
+			internalServerError(w)
+		}
+
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, &JsonUserExpiration{Status: "OK", Segments: segments})
 }
 
 // GET /user/segments
 // @Summary Get user's active segments
+// @Description Bucketed segments whose percent user's bucket is in are returned with `bucketed` flag set, they are added
+// @Description at the creation of the segment and have no expiry date.
+// @Description Composite segments whose expressions hold for user's memberships are returned with `composite` flag set,
+// @Description they are added at the latest start of the memberships in the segments the expression references and have no expiry date.
+// @Description Variants of experiments are returned with the slug of their experiment in `experiment`.
+// @Description If `with_inherited` is set, parents and further ancestors of these segments are returned too, with `inherited` flag
+// @Description set unless user is in them explicitly. An inherited segment is added at the earliest and expires at the latest
+// @Description of the memberships it's inherited from
 // @Accept json
 // @Produce json
 // @Param input body v1.JsonUserSegmentsHandlerRequest true "input"
@@ -279,7 +732,7 @@ func (routes *Routes) UserSegmentsHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	segments, err := routes.s.GetActiveUserSegments(j.UserID)
+	segments, err := routes.s.GetActiveUserSegments(r.Context(), j.UserID, j.WithInherited)
 	if err != nil {
 		log.Error().Err(err).Msg("")
 		internalServerError(w)
@@ -290,6 +743,187 @@ func (routes *Routes) UserSegmentsHandler(w http.ResponseWriter, r *http.Request
 	respondWithJson(w, http.StatusOK, &JsonUserSegments{segments})
 }
 
+// GET /segments/{slug}/stats
+// @Summary Get statistics of the segment
+// @Description Get the number of users that are in the segment now and the number of users added, removed
+// @Description and expired on every day of the window. Days are in UTC, the window includes `from` and excludes `to`
+// @Description and can't be longer than 366 days. Deleted segments and old slugs can be looked up too
+// @Produce json
+// @Param slug path string true "slug of the segment"
+// @Param from query string true "first day of the window (YYYY-MM-DD)"
+// @Param to query string true "day after the last day of the window (YYYY-MM-DD)"
+// @Success 200 {object} v1.JsonSegmentStats
+// @Failure 400 {object} v1.JsonError
+// @Failure 500 {object} v1.JsonError
+// @Router /api/v1/segments/{slug}/stats [get]
+func (routes *Routes) SegmentStatsHandler(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseStatsWindow(r)
+	if err != nil {
+		log.Error().Err(err).Msg("")
+		respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, err.Error()})
+
+		return
+	}
+
+	stats, err := routes.s.GetSegmentStats(r.Context(), chi.URLParam(r, "slug"), from, to)
+	if err != nil {
+		log.Error().Err(err).Msg("")
+
+		if errors.Is(err, service.ErrSegmentNotFound) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Segment wasn't found"})
+		} else {
+			internalServerError(w)
+		}
+
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, &JsonSegmentStats{stats})
+}
+
+// POST /segments/refresh
+// @Summary Refresh dynamic segments
+// @Description Evaluates the rule of every active dynamic segment for every user of user DB service, adds the segment
+// @Description to users that match it and removes it from the ones that don't anymore. Changes are recorded in the history.
+// @Description Segments are also refreshed periodically, if `DYNAMIC_SEGMENT_REFRESH_INTERVAL` is set
+// @Produce json
+// @Success 200 {object} v1.JsonRefresh "how many users were added to and removed from every segment"
+// @Failure 500 {object} v1.JsonError
+// @Router /api/v1/segments/refresh [post]
+func (routes *Routes) SegmentsRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	results, err := routes.s.RefreshDynamicSegments(r.Context())
+	if err != nil {
+		log.Error().Err(err).Msg("")
+		internalServerError(w)
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, &JsonRefresh{results})
+}
+
+// GET /segment/members
+// @Summary Get users that are in the segment
+// @Description Get ids of users that are in the segment (or were in it at `as_of`) page by page, sorted by id.
+// @Description Deleted segments and old slugs can be looked up too. Members of composite segments are computed from the members
+// @Description of the segments their expressions reference, members of bucketed segments are the users of user DB service
+// @Description whose buckets are in the current percent. To get the next page pass `next_cursor` of the response
+// @Description as `cursor`, every page is built for the `as_of` of the first one. The last page has no `next_cursor`
+// @Produce json
+// @Param slug query string true "slug of the segment"
+// @Param as_of query string false "moment at which users must have been in the segment (RFC 3339), now by default"
+// @Param cursor query string false "next_cursor from the previous page"
+// @Param limit query int false "page size" minimum(1) maximum(10000) default(1000)
+// @Success 200 {object} v1.JsonSegmentMembers
+// @Failure 400 {object} v1.JsonError
+// @Failure 500 {object} v1.JsonError
+// @Router /api/v1/segment/members [get]
+func (routes *Routes) SegmentMembersHandler(w http.ResponseWriter, r *http.Request) {
+	request, err := parseSegmentMembersRequest(r)
+	if err != nil {
+		log.Error().Err(err).Msg("")
+		respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, err.Error()})
+
+		return
+	}
+
+	result, err := routes.s.GetSegmentMembers(r.Context(), r.URL.Query().Get("slug"), request)
+	if err != nil {
+		log.Error().Err(err).Msg("")
+
+		if errors.Is(err, service.ErrSegmentNotFound) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Segment wasn't found"})
+		} else if errors.Is(err, service.ErrInvalidCursor) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Invalid cursor"})
+		} else {
+			internalServerError(w)
+		}
+
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, &JsonSegmentMembers{result})
+}
+
+// membersFlushInterval is the number of user ids written by the streaming handler between flushes
+const membersFlushInterval = 1000
+
+// GET /segment/members/stream
+// @Summary Stream all users that are in the segment
+// @Description Streams ids of all users that are in the segment (or were in it at `as_of`) as plain text, one id per line,
+// @Description sorted by id. Members of composite and bucketed segments are computed the same way as in /api/v1/segment/members.
+// @Description Meant for segments that are too large to be fetched page by page. Errors that occur after
+// @Description the first id was sent can't be reported, so the response is cut short instead
+// @Produce plain
+// @Param slug query string true "slug of the segment"
+// @Param as_of query string false "moment at which users must have been in the segment (RFC 3339), now by default"
+// @Success 200 {string} string
+// @Failure 400 {object} v1.JsonError
+// @Failure 500 {object} v1.JsonError
+// @Router /api/v1/segment/members/stream [get]
+func (routes *Routes) SegmentMembersStreamHandler(w http.ResponseWriter, r *http.Request) {
+	asOf, err := parseAsOf(r)
+	if err != nil {
+		log.Error().Err(err).Msg("")
+		respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, err.Error()})
+
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	bw := bufio.NewWriter(w)
+	written := 0
+
+	err = routes.s.StreamSegmentMembers(r.Context(), r.URL.Query().Get("slug"), asOf, func(userID int) error {
+		if written == 0 {
+			w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+		}
+
+		if _, err := bw.WriteString(strconv.Itoa(userID) + "\n"); err != nil {
+			return err
+		}
+
+		written++
+		if written%membersFlushInterval == 0 {
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("")
+
+		if written != 0 { // the status is already sent
+			return
+		}
+
+		if errors.Is(err, service.ErrSegmentNotFound) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Segment wasn't found"})
+		} else {
+			internalServerError(w)
+		}
+
+		return
+	}
+
+	if written == 0 { // segment is empty
+		w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+
+		return
+	}
+
+	if err := bw.Flush(); err != nil {
+		log.Error().Err(err).Msg("")
+	}
+}
+
 // GET /user/csv
 // @Summary Generate CSV report on user's segment history
 // @Description Generate CSV report file on user's segment history and uploads it to service's configured file storage service.
@@ -329,7 +963,7 @@ func (routes *Routes) UserCSVHandler(w http.ResponseWriter, r *http.Request) {
 	fromTime := time.Date(j.FromDate.Year, time.Month(j.FromDate.Month), 1, 0, 0, 0, 0, time.UTC)
 	toTime := time.Date(j.ToDate.Year, time.Month(j.ToDate.Month), 1, 0, 0, 0, 0, time.UTC)
 
-	link, err := routes.s.DumpHistoryCSV(j.UserID, fromTime, toTime)
+	link, err := routes.s.DumpHistoryCSV(r.Context(), j.UserID, fromTime, toTime)
 	if err != nil {
 		log.Error().Err(err).Msg("")
 		internalServerError(w)
@@ -338,3 +972,231 @@ func (routes *Routes) UserCSVHandler(w http.ResponseWriter, r *http.Request) {
 
 	respondWithJson(w, http.StatusOK, &JsonLink{link})
 }
+
+// POST /user/erase
+// @Summary Erase all data of the user
+// @Description Deletes every membership of the user, the history of the memberships and all stored CSV reports
+// @Description about the user. Only a tombstone with the time of the erasure and the number of deleted records is kept
+// @Accept json
+// @Produce json
+// @Param input body v1.JsonUserEraseRequest true "input"
+// @Success 200 {object} v1.JsonErasure
+// @Failure 400 {object} v1.JsonError
+// @Failure 500 {object} v1.JsonError
+// @Router /api/v1/user/erase [post]
+func (routes *Routes) UserEraseHandler(w http.ResponseWriter, r *http.Request) {
+	var j JsonUserEraseRequest
+	if err := json.NewDecoder(r.Body).Decode(&j); err != nil {
+		log.Error().Err(err).Msg("")
+		respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Error while unmarshalling request JSON"})
+
+		return
+	}
+
+	erasure, err := routes.s.EraseUser(r.Context(), j.UserID)
+	if err != nil {
+		log.Error().Err(err).Msg("")
+		internalServerError(w)
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, &JsonErasure{erasure})
+}
+
+const (
+	experimentNotFoundMessage       = "Experiment wasn't found"
+	experimentNotStartedMessage     = "Experiment isn't started"
+	experimentAlreadyStoppedMessage = "Experiment is already stopped"
+)
+
+// GET /experiments
+// @Summary Get all experiments
+// @Description Get every experiment with its variants and the times it was created, started and stopped, oldest first
+// @Produce json
+// @Success 200 {object} v1.JsonExperiments
+// @Failure 500 {object} v1.JsonError
+// @Router /api/v1/experiments [get]
+func (routes *Routes) ExperimentsHandler(w http.ResponseWriter, r *http.Request) {
+	experiments, err := routes.s.GetAllExperiments(r.Context())
+	if err != nil {
+		log.Error().Err(err).Msg("")
+		internalServerError(w)
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, &JsonExperiments{experiments})
+}
+
+// POST /experiment/create
+// @Summary Create new experiment
+// @Description Creates an experiment with given slug and its variant segments. Variants are plain segments
+// @Description in the exclusion group named after the experiment, so a user can be in at most one of them.
+// @Description There must be at least two variants with distinct slugs and positive weights that sum up to 100.
+// @Description The experiment isn't started, so it doesn't enroll users until `/experiment/start`.
+// @Description If there is already an experiment with this slug, or if any of the variant slugs is taken by a segment,
+// @Description responds with an error and 400 status code
+// @Accept json
+// @Produce json
+// @Param input body v1.JsonCreateExperimentRequest true "input"
+// @Success 200 {object} v1.JsonStatus
+// @Failure 400 {object} v1.JsonError
+// @Failure 500 {object} v1.JsonError
+// @Router /api/v1/experiment/create [post]
+func (routes *Routes) ExperimentCreateHandler(w http.ResponseWriter, r *http.Request) {
+	var j JsonCreateExperimentRequest
+	if err := json.NewDecoder(r.Body).Decode(&j); err != nil {
+		log.Error().Err(err).Msg("")
+		respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Error while unmarshalling request JSON"})
+
+		return
+	}
+
+	if err := routes.s.CreateExperiment(r.Context(), j.Slug, j.Variants); err != nil {
+		log.Error().Err(err).Msg("")
+
+		if errors.Is(err, service.ErrInvalidVariants) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "There must be at least two variants with distinct slugs and positive weights that sum up to 100"})
+		} else if errors.Is(err, service.ErrExperimentAlreadyExists) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Experiment already exists"})
+		} else if errors.Is(err, service.ErrSegmentAlreadyExists) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Segment already exists"})
+		} else {
+			internalServerError(w)
+		}
+
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, &JsonStatus{"OK"})
+}
+
+// POST /experiment/start
+// @Summary Start an experiment
+// @Description Records the start of the experiment, from then on it enrolls users. If there is no experiment like this,
+// @Description or if it was started before, responds with an error and 400 status code
+// @Accept json
+// @Produce json
+// @Param input body v1.JsonExperimentRequest true "input"
+// @Success 200 {object} v1.JsonStatus
+// @Failure 400 {object} v1.JsonError
+// @Failure 500 {object} v1.JsonError
+// @Router /api/v1/experiment/start [post]
+func (routes *Routes) ExperimentStartHandler(w http.ResponseWriter, r *http.Request) {
+	var j JsonExperimentRequest
+	if err := json.NewDecoder(r.Body).Decode(&j); err != nil {
+		log.Error().Err(err).Msg("")
+		respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Error while unmarshalling request JSON"})
+
+		return
+	}
+
+	if err := routes.s.StartExperiment(r.Context(), j.Slug); err != nil {
+		log.Error().Err(err).Msg("")
+
+		if errors.Is(err, service.ErrExperimentNotFound) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, experimentNotFoundMessage})
+		} else if errors.Is(err, service.ErrExperimentAlreadyStarted) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Experiment is already started"})
+		} else {
+			internalServerError(w)
+		}
+
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, &JsonStatus{"OK"})
+}
+
+// POST /experiment/stop
+// @Summary Stop an experiment
+// @Description Records the stop of the experiment, from then on it doesn't enroll users. Users keep the variants they got.
+// @Description If there is no experiment like this, if it isn't started or if it was stopped before,
+// @Description responds with an error and 400 status code
+// @Accept json
+// @Produce json
+// @Param input body v1.JsonExperimentRequest true "input"
+// @Success 200 {object} v1.JsonStatus
+// @Failure 400 {object} v1.JsonError
+// @Failure 500 {object} v1.JsonError
+// @Router /api/v1/experiment/stop [post]
+func (routes *Routes) ExperimentStopHandler(w http.ResponseWriter, r *http.Request) {
+	var j JsonExperimentRequest
+	if err := json.NewDecoder(r.Body).Decode(&j); err != nil {
+		log.Error().Err(err).Msg("")
+		respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Error while unmarshalling request JSON"})
+
+		return
+	}
+
+	if err := routes.s.StopExperiment(r.Context(), j.Slug); err != nil {
+		log.Error().Err(err).Msg("")
+
+		if errors.Is(err, service.ErrExperimentNotFound) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, experimentNotFoundMessage})
+		} else if errors.Is(err, service.ErrExperimentNotStarted) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, experimentNotStartedMessage})
+		} else if errors.Is(err, service.ErrExperimentAlreadyStopped) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, experimentAlreadyStoppedMessage})
+		} else {
+			internalServerError(w)
+		}
+
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, &JsonStatus{"OK"})
+}
+
+// POST /experiment/enroll
+// @Summary Adds variants of a running experiment to randomly selected users
+// @Description Get a percent of randomly selected users from user DB service and adds every one of them to the variant
+// @Description their bucket in the experiment falls into, so users are split by the weights of the variants and the same user
+// @Description always gets the same variant. Users that already have the variant are counted in `skipped_count`,
+// @Description users that are in another variant are counted in `excluded_count`. Memberships expire at `expires_at`, if it's set,
+// @Description otherwise after `default_ttl` of the variant, if it's set. If there is no experiment like this, if it isn't running,
+// @Description if any of its variants was deleted or if `expires_at` is in the past, responds with an error and 400 status code
+// @Accept json
+// @Produce json
+// @Param input body v1.JsonExperimentEnroll true "input"
+// @Success 200 {object} v1.JsonExperimentEnrollment "IDs of users that were selected and how many of them got every variant"
+// @Failure 400 {object} v1.JsonError
+// @Failure 500 {object} v1.JsonError
+// @Router /api/v1/experiment/enroll [post]
+func (routes *Routes) ExperimentEnrollHandler(w http.ResponseWriter, r *http.Request) {
+	var j JsonExperimentEnroll
+	if err := json.NewDecoder(r.Body).Decode(&j); err != nil {
+		log.Error().Err(err).Msg("")
+		respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Error while unmarshalling request JSON"})
+
+		return
+	}
+
+	if j.Percent < 0 || j.Percent > 100 {
+		respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Invalid percent value"})
+
+		return
+	}
+
+	userIDs, variants, err := routes.s.EnrollExperiment(r.Context(), j.Slug, j.Percent, j.ExpiresAt)
+	if err != nil {
+		log.Error().Err(err).Msg("")
+
+		if errors.Is(err, service.ErrExperimentNotFound) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, experimentNotFoundMessage})
+		} else if errors.Is(err, service.ErrExperimentNotStarted) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, experimentNotStartedMessage})
+		} else if errors.Is(err, service.ErrExperimentAlreadyStopped) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, experimentAlreadyStoppedMessage})
+		} else if errors.Is(err, service.ErrSegmentAlreadyDeleted) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Variant of the experiment is deleted"})
+		} else if errors.Is(err, service.ErrExpirationInPast) {
+			respondWithJson(w, http.StatusBadRequest, &JsonError{http.StatusBadRequest, "Expiry date is in the past"})
+		} else {
+			internalServerError(w)
+		}
+
+		return
+	}
+
+	respondWithJson(w, http.StatusOK, &JsonExperimentEnrollment{UserIDs: userIDs, Variants: variants})
+}
@@ -0,0 +1,20 @@
+package v1
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// RequestTimeout sets a deadline on the context of every request. Unlike `middleware.Timeout` it doesn't
+// write a response on its own: the handler fails with the context error and responds as usual
+func RequestTimeout(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -33,12 +33,27 @@ func apiMux(routes *Routes) http.Handler {
 
 	mux.Get("/segments", routes.SegmentsHandler)
 	mux.Get("/segments/active", routes.SegmentsActiveHandler)
+	mux.Get("/segments/{slug}/stats", routes.SegmentStatsHandler)
+	mux.Post("/segments/refresh", routes.SegmentsRefreshHandler)
 	mux.Post("/segment/create", routes.SegmentCreateHandler)
 	mux.Post("/segment/create/enroll", routes.SegmentCreateEnrollHandler)
+	mux.Post("/segment/enroll", routes.SegmentEnrollHandler)
+	mux.Post("/segment/update", routes.SegmentUpdateHandler)
+	mux.Post("/segment/rename", routes.SegmentRenameHandler)
 	mux.Post("/segment/delete", routes.SegmentDeleteHandler)
+	mux.Post("/segment/restore", routes.SegmentRestoreHandler)
+	mux.Get("/segment/members", routes.SegmentMembersHandler)
+	mux.Get("/segment/members/stream", routes.SegmentMembersStreamHandler)
 	mux.Post("/user/update", routes.UserUpdateHandler)
+	mux.Post("/user/expiration", routes.UserExpirationHandler)
 	mux.Get("/user/segments", routes.UserSegmentsHandler)
 	mux.Get("/user/csv", routes.UserCSVHandler)
+	mux.Post("/user/erase", routes.UserEraseHandler)
+	mux.Get("/experiments", routes.ExperimentsHandler)
+	mux.Post("/experiment/create", routes.ExperimentCreateHandler)
+	mux.Post("/experiment/start", routes.ExperimentStartHandler)
+	mux.Post("/experiment/stop", routes.ExperimentStopHandler)
+	mux.Post("/experiment/enroll", routes.ExperimentEnrollHandler)
 
 	return mux
 }
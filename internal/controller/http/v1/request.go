@@ -1,18 +1,237 @@
 package v1
 
-import "github.com/QiZD90/dynamic-customer-segmentation/internal/entity"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/entity"
+)
 
 type JsonCreateSegmentRequest struct {
 	Slug string
+	entity.SegmentMetadata
 }
 
 type JsonSegmentCreateAndEnroll struct {
 	Slug    string
 	Percent int
+	entity.SegmentMetadata
+}
+
+type JsonSegmentEnroll struct {
+	Slug      string     `json:"slug"`
+	Percent   int        `json:"percent"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type JsonUpdateSegmentRequest struct {
+	Slug string `json:"slug"`
+	entity.SegmentMetadataUpdate
+}
+
+type JsonRenameSegmentRequest struct {
+	Slug    string `json:"slug"`
+	NewSlug string `json:"new_slug"`
+}
+
+type JsonRestoreSegmentRequest struct {
+	Slug               string `json:"slug"`
+	RestoreMemberships bool   `json:"restore_memberships"`
+}
+
+const (
+	defaultSegmentPageLimit = 100
+	maxSegmentPageLimit     = 1000
+)
+
+// parseSegmentFilter reads segment filter from query parameters: `owner`, `exclusion_group`, `bucketed`, `tag` (may be repeated),
+// `attributes` (JSON object), `slug`, `slug_prefix`, `slug_contains` and `created_from`, `created_to`,
+// `deleted_from`, `deleted_to` (RFC 3339). Returned error message can be shown to the client
+func parseSegmentFilter(r *http.Request) (entity.SegmentFilter, error) {
+	query := r.URL.Query()
+	filter := entity.SegmentFilter{
+		Owner:          query.Get("owner"),
+		ExclusionGroup: query.Get("exclusion_group"),
+		Tags:           query["tag"],
+		Slug:           query.Get("slug"),
+		SlugPrefix:     query.Get("slug_prefix"),
+		SlugContains:   query.Get("slug_contains"),
+	}
+
+	if attributes := query.Get("attributes"); attributes != "" {
+		if err := json.Unmarshal([]byte(attributes), &filter.Attributes); err != nil {
+			return entity.SegmentFilter{}, errors.New("Invalid attributes filter")
+		}
+	}
+
+	if bucketed := query.Get("bucketed"); bucketed != "" {
+		b, err := strconv.ParseBool(bucketed)
+		if err != nil {
+			return entity.SegmentFilter{}, errors.New("Invalid bucketed flag")
+		}
+
+		filter.Bucketed = b
+	}
+
+	timeParams := []struct {
+		name  string
+		bound **time.Time
+	}{
+		{"created_from", &filter.CreatedFrom},
+		{"created_to", &filter.CreatedTo},
+		{"deleted_from", &filter.DeletedFrom},
+		{"deleted_to", &filter.DeletedTo},
+	}
+	for _, p := range timeParams {
+		value := query.Get(p.name)
+		if value == "" {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return entity.SegmentFilter{}, fmt.Errorf("Invalid %s date", p.name)
+		}
+
+		t = t.UTC()
+		*p.bound = &t
+	}
+
+	return filter, nil
+}
+
+// parseSegmentPage reads the page of segments from query parameters: `sort` (`created_at` or `slug`),
+// `order` (`asc` or `desc`), `cursor`, `limit` and `with_member_counts`. Without `cursor` and `limit` the page has no limit.
+// Returned error message can be shown to the client
+func parseSegmentPage(r *http.Request) (entity.SegmentPageRequest, error) {
+	query := r.URL.Query()
+	page := entity.SegmentPageRequest{Cursor: query.Get("cursor")}
+
+	// the lists were not paged before, so only the clients that page get a limit
+	if page.Cursor != "" {
+		page.Limit = defaultSegmentPageLimit
+	}
+
+	switch sortBy := entity.SegmentSortField(query.Get("sort")); sortBy {
+	case "", entity.SortByCreatedAt, entity.SortBySlug:
+		page.SortBy = sortBy
+	default:
+		return entity.SegmentPageRequest{}, errors.New("Invalid sort field")
+	}
+
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		page.Descending = true
+	default:
+		return entity.SegmentPageRequest{}, errors.New("Invalid sort order")
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxSegmentPageLimit {
+			return entity.SegmentPageRequest{}, fmt.Errorf("Limit must be between 1 and %d", maxSegmentPageLimit)
+		}
+
+		page.Limit = n
+	}
+
+	if withMemberCounts := query.Get("with_member_counts"); withMemberCounts != "" {
+		b, err := strconv.ParseBool(withMemberCounts)
+		if err != nil {
+			return entity.SegmentPageRequest{}, errors.New("Invalid with_member_counts flag")
+		}
+
+		page.WithMemberCounts = b
+	}
+
+	return page, nil
+}
+
+const (
+	defaultMembersPageLimit = 1000
+	maxMembersPageLimit     = 10000
+)
+
+// parseAsOf reads optional `as_of` query parameter (RFC 3339). Zero time is returned if there is none
+func parseAsOf(r *http.Request) (time.Time, error) {
+	value := r.URL.Query().Get("as_of")
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, errors.New("Invalid as_of date")
+	}
+
+	return t.UTC(), nil
+}
+
+// parseSegmentMembersRequest reads the page of segment members from query parameters: `as_of` (RFC 3339),
+// `cursor` and `limit`. Returned error message can be shown to the client
+func parseSegmentMembersRequest(r *http.Request) (entity.SegmentMembersRequest, error) {
+	asOf, err := parseAsOf(r)
+	if err != nil {
+		return entity.SegmentMembersRequest{}, err
+	}
+
+	query := r.URL.Query()
+	request := entity.SegmentMembersRequest{
+		AsOf:   asOf,
+		Cursor: query.Get("cursor"),
+		Limit:  defaultMembersPageLimit,
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxMembersPageLimit {
+			return entity.SegmentMembersRequest{}, fmt.Errorf("Limit must be between 1 and %d", maxMembersPageLimit)
+		}
+
+		request.Limit = n
+	}
+
+	return request, nil
+}
+
+// maxStatsDays is the longest window of segment stats
+const maxStatsDays = 366
+
+// parseStatsWindow reads the window of segment stats from query parameters `from` and `to` (dates in UTC,
+// `to` is excluded). Returned error message can be shown to the client
+func parseStatsWindow(r *http.Request) (time.Time, time.Time, error) {
+	query := r.URL.Query()
+
+	from, err := time.Parse(time.DateOnly, query.Get("from"))
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.New("Invalid from date")
+	}
+
+	to, err := time.Parse(time.DateOnly, query.Get("to"))
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.New("Invalid to date")
+	}
+
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, errors.New("From date is not earlier than to date")
+	}
+
+	if to.Sub(from) > maxStatsDays*24*time.Hour {
+		return time.Time{}, time.Time{}, fmt.Errorf("Window can't be longer than %d days", maxStatsDays)
+	}
+
+	return from, to, nil
 }
 
 type JsonDeleteSegmentRequest struct {
-	Slug string
+	Slug     string
+	Children entity.ChildrenPolicy `json:"children" enums:"restrict,cascade,detach"`
+	Force    bool                  `json:"force"` // delete even if composite segments reference it
 }
 
 type JsonUserUpdateRequest struct {
@@ -21,10 +240,35 @@ type JsonUserUpdateRequest struct {
 	RemoveSegments []entity.SegmentExpiration `json:"remove_segments"`
 }
 
+type JsonUserExpirationRequest struct {
+	UserID   int                        `json:"user_id"`
+	Segments []entity.SegmentExpiration `json:"segments"`
+}
+
 type JsonUserSegmentsHandlerRequest struct {
+	UserID        int  `json:"user_id"`
+	WithInherited bool `json:"with_inherited"`
+}
+
+type JsonUserEraseRequest struct {
 	UserID int `json:"user_id"`
 }
 
+type JsonCreateExperimentRequest struct {
+	Slug     string                     `json:"slug"`
+	Variants []entity.ExperimentVariant `json:"variants"`
+}
+
+type JsonExperimentRequest struct {
+	Slug string `json:"slug"`
+}
+
+type JsonExperimentEnroll struct {
+	Slug      string     `json:"slug"`
+	Percent   int        `json:"percent"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
 type JsonDate struct {
 	Month int `json:"month"`
 	Year  int `json:"year"`
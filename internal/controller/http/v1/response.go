@@ -44,13 +44,34 @@ func (j *JsonLink) Bytes() ([]byte, error) {
 }
 
 type JsonSegments struct {
-	Segments []entity.Segment `json:"segments"`
+	Segments   []entity.Segment `json:"segments"`
+	NextCursor string           `json:"next_cursor,omitempty"`
 }
 
 func (j *JsonSegments) Bytes() ([]byte, error) {
 	return json.Marshal(j)
 }
 
+// JsonUserUpdate echoes the add list back with relative expirations resolved
+type JsonUserUpdate struct {
+	Status      string                     `json:"status"`
+	AddSegments []entity.SegmentExpiration `json:"add_segments"`
+}
+
+func (j *JsonUserUpdate) Bytes() ([]byte, error) {
+	return json.Marshal(j)
+}
+
+// JsonUserExpiration echoes the list back with relative expirations resolved
+type JsonUserExpiration struct {
+	Status   string                     `json:"status"`
+	Segments []entity.SegmentExpiration `json:"segments"`
+}
+
+func (j *JsonUserExpiration) Bytes() ([]byte, error) {
+	return json.Marshal(j)
+}
+
 type JsonUserSegments struct {
 	Segments []entity.UserSegment `json:"segments"`
 }
@@ -59,10 +80,68 @@ func (j *JsonUserSegments) Bytes() ([]byte, error) {
 	return json.Marshal(j)
 }
 
-type JsonUserIDs struct {
+type JsonEnrollment struct {
 	UserIDs []int `json:"user_ids"`
+	entity.EnrollmentResult
+}
+
+func (j *JsonEnrollment) Bytes() ([]byte, error) {
+	return json.Marshal(j)
+}
+
+type JsonRestore struct {
+	RestoredCount int `json:"restored_count"`
+}
+
+func (j *JsonRestore) Bytes() ([]byte, error) {
+	return json.Marshal(j)
+}
+
+type JsonErasure struct {
+	entity.Erasure
+}
+
+func (j *JsonErasure) Bytes() ([]byte, error) {
+	return json.Marshal(j)
+}
+
+type JsonSegmentMembers struct {
+	entity.SegmentMembersPage
+}
+
+func (j *JsonSegmentMembers) Bytes() ([]byte, error) {
+	return json.Marshal(j)
+}
+
+type JsonSegmentStats struct {
+	entity.SegmentStats
+}
+
+func (j *JsonSegmentStats) Bytes() ([]byte, error) {
+	return json.Marshal(j)
+}
+
+type JsonRefresh struct {
+	Segments []entity.RefreshResult `json:"segments"`
+}
+
+func (j *JsonRefresh) Bytes() ([]byte, error) {
+	return json.Marshal(j)
+}
+
+type JsonExperiments struct {
+	Experiments []entity.Experiment `json:"experiments"`
+}
+
+func (j *JsonExperiments) Bytes() ([]byte, error) {
+	return json.Marshal(j)
+}
+
+type JsonExperimentEnrollment struct {
+	UserIDs  []int                      `json:"user_ids"`
+	Variants []entity.VariantEnrollment `json:"variants"`
 }
 
-func (j *JsonUserIDs) Bytes() ([]byte, error) {
+func (j *JsonExperimentEnrollment) Bytes() ([]byte, error) {
 	return json.Marshal(j)
 }
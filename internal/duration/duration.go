@@ -0,0 +1,56 @@
+package duration
+
+import (
+	"errors"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errInvalid = errors.New("duration is invalid")
+
+// isoDurationRegexp matches ISO-8601 durations made of weeks, days, hours, minutes and seconds.
+// Years and months have no fixed length, so they aren't supported
+var isoDurationRegexp = regexp.MustCompile(`^P(?:([\d.,]+)W)?(?:([\d.,]+)D)?(?:T(?:([\d.,]+)H)?(?:([\d.,]+)M)?(?:([\d.,]+)S)?)?$`)
+
+// isoDurationUnits are the units of the groups of `isoDurationRegexp`, a day is always 24 hours
+var isoDurationUnits = []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+
+// Parse parses an ISO-8601 duration (`P7D`, `PT1H30M`) or a Go duration (`168h`, `1h30m`)
+func Parse(s string) (time.Duration, error) {
+	if !strings.HasPrefix(s, "P") {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return 0, errInvalid
+		}
+
+		return d, nil
+	}
+
+	match := isoDurationRegexp.FindStringSubmatch(s)
+	if match == nil || strings.HasSuffix(s, "T") || s == "P" { // no components at all
+		return 0, errInvalid
+	}
+
+	var total float64
+	for i, value := range match[1:] {
+		if value == "" {
+			continue
+		}
+
+		v, err := strconv.ParseFloat(strings.Replace(value, ",", ".", 1), 64)
+		if err != nil {
+			return 0, errInvalid
+		}
+
+		total += v * float64(isoDurationUnits[i])
+	}
+
+	if total > math.MaxInt64 {
+		return 0, errInvalid
+	}
+
+	return time.Duration(total), nil
+}
@@ -0,0 +1,43 @@
+package duration
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		testName  string
+		input     string
+		want      time.Duration
+		wantError bool
+	}{
+		{testName: "iso days", input: "P7D", want: 7 * 24 * time.Hour},
+		{testName: "iso weeks", input: "P2W", want: 14 * 24 * time.Hour},
+		{testName: "iso time", input: "PT1H30M", want: 90 * time.Minute},
+		{testName: "iso days and time", input: "P1DT12H", want: 36 * time.Hour},
+		{testName: "iso fraction", input: "PT0,5S", want: 500 * time.Millisecond},
+		{testName: "go duration", input: "168h", want: 168 * time.Hour},
+		{testName: "go complex duration", input: "1h30m", want: 90 * time.Minute},
+		{testName: "empty iso duration", input: "P", wantError: true},
+		{testName: "empty iso time", input: "P1DT", wantError: true},
+		{testName: "iso months", input: "P1M", wantError: true},
+		{testName: "iso years", input: "P1Y", wantError: true},
+		{testName: "malformed number", input: "P1.2.3D", wantError: true},
+		{testName: "overflow", input: "P999999999W", wantError: true},
+		{testName: "garbage", input: "week", wantError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			got, err := Parse(tc.input)
+			if (err != nil) != tc.wantError {
+				t.Errorf("ParseDuration -- %s -- want error: %t, got error: %v", tc.testName, tc.wantError, err)
+			}
+
+			if got != tc.want {
+				t.Errorf("ParseDuration -- %s -- want: %s, got: %s", tc.testName, tc.want, got)
+			}
+		})
+	}
+}
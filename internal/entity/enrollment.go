@@ -0,0 +1,21 @@
+package entity
+
+// EnrollmentResult describes the outcome of adding a segment to a batch of users
+type EnrollmentResult struct {
+	EnrolledCount int `json:"enrolled_count"` // users that got the segment added
+	SkippedCount  int `json:"skipped_count"`  // users that already had the segment active
+	ExcludedCount int `json:"excluded_count"` // users that are already in another segment of the exclusion group
+}
+
+// VariantEnrollment describes the outcome of adding a variant of an experiment to the users that fell into it
+type VariantEnrollment struct {
+	Slug string `json:"slug"`
+	EnrollmentResult
+}
+
+// RefreshResult describes the changes made by a refresh of a dynamic segment
+type RefreshResult struct {
+	Slug         string `json:"slug"`
+	AddedCount   int    `json:"added_count"`   // users that now match the rule and got the segment added
+	RemovedCount int    `json:"removed_count"` // users that no longer match the rule and were removed from the segment
+}
@@ -0,0 +1,12 @@
+package entity
+
+import "time"
+
+// Erasure is a tombstone left after all data of the user was erased
+type Erasure struct {
+	UserID           int       `json:"user_id"`
+	ErasedAt         time.Time `json:"erased_at"`
+	MembershipsCount int       `json:"memberships_count"`
+	OperationsCount  int       `json:"operations_count"`
+	FilesCount       int       `json:"files_count"`
+}
@@ -0,0 +1,19 @@
+package entity
+
+import "time"
+
+// ExperimentVariant is a segment of an experiment and the share of enrolled users that get it
+type ExperimentVariant struct {
+	Slug   string `json:"slug"`
+	Weight int    `json:"weight"` // percent of enrolled users, weights of an experiment sum up to 100
+}
+
+// Experiment splits enrolled users between its variant segments by their weights.
+// Variants are segments in the exclusion group named after the experiment, so a user is in at most one of them
+type Experiment struct {
+	Slug      string              `json:"slug"`
+	Variants  []ExperimentVariant `json:"variants"`
+	CreatedAt time.Time           `json:"created_at"`
+	StartedAt *time.Time          `json:"started_at,omitempty"` // nil until the experiment is started
+	StoppedAt *time.Time          `json:"stopped_at,omitempty"` // nil until the experiment is stopped
+}
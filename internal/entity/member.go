@@ -0,0 +1,22 @@
+package entity
+
+import "time"
+
+// SegmentMembersRequest describes a page of users that are in the segment
+type SegmentMembersRequest struct {
+	// AsOf is the moment at which memberships must be active. Zero value means now
+	AsOf time.Time
+
+	// Cursor is `NextCursor` of the previous page, empty for the first page
+	Cursor string
+
+	// Limit is the maximum number of users in the page, 0 means no limit
+	Limit int
+}
+
+// SegmentMembersPage is a page of ids of users that are in the segment, sorted by id
+type SegmentMembersPage struct {
+	AsOf       time.Time `json:"as_of"`
+	UserIDs    []int     `json:"user_ids"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
@@ -8,6 +8,16 @@ const (
 	AddedOperationType   OperationType = "added"
 	RemovedOperationType OperationType = "removed"
 	ExpiredOperationType OperationType = "expired"
+
+	// SegmentDeletedOperationType is a removal caused by deletion of the segment itself
+	SegmentDeletedOperationType OperationType = "segment_deleted"
+
+	// SegmentRestoredOperationType is a membership re-activated by restoring the deleted segment
+	SegmentRestoredOperationType OperationType = "segment_restored"
+
+	// ExpirationChangedOperationType is a change of the expiration date of an active membership,
+	// the operation holds the new date
+	ExpirationChangedOperationType OperationType = "expiration_changed"
 )
 
 type Operation struct {
@@ -15,4 +25,7 @@ type Operation struct {
 	SegmentSlug string
 	Type        OperationType
 	Time        time.Time
+
+	// ExpiresAt is the expiration date the membership had at the time of the operation
+	ExpiresAt *time.Time
 }
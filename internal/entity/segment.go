@@ -2,10 +2,121 @@ package entity
 
 import "time"
 
+// SegmentMetadata is descriptive information about a segment
+type SegmentMetadata struct {
+	Description string         `json:"description,omitempty"`
+	Owner       string         `json:"owner,omitempty"`
+	Tags        []string       `json:"tags,omitempty"`
+	Attributes  map[string]any `json:"attributes,omitempty"`
+
+	// DefaultTTL is an ISO-8601 (`P30D`) or Go (`720h`) duration after which memberships added
+	// without an explicit expiration expire. Empty means that they don't expire
+	DefaultTTL string `json:"default_ttl,omitempty"`
+
+	// Parent is the slug of the parent segment, empty for top-level segments.
+	// Members of the segment are inherited members of its parent and of the parent's ancestors
+	Parent string `json:"parent,omitempty"`
+
+	// Expression makes the segment composite: users are in it while this boolean expression over other segments,
+	// such as `VOICE_MESSAGES AND NOT PERFORMANCE_VAS`, holds for their memberships. Memberships of composite
+	// segments are computed rather than stored, so users can't be added to or removed from them directly
+	Expression string `json:"expression,omitempty"`
+
+	// Rule makes the segment dynamic: users are in it while this rule over their attributes from the user service,
+	// such as `country = "RU" AND signup_date > 2023-01-01`, holds. Memberships of dynamic segments are stored
+	// and changed by refreshes of the segment, so users can't be added to or removed from them directly
+	Rule string `json:"rule,omitempty"`
+
+	// ExclusionGroup is the name of the exclusion group of the segment, empty if it isn't in one.
+	// Segments of the same group are mutually exclusive: a user can be in at most one of them at a time
+	ExclusionGroup string `json:"exclusion_group,omitempty"`
+
+	// BucketSalt makes the segment bucketed: a user is in it if the hash of the salt and the user id falls
+	// into the first `BucketPercent` of 100 buckets. Memberships of bucketed segments are computed rather than stored,
+	// so any user id gets the same answer without being enrolled, and raising the percent only adds users
+	BucketSalt    string `json:"bucket_salt,omitempty"`
+	BucketPercent int    `json:"bucket_percent,omitempty"`
+}
+
+// SegmentMetadataUpdate describes changes to segment's metadata.
+// Nil fields are left unchanged, so to clear tags or attributes pass an empty slice or map
+type SegmentMetadataUpdate struct {
+	Description *string        `json:"description,omitempty"`
+	Owner       *string        `json:"owner,omitempty"`
+	Tags        []string       `json:"tags,omitempty"`
+	Attributes  map[string]any `json:"attributes,omitempty"`
+	DefaultTTL  *string        `json:"default_ttl,omitempty"` // empty string removes the default TTL
+	Parent      *string        `json:"parent,omitempty"`      // empty string makes the segment top-level
+	Expression  *string        `json:"expression,omitempty"`  // only composite segments have one to change
+	Rule        *string        `json:"rule,omitempty"`        // only dynamic segments have one to change
+
+	ExclusionGroup *string `json:"exclusion_group,omitempty"` // empty string takes the segment out of its group
+	BucketPercent  *int    `json:"bucket_percent,omitempty"`  // only bucketed segments have one to change
+}
+
+// ChildrenPolicy tells what happens to active children of a segment when it's deleted
+type ChildrenPolicy string
+
+const (
+	ChildrenRestrict ChildrenPolicy = "restrict" // segment with children can't be deleted
+	ChildrenCascade  ChildrenPolicy = "cascade"  // children and their descendants are deleted too
+	ChildrenDetach   ChildrenPolicy = "detach"   // children become top-level segments
+)
+
+// SegmentFilter limits the list of segments. Zero value matches every segment
+type SegmentFilter struct {
+	OnlyActive   bool           // if set, deleted segments are left out
+	Slug         string         // if not empty, segment must have this slug or alias
+	Owner        string         // if not empty, segment must be owned by this owner
+	Tags         []string       // segment must have all of these tags
+	Attributes   map[string]any // segment must have all of these attributes with equal values
+	SlugPrefix   string         // if not empty, slug must start with it
+	SlugContains string         // if not empty, slug must contain it
+
+	ExclusionGroup string // if not empty, segment must be in this exclusion group
+	Bucketed       bool   // if set, segment must be bucketed
+
+	// time ranges include the start and exclude the end, nil bounds are open.
+	// Any bound of the deletion range leaves out active segments
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+	DeletedFrom *time.Time
+	DeletedTo   *time.Time
+}
+
+// SegmentSortField is a field the list of segments is sorted by. Ties are broken by creation order
+type SegmentSortField string
+
+const (
+	SortByCreatedAt SegmentSortField = "created_at"
+	SortBySlug      SegmentSortField = "slug"
+)
+
+// SegmentPageRequest describes a page of the list of segments
+type SegmentPageRequest struct {
+	SortBy     SegmentSortField // defaults to `SortByCreatedAt`
+	Descending bool
+	Cursor     string // `NextCursor` of the previous page, empty for the first page
+	Limit      int    // maximum number of segments on the page, 0 means no limit
+
+	WithMemberCounts bool // if set, `MemberCount` of every segment is filled
+}
+
+// SegmentPage is a page of the list of segments
+type SegmentPage struct {
+	Segments   []Segment
+	NextCursor string // empty if there are no more segments
+}
+
 type Segment struct {
-	Slug      string     `json:"slug"`
+	Slug    string   `json:"slug"`
+	Aliases []string `json:"aliases,omitempty"` // previous slugs of the segment, oldest first
+	SegmentMetadata
 	CreatedAt time.Time  `json:"created_at"`
 	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+
+	// MemberCount is the number of users in the segment now. Only filled on request
+	MemberCount *int `json:"member_count,omitempty"`
 }
 
 type UserSegment struct {
@@ -13,9 +124,31 @@ type UserSegment struct {
 	AddedAt   time.Time  `json:"added_at"`
 	RemovedAt *time.Time `json:"removed_at,omitempty"`
 	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// Inherited is set if the user isn't in the segment itself but in one of its descendants.
+	// Then `AddedAt` is the earliest start and `ExpiresAt` is the latest expiry of these memberships
+	Inherited bool `json:"inherited,omitempty"`
+
+	// Composite is set if the segment is composite and user is in it because its expression holds.
+	// Then `AddedAt` is the latest start of the memberships it's computed from and `ExpiresAt` is nil
+	Composite bool `json:"composite,omitempty"`
+
+	// Bucketed is set if the segment is bucketed and user's bucket is in its percent.
+	// Then `AddedAt` is the creation time of the segment and `ExpiresAt` is nil
+	Bucketed bool `json:"bucketed,omitempty"`
+
+	// Experiment is the slug of the experiment if the segment is one of its variants
+	Experiment string `json:"experiment,omitempty"`
 }
 
 type SegmentExpiration struct {
 	Slug      string     `json:"slug"`
 	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// StartsAt schedules the membership to start in the future. Nil or past time means that it starts now
+	StartsAt *time.Time `json:"starts_at,omitempty"`
+
+	// ExpiresIn is the expiration relative to the start of the membership, an ISO-8601 (`P7D`) or Go (`168h`) duration.
+	// The service resolves it to `ExpiresAt`, so only one of them may be set. Repositories ignore it
+	ExpiresIn string `json:"expires_in,omitempty"`
 }
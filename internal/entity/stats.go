@@ -0,0 +1,22 @@
+package entity
+
+import "time"
+
+// SegmentStats describes the size of a segment and how its membership changed day by day
+type SegmentStats struct {
+	Slug        string `json:"slug"`
+	ActiveCount int    `json:"active_count"` // users in the segment now
+
+	// From and To are the bounds of the window, midnights in UTC. From is included and To is excluded
+	From time.Time         `json:"from"`
+	To   time.Time         `json:"to"`
+	Days []SegmentDayStats `json:"days"`
+}
+
+// SegmentDayStats counts changes of the membership during a day (UTC)
+type SegmentDayStats struct {
+	Date    time.Time `json:"date"`
+	Added   int       `json:"added"`   // users added, including restored by restoring the segment
+	Removed int       `json:"removed"` // users removed, including removed by deleting the segment
+	Expired int       `json:"expired"` // memberships that reached their expiration date
+}
@@ -0,0 +1,7 @@
+package entity
+
+// UserAttributes is a user from the user service along with the attributes rules of dynamic segments are evaluated on
+type UserAttributes struct {
+	UserID     int            `json:"user_id"`
+	Attributes map[string]any `json:"attributes"`
+}
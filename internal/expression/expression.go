@@ -0,0 +1,257 @@
+package expression
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+var errInvalid = errors.New("expression is invalid")
+
+// Op is the kind of a node of an expression
+type Op int
+
+const (
+	OpSegment Op = iota // user is in the segment `Slug`
+	OpNot
+	OpAnd
+	OpOr
+)
+
+// Expr is a boolean expression over segments, such as `VOICE_MESSAGES AND NOT PERFORMANCE_VAS`.
+// `NOT` binds tighter than `AND`, which binds tighter than `OR`, keywords are case-insensitive
+type Expr struct {
+	Op       Op
+	Slug     string  // only set for `OpSegment`
+	Operands []*Expr // one for `OpNot`, two or more for `OpAnd` and `OpOr`
+}
+
+// Parse parses an expression. Slugs are any runs of characters other than whitespace and parentheses
+func Parse(s string) (*Expr, error) {
+	p := parser{tokens: tokenize(s)}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos != len(p.tokens) { // something is left after a complete expression
+		return nil, errInvalid
+	}
+
+	return e, nil
+}
+
+// Eval evaluates the expression, `member` tells whether user is in the segment
+func (e *Expr) Eval(member func(slug string) bool) bool {
+	switch e.Op {
+	case OpSegment:
+		return member(e.Slug)
+	case OpNot:
+		return !e.Operands[0].Eval(member)
+	case OpAnd:
+		for _, operand := range e.Operands {
+			if !operand.Eval(member) {
+				return false
+			}
+		}
+		return true
+	default:
+		for _, operand := range e.Operands {
+			if operand.Eval(member) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Bounded reports whether the expression never matches users that are in none of its segments.
+// Only such expressions can be evaluated for the members of its segments instead of every user
+func (e *Expr) Bounded() bool {
+	return !e.Eval(func(string) bool { return false })
+}
+
+// Slugs returns every slug the expression references once, in order of appearance
+func (e *Expr) Slugs() []string {
+	var slugs []string
+	seen := make(map[string]struct{})
+	e.walk(func(slug string) {
+		if _, ok := seen[slug]; !ok {
+			seen[slug] = struct{}{}
+			slugs = append(slugs, slug)
+		}
+	})
+
+	return slugs
+}
+
+// Rename replaces slugs that `rename` has a new slug for
+func (e *Expr) Rename(rename map[string]string) {
+	if e.Op == OpSegment {
+		if newSlug, ok := rename[e.Slug]; ok {
+			e.Slug = newSlug
+		}
+		return
+	}
+
+	for _, operand := range e.Operands {
+		operand.Rename(rename)
+	}
+}
+
+// String returns the expression with uppercase keywords and only necessary parentheses
+func (e *Expr) String() string {
+	switch e.Op {
+	case OpSegment:
+		return e.Slug
+	case OpNot:
+		return "NOT " + e.Operands[0].operand(OpNot)
+	}
+
+	operands := make([]string, len(e.Operands))
+	for i, operand := range e.Operands {
+		operands[i] = operand.operand(e.Op)
+	}
+
+	if e.Op == OpAnd {
+		return strings.Join(operands, " AND ")
+	}
+	return strings.Join(operands, " OR ")
+}
+
+// operand returns the expression as an operand of `op`, in parentheses if it binds looser
+func (e *Expr) operand(op Op) string {
+	if e.Op == OpOr && op != OpOr || e.Op == OpAnd && op == OpNot {
+		return "(" + e.String() + ")"
+	}
+
+	return e.String()
+}
+
+func (e *Expr) walk(fn func(slug string)) {
+	if e.Op == OpSegment {
+		fn(e.Slug)
+		return
+	}
+
+	for _, operand := range e.Operands {
+		operand.walk(fn)
+	}
+}
+
+// tokenize splits the expression into parentheses and words
+func tokenize(s string) []string {
+	var tokens []string
+	start := -1
+	for i, r := range s {
+		if r == '(' || r == ')' || unicode.IsSpace(r) {
+			if start >= 0 {
+				tokens = append(tokens, s[start:i])
+				start = -1
+			}
+
+			if !unicode.IsSpace(r) {
+				tokens = append(tokens, string(r))
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+
+	if start >= 0 {
+		tokens = append(tokens, s[start:])
+	}
+
+	return tokens
+}
+
+// parser is a recursive descent parser over the tokens
+type parser struct {
+	tokens []string
+	pos    int
+}
+
+// accept skips the next token if it's the keyword or parenthesis `token`
+func (p *parser) accept(token string) bool {
+	if p.pos < len(p.tokens) && strings.EqualFold(p.tokens[p.pos], token) {
+		p.pos++
+		return true
+	}
+
+	return false
+}
+
+func (p *parser) parseOr() (*Expr, error) {
+	return p.parseBinary(OpOr, "OR", p.parseAnd)
+}
+
+func (p *parser) parseAnd() (*Expr, error) {
+	return p.parseBinary(OpAnd, "AND", p.parseNot)
+}
+
+// parseBinary parses operands of `op` separated by `keyword`, a single operand is returned as is
+func (p *parser) parseBinary(op Op, keyword string, parseOperand func() (*Expr, error)) (*Expr, error) {
+	operand, err := parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	operands := []*Expr{operand}
+	for p.accept(keyword) {
+		operand, err := parseOperand()
+		if err != nil {
+			return nil, err
+		}
+
+		operands = append(operands, operand)
+	}
+
+	if len(operands) == 1 {
+		return operand, nil
+	}
+
+	return &Expr{Op: op, Operands: operands}, nil
+}
+
+func (p *parser) parseNot() (*Expr, error) {
+	if !p.accept("NOT") {
+		return p.parseOperand()
+	}
+
+	operand, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Expr{Op: OpNot, Operands: []*Expr{operand}}, nil
+}
+
+// parseOperand parses a slug or an expression in parentheses
+func (p *parser) parseOperand() (*Expr, error) {
+	if p.accept("(") {
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if !p.accept(")") {
+			return nil, errInvalid
+		}
+
+		return e, nil
+	}
+
+	if p.pos == len(p.tokens) {
+		return nil, errInvalid
+	}
+
+	token := p.tokens[p.pos]
+	for _, keyword := range []string{"AND", "OR", "NOT", ")"} {
+		if strings.EqualFold(token, keyword) {
+			return nil, errInvalid
+		}
+	}
+
+	p.pos++
+	return &Expr{Op: OpSegment, Slug: token}, nil
+}
@@ -0,0 +1,98 @@
+package expression
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		testName  string
+		input     string
+		want      string
+		wantSlugs []string
+		wantError bool
+	}{
+		{testName: "single segment", input: "VOICE_MESSAGES", want: "VOICE_MESSAGES", wantSlugs: []string{"VOICE_MESSAGES"}},
+		{testName: "and not", input: "VOICE_MESSAGES AND NOT PERFORMANCE_VAS", want: "VOICE_MESSAGES AND NOT PERFORMANCE_VAS", wantSlugs: []string{"VOICE_MESSAGES", "PERFORMANCE_VAS"}},
+		{testName: "lowercase keywords", input: "a and not b or c", want: "a AND NOT b OR c", wantSlugs: []string{"a", "b", "c"}},
+		{testName: "and binds tighter than or", input: "A OR B AND C", want: "A OR B AND C", wantSlugs: []string{"A", "B", "C"}},
+		{testName: "necessary parentheses", input: "(A OR B) AND NOT (C AND D)", want: "(A OR B) AND NOT (C AND D)", wantSlugs: []string{"A", "B", "C", "D"}},
+		{testName: "redundant parentheses", input: "((A)) AND (B AND C) OR (D)", want: "A AND B AND C OR D", wantSlugs: []string{"A", "B", "C", "D"}},
+		{testName: "repeated slug", input: "A AND (A OR B)", want: "A AND (A OR B)", wantSlugs: []string{"A", "B"}},
+		{testName: "parentheses without spaces", input: "NOT(A)AND(B)", want: "NOT A AND B", wantSlugs: []string{"A", "B"}},
+		{testName: "empty", input: " ", wantError: true},
+		{testName: "missing operand", input: "A AND", wantError: true},
+		{testName: "missing operator", input: "A B", wantError: true},
+		{testName: "unclosed parenthesis", input: "(A OR B", wantError: true},
+		{testName: "unopened parenthesis", input: "A OR B)", wantError: true},
+		{testName: "empty parentheses", input: "A AND ()", wantError: true},
+		{testName: "keyword as slug", input: "A AND OR", wantError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			got, err := Parse(tc.input)
+			if tc.wantError {
+				assert.Error(t, err)
+				return
+			}
+
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.want, got.String())
+				assert.Equal(t, tc.wantSlugs, got.Slugs())
+			}
+		})
+	}
+}
+
+func TestEval(t *testing.T) {
+	testCases := []struct {
+		testName    string
+		input       string
+		segments    []string
+		want        bool
+		wantBounded bool
+	}{
+		{testName: "in both", input: "A AND B", segments: []string{"A", "B"}, want: true, wantBounded: true},
+		{testName: "in one of and", input: "A AND B", segments: []string{"A"}, want: false, wantBounded: true},
+		{testName: "in one of or", input: "A OR B", segments: []string{"B"}, want: true, wantBounded: true},
+		{testName: "excluded", input: "A AND NOT B", segments: []string{"A", "B"}, want: false, wantBounded: true},
+		{testName: "not excluded", input: "A AND NOT B", segments: []string{"A"}, want: true, wantBounded: true},
+		{testName: "negation only", input: "NOT A", segments: nil, want: true, wantBounded: false},
+		{testName: "negation in or", input: "A OR NOT B", segments: []string{"B"}, want: false, wantBounded: false},
+		{testName: "double negation", input: "NOT NOT A", segments: []string{"A"}, want: true, wantBounded: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			e, err := Parse(tc.input)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			got := e.Eval(func(slug string) bool {
+				for _, segment := range tc.segments {
+					if segment == slug {
+						return true
+					}
+				}
+				return false
+			})
+
+			assert.Equal(t, tc.want, got)
+			assert.Equal(t, tc.wantBounded, e.Bounded())
+		})
+	}
+}
+
+func TestRename(t *testing.T) {
+	e, err := Parse("A AND NOT (B OR A)")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	e.Rename(map[string]string{"A": "C"})
+	assert.Equal(t, "C AND NOT (B OR C)", e.String())
+}
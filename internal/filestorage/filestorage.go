@@ -1,8 +1,14 @@
 package filestorage
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 type FileStorage interface {
 	// StoreCSV stores supplied CSV in string format and returns the URL of the resource
-	StoreCSV(csv string, userID int, timeFrom time.Time, timeTo time.Time) (string, error)
+	StoreCSV(ctx context.Context, csv string, userID int, timeFrom time.Time, timeTo time.Time) (string, error)
+
+	// DeleteUserCSVs deletes every stored CSV with the data of the user and returns their number
+	DeleteUserCSVs(ctx context.Context, userID int) (int, error)
 }
@@ -1,29 +1,47 @@
 package ondisk
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"io/fs"
 	"net/url"
 	"os"
 	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/QiZD90/dynamic-customer-segmentation/internal/filestorage"
 )
 
+// OnDiskFileStorage keeps CSV files of every user in a separate subdirectory
+// of `DirectoryPath` so that they can be found and deleted later
 type OnDiskFileStorage struct {
 	BaseURL       string
 	DirectoryPath string
 	NameSupplier  filestorage.FileStorageNameSupplier
 }
 
-func (f *OnDiskFileStorage) StoreCSV(csv string, userID int, timeFrom time.Time, timeTo time.Time) (string, error) {
+func (f *OnDiskFileStorage) StoreCSV(ctx context.Context, csv string, userID int, timeFrom time.Time, timeTo time.Time) (string, error) {
+	// file operations can't be interrupted, so at least don't start if the request is already gone
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	userDirectory := strconv.Itoa(userID)
+	if err := os.MkdirAll(path.Join(f.DirectoryPath, userDirectory), 0777); err != nil {
+		return "", err
+	}
+
 	filename := f.NameSupplier.GenerateFileName(userID, timeFrom, timeTo)
-	path := path.Join(f.DirectoryPath, filename)
+	path := path.Join(f.DirectoryPath, userDirectory, filename)
 
 	if err := os.WriteFile(path, []byte(csv), 0777); err != nil {
 		return "", err
 	}
 
-	csvURL, err := url.JoinPath(f.BaseURL, filename)
+	csvURL, err := url.JoinPath(f.BaseURL, userDirectory, filename)
 	if err != nil {
 		return "", err
 	}
@@ -31,6 +49,82 @@ func (f *OnDiskFileStorage) StoreCSV(csv string, userID int, timeFrom time.Time,
 	return csvURL, nil
 }
 
+func (f *OnDiskFileStorage) DeleteUserCSVs(ctx context.Context, userID int) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+
+	// files of the user
+	userDirectory := path.Join(f.DirectoryPath, strconv.Itoa(userID))
+	entries, err := os.ReadDir(userDirectory)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			deleted++
+		}
+	}
+
+	if err := os.RemoveAll(userDirectory); err != nil {
+		return 0, err
+	}
+
+	// files stored before they were split by users lie in the root directory,
+	// every line of them starts with the id of the user
+	entries, err = os.ReadDir(f.DirectoryPath)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, entry := range entries {
+		// every legacy file has to be read, so stop between them if the request is gone
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		if entry.IsDir() {
+			continue
+		}
+
+		filePath := path.Join(f.DirectoryPath, entry.Name())
+		ok, err := csvBelongsToUser(filePath, userID)
+		if err != nil {
+			return 0, err
+		}
+
+		if !ok {
+			continue
+		}
+
+		if err := os.Remove(filePath); err != nil {
+			return 0, err
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// csvBelongsToUser checks if the first line of the CSV file is about the user
+func csvBelongsToUser(filePath string, userID int) (bool, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() {
+		return false, scanner.Err()
+	}
+
+	return strings.HasPrefix(scanner.Text(), strconv.Itoa(userID)+";"), nil
+}
+
 func New(baseURL string, directoryPath string, nameSupplier filestorage.FileStorageNameSupplier) (*OnDiskFileStorage, error) {
 	err := os.MkdirAll(directoryPath, 0777)
 	if err != nil {
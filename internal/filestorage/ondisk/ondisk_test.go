@@ -0,0 +1,71 @@
+package ondisk
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/filestorage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeleteUserCSVs(t *testing.T) {
+	directory := t.TempDir()
+	fstorage, err := New("http://localhost/csv", directory, filestorage.NewUUIDFileStorageNameSupplier())
+	assert.NoError(t, err)
+
+	link, err := fstorage.StoreCSV(context.Background(), "1000;AVITO_SEGMENT;added;2000-11-15 15:00:00 +0000 UTC\n", 1000, time.Time{}, time.Time{})
+	assert.NoError(t, err)
+	assert.Regexp(t, `^http://localhost/csv/1000/.+\.csv$`, link)
+
+	_, err = fstorage.StoreCSV(context.Background(), "", 1000, time.Time{}, time.Time{})
+	assert.NoError(t, err)
+	_, err = fstorage.StoreCSV(context.Background(), "1001;AVITO_SEGMENT;added;2000-11-15 15:00:00 +0000 UTC\n", 1001, time.Time{}, time.Time{})
+	assert.NoError(t, err)
+
+	// files that were stored before they were split by users
+	assert.NoError(t, os.WriteFile(path.Join(directory, "old.csv"), []byte("1000;AVITO_SEGMENT;added;2000-11-15 15:00:00 +0000 UTC\n"), 0777))
+	assert.NoError(t, os.WriteFile(path.Join(directory, "other.csv"), []byte("10000;AVITO_SEGMENT;added;2000-11-15 15:00:00 +0000 UTC\n"), 0777))
+
+	deleted, err := fstorage.DeleteUserCSVs(context.Background(), 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, deleted)
+
+	_, err = os.Stat(path.Join(directory, "1000"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path.Join(directory, "old.csv"))
+	assert.True(t, os.IsNotExist(err))
+
+	entries, err := os.ReadDir(path.Join(directory, "1001"))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	_, err = os.Stat(path.Join(directory, "other.csv"))
+	assert.NoError(t, err)
+
+	// nothing to delete
+	deleted, err = fstorage.DeleteUserCSVs(context.Background(), 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, deleted)
+}
+
+func TestCancelledContext(t *testing.T) {
+	directory := t.TempDir()
+	fstorage, err := New("http://localhost/csv", directory, filestorage.NewUUIDFileStorageNameSupplier())
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = fstorage.StoreCSV(ctx, "1000;AVITO_SEGMENT;added;2000-11-15 15:00:00 +0000 UTC\n", 1000, time.Time{}, time.Time{})
+	assert.ErrorIs(t, err, context.Canceled)
+
+	_, err = fstorage.DeleteUserCSVs(ctx, 1000)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// nothing was written
+	entries, err := os.ReadDir(directory)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
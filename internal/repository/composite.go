@@ -0,0 +1,111 @@
+package repository
+
+import (
+	"slices"
+
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/expression"
+)
+
+// ResolveExpression parses the expression of the composite segment `slug` and replaces every referenced slug
+// or alias with the current slug of the segment, which `resolve` returns (or `ErrReferenceNotFound` if there
+// is no active segment by it). `composites` are the expressions of composite segments, active and deleted,
+// by their slugs. Returns `ErrExpressionCycle` if the segment would depend on itself through them
+func ResolveExpression(slug string, expr string, composites map[string]string, resolve func(ref string) (string, error)) (string, error) {
+	e, err := expression.Parse(expr)
+	if err != nil {
+		return "", err
+	}
+
+	rename := make(map[string]string)
+	for _, ref := range e.Slugs() {
+		if ref == slug {
+			return "", ErrExpressionCycle
+		}
+
+		current, err := resolve(ref)
+		if err != nil {
+			return "", err
+		}
+
+		if current == slug { // an alias of the segment itself
+			return "", ErrExpressionCycle
+		}
+
+		rename[ref] = current
+	}
+	e.Rename(rename)
+
+	// the segment depends on itself if it can be reached from its references
+	visited := make(map[string]struct{})
+	stack := e.Slugs()
+	for len(stack) > 0 {
+		ref := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if ref == slug {
+			return "", ErrExpressionCycle
+		}
+
+		if _, ok := visited[ref]; ok {
+			continue
+		}
+		visited[ref] = struct{}{}
+
+		if def, ok := composites[ref]; ok {
+			refExpr, err := expression.Parse(def)
+			if err != nil {
+				return "", err
+			}
+
+			stack = append(stack, refExpr.Slugs()...)
+		}
+	}
+
+	return e.String(), nil
+}
+
+// ReferencingComposites returns sorted slugs of the composite segments that reference any of `slugs`
+// and aren't among them. `composites` are the expressions of composite segments by their slugs
+func ReferencingComposites(composites map[string]string, slugs []string) ([]string, error) {
+	var referencing []string
+	for slug, def := range composites {
+		if slices.Contains(slugs, slug) {
+			continue
+		}
+
+		e, err := expression.Parse(def)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ref := range e.Slugs() {
+			if slices.Contains(slugs, ref) {
+				referencing = append(referencing, slug)
+				break
+			}
+		}
+	}
+
+	slices.Sort(referencing)
+	return referencing, nil
+}
+
+// RenameReferences returns the expressions of the composite segments that reference `slug`,
+// rewritten to reference `newSlug` instead, by the slugs of the composites
+func RenameReferences(composites map[string]string, slug string, newSlug string) (map[string]string, error) {
+	renamed := make(map[string]string)
+	for composite, def := range composites {
+		e, err := expression.Parse(def)
+		if err != nil {
+			return nil, err
+		}
+
+		if !slices.Contains(e.Slugs(), slug) {
+			continue
+		}
+
+		e.Rename(map[string]string{slug: newSlug})
+		renamed[composite] = e.String()
+	}
+
+	return renamed, nil
+}
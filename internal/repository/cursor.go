@@ -0,0 +1,124 @@
+package repository
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/entity"
+)
+
+var ErrInvalidCursor = errors.New("cursor is invalid")
+
+// EncodeCursor encodes a position in a list as an opaque string for API clients
+func EncodeCursor(position any) (string, error) {
+	b, err := json.Marshal(position)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// DecodeCursor decodes a position encoded by `EncodeCursor`. Returns `ErrInvalidCursor` if it is malformed
+func DecodeCursor(cursor string, position any) error {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return ErrInvalidCursor
+	}
+
+	if err := json.Unmarshal(b, position); err != nil {
+		return ErrInvalidCursor
+	}
+
+	return nil
+}
+
+// SegmentCursor is a position in the list of segments: the last segment of the page and the order of the list
+type SegmentCursor struct {
+	SortBy     entity.SegmentSortField `json:"sort_by"`
+	Descending bool                    `json:"desc,omitempty"`
+	CreatedAt  time.Time               `json:"created_at"`
+	Slug       string                  `json:"slug"`
+	ID         int                     `json:"id"`
+}
+
+// SortBy returns the sort field of the page request, applying the default
+func SortBy(page entity.SegmentPageRequest) entity.SegmentSortField {
+	if page.SortBy == "" {
+		return entity.SortByCreatedAt
+	}
+
+	return page.SortBy
+}
+
+// DecodeSegmentCursor decodes the cursor of the page request. Returns nil for the first page
+// and `ErrInvalidCursor` if the cursor is malformed or belongs to a list with another order
+func DecodeSegmentCursor(page entity.SegmentPageRequest) (*SegmentCursor, error) {
+	if page.Cursor == "" {
+		return nil, nil
+	}
+
+	var cursor SegmentCursor
+	if err := DecodeCursor(page.Cursor, &cursor); err != nil {
+		return nil, err
+	}
+
+	if cursor.SortBy != SortBy(page) || cursor.Descending != page.Descending {
+		return nil, ErrInvalidCursor
+	}
+
+	return &cursor, nil
+}
+
+// EncodeSegmentCursor encodes position after the segment with id `id` in the list ordered as requested by `page`
+func EncodeSegmentCursor(page entity.SegmentPageRequest, segment entity.Segment, id int) (string, error) {
+	return EncodeCursor(SegmentCursor{
+		SortBy:     SortBy(page),
+		Descending: page.Descending,
+		CreatedAt:  segment.CreatedAt,
+		Slug:       segment.Slug,
+		ID:         id,
+	})
+}
+
+// MembersCursor is a position in the list of members of a segment: the last user of the page
+// and the moment the list is built for, so that every page is consistent with the first one
+type MembersCursor struct {
+	AsOf   time.Time `json:"as_of"`
+	UserID int       `json:"user_id"`
+}
+
+// DecodeMembersCursor decodes the cursor of the members request. Returns nil for the first page
+// and `ErrInvalidCursor` if the cursor is malformed or was built for another moment than requested
+func DecodeMembersCursor(request entity.SegmentMembersRequest) (*MembersCursor, error) {
+	if request.Cursor == "" {
+		return nil, nil
+	}
+
+	var cursor MembersCursor
+	if err := DecodeCursor(request.Cursor, &cursor); err != nil {
+		return nil, err
+	}
+
+	if !request.AsOf.IsZero() && !request.AsOf.Equal(cursor.AsOf) {
+		return nil, ErrInvalidCursor
+	}
+
+	return &cursor, nil
+}
+
+// MembersAsOf returns the moment the list of members is built for: the one of the cursor if there is one,
+// otherwise the requested one or `now` if none was requested
+func MembersAsOf(request entity.SegmentMembersRequest, cursor *MembersCursor, now time.Time) time.Time {
+	if cursor != nil {
+		return cursor.AsOf
+	}
+
+	if request.AsOf.IsZero() {
+		return now
+	}
+
+	return request.AsOf
+}
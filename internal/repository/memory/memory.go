@@ -0,0 +1,1611 @@
+package memory
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/entity"
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/repository"
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/timeprovider"
+)
+
+// segmentRecord mirrors a row of `segments` table
+type segmentRecord struct {
+	id          int
+	slug        string
+	description string
+	owner       string
+	tags        []byte // JSON, the same way SQL repositories store it
+	attributes  []byte // JSON, the same way SQL repositories store it
+	defaultTTL  string
+	parent      *segmentRecord        // nil for top-level segments
+	expression  string                // empty for segments that aren't composite
+	rule        string                // empty for segments that aren't dynamic
+	group       *exclusionGroupRecord // nil for segments that aren't in an exclusion group
+	salt        string                // bucket salt, empty for segments that aren't bucketed
+	percent     int                   // bucket percent of bucketed segments
+	aliases     []string
+	createdAt   time.Time
+	deletedAt   *time.Time
+}
+
+// exclusionGroupRecord mirrors a row of `exclusion_groups` table
+type exclusionGroupRecord struct {
+	name      string
+	createdAt time.Time
+}
+
+// userSegmentRecord mirrors a row of `users_segments` table
+type userSegmentRecord struct {
+	id        int
+	segmentID int
+	userID    int
+	addedAt   time.Time
+	removedAt *time.Time
+	expiresAt *time.Time
+}
+
+// operationRecord mirrors a row of `operations` table
+type operationRecord struct {
+	userID        int
+	segmentID     int
+	operationType entity.OperationType
+	time          time.Time
+	expiresAt     *time.Time
+}
+
+// experimentRecord mirrors a row of `experiments` table along with its rows of `experiment_variants`
+type experimentRecord struct {
+	slug      string
+	variants  []*segmentRecord
+	weights   []int // weights of the variants in the same order
+	createdAt time.Time
+	startedAt *time.Time
+	stoppedAt *time.Time
+}
+
+// MemoryRepository is an implementation of `repository.Repository` that keeps
+// everything in memory. It follows the same rules as `postgres.PostgresRepository`
+// and is meant to be used in tests and local runs
+type MemoryRepository struct {
+	mu           sync.Mutex
+	timeProvider timeprovider.TimeProvider
+
+	segments       []*segmentRecord
+	segmentsBySlug map[string]*segmentRecord // both current slugs and aliases
+	groupsByName   map[string]*exclusionGroupRecord
+	usersSegments  []*userSegmentRecord
+	operations     []operationRecord
+	erasures       []entity.Erasure
+	experiments    []*experimentRecord
+
+	lastUserSegmentID int // ids aren't reused after records are erased
+}
+
+// isOpen reports whether the record is neither removed nor expired at the time `now`.
+// Open records include scheduled ones that haven't started yet
+func (r *userSegmentRecord) isOpen(now time.Time) bool {
+	return r.removedAt == nil && (r.expiresAt == nil || r.expiresAt.After(now))
+}
+
+// wasActiveAt reports whether the record was added, not removed and not expired at the time `t`
+func (r *userSegmentRecord) wasActiveAt(t time.Time) bool {
+	return !r.addedAt.After(t) && (r.removedAt == nil || r.removedAt.After(t)) && (r.expiresAt == nil || r.expiresAt.After(t))
+}
+
+// isExpired reports whether the record is not removed, but has expired by the time `now`
+func (r *userSegmentRecord) isExpired(now time.Time) bool {
+	return r.removedAt == nil && r.expiresAt != nil && !r.expiresAt.After(now)
+}
+
+// openUserSegment returns open record of the user with the segment or nil if there is none
+func (m *MemoryRepository) openUserSegment(userID int, segmentID int, now time.Time) *userSegmentRecord {
+	for _, us := range m.usersSegments {
+		if us.userID == userID && us.segmentID == segmentID && us.isOpen(now) {
+			return us
+		}
+	}
+
+	return nil
+}
+
+// exclusionGroup returns the exclusion group with this name, creating it if there is none yet.
+// Returns nil for the empty name
+func (m *MemoryRepository) exclusionGroup(name string) *exclusionGroupRecord {
+	if name == "" {
+		return nil
+	}
+
+	group, ok := m.groupsByName[name]
+	if !ok {
+		group = &exclusionGroupRecord{name: name, createdAt: m.timeProvider.Now()}
+		m.groupsByName[name] = group
+	}
+
+	return group
+}
+
+// inExclusionGroup reports whether the user has an open membership in a segment of the group other than `segment`
+func (m *MemoryRepository) inExclusionGroup(userID int, group *exclusionGroupRecord, segment *segmentRecord, now time.Time) bool {
+	if group == nil {
+		return false
+	}
+
+	for _, us := range m.usersSegments {
+		other := m.segments[us.segmentID-1]
+		if us.userID == userID && other != segment && other.group == group && us.isOpen(now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// activeSegment returns the segment by this slug or alias, or `ErrSegmentNotFound` and `ErrSegmentAlreadyDeleted`
+// if it doesn't exist or was deleted
+func (m *MemoryRepository) activeSegment(slug string) (*segmentRecord, error) {
+	segment, ok := m.segmentsBySlug[slug]
+	if !ok { // segment doesn't exist
+		return nil, repository.ErrSegmentNotFound
+	}
+
+	if segment.deletedAt != nil { // segment is already deleted
+		return nil, repository.ErrSegmentAlreadyDeleted
+	}
+
+	return segment, nil
+}
+
+// parentSegment returns the active segment by this slug that is going to be a parent,
+// or `ErrParentNotFound` if there is no such segment
+func (m *MemoryRepository) parentSegment(slug string) (*segmentRecord, error) {
+	parent, err := m.activeSegment(slug)
+	if err != nil {
+		return nil, repository.ErrParentNotFound
+	}
+
+	return parent, nil
+}
+
+// memberSegment returns the active segment by this slug or alias whose memberships can be changed,
+// or `ErrSegmentComposite` if it's composite, `ErrSegmentDynamic` if it's dynamic and `ErrSegmentBucketed` if it's bucketed
+func (m *MemoryRepository) memberSegment(slug string) (*segmentRecord, error) {
+	segment, err := m.activeSegment(slug)
+	if err != nil {
+		return nil, err
+	}
+
+	if segment.expression != "" {
+		return nil, repository.ErrSegmentComposite
+	}
+
+	if segment.rule != "" {
+		return nil, repository.ErrSegmentDynamic
+	}
+
+	if segment.salt != "" {
+		return nil, repository.ErrSegmentBucketed
+	}
+
+	return segment, nil
+}
+
+// referencedSlug returns the current slug of the active segment by this slug or alias that is referenced
+// by an expression, or `ErrReferenceNotFound` if there is no such segment
+func (m *MemoryRepository) referencedSlug(ref string) (string, error) {
+	segment, err := m.activeSegment(ref)
+	if err != nil {
+		return "", repository.ErrReferenceNotFound
+	}
+
+	return segment.slug, nil
+}
+
+// compositeExpressions returns the expressions of composite segments by their slugs, deleted ones too unless `onlyActive` is set
+func (m *MemoryRepository) compositeExpressions(onlyActive bool) map[string]string {
+	composites := make(map[string]string)
+	for _, s := range m.segments {
+		if s.expression != "" && (s.deletedAt == nil || !onlyActive) {
+			composites[s.slug] = s.expression
+		}
+	}
+
+	return composites
+}
+
+// activeChildren returns active segments whose parent is the segment
+func (m *MemoryRepository) activeChildren(segment *segmentRecord) []*segmentRecord {
+	var children []*segmentRecord
+	for _, s := range m.segments {
+		if s.parent == segment && s.deletedAt == nil {
+			children = append(children, s)
+		}
+	}
+
+	return children
+}
+
+// latest returns the later of two times
+func latest(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+
+	return b
+}
+
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+
+	c := *t
+	return &c
+}
+
+// recordOperation appends an operation to the operations log
+func (m *MemoryRepository) recordOperation(userID int, segmentID int, operationType entity.OperationType, t time.Time, expiresAt *time.Time) {
+	m.operations = append(m.operations, operationRecord{
+		userID:        userID,
+		segmentID:     segmentID,
+		operationType: operationType,
+		time:          t,
+		expiresAt:     copyTime(expiresAt),
+	})
+}
+
+// closeMembership marks an expired record as removed at its expiration and logs the expiration
+func (m *MemoryRepository) closeMembership(us *userSegmentRecord) entity.Operation {
+	us.removedAt = copyTime(us.expiresAt)
+	m.recordOperation(us.userID, us.segmentID, entity.ExpiredOperationType, *us.expiresAt, us.expiresAt)
+
+	return entity.Operation{
+		UserID:      us.userID,
+		SegmentSlug: m.segments[us.segmentID-1].slug,
+		Type:        entity.ExpiredOperationType,
+		Time:        *us.expiresAt,
+		ExpiresAt:   copyTime(us.expiresAt),
+	}
+}
+
+// closeExpiredMemberships closes not removed records of the user with the segment that have expired by `now`,
+// the same way the database backends keep only one not removed record of a user with a segment.
+// Returns the logged expirations
+func (m *MemoryRepository) closeExpiredMemberships(userID int, segmentID int, now time.Time) []entity.Operation {
+	var operations []entity.Operation
+	for _, us := range m.usersSegments {
+		if us.userID == userID && us.segmentID == segmentID && us.isExpired(now) {
+			operations = append(operations, m.closeMembership(us))
+		}
+	}
+
+	return operations
+}
+
+func (m *MemoryRepository) addUserSegment(segmentID int, userID int, addedAt time.Time, expiresAt *time.Time) {
+	m.lastUserSegmentID++
+	m.usersSegments = append(m.usersSegments, &userSegmentRecord{
+		id:        m.lastUserSegmentID,
+		segmentID: segmentID,
+		userID:    userID,
+		addedAt:   addedAt,
+		expiresAt: copyTime(expiresAt),
+	})
+	m.recordOperation(userID, segmentID, entity.AddedOperationType, addedAt, expiresAt)
+}
+
+func (m *MemoryRepository) CreateSegment(ctx context.Context, slug string, metadata entity.SegmentMetadata) error {
+	tags, attributes, err := repository.MarshalMetadata(metadata.Tags, metadata.Attributes)
+	if err != nil {
+		return fmt.Errorf("CreateSegment() - repository.MarshalMetadata(): %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// check if there is a segment under this slug
+	if _, ok := m.segmentsBySlug[slug]; ok {
+		return repository.ErrSegmentAlreadyExists
+	}
+
+	var parent *segmentRecord
+	if metadata.Parent != "" {
+		parent, err = m.parentSegment(metadata.Parent)
+		if err != nil {
+			return err
+		}
+	}
+
+	expression := ""
+	if metadata.Expression != "" {
+		expression, err = repository.ResolveExpression(slug, metadata.Expression, m.compositeExpressions(false), m.referencedSlug)
+		if err != nil {
+			return err
+		}
+	}
+
+	// create the segment
+	segment := &segmentRecord{
+		id:          len(m.segments) + 1,
+		slug:        slug,
+		description: metadata.Description,
+		owner:       metadata.Owner,
+		tags:        tags,
+		attributes:  attributes,
+		defaultTTL:  metadata.DefaultTTL,
+		parent:      parent,
+		expression:  expression,
+		rule:        metadata.Rule,
+		group:       m.exclusionGroup(metadata.ExclusionGroup),
+		salt:        metadata.BucketSalt,
+		percent:     metadata.BucketPercent,
+		createdAt:   m.timeProvider.Now(),
+	}
+	m.segments = append(m.segments, segment)
+	m.segmentsBySlug[slug] = segment
+
+	return nil
+}
+
+func (m *MemoryRepository) UpdateSegment(ctx context.Context, slug string, update entity.SegmentMetadataUpdate) error {
+	// encode everything before taking the lock so that failed update leaves no trace
+	var tags, attributes []byte
+	if update.Tags != nil {
+		b, err := json.Marshal(update.Tags)
+		if err != nil {
+			return fmt.Errorf("UpdateSegment() - json.Marshal(): %w", err)
+		}
+		tags = b
+	}
+
+	if update.Attributes != nil {
+		b, err := json.Marshal(update.Attributes)
+		if err != nil {
+			return fmt.Errorf("UpdateSegment() - json.Marshal(): %w", err)
+		}
+		attributes = b
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	segment, err := m.activeSegment(slug)
+	if err != nil {
+		return err
+	}
+
+	expression := segment.expression
+	if update.Expression != nil {
+		if segment.expression == "" {
+			return repository.ErrNotComposite
+		}
+
+		expression, err = repository.ResolveExpression(segment.slug, *update.Expression, m.compositeExpressions(false), m.referencedSlug)
+		if err != nil {
+			return err
+		}
+	}
+
+	if update.Rule != nil && segment.rule == "" {
+		return repository.ErrNotDynamic
+	}
+
+	if update.BucketPercent != nil && segment.salt == "" {
+		return repository.ErrNotBucketed
+	}
+
+	if update.ExclusionGroup != nil && *update.ExclusionGroup != "" {
+		if segment.expression != "" {
+			return repository.ErrSegmentComposite
+		}
+
+		if segment.rule != "" {
+			return repository.ErrSegmentDynamic
+		}
+
+		if segment.salt != "" {
+			return repository.ErrSegmentBucketed
+		}
+
+		// members of the segment must not be in other segments of the new group
+		now := m.timeProvider.Now()
+		for _, us := range m.usersSegments {
+			if us.segmentID == segment.id && us.isOpen(now) && m.inExclusionGroup(us.userID, m.groupsByName[*update.ExclusionGroup], segment, now) {
+				return repository.ErrExclusionConflict
+			}
+		}
+	}
+
+	// check the new parent before changing anything. Walking up from it must not reach the segment
+	parent := segment.parent
+	if update.Parent != nil {
+		parent = nil
+		if *update.Parent != "" {
+			parent, err = m.parentSegment(*update.Parent)
+			if err != nil {
+				return err
+			}
+
+			for ancestor := parent; ancestor != nil; ancestor = ancestor.parent {
+				if ancestor == segment {
+					return repository.ErrSegmentCycle
+				}
+			}
+		}
+	}
+	segment.parent = parent
+	segment.expression = expression
+
+	if update.Description != nil {
+		segment.description = *update.Description
+	}
+
+	if update.Owner != nil {
+		segment.owner = *update.Owner
+	}
+
+	if tags != nil {
+		segment.tags = tags
+	}
+
+	if attributes != nil {
+		segment.attributes = attributes
+	}
+
+	if update.DefaultTTL != nil {
+		segment.defaultTTL = *update.DefaultTTL
+	}
+
+	if update.Rule != nil {
+		segment.rule = *update.Rule
+	}
+
+	if update.ExclusionGroup != nil {
+		segment.group = m.exclusionGroup(*update.ExclusionGroup)
+	}
+
+	if update.BucketPercent != nil {
+		segment.percent = *update.BucketPercent
+	}
+
+	return nil
+}
+
+func (m *MemoryRepository) RenameSegment(ctx context.Context, slug string, newSlug string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	segment, err := m.activeSegment(slug)
+	if err != nil {
+		return err
+	}
+
+	if newSlug == segment.slug { // nothing to do
+		return nil
+	}
+
+	// check if the new slug is free. The only exception is an alias of this very segment,
+	// it stops being an alias and becomes the current slug again
+	if other, ok := m.segmentsBySlug[newSlug]; ok {
+		if other != segment {
+			return repository.ErrSegmentAlreadyExists
+		}
+
+		segment.aliases = slices.DeleteFunc(segment.aliases, func(alias string) bool { return alias == newSlug })
+	}
+
+	// composite segments that reference the segment reference it by the new slug
+	renamed, err := repository.RenameReferences(m.compositeExpressions(false), segment.slug, newSlug)
+	if err != nil {
+		return fmt.Errorf("RenameSegment() - repository.RenameReferences(): %w", err)
+	}
+
+	for composite, expression := range renamed {
+		m.segmentsBySlug[composite].expression = expression
+	}
+
+	// keep the current slug as an alias and rename the segment
+	segment.aliases = append(segment.aliases, segment.slug)
+	segment.slug = newSlug
+	m.segmentsBySlug[newSlug] = segment
+
+	return nil
+}
+
+func (m *MemoryRepository) AddSegmentToUsers(ctx context.Context, slug string, userIDs []int, explicitExpiresAt *time.Time) (entity.EnrollmentResult, []entity.Operation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var result entity.EnrollmentResult
+	segment, err := m.memberSegment(slug)
+	if err != nil {
+		return result, nil, err
+	}
+
+	now := m.timeProvider.Now()
+	expiresAt, err := repository.MembershipExpiration(explicitExpiresAt, segment.defaultTTL, now)
+	if err != nil {
+		return result, nil, fmt.Errorf("AddSegmentToUsers() - repository.MembershipExpiration(): %w", err)
+	}
+
+	var operations []entity.Operation
+
+	for _, userID := range repository.UniqueUserIDs(userIDs) {
+		if m.openUserSegment(userID, segment.id, now) != nil { // segment already exists and is open
+			result.SkippedCount++
+			continue
+		}
+
+		if m.inExclusionGroup(userID, segment.group, segment, now) {
+			result.ExcludedCount++
+			continue
+		}
+
+		operations = append(operations, m.closeExpiredMemberships(userID, segment.id, now)...)
+		m.addUserSegment(segment.id, userID, now, expiresAt)
+		operations = append(operations, entity.Operation{
+			UserID:      userID,
+			SegmentSlug: segment.slug,
+			Type:        entity.AddedOperationType,
+			Time:        now,
+			ExpiresAt:   copyTime(expiresAt),
+		})
+		result.EnrolledCount++
+	}
+
+	return result, operations, nil
+}
+
+func (m *MemoryRepository) GetExclusionGroupMembers(ctx context.Context, slug string, userIDs []int) ([]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	segment, ok := m.segmentsBySlug[slug]
+	if !ok { // segment doesn't exist
+		return nil, repository.ErrSegmentNotFound
+	}
+
+	now := m.timeProvider.Now()
+	var members []int
+	for _, userID := range repository.UniqueUserIDs(userIDs) {
+		if m.inExclusionGroup(userID, segment.group, segment, now) {
+			members = append(members, userID)
+		}
+	}
+
+	return members, nil
+}
+
+func (m *MemoryRepository) DeleteSegment(ctx context.Context, slug string, children entity.ChildrenPolicy, force bool) ([]entity.Operation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	segment, err := m.activeSegment(slug)
+	if err != nil {
+		return nil, err
+	}
+
+	// find out which segments are deleted, detached children are dealt with after every check has passed
+	segments := []*segmentRecord{segment}
+	switch children {
+	case entity.ChildrenCascade:
+		for i := 0; i < len(segments); i++ {
+			segments = append(segments, m.activeChildren(segments[i])...)
+		}
+	case entity.ChildrenDetach:
+	default:
+		if len(m.activeChildren(segment)) != 0 {
+			return nil, repository.ErrSegmentHasChildren
+		}
+	}
+
+	if !force {
+		slugs := make([]string, len(segments))
+		for i, s := range segments {
+			slugs[i] = s.slug
+		}
+
+		referencing, err := repository.ReferencingComposites(m.compositeExpressions(true), slugs)
+		if err != nil {
+			return nil, fmt.Errorf("DeleteSegment() - repository.ReferencingComposites(): %w", err)
+		}
+
+		if len(referencing) != 0 {
+			return nil, repository.ErrSegmentReferenced
+		}
+	}
+
+	if children == entity.ChildrenDetach {
+		for _, child := range m.activeChildren(segment) {
+			child.parent = nil
+		}
+	}
+
+	now := m.timeProvider.Now()
+	var operations []entity.Operation
+	for _, segment := range segments {
+		// mark the segment as deleted
+		deletedAt := now
+		segment.deletedAt = &deletedAt
+
+		// mark open user segments with this segment as removed and log it.
+		// Scheduled ones are removed at their start, so they never become active
+		for _, us := range m.usersSegments {
+			if us.segmentID == segment.id && us.isOpen(now) {
+				removedAt := latest(us.addedAt, now)
+				us.removedAt = &removedAt
+				m.recordOperation(us.userID, segment.id, entity.SegmentDeletedOperationType, removedAt, us.expiresAt)
+				operations = append(operations, entity.Operation{
+					UserID:      us.userID,
+					SegmentSlug: segment.slug,
+					Type:        entity.SegmentDeletedOperationType,
+					Time:        removedAt,
+					ExpiresAt:   copyTime(us.expiresAt),
+				})
+			}
+		}
+	}
+
+	// the removals are returned in the order of slugs and user ids, the same way the database backends do
+	slices.SortFunc(operations, func(a, b entity.Operation) int {
+		if a.SegmentSlug != b.SegmentSlug {
+			return cmp.Compare(a.SegmentSlug, b.SegmentSlug)
+		}
+		return cmp.Compare(a.UserID, b.UserID)
+	})
+
+	return operations, nil
+}
+
+// removedByDeletion checks if the removal of the membership was logged by the deletion of its segment at `deletedAt`.
+// Scheduled memberships are removed and logged at their start, which may be later than the deletion
+func (m *MemoryRepository) removedByDeletion(us *userSegmentRecord, deletedAt time.Time) bool {
+	for _, o := range m.operations {
+		if o.userID == us.userID && o.segmentID == us.segmentID && o.operationType == entity.SegmentDeletedOperationType &&
+			o.time.Equal(*us.removedAt) && !o.time.Before(deletedAt) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *MemoryRepository) RestoreSegment(ctx context.Context, slug string, restoreMemberships bool) ([]entity.Operation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	segment, ok := m.segmentsBySlug[slug]
+	if !ok { // segment doesn't exist
+		return nil, repository.ErrSegmentNotFound
+	}
+
+	if segment.deletedAt == nil { // segment is active
+		return nil, repository.ErrSegmentNotDeleted
+	}
+
+	// only memberships whose removal was logged by the deletion are restored: the removal time alone
+	// can't tell a scheduled membership closed by the deletion from one cancelled before it.
+	// The ones that would have expired by now stay removed
+	now := m.timeProvider.Now()
+	var operations []entity.Operation
+	if restoreMemberships {
+		for _, us := range m.usersSegments {
+			if us.segmentID != segment.id || us.removedAt == nil {
+				continue
+			}
+
+			if !m.removedByDeletion(us, *segment.deletedAt) {
+				continue
+			}
+
+			if us.expiresAt != nil && !us.expiresAt.After(now) {
+				continue
+			}
+
+			if m.inExclusionGroup(us.userID, segment.group, segment, now) {
+				continue
+			}
+
+			us.removedAt = nil
+			m.recordOperation(us.userID, segment.id, entity.SegmentRestoredOperationType, now, us.expiresAt)
+			operations = append(operations, entity.Operation{
+				UserID:      us.userID,
+				SegmentSlug: segment.slug,
+				Type:        entity.SegmentRestoredOperationType,
+				Time:        now,
+				ExpiresAt:   copyTime(us.expiresAt),
+			})
+		}
+		slices.SortFunc(operations, func(a, b entity.Operation) int { return cmp.Compare(a.UserID, b.UserID) })
+	}
+
+	// mark the segment as active. If its parent is deleted, it becomes a top-level segment
+	segment.deletedAt = nil
+	if segment.parent != nil && segment.parent.deletedAt != nil {
+		segment.parent = nil
+	}
+
+	return operations, nil
+}
+
+func (m *MemoryRepository) UpdateUserSegments(ctx context.Context, userID int, addSegments []entity.SegmentExpiration, removeSegments []entity.SegmentExpiration) ([]entity.Operation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// check every segment before changing anything so that failed update leaves no trace,
+	// the same way a rolled back transaction would
+	now := m.timeProvider.Now()
+	starts := make([]time.Time, len(addSegments))
+	expirations := make([]*time.Time, len(addSegments))
+	for i, s := range addSegments {
+		segment, err := m.memberSegment(s.Slug)
+		if err != nil {
+			return nil, err
+		}
+
+		// a scheduled membership is added at its start
+		starts[i] = now
+		if s.StartsAt != nil {
+			starts[i] = latest(*s.StartsAt, now)
+		}
+
+		expirations[i], err = repository.MembershipExpiration(s.ExpiresAt, segment.defaultTTL, starts[i])
+		if err != nil {
+			return nil, fmt.Errorf("UpdateUserSegments() - repository.MembershipExpiration(): %w", err)
+		}
+	}
+
+	removed := make(map[*segmentRecord]bool, len(removeSegments))
+	for _, s := range removeSegments {
+		segment, err := m.memberSegment(s.Slug)
+		if err != nil {
+			return nil, err
+		}
+		removed[segment] = true
+	}
+
+	// after the update the user must be in at most one segment of every exclusion group
+	groups := make(map[*exclusionGroupRecord]*segmentRecord)
+	for _, us := range m.usersSegments {
+		segment := m.segments[us.segmentID-1]
+		if us.userID == userID && segment.group != nil && us.isOpen(now) && !removed[segment] {
+			groups[segment.group] = segment
+		}
+	}
+
+	for _, s := range addSegments {
+		segment := m.segmentsBySlug[s.Slug]
+		if segment.group == nil {
+			continue
+		}
+
+		if other, ok := groups[segment.group]; ok && other != segment {
+			return nil, repository.ErrExclusionConflict
+		}
+		groups[segment.group] = segment
+	}
+
+	var operations []entity.Operation
+	for i, s := range addSegments {
+		segment := m.segmentsBySlug[s.Slug]
+		if m.openUserSegment(userID, segment.id, now) != nil { // segment already exists and is open
+			continue
+		}
+
+		operations = append(operations, m.closeExpiredMemberships(userID, segment.id, now)...)
+		m.addUserSegment(segment.id, userID, starts[i], expirations[i])
+		operations = append(operations, entity.Operation{
+			UserID:      userID,
+			SegmentSlug: segment.slug,
+			Type:        entity.AddedOperationType,
+			Time:        starts[i],
+			ExpiresAt:   copyTime(expirations[i]),
+		})
+	}
+
+	for _, s := range removeSegments {
+		segment := m.segmentsBySlug[s.Slug]
+		us := m.openUserSegment(userID, segment.id, now)
+		if us == nil { // user doesn't have the segment
+			continue
+		}
+
+		// a scheduled membership is removed at its start
+		removedAt := latest(us.addedAt, now)
+		us.removedAt = &removedAt
+		m.recordOperation(userID, segment.id, entity.RemovedOperationType, removedAt, us.expiresAt)
+		operations = append(operations, entity.Operation{
+			UserID:      userID,
+			SegmentSlug: segment.slug,
+			Type:        entity.RemovedOperationType,
+			Time:        removedAt,
+			ExpiresAt:   copyTime(us.expiresAt),
+		})
+	}
+
+	return operations, nil
+}
+
+func (m *MemoryRepository) UpdateUserSegmentExpirations(ctx context.Context, userID int, segments []entity.SegmentExpiration) ([]entity.Operation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// check every segment before changing anything so that failed update leaves no trace
+	now := m.timeProvider.Now()
+	for _, s := range segments {
+		segment, err := m.memberSegment(s.Slug)
+		if err != nil {
+			return nil, err
+		}
+
+		if s.ExpiresAt != nil && !s.ExpiresAt.After(now) {
+			return nil, repository.ErrExpirationInPast
+		}
+
+		// a scheduled membership can't expire before it starts
+		us := m.openUserSegment(userID, segment.id, now)
+		if us != nil && s.ExpiresAt != nil && !s.ExpiresAt.After(us.addedAt) {
+			return nil, repository.ErrExpirationBeforeStart
+		}
+	}
+
+	var operations []entity.Operation
+	for _, s := range segments {
+		segment := m.segmentsBySlug[s.Slug]
+		us := m.openUserSegment(userID, segment.id, now)
+		if us == nil { // user doesn't have the segment
+			continue
+		}
+
+		if (us.expiresAt == nil && s.ExpiresAt == nil) || (us.expiresAt != nil && s.ExpiresAt != nil && us.expiresAt.Equal(*s.ExpiresAt)) {
+			continue // already expires at this date
+		}
+
+		us.expiresAt = copyTime(s.ExpiresAt)
+		m.recordOperation(userID, segment.id, entity.ExpirationChangedOperationType, now, us.expiresAt)
+		operations = append(operations, entity.Operation{
+			UserID:      userID,
+			SegmentSlug: segment.slug,
+			Type:        entity.ExpirationChangedOperationType,
+			Time:        now,
+			ExpiresAt:   copyTime(s.ExpiresAt),
+		})
+	}
+
+	return operations, nil
+}
+
+func (m *MemoryRepository) SyncSegmentMembers(ctx context.Context, slug string, userIDs []int) ([]entity.Operation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	segment, err := m.activeSegment(slug)
+	if err != nil {
+		return nil, err
+	}
+
+	if segment.rule == "" {
+		return nil, repository.ErrNotDynamic
+	}
+
+	now := m.timeProvider.Now()
+	expiresAt, err := repository.MembershipExpiration(nil, segment.defaultTTL, now)
+	if err != nil {
+		return nil, fmt.Errorf("SyncSegmentMembers() - repository.MembershipExpiration(): %w", err)
+	}
+
+	var operations []entity.Operation
+	members := make(map[int]struct{}, len(userIDs))
+	for _, userID := range repository.UniqueUserIDs(userIDs) {
+		members[userID] = struct{}{}
+		if m.openUserSegment(userID, segment.id, now) != nil { // user is already in the segment
+			continue
+		}
+
+		operations = append(operations, m.closeExpiredMemberships(userID, segment.id, now)...)
+		m.addUserSegment(segment.id, userID, now, expiresAt)
+		operations = append(operations, entity.Operation{
+			UserID:      userID,
+			SegmentSlug: segment.slug,
+			Type:        entity.AddedOperationType,
+			Time:        now,
+			ExpiresAt:   copyTime(expiresAt),
+		})
+	}
+
+	// the rest of open memberships are removed in the order of user ids, the same way the database backends do
+	var removed []*userSegmentRecord
+	for _, us := range m.usersSegments {
+		if _, ok := members[us.userID]; !ok && us.segmentID == segment.id && us.isOpen(now) {
+			removed = append(removed, us)
+		}
+	}
+	slices.SortFunc(removed, func(a, b *userSegmentRecord) int { return cmp.Compare(a.userID, b.userID) })
+
+	for _, us := range removed {
+		removedAt := latest(us.addedAt, now)
+		us.removedAt = &removedAt
+		m.recordOperation(us.userID, segment.id, entity.RemovedOperationType, removedAt, us.expiresAt)
+		operations = append(operations, entity.Operation{
+			UserID:      us.userID,
+			SegmentSlug: segment.slug,
+			Type:        entity.RemovedOperationType,
+			Time:        removedAt,
+			ExpiresAt:   copyTime(us.expiresAt),
+		})
+	}
+
+	return operations, nil
+}
+
+func (m *MemoryRepository) ExpireMemberships(ctx context.Context, limit int) ([]entity.Operation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.timeProvider.Now()
+	var expired []*userSegmentRecord
+	for _, us := range m.usersSegments {
+		if us.isExpired(now) {
+			expired = append(expired, us)
+		}
+	}
+
+	// the oldest expirations are closed first, the same way the database backends do
+	slices.SortStableFunc(expired, func(a, b *userSegmentRecord) int { return a.expiresAt.Compare(*b.expiresAt) })
+	if len(expired) > limit {
+		expired = expired[:limit]
+	}
+
+	operations := make([]entity.Operation, 0, len(expired))
+	for _, us := range expired {
+		operations = append(operations, m.closeMembership(us))
+	}
+
+	return operations, nil
+}
+
+func (m *MemoryRepository) GetActiveUserSegments(ctx context.Context, userID int) ([]entity.UserSegment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.timeProvider.Now()
+	userSegments := make([]entity.UserSegment, 0, 30)
+	for _, us := range m.usersSegments {
+		if us.userID != userID || !us.wasActiveAt(now) {
+			continue
+		}
+
+		userSegments = append(userSegments, entity.UserSegment{
+			Slug:      m.segments[us.segmentID-1].slug,
+			AddedAt:   us.addedAt,
+			ExpiresAt: copyTime(us.expiresAt),
+		})
+	}
+
+	return userSegments, nil
+}
+
+func (m *MemoryRepository) GetSegmentParents(ctx context.Context) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	parents := make(map[string]string)
+	for _, segment := range m.segments {
+		if segment.deletedAt == nil && segment.parent != nil {
+			parents[segment.slug] = segment.parent.slug
+		}
+	}
+
+	return parents, nil
+}
+
+func (m *MemoryRepository) GetCompositeSegments(ctx context.Context) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.compositeExpressions(true), nil
+}
+
+// segmentMembers returns sorted ids of users that were in the segment at `asOf` and have id greater than `afterUserID`
+func (m *MemoryRepository) segmentMembers(slug string, asOf time.Time, afterUserID int) ([]int, error) {
+	// deleted segments are fine: their memberships were removed at the deletion time
+	segment, ok := m.segmentsBySlug[slug]
+	if !ok {
+		return nil, repository.ErrSegmentNotFound
+	}
+
+	userIDs := make([]int, 0, 30)
+	for _, us := range m.usersSegments {
+		if us.segmentID == segment.id && us.userID > afterUserID && us.wasActiveAt(asOf) {
+			userIDs = append(userIDs, us.userID)
+		}
+	}
+
+	return repository.UniqueUserIDs(userIDs), nil
+}
+
+func (m *MemoryRepository) GetSegmentMembers(ctx context.Context, slug string, request entity.SegmentMembersRequest) (entity.SegmentMembersPage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cursor, err := repository.DecodeMembersCursor(request)
+	if err != nil {
+		return entity.SegmentMembersPage{}, err
+	}
+
+	afterUserID := 0
+	if cursor != nil {
+		afterUserID = cursor.UserID
+	}
+	asOf := repository.MembersAsOf(request, cursor, m.timeProvider.Now())
+
+	userIDs, err := m.segmentMembers(slug, asOf, afterUserID)
+	if err != nil {
+		return entity.SegmentMembersPage{}, err
+	}
+
+	result := entity.SegmentMembersPage{AsOf: asOf, UserIDs: userIDs}
+	if request.Limit > 0 && len(userIDs) > request.Limit {
+		result.UserIDs = userIDs[:request.Limit]
+		result.NextCursor, err = repository.EncodeCursor(repository.MembersCursor{AsOf: asOf, UserID: userIDs[request.Limit-1]})
+		if err != nil {
+			return entity.SegmentMembersPage{}, fmt.Errorf("GetSegmentMembers() - repository.EncodeCursor(): %w", err)
+		}
+	}
+
+	return result, nil
+}
+
+func (m *MemoryRepository) StreamSegmentMembers(ctx context.Context, slug string, asOf time.Time, fn func(userID int) error) error {
+	m.mu.Lock()
+	if asOf.IsZero() {
+		asOf = m.timeProvider.Now()
+	}
+
+	userIDs, err := m.segmentMembers(slug, asOf, 0)
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// `fn` is called without holding the lock, so that it may be slow or use the repository itself
+	for _, userID := range userIDs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := fn(userID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// activeMembersCount returns the number of users that are in the segment at the time `now`
+func (m *MemoryRepository) activeMembersCount(segmentID int, now time.Time) int {
+	userIDs := make([]int, 0, 30)
+	for _, us := range m.usersSegments {
+		if us.segmentID == segmentID && us.wasActiveAt(now) {
+			userIDs = append(userIDs, us.userID)
+		}
+	}
+
+	return len(repository.UniqueUserIDs(userIDs))
+}
+
+func (m *MemoryRepository) GetSegmentStats(ctx context.Context, slug string, from time.Time, to time.Time) (entity.SegmentStats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// deleted segments are fine: their stats are still meaningful
+	segment, ok := m.segmentsBySlug[slug]
+	if !ok {
+		return entity.SegmentStats{}, repository.ErrSegmentNotFound
+	}
+
+	now := m.timeProvider.Now()
+	stats := repository.NewSegmentStats(segment.slug, m.activeMembersCount(segment.id, now), from, to)
+
+	// operations of scheduled memberships are left out until they happen
+	for _, o := range m.operations {
+		if o.segmentID == segment.id && timeInBounds(o.time, from, to) && !o.time.After(now) {
+			repository.CountStatsEvents(&stats, o.time, o.operationType, 1)
+		}
+	}
+
+	// expirations that aren't logged yet are derived from memberships the same way `DumpHistory` does
+	for _, us := range m.usersSegments {
+		if us.segmentID != segment.id || us.removedAt != nil || us.expiresAt == nil || us.expiresAt.After(now) {
+			continue
+		}
+
+		if timeInBounds(*us.expiresAt, from, to) {
+			repository.CountStatsEvents(&stats, *us.expiresAt, entity.ExpiredOperationType, 1)
+		}
+	}
+
+	return stats, nil
+}
+
+func timeInBounds(t time.Time, timeFrom time.Time, timeTo time.Time) bool {
+	return (t.After(timeFrom) || t.Equal(timeFrom)) && t.Before(timeTo)
+}
+
+func (m *MemoryRepository) DumpHistory(ctx context.Context, userID int, timeFrom time.Time, timeTo time.Time) ([]entity.Operation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// operations of scheduled memberships are left out until they happen
+	now := m.timeProvider.Now()
+	operations := make([]entity.Operation, 0, 30)
+	for _, o := range m.operations {
+		if o.userID != userID || !timeInBounds(o.time, timeFrom, timeTo) || o.time.After(now) {
+			continue
+		}
+
+		operations = append(operations, entity.Operation{
+			UserID:      userID,
+			SegmentSlug: m.segments[o.segmentID-1].slug,
+			Type:        o.operationType,
+			Time:        o.time,
+			ExpiresAt:   copyTime(o.expiresAt),
+		})
+	}
+
+	// expirations aren't mutations, so they are only logged once the expired membership is closed by
+	// the expiration sweep or by adding the segment again. Until then they are derived from memberships
+	// that expired while being active
+	for _, us := range m.usersSegments {
+		if us.userID != userID || us.removedAt != nil || us.expiresAt == nil || us.expiresAt.After(now) {
+			continue
+		}
+
+		if !timeInBounds(*us.expiresAt, timeFrom, timeTo) {
+			continue
+		}
+
+		operations = append(operations, entity.Operation{
+			UserID:      userID,
+			SegmentSlug: m.segments[us.segmentID-1].slug,
+			Type:        entity.ExpiredOperationType,
+			Time:        *us.expiresAt,
+			ExpiresAt:   copyTime(us.expiresAt),
+		})
+	}
+
+	// sort by operation time ascending
+	sort.SliceStable(operations, func(i, j int) bool { return operations[i].Time.Before(operations[j].Time) })
+
+	return operations, nil
+}
+
+func (m *MemoryRepository) EraseUser(ctx context.Context, userID int, filesCount int) (entity.Erasure, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	erasure := entity.Erasure{UserID: userID, ErasedAt: m.timeProvider.Now(), FilesCount: filesCount}
+
+	operations := len(m.operations)
+	m.operations = slices.DeleteFunc(m.operations, func(o operationRecord) bool { return o.userID == userID })
+	erasure.OperationsCount = operations - len(m.operations)
+
+	memberships := len(m.usersSegments)
+	m.usersSegments = slices.DeleteFunc(m.usersSegments, func(us *userSegmentRecord) bool { return us.userID == userID })
+	erasure.MembershipsCount = memberships - len(m.usersSegments)
+
+	// leave the tombstone
+	m.erasures = append(m.erasures, erasure)
+
+	return erasure, nil
+}
+
+// experiment returns the experiment by this slug or nil if there is none
+func (m *MemoryRepository) experiment(slug string) *experimentRecord {
+	for _, e := range m.experiments {
+		if e.slug == slug {
+			return e
+		}
+	}
+
+	return nil
+}
+
+func (m *MemoryRepository) CreateExperiment(ctx context.Context, slug string, variants []entity.ExperimentVariant) error {
+	tags, attributes, err := repository.MarshalMetadata(nil, nil)
+	if err != nil {
+		return fmt.Errorf("CreateExperiment() - repository.MarshalMetadata(): %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.experiment(slug) != nil {
+		return repository.ErrExperimentAlreadyExists
+	}
+
+	// check every slug before creating anything
+	taken := make(map[string]struct{}, len(variants))
+	for _, variant := range variants {
+		if _, ok := m.segmentsBySlug[variant.Slug]; ok {
+			return repository.ErrSegmentAlreadyExists
+		}
+
+		if _, ok := taken[variant.Slug]; ok {
+			return repository.ErrSegmentAlreadyExists
+		}
+		taken[variant.Slug] = struct{}{}
+	}
+
+	now := m.timeProvider.Now()
+	experiment := &experimentRecord{slug: slug, createdAt: now}
+	group := m.exclusionGroup(slug)
+	for _, variant := range variants {
+		segment := &segmentRecord{
+			id:         len(m.segments) + 1,
+			slug:       variant.Slug,
+			tags:       tags,
+			attributes: attributes,
+			group:      group,
+			createdAt:  now,
+		}
+		m.segments = append(m.segments, segment)
+		m.segmentsBySlug[variant.Slug] = segment
+
+		experiment.variants = append(experiment.variants, segment)
+		experiment.weights = append(experiment.weights, variant.Weight)
+	}
+	m.experiments = append(m.experiments, experiment)
+
+	return nil
+}
+
+// toEntity converts the record to `entity.Experiment`
+func (e *experimentRecord) toEntity() entity.Experiment {
+	experiment := entity.Experiment{
+		Slug:      e.slug,
+		Variants:  make([]entity.ExperimentVariant, 0, len(e.variants)),
+		CreatedAt: e.createdAt,
+		StartedAt: copyTime(e.startedAt),
+		StoppedAt: copyTime(e.stoppedAt),
+	}
+
+	for i, segment := range e.variants {
+		experiment.Variants = append(experiment.Variants, entity.ExperimentVariant{Slug: segment.slug, Weight: e.weights[i]})
+	}
+
+	return experiment
+}
+
+func (m *MemoryRepository) GetExperiment(ctx context.Context, slug string) (entity.Experiment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	experiment := m.experiment(slug)
+	if experiment == nil {
+		return entity.Experiment{}, repository.ErrExperimentNotFound
+	}
+
+	return experiment.toEntity(), nil
+}
+
+func (m *MemoryRepository) GetAllExperiments(ctx context.Context) ([]entity.Experiment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	experiments := make([]entity.Experiment, 0, len(m.experiments))
+	for _, experiment := range m.experiments {
+		experiments = append(experiments, experiment.toEntity())
+	}
+
+	return experiments, nil
+}
+
+func (m *MemoryRepository) StartExperiment(ctx context.Context, slug string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	experiment := m.experiment(slug)
+	if experiment == nil {
+		return repository.ErrExperimentNotFound
+	}
+
+	if experiment.startedAt != nil {
+		return repository.ErrExperimentAlreadyStarted
+	}
+
+	now := m.timeProvider.Now()
+	experiment.startedAt = &now
+
+	return nil
+}
+
+func (m *MemoryRepository) StopExperiment(ctx context.Context, slug string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	experiment := m.experiment(slug)
+	if experiment == nil {
+		return repository.ErrExperimentNotFound
+	}
+
+	if experiment.startedAt == nil {
+		return repository.ErrExperimentNotStarted
+	}
+
+	if experiment.stoppedAt != nil {
+		return repository.ErrExperimentAlreadyStopped
+	}
+
+	now := m.timeProvider.Now()
+	experiment.stoppedAt = &now
+
+	return nil
+}
+
+func (m *MemoryRepository) GetExperimentVariants(ctx context.Context) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	variants := make(map[string]string)
+	for _, experiment := range m.experiments {
+		for _, segment := range experiment.variants {
+			if segment.deletedAt == nil {
+				variants[segment.slug] = experiment.slug
+			}
+		}
+	}
+
+	return variants, nil
+}
+
+// toEntity decodes the record to `entity.Segment`
+func (s *segmentRecord) toEntity() (entity.Segment, error) {
+	segment := entity.Segment{
+		Slug: s.slug,
+		SegmentMetadata: entity.SegmentMetadata{
+			Description:   s.description,
+			Owner:         s.owner,
+			DefaultTTL:    s.defaultTTL,
+			Expression:    s.expression,
+			Rule:          s.rule,
+			BucketSalt:    s.salt,
+			BucketPercent: s.percent,
+		},
+		CreatedAt: s.createdAt,
+		DeletedAt: copyTime(s.deletedAt),
+	}
+
+	if s.parent != nil {
+		segment.Parent = s.parent.slug
+	}
+
+	if s.group != nil {
+		segment.ExclusionGroup = s.group.name
+	}
+
+	if len(s.aliases) != 0 {
+		segment.Aliases = slices.Clone(s.aliases)
+	}
+
+	if err := repository.UnmarshalMetadata(s.tags, s.attributes, &segment.SegmentMetadata); err != nil {
+		return entity.Segment{}, err
+	}
+
+	return segment, nil
+}
+
+// inRange reports whether `t` lies in the range [from, to), nil bounds are open
+func inRange(t time.Time, from *time.Time, to *time.Time) bool {
+	return (from == nil || !t.Before(*from)) && (to == nil || t.Before(*to))
+}
+
+// matchesFilter reports whether the segment satisfies the filter.
+// Attribute values of the filter must be normalized by a JSON round trip beforehand
+func matchesFilter(segment entity.Segment, filter entity.SegmentFilter) bool {
+	if filter.OnlyActive && segment.DeletedAt != nil {
+		return false
+	}
+
+	if filter.Owner != "" && segment.Owner != filter.Owner {
+		return false
+	}
+
+	if filter.ExclusionGroup != "" && segment.ExclusionGroup != filter.ExclusionGroup {
+		return false
+	}
+
+	if filter.Bucketed && segment.BucketSalt == "" {
+		return false
+	}
+
+	for _, tag := range filter.Tags {
+		if !slices.Contains(segment.Tags, tag) {
+			return false
+		}
+	}
+
+	for key, value := range filter.Attributes {
+		segmentValue, ok := segment.Attributes[key]
+		if !ok || !reflect.DeepEqual(segmentValue, value) {
+			return false
+		}
+	}
+
+	if filter.Slug != "" && segment.Slug != filter.Slug && !slices.Contains(segment.Aliases, filter.Slug) {
+		return false
+	}
+
+	if !strings.HasPrefix(segment.Slug, filter.SlugPrefix) || !strings.Contains(segment.Slug, filter.SlugContains) {
+		return false
+	}
+
+	if !inRange(segment.CreatedAt, filter.CreatedFrom, filter.CreatedTo) {
+		return false
+	}
+
+	if filter.DeletedFrom != nil || filter.DeletedTo != nil {
+		if segment.DeletedAt == nil || !inRange(*segment.DeletedAt, filter.DeletedFrom, filter.DeletedTo) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// compareSegments compares segments by the sort field, breaking ties by their ids
+func compareSegments(sortBy entity.SegmentSortField, a entity.Segment, aID int, b entity.Segment, bID int) int {
+	var c int
+	if sortBy == entity.SortBySlug {
+		c = strings.Compare(a.Slug, b.Slug)
+	} else {
+		c = a.CreatedAt.Compare(b.CreatedAt)
+	}
+
+	if c != 0 {
+		return c
+	}
+
+	return cmp.Compare(aID, bID)
+}
+
+// getSegments returns a page of segments matching the filter
+func (m *MemoryRepository) getSegments(filter entity.SegmentFilter, page entity.SegmentPageRequest) (entity.SegmentPage, error) {
+	sortBy := repository.SortBy(page)
+	if sortBy != entity.SortByCreatedAt && sortBy != entity.SortBySlug {
+		return entity.SegmentPage{}, fmt.Errorf("unknown sort field %q", page.SortBy)
+	}
+
+	cursor, err := repository.DecodeSegmentCursor(page)
+	if err != nil {
+		return entity.SegmentPage{}, err
+	}
+
+	// normalize the attributes the same way the stored ones are, e.g. all numbers become float64
+	if filter.Attributes != nil {
+		b, err := json.Marshal(filter.Attributes)
+		if err != nil {
+			return entity.SegmentPage{}, fmt.Errorf("json.Marshal(): %w", err)
+		}
+
+		filter.Attributes = nil
+		if err := json.Unmarshal(b, &filter.Attributes); err != nil {
+			return entity.SegmentPage{}, fmt.Errorf("json.Unmarshal(): %w", err)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	segments := make([]entity.Segment, 0, 30)
+	ids := make([]int, 0, 30)
+	for _, s := range m.segments {
+		segment, err := s.toEntity()
+		if err != nil {
+			return entity.SegmentPage{}, fmt.Errorf("s.toEntity(): %w", err)
+		}
+
+		if !matchesFilter(segment, filter) {
+			continue
+		}
+
+		segments = append(segments, segment)
+		ids = append(ids, s.id)
+	}
+
+	// sort the indices so that segments and their ids stay together
+	order := make([]int, len(segments))
+	for i := range order {
+		order[i] = i
+	}
+
+	slices.SortFunc(order, func(i, j int) int {
+		c := compareSegments(sortBy, segments[i], ids[i], segments[j], ids[j])
+		if page.Descending {
+			return -c
+		}
+
+		return c
+	})
+
+	// keyset pagination: skip everything up to the last segment of the previous page
+	if cursor != nil {
+		last := entity.Segment{Slug: cursor.Slug, CreatedAt: cursor.CreatedAt}
+		order = slices.DeleteFunc(order, func(i int) bool {
+			c := compareSegments(sortBy, segments[i], ids[i], last, cursor.ID)
+			return (!page.Descending && c <= 0) || (page.Descending && c >= 0)
+		})
+	}
+
+	var nextCursor string
+	if page.Limit > 0 && len(order) > page.Limit {
+		order = order[:page.Limit]
+		last := order[page.Limit-1]
+		nextCursor, err = repository.EncodeSegmentCursor(page, segments[last], ids[last])
+		if err != nil {
+			return entity.SegmentPage{}, fmt.Errorf("repository.EncodeSegmentCursor(): %w", err)
+		}
+	}
+
+	now := m.timeProvider.Now()
+	result := entity.SegmentPage{Segments: make([]entity.Segment, 0, len(order)), NextCursor: nextCursor}
+	for _, i := range order {
+		if page.WithMemberCounts {
+			memberCount := m.activeMembersCount(ids[i], now)
+			segments[i].MemberCount = &memberCount
+		}
+
+		result.Segments = append(result.Segments, segments[i])
+	}
+
+	return result, nil
+}
+
+func (m *MemoryRepository) ListSegments(ctx context.Context, filter entity.SegmentFilter, page entity.SegmentPageRequest) (entity.SegmentPage, error) {
+	result, err := m.getSegments(filter, page)
+	if err != nil {
+		if errors.Is(err, repository.ErrInvalidCursor) {
+			return entity.SegmentPage{}, err
+		}
+
+		return entity.SegmentPage{}, fmt.Errorf("ListSegments() - %w", err)
+	}
+
+	return result, nil
+}
+
+func (m *MemoryRepository) GetAllActiveSegments(ctx context.Context, filter entity.SegmentFilter) ([]entity.Segment, error) {
+	filter.OnlyActive = true
+	result, err := m.getSegments(filter, entity.SegmentPageRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("GetAllActiveSegments() - %w", err)
+	}
+
+	return result.Segments, nil
+}
+
+func (m *MemoryRepository) GetAllSegments(ctx context.Context, filter entity.SegmentFilter) ([]entity.Segment, error) {
+	result, err := m.getSegments(filter, entity.SegmentPageRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("GetAllSegments() - %w", err)
+	}
+
+	return result.Segments, nil
+}
+
+func New(timeProvider timeprovider.TimeProvider) *MemoryRepository {
+	return &MemoryRepository{
+		timeProvider:   timeProvider,
+		segmentsBySlug: make(map[string]*segmentRecord),
+		groupsByName:   make(map[string]*exclusionGroupRecord),
+	}
+}
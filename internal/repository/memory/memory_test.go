@@ -0,0 +1,15 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/repository"
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/repository/repotest"
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/timeprovider"
+)
+
+func TestRepository(t *testing.T) {
+	repotest.Run(t, func(t *testing.T, timeProvider timeprovider.TimeProvider) repository.Repository {
+		return New(timeProvider)
+	})
+}
@@ -1,45 +1,153 @@
 package postgres
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/QiZD90/dynamic-customer-segmentation/internal/entity"
 	"github.com/QiZD90/dynamic-customer-segmentation/internal/repository"
 	"github.com/QiZD90/dynamic-customer-segmentation/internal/timeprovider"
+	"github.com/golang-migrate/migrate/v4"
+	pgmigrate "github.com/golang-migrate/migrate/v4/database/postgres"
+	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/jackc/pgx/v5/pgconn"
 	_ "github.com/jackc/pgx/v5/stdlib"
 )
 
+// segmentSlugCondition matches the segment by its current slug or by one of its aliases, the slug is `$1`
+const segmentSlugCondition = "(slug=$1 OR id=(SELECT segment_id FROM segment_aliases WHERE slug=$1))"
+
+// uniqueViolationCode is the SQLSTATE of a unique constraint violation
+const uniqueViolationCode = "23505"
+
+// isUniqueViolation reports whether the error is a violation of a unique constraint,
+// e.g. a concurrent transaction has inserted the same row first
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolationCode
+}
+
 type PostgresRepository struct {
 	db           *sql.DB
 	timeProvider timeprovider.TimeProvider
 }
 
-func (p *PostgresRepository) CreateSegment(slug string) error {
-	tx, err := p.db.Begin()
+// Migrate brings the database up to date using migrations from `sourceURL`
+func (p *PostgresRepository) Migrate(sourceURL string) error {
+	driver, err := pgmigrate.WithInstance(p.db, &pgmigrate.Config{})
+	if err != nil {
+		return fmt.Errorf("Migrate() - pgmigrate.WithInstance(): %w", err)
+	}
+
+	m, err := migrate.NewWithDatabaseInstance(sourceURL, "postgres", driver)
+	if err != nil {
+		return fmt.Errorf("Migrate() - migrate.NewWithDatabaseInstance(): %w", err)
+	}
+
+	if err := m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return fmt.Errorf("Migrate() - m.Up(): %w", err)
+	}
+
+	// closes only the connection that was taken by the driver, not the whole pool
+	if srcErr, dbErr := m.Close(); srcErr != nil || dbErr != nil {
+		return fmt.Errorf("Migrate() - m.Close(): src: %v, db: %v", srcErr, dbErr)
+	}
+
+	return nil
+}
+
+// parentSegmentID returns the id of the active segment that is going to be a parent and locks it,
+// so that it can't be deleted until the transaction ends. Returns `ErrParentNotFound` if there is no such segment
+func parentSegmentID(ctx context.Context, tx *sql.Tx, slug string) (int, error) {
+	var id int
+	row := tx.QueryRowContext(ctx, "SELECT id FROM segments WHERE "+segmentSlugCondition+" AND deleted_at IS NULL FOR SHARE", slug)
+	if err := row.Scan(&id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, repository.ErrParentNotFound
+		}
+
+		return 0, fmt.Errorf("parentSegmentID() - tx.QueryRowContext(): %w", err)
+	}
+
+	return id, nil
+}
+
+func (p *PostgresRepository) CreateSegment(ctx context.Context, slug string, metadata entity.SegmentMetadata) error {
+	tags, attributes, err := repository.MarshalMetadata(metadata.Tags, metadata.Attributes)
 	if err != nil {
-		return fmt.Errorf("CreateSegment() - p.db.Begin(): %w", err)
+		return fmt.Errorf("CreateSegment() - repository.MarshalMetadata(): %w", err)
+	}
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("CreateSegment() - p.db.BeginTx(): %w", err)
 	}
 	defer tx.Rollback()
 
-	// check if there is a segment under this slug
+	// check if there is a segment under this slug, either current or an alias
 	var cnt int
-	row := tx.QueryRow("SELECT COUNT(*) FROM segments WHERE slug=$1", slug)
+	row := tx.QueryRowContext(ctx,
+		"SELECT (SELECT COUNT(*) FROM segments WHERE slug=$1) + (SELECT COUNT(*) FROM segment_aliases WHERE slug=$1)",
+		slug,
+	)
 	if err := row.Scan(&cnt); err != nil {
-		return fmt.Errorf("CreateSegment() - tx.QueryRow(): %w", err)
+		return fmt.Errorf("CreateSegment() - tx.QueryRowContext(): %w", err)
 	}
 
 	if cnt != 0 {
 		return repository.ErrSegmentAlreadyExists
 	}
 
+	var parentID sql.NullInt64
+	if metadata.Parent != "" {
+		id, err := parentSegmentID(ctx, tx, metadata.Parent)
+		if err != nil {
+			if errors.Is(err, repository.ErrParentNotFound) {
+				return err
+			}
+
+			return fmt.Errorf("CreateSegment() - %w", err)
+		}
+
+		parentID = sql.NullInt64{Int64: int64(id), Valid: true}
+	}
+
+	expression := ""
+	if metadata.Expression != "" {
+		expression, err = resolveExpression(ctx, tx, slug, metadata.Expression)
+		if err != nil {
+			if errors.Is(err, repository.ErrReferenceNotFound) || errors.Is(err, repository.ErrExpressionCycle) {
+				return err
+			}
+
+			return fmt.Errorf("CreateSegment() - %w", err)
+		}
+	}
+
+	groupID, err := exclusionGroupID(ctx, tx, metadata.ExclusionGroup, p.timeProvider.Now())
+	if err != nil {
+		return fmt.Errorf("CreateSegment() - %w", err)
+	}
+
 	// create the segment
-	_, err = tx.Exec("INSERT INTO segments(slug, created_at) VALUES ($1, $2)", slug, p.timeProvider.Now())
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO segments(slug, created_at, description, owner, tags, attributes, default_ttl, parent_id, expression, rule, exclusion_group_id, bucket_salt, bucket_percent)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+		slug, p.timeProvider.Now(), metadata.Description, metadata.Owner, tags, attributes, metadata.DefaultTTL, parentID, expression, metadata.Rule, groupID,
+		metadata.BucketSalt, metadata.BucketPercent,
+	)
 	if err != nil {
-		return fmt.Errorf("CreateSegment() - tx.Exec(): %w", err)
+		if isUniqueViolation(err) { // created by a concurrent transaction after the check
+			return repository.ErrSegmentAlreadyExists
+		}
+
+		return fmt.Errorf("CreateSegment() - tx.ExecContext(): %w", err)
 	}
 
 	// commit changes
@@ -50,359 +158,2355 @@ func (p *PostgresRepository) CreateSegment(slug string) error {
 	return nil
 }
 
-func (p *PostgresRepository) AddSegmentToUsers(slug string, userIDs []int) error {
-	tx, err := p.db.Begin()
+func (p *PostgresRepository) UpdateSegment(ctx context.Context, slug string, update entity.SegmentMetadataUpdate) error {
+	// nil values are passed as NULL and leave the column unchanged
+	var tags, attributes []byte
+	if update.Tags != nil {
+		b, err := json.Marshal(update.Tags)
+		if err != nil {
+			return fmt.Errorf("UpdateSegment() - json.Marshal(): %w", err)
+		}
+		tags = b
+	}
+
+	if update.Attributes != nil {
+		b, err := json.Marshal(update.Attributes)
+		if err != nil {
+			return fmt.Errorf("UpdateSegment() - json.Marshal(): %w", err)
+		}
+		attributes = b
+	}
+
+	tx, err := p.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("AddSegmentToUsers() - p.db.Begin(): %w", err)
+		return fmt.Errorf("UpdateSegment() - p.db.BeginTx(): %w", err)
 	}
+	defer tx.Rollback()
 
-	// check if segment actually exists and get its id and status
-	var id int
+	// check if segment exists and is not deleted
+	var segmentID int
+	var currentSlug string
 	var deletedAt sql.NullTime
-	row := tx.QueryRow("SELECT id, deleted_at FROM segments WHERE slug=$1", slug)
-	if err := row.Scan(&id, &deletedAt); err != nil {
-		if errors.Is(err, sql.ErrNoRows) { // segment doesn't exist
+	var composite, dynamic, bucketed bool
+	row := tx.QueryRowContext(ctx, "SELECT id, slug, deleted_at, expression<>'', rule<>'', bucket_salt<>'' FROM segments WHERE "+segmentSlugCondition+" FOR UPDATE", slug)
+	if err := row.Scan(&segmentID, &currentSlug, &deletedAt, &composite, &dynamic, &bucketed); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
 			return repository.ErrSegmentNotFound
-		} else {
-			return fmt.Errorf("AddSegmentToUsers() - tx.QueryRow(): %w", err)
 		}
+
+		return fmt.Errorf("UpdateSegment() - tx.QueryRowContext(): %w", err)
 	}
 
-	if deletedAt.Valid { // segment is already deleted
+	if deletedAt.Valid {
 		return repository.ErrSegmentAlreadyDeleted
 	}
 
-	for _, userID := range userIDs {
-		// check if user already has an active segment
-		var cnt int
-		row = tx.QueryRow(
-			`SELECT COUNT(*)
-			FROM users_segments
-			WHERE user_id=$1
-			AND segment_id=(SELECT id FROM segments WHERE slug=$2)
-			AND removed_at IS NULL
-			AND (expires_at IS NULL OR expires_at > $3)`,
-			userID, slug, p.timeProvider.Now(),
-		)
-		if err := row.Scan(&cnt); err != nil {
-			return fmt.Errorf("AddSegmentToUsers() - tx.QueryRow(): %w", err)
+	if update.Rule != nil && !dynamic {
+		return repository.ErrNotDynamic
+	}
+
+	if update.BucketPercent != nil && !bucketed {
+		return repository.ErrNotBucketed
+	}
+
+	var groupID sql.NullInt64
+	if update.ExclusionGroup != nil && *update.ExclusionGroup != "" {
+		if composite {
+			return repository.ErrSegmentComposite
 		}
 
-		if cnt != 0 { // segment already exists and is active
-			continue
+		if dynamic {
+			return repository.ErrSegmentDynamic
 		}
 
-		// add segment
-		_, err := tx.Exec(
-			`INSERT INTO users_segments(segment_id, user_id, added_at)
-			VALUES ((SELECT id FROM segments WHERE slug=$1), $2, $3)`,
-			slug, userID, p.timeProvider.Now(),
+		if bucketed {
+			return repository.ErrSegmentBucketed
+		}
+
+		groupID, err = exclusionGroupID(ctx, tx, *update.ExclusionGroup, p.timeProvider.Now())
+		if err != nil {
+			return fmt.Errorf("UpdateSegment() - %w", err)
+		}
+
+		if err := lockExclusionGroups(ctx, tx, []int64{groupID.Int64}); err != nil {
+			return fmt.Errorf("UpdateSegment() - %w", err)
+		}
+
+		// members of the segment must not be in other segments of the new group
+		var conflict bool
+		row := tx.QueryRowContext(ctx,
+			`SELECT EXISTS(
+				SELECT 1 FROM users_segments us
+				WHERE us.segment_id=$1
+				AND us.removed_at IS NULL
+				AND (us.expires_at IS NULL OR us.expires_at > $3)
+				AND `+inExclusionGroupCondition("us.user_id", "$1", "$2", "$3")+`
+			)`,
+			segmentID, groupID, p.timeProvider.Now(),
 		)
+		if err := row.Scan(&conflict); err != nil {
+			return fmt.Errorf("UpdateSegment() - tx.QueryRowContext(): %w", err)
+		}
 
+		if conflict {
+			return repository.ErrExclusionConflict
+		}
+	}
+
+	var expression sql.NullString
+	if update.Expression != nil {
+		if !composite {
+			return repository.ErrNotComposite
+		}
+
+		resolved, err := resolveExpression(ctx, tx, currentSlug, *update.Expression)
+		if err != nil {
+			if errors.Is(err, repository.ErrReferenceNotFound) || errors.Is(err, repository.ErrExpressionCycle) {
+				return err
+			}
+
+			return fmt.Errorf("UpdateSegment() - %w", err)
+		}
+		expression = sql.NullString{String: resolved, Valid: true}
+	}
+
+	// update the metadata
+	_, err = tx.ExecContext(ctx,
+		`UPDATE segments SET
+			description = COALESCE($2, description),
+			owner = COALESCE($3, owner),
+			tags = COALESCE($4::JSONB, tags),
+			attributes = COALESCE($5::JSONB, attributes),
+			default_ttl = COALESCE($6, default_ttl),
+			expression = COALESCE($7, expression),
+			rule = COALESCE($8, rule),
+			bucket_percent = COALESCE($9, bucket_percent)
+		WHERE id=$1`,
+		segmentID, update.Description, update.Owner, tags, attributes, update.DefaultTTL, expression, update.Rule, update.BucketPercent,
+	)
+	if err != nil {
+		return fmt.Errorf("UpdateSegment() - tx.ExecContext(): %w", err)
+	}
+
+	// the empty group leaves NULL and takes the segment out of its group
+	if update.ExclusionGroup != nil {
+		_, err = tx.ExecContext(ctx, "UPDATE segments SET exclusion_group_id=$2 WHERE id=$1", segmentID, groupID)
 		if err != nil {
-			return fmt.Errorf("AddSegmentToUsers() - tx.Exec(): %w", err)
+			return fmt.Errorf("UpdateSegment() - tx.ExecContext(): %w", err)
+		}
+	}
+
+	if update.Parent != nil {
+		if err := setSegmentParent(ctx, tx, segmentID, *update.Parent); err != nil {
+			if errors.Is(err, repository.ErrParentNotFound) || errors.Is(err, repository.ErrSegmentCycle) {
+				return err
+			}
+
+			return fmt.Errorf("UpdateSegment() - %w", err)
 		}
 	}
 
 	// commit changes
 	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("AddSegmentToUsers() - tx.Commit(): %w", err)
+		return fmt.Errorf("UpdateSegment() - tx.Commit(): %w", err)
 	}
 
 	return nil
 }
 
-func (p *PostgresRepository) DeleteSegment(slug string) error {
-	tx, err := p.db.Begin()
+// exclusionGroupNameColumn is an SQL expression that selects the name of the exclusion group of a row of `segments`,
+// empty for segments that aren't in one
+const exclusionGroupNameColumn = "COALESCE((SELECT g.name FROM exclusion_groups g WHERE g.id=segments.exclusion_group_id), '')"
+
+// exclusionGroupID returns the id of the exclusion group with this name, creating the group if there is none yet.
+// Returns NULL for the empty name
+func exclusionGroupID(ctx context.Context, tx *sql.Tx, name string, now time.Time) (sql.NullInt64, error) {
+	if name == "" {
+		return sql.NullInt64{}, nil
+	}
+
+	// a group created by a concurrent transaction is waited for and then selected
+	_, err := tx.ExecContext(ctx, "INSERT INTO exclusion_groups(name, created_at) VALUES ($1, $2) ON CONFLICT (name) DO NOTHING", name, now)
 	if err != nil {
-		return fmt.Errorf("DeleteSegment() - p.db.Begin(): %w", err)
+		return sql.NullInt64{}, fmt.Errorf("exclusionGroupID() - tx.ExecContext(): %w", err)
 	}
-	defer tx.Rollback()
 
-	// get the deletion time of this segment to check its status
-	var deletedAt sql.NullTime
-	row := tx.QueryRow("SELECT deleted_at FROM segments WHERE slug=$1", slug)
-	if err := row.Scan(&deletedAt); err != nil {
-		if errors.Is(err, sql.ErrNoRows) { // no such segment at all
-			return repository.ErrSegmentNotFound
-		}
+	var id sql.NullInt64
+	if err := tx.QueryRowContext(ctx, "SELECT id FROM exclusion_groups WHERE name=$1", name).Scan(&id); err != nil {
+		return sql.NullInt64{}, fmt.Errorf("exclusionGroupID() - tx.QueryRowContext(): %w", err)
+	}
+
+	return id, nil
+}
+
+// inExclusionGroupCondition is an SQL condition that holds if the user has an open membership at `now`
+// in a segment of the exclusion group other than the segment. Arguments are SQL expressions,
+// the condition never holds for a NULL group
+func inExclusionGroupCondition(userID string, segmentID string, groupID string, now string) string {
+	return fmt.Sprintf(`EXISTS(
+		SELECT 1 FROM users_segments g
+		JOIN segments gs ON gs.id=g.segment_id
+		WHERE g.user_id=%[1]s
+		AND gs.id<>%[2]s
+		AND gs.exclusion_group_id=%[3]s
+		AND g.removed_at IS NULL
+		AND (g.expires_at IS NULL OR g.expires_at > %[4]s)
+	)`, userID, segmentID, groupID, now)
+}
 
-		return fmt.Errorf("DeleteSegment() - tx.QueryRow(): %w", err)
+// lockExclusionGroups locks the rows of the exclusion groups until the end of the transaction.
+// Memberships in segments of a group are added by one transaction at a time, otherwise concurrent transactions
+// could put a user in two segments of the group without seeing each other. Rows are locked in the same order
+// by every transaction, so that they don't deadlock, and without blocking the foreign keys of segments
+func lockExclusionGroups(ctx context.Context, tx *sql.Tx, groupIDs []int64) error {
+	_, err := tx.ExecContext(ctx,
+		"SELECT id FROM exclusion_groups WHERE id=ANY($1::INT[]) ORDER BY id FOR NO KEY UPDATE",
+		groupIDs,
+	)
+	if err != nil {
+		return fmt.Errorf("lockExclusionGroups() - tx.ExecContext(): %w", err)
 	}
 
-	if deletedAt.Valid { // already deleted
-		return repository.ErrSegmentAlreadyDeleted
+	return nil
+}
+
+// compositeExpressions returns the expressions of composite segments by their slugs,
+// deleted ones too unless `onlyActive` is set
+func compositeExpressions(ctx context.Context, tx *sql.Tx, onlyActive bool) (map[string]string, error) {
+	query := "SELECT slug, expression FROM segments WHERE expression<>''"
+	if onlyActive {
+		query += " AND deleted_at IS NULL"
 	}
 
-	// mark the segment as deleted
-	_, err = tx.Exec("UPDATE segments SET deleted_at=$2 WHERE slug=$1", slug, p.timeProvider.Now())
+	rows, err := tx.QueryContext(ctx, query)
 	if err != nil {
-		return fmt.Errorf("DeleteSegment() - tx.Exec(): %w", err)
+		return nil, fmt.Errorf("compositeExpressions() - tx.QueryContext(): %w", err)
 	}
+	defer rows.Close()
 
-	// mark active user segments with this segment as removed
-	_, err = tx.Exec(
-		`UPDATE users_segments SET removed_at=$2, expires_at=NULL
-		WHERE segment_id=(SELECT id FROM segments WHERE slug=$1)
-		AND removed_at IS NULL
-		AND (expires_at IS NULL OR expires_at > $2)`, slug, p.timeProvider.Now())
-	if err != nil {
-		return fmt.Errorf("DeleteSegment() - tx.Exec(): %w", err)
+	composites := make(map[string]string)
+	for rows.Next() {
+		var slug, expression string
+		if err := rows.Scan(&slug, &expression); err != nil {
+			return nil, fmt.Errorf("compositeExpressions() - rows.Scan(): %w", err)
+		}
+
+		composites[slug] = expression
 	}
 
-	// commit changes
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("DeleteSegment() - tx.Commit(): %w", err)
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("compositeExpressions() - rows.Err(): %w", err)
 	}
 
-	return nil
+	return composites, nil
 }
 
-func (p *PostgresRepository) UpdateUserSegments(userID int, addSegments []entity.SegmentExpiration, removeSegments []entity.SegmentExpiration) error {
-	tx, err := p.db.Begin()
+// resolveExpression checks the expression of the composite segment `slug` and rewrites it with current slugs
+// of the referenced segments, which are locked so that they can't be deleted in the meantime.
+// Returns `ErrReferenceNotFound` if any of them isn't an active segment and `ErrExpressionCycle`
+// if the segment would depend on itself
+func resolveExpression(ctx context.Context, tx *sql.Tx, slug string, expression string) (string, error) {
+	composites, err := compositeExpressions(ctx, tx, false)
 	if err != nil {
-		return fmt.Errorf("UpdateUserSegments() - p.db.Begin(): %w", err)
+		return "", fmt.Errorf("resolveExpression() - %w", err)
 	}
-	defer tx.Rollback()
 
-	for _, segment := range addSegments {
-		// check segment existence and status and get its id
-		var segmentID int
-		var deletedAt sql.NullTime
-		row := tx.QueryRow("SELECT id, deleted_at FROM segments WHERE slug=$1", segment.Slug)
-		if err := row.Scan(&segmentID, &deletedAt); err != nil {
-			if errors.Is(err, sql.ErrNoRows) { // no such segment at all
-				return repository.ErrSegmentNotFound
+	resolved, err := repository.ResolveExpression(slug, expression, composites, func(ref string) (string, error) {
+		var currentSlug string
+		row := tx.QueryRowContext(ctx, "SELECT slug FROM segments WHERE "+segmentSlugCondition+" AND deleted_at IS NULL FOR SHARE", ref)
+		if err := row.Scan(&currentSlug); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return "", repository.ErrReferenceNotFound
 			}
 
-			return fmt.Errorf("UpdateUserSegments() - tx.QueryRow(): %w", err)
-		}
-
-		if deletedAt.Valid { // already deleted
-			return repository.ErrSegmentAlreadyDeleted
-		}
-
-		// check if user already has the segment
-		var cnt int
-		row = tx.QueryRow(
-			`SELECT COUNT(*)
-			FROM users_segments
-			WHERE user_id=$1
-			AND segment_id=$2
-			AND removed_at IS NULL
-			AND (expires_at IS NULL OR expires_at > $3)`,
-			userID, segmentID, p.timeProvider.Now(),
-		)
-		if err := row.Scan(&cnt); err != nil {
-			return fmt.Errorf("UpdateUserSegments() - tx.QueryRow(): %w", err)
-		}
-
-		if cnt != 0 { // segment already exists and is active
-			continue
+			return "", fmt.Errorf("tx.QueryRowContext(): %w", err)
 		}
 
-		// add the segment
-		var expiresAt sql.NullTime
-		if segment.ExpiresAt != nil {
-			expiresAt.Time = *segment.ExpiresAt
-			expiresAt.Valid = true
+		return currentSlug, nil
+	})
+	if err != nil {
+		if errors.Is(err, repository.ErrReferenceNotFound) || errors.Is(err, repository.ErrExpressionCycle) {
+			return "", err
 		}
-		_, err := tx.Exec(
-			`INSERT INTO users_segments(segment_id, user_id, added_at, expires_at)
-			VALUES ($1, $2, $3, $4)`,
-			segmentID, userID, p.timeProvider.Now(), expiresAt,
-		)
 
-		if err != nil {
-			return fmt.Errorf("UpdateUserSegments() - tx.Exec(): %w", err)
-		}
+		return "", fmt.Errorf("resolveExpression() - repository.ResolveExpression(): %w", err)
 	}
 
-	for _, segment := range removeSegments {
-		// check segment existence and status and get its id
-		var segmentID int
-		var deletedAt sql.NullTime
-		row := tx.QueryRow("SELECT id, deleted_at FROM segments WHERE slug=$1", segment.Slug)
-		if err := row.Scan(&segmentID, &deletedAt); err != nil {
-			if errors.Is(err, sql.ErrNoRows) { // no such segment at all
-				return repository.ErrSegmentNotFound
-			}
-
-			return fmt.Errorf("UpdateUserSegments() - tx.QueryRow(): %w", err)
-		}
+	return resolved, nil
+}
 
-		if deletedAt.Valid { // already deleted
-			return repository.ErrSegmentAlreadyDeleted
+// setSegmentParent moves the segment under the active segment by `parentSlug`, or to the top level if it's empty.
+// Returns `ErrParentNotFound` if there is no such parent and `ErrSegmentCycle` if the parent is
+// the segment itself or one of its descendants
+func setSegmentParent(ctx context.Context, tx *sql.Tx, segmentID int, parentSlug string) error {
+	var parentID sql.NullInt64
+	if parentSlug != "" {
+		id, err := parentSegmentID(ctx, tx, parentSlug)
+		if err != nil {
+			return err
 		}
 
-		// check if user already has the segment
-		var cnt int
-		row = tx.QueryRow(
-			`SELECT COUNT(*)
-			FROM users_segments
-			WHERE user_id=$1
-			AND segment_id=$2
-			AND removed_at IS NULL
-			AND (expires_at IS NULL OR expires_at > $3)`,
-			userID, segmentID, p.timeProvider.Now(),
+		// walk up from the new parent, the segment must not be on the way
+		var cycle bool
+		row := tx.QueryRowContext(ctx,
+			`WITH RECURSIVE ancestors(id) AS (
+				SELECT $1::INT
+				UNION
+				SELECT s.parent_id FROM segments s JOIN ancestors a ON s.id=a.id WHERE s.parent_id IS NOT NULL
+			)
+			SELECT EXISTS(SELECT 1 FROM ancestors WHERE id=$2)`,
+			id, segmentID,
 		)
-		if err := row.Scan(&cnt); err != nil {
-			return fmt.Errorf("UpdateUserSegments() - tx.QueryRow(): %w", err)
+		if err := row.Scan(&cycle); err != nil {
+			return fmt.Errorf("setSegmentParent() - tx.QueryRowContext(): %w", err)
 		}
 
-		if cnt == 0 { // segment doesn't exist
-			continue
+		if cycle {
+			return repository.ErrSegmentCycle
 		}
 
-		// remove the segment
-		_, err := tx.Exec(
-			`UPDATE users_segments
-			SET removed_at=$3
-			WHERE user_id=$1
-			AND segment_id=$2`,
-			userID, segmentID, p.timeProvider.Now(),
-		)
-		if err != nil {
-			return fmt.Errorf("UpdateUserSegments() - tx.Exec(): %w", err)
-		}
+		parentID = sql.NullInt64{Int64: int64(id), Valid: true}
 	}
 
-	// commit changes
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("UpdateUserSegments() - tx.Commit(): %w", err)
+	_, err := tx.ExecContext(ctx, "UPDATE segments SET parent_id=$2 WHERE id=$1", segmentID, parentID)
+	if err != nil {
+		return fmt.Errorf("setSegmentParent() - tx.ExecContext(): %w", err)
 	}
 
 	return nil
 }
 
-func (p *PostgresRepository) GetActiveUserSegments(userID int) ([]entity.UserSegment, error) {
-	rows, err := p.db.Query(
-		`SELECT (SELECT slug FROM segments WHERE id=segment_id), added_at, expires_at
-		FROM users_segments
-		WHERE user_id=$1
-		AND removed_at IS NULL
-		AND (expires_at IS NULL OR expires_at > $2)`,
-		userID, p.timeProvider.Now(),
-	)
+func (p *PostgresRepository) RenameSegment(ctx context.Context, slug string, newSlug string) error {
+	tx, err := p.db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, fmt.Errorf("GetActiveUserSegments() - p.db.Query(): %w", err)
+		return fmt.Errorf("RenameSegment() - p.db.BeginTx(): %w", err)
 	}
+	defer tx.Rollback()
 
-	userSegments := make([]entity.UserSegment, 0, 30)
-	for rows.Next() {
-		var userSegment entity.UserSegment
-		var expiresAt sql.NullTime
-		rows.Scan(&userSegment.Slug, &userSegment.AddedAt, &expiresAt)
-
-		if expiresAt.Valid {
-			userSegment.ExpiresAt = &expiresAt.Time
-		} else {
-			userSegment.ExpiresAt = nil
+	// get the segment by its current slug or an alias and lock it
+	var segmentID int
+	var currentSlug string
+	var deletedAt sql.NullTime
+	row := tx.QueryRowContext(ctx, "SELECT id, slug, deleted_at FROM segments WHERE "+segmentSlugCondition+" FOR UPDATE", slug)
+	if err := row.Scan(&segmentID, &currentSlug, &deletedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) { // no such segment at all
+			return repository.ErrSegmentNotFound
 		}
 
-		userSegments = append(userSegments, userSegment)
+		return fmt.Errorf("RenameSegment() - tx.QueryRowContext(): %w", err)
 	}
 
-	return userSegments, nil
-}
+	if deletedAt.Valid { // deleted segments can't be renamed
+		return repository.ErrSegmentAlreadyDeleted
+	}
 
-func timeInBounds(t time.Time, timeFrom time.Time, timeTo time.Time) bool {
-	return (t.After(timeFrom) || t.Equal(timeFrom)) && t.Before(timeTo)
-}
+	if newSlug == currentSlug { // nothing to do
+		return nil
+	}
 
-func (p *PostgresRepository) DumpHistory(userID int, timeFrom time.Time, timeTo time.Time) ([]entity.Operation, error) {
-	rows, err := p.db.Query(
-		`SELECT (SELECT slug FROM segments WHERE id=segment_id), user_id, added_at, removed_at, expires_at
-		FROM users_segments
-		WHERE user_id=$1`, userID,
+	// check if the new slug is free. The only exception is an alias of this very segment,
+	// it stops being an alias and becomes the current slug again
+	var cnt int
+	row = tx.QueryRowContext(ctx,
+		`SELECT (SELECT COUNT(*) FROM segments WHERE slug=$1)
+		+ (SELECT COUNT(*) FROM segment_aliases WHERE slug=$1 AND segment_id<>$2)`,
+		newSlug, segmentID,
 	)
-	if err != nil {
-		return nil, fmt.Errorf("DumpHistory() - p.db.Query(): %w", err)
+	if err := row.Scan(&cnt); err != nil {
+		return fmt.Errorf("RenameSegment() - tx.QueryRowContext(): %w", err)
 	}
 
-	operations := make([]entity.Operation, 0, 30)
-	for rows.Next() {
-		var slug string
-		var userID int
-		var addedAt time.Time
-		var removedAt sql.NullTime
-		var expiresAt sql.NullTime
+	if cnt != 0 {
+		return repository.ErrSegmentAlreadyExists
+	}
 
-		rows.Scan(&slug, &userID, &addedAt, &removedAt, &expiresAt)
+	_, err = tx.ExecContext(ctx, "DELETE FROM segment_aliases WHERE slug=$1", newSlug)
+	if err != nil {
+		return fmt.Errorf("RenameSegment() - tx.ExecContext(): %w", err)
+	}
 
-		if timeInBounds(addedAt, timeFrom, timeTo) {
-			operations = append(operations, entity.Operation{
-				UserID:      userID,
-				SegmentSlug: slug,
-				Type:        entity.AddedOperationType,
-				Time:        addedAt,
-			})
-		}
+	// keep the current slug as an alias and rename the segment
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO segment_aliases(slug, segment_id, created_at) VALUES ($1, $2, $3)",
+		currentSlug, segmentID, p.timeProvider.Now(),
+	)
+	if err != nil {
+		return fmt.Errorf("RenameSegment() - tx.ExecContext(): %w", err)
+	}
 
-		if removedAt.Valid && timeInBounds(removedAt.Time, timeFrom, timeTo) {
-			operations = append(operations, entity.Operation{
-				UserID:      userID,
-				SegmentSlug: slug,
-				Type:        entity.RemovedOperationType,
-				Time:        removedAt.Time,
-			})
+	_, err = tx.ExecContext(ctx, "UPDATE segments SET slug=$2 WHERE id=$1", segmentID, newSlug)
+	if err != nil {
+		if isUniqueViolation(err) { // taken by a concurrent transaction after the check
+			return repository.ErrSegmentAlreadyExists
 		}
 
-		if expiresAt.Valid && expiresAt.Time.Before(p.timeProvider.Now()) && timeInBounds(expiresAt.Time, timeFrom, timeTo) {
-			operations = append(operations, entity.Operation{
-				UserID:      userID,
-				SegmentSlug: slug,
-				Type:        entity.ExpiredOperationType,
-				Time:        expiresAt.Time,
-			})
-		}
+		return fmt.Errorf("RenameSegment() - tx.ExecContext(): %w", err)
 	}
 
-	// sort by operation time ascending
-	sort.Slice(operations, func(i, j int) bool { return operations[i].Time.Before(operations[j].Time) })
-
-	return operations, nil
-}
+	// composite segments that reference the segment reference it by the new slug
+	composites, err := compositeExpressions(ctx, tx, false)
+	if err != nil {
+		return fmt.Errorf("RenameSegment() - %w", err)
+	}
 
-func (p *PostgresRepository) GetAllActiveSegments() ([]entity.Segment, error) {
-	rows, err := p.db.Query("SELECT slug, created_at FROM segments WHERE deleted_at IS NULL")
+	renamed, err := repository.RenameReferences(composites, currentSlug, newSlug)
 	if err != nil {
-		return nil, fmt.Errorf("GetAllActiveSegments() - p.db.Query(): %w", err)
+		return fmt.Errorf("RenameSegment() - repository.RenameReferences(): %w", err)
 	}
 
-	segments := make([]entity.Segment, 0)
-	for rows.Next() {
-		var segment entity.Segment
-		rows.Scan(&segment.Slug, &segment.CreatedAt)
+	for composite, expression := range renamed {
+		_, err = tx.ExecContext(ctx, "UPDATE segments SET expression=$2 WHERE slug=$1", composite, expression)
+		if err != nil {
+			return fmt.Errorf("RenameSegment() - tx.ExecContext(): %w", err)
+		}
+	}
 
-		segments = append(segments, segment)
+	// commit changes
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("RenameSegment() - tx.Commit(): %w", err)
 	}
 
-	return segments, nil
+	return nil
 }
 
-func (p *PostgresRepository) GetAllSegments() ([]entity.Segment, error) {
-	rows, err := p.db.Query("SELECT slug, created_at, deleted_at FROM segments")
+// recordOperation appends an operation to the operations log
+func recordOperation(ctx context.Context, tx *sql.Tx, userID int, segmentID int, operationType entity.OperationType, t time.Time, expiresAt sql.NullTime) error {
+	_, err := tx.ExecContext(ctx,
+		`INSERT INTO operations(user_id, segment_id, type, time, expires_at)
+		VALUES ($1, $2, $3, $4, $5)`,
+		userID, segmentID, operationType, t, expiresAt,
+	)
 	if err != nil {
-		return nil, fmt.Errorf("GetAllSegments() - p.db.Query(): %w", err)
+		return fmt.Errorf("recordOperation() - tx.ExecContext(): %w", err)
 	}
 
-	segments := make([]entity.Segment, 0, 30)
-	for rows.Next() {
-		var segment entity.Segment
-		var deletedAt sql.NullTime
-		rows.Scan(&segment.Slug, &segment.CreatedAt, &deletedAt)
+	return nil
+}
 
-		if deletedAt.Valid {
-			segment.DeletedAt = &deletedAt.Time
-		} else {
-			segment.DeletedAt = nil
+// scanClosedMemberships reads the rows of `user_id, slug, time` of logged expirations into operations
+func scanClosedMemberships(rows *sql.Rows) ([]entity.Operation, error) {
+	defer rows.Close()
+
+	var operations []entity.Operation
+	for rows.Next() {
+		operation := entity.Operation{Type: entity.ExpiredOperationType}
+		var expiresAt time.Time
+		if err := rows.Scan(&operation.UserID, &operation.SegmentSlug, &expiresAt); err != nil {
+			return nil, fmt.Errorf("rows.Scan(): %w", err)
+		}
+
+		operation.Time = expiresAt
+		operation.ExpiresAt = &expiresAt
+		operations = append(operations, operation)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows.Err(): %w", err)
+	}
+
+	return operations, nil
+}
+
+// closeExpiredMemberships marks not removed memberships of the users in the segment that have expired by `now`
+// as removed at their expiration and logs the expirations. Only one not removed membership of a user
+// in a segment is allowed, so expired ones have to be closed before the user is added again.
+// Returns the logged expirations
+func closeExpiredMemberships(ctx context.Context, tx *sql.Tx, segmentID int, userIDs []int64, now time.Time) ([]entity.Operation, error) {
+	rows, err := tx.QueryContext(ctx,
+		`WITH closed AS (
+			UPDATE users_segments SET removed_at=expires_at
+			WHERE segment_id=$1
+			AND user_id=ANY($2::INT[])
+			AND removed_at IS NULL
+			AND expires_at <= $3
+			RETURNING user_id, segment_id, expires_at
+		), logged AS (
+			INSERT INTO operations(user_id, segment_id, type, time, expires_at)
+			SELECT user_id, segment_id, $4, expires_at, expires_at FROM closed
+			RETURNING user_id, segment_id, time
+		)
+		SELECT logged.user_id, segments.slug, logged.time
+		FROM logged
+		JOIN segments ON segments.id=logged.segment_id
+		ORDER BY logged.time, logged.user_id`,
+		segmentID, userIDs, now, entity.ExpiredOperationType,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("closeExpiredMemberships() - tx.QueryContext(): %w", err)
+	}
+
+	operations, err := scanClosedMemberships(rows)
+	if err != nil {
+		return nil, fmt.Errorf("closeExpiredMemberships() - %w", err)
+	}
+
+	return operations, nil
+}
+
+// enrollChunkSize is the maximum number of users that are added to a segment in one transaction
+const enrollChunkSize = 10000
+
+func (p *PostgresRepository) AddSegmentToUsers(ctx context.Context, slug string, userIDs []int, expiresAt *time.Time) (entity.EnrollmentResult, []entity.Operation, error) {
+	var result entity.EnrollmentResult
+	var operations []entity.Operation
+
+	userIDs = repository.UniqueUserIDs(userIDs)
+	for len(userIDs) > 0 {
+		chunk := userIDs[:min(enrollChunkSize, len(userIDs))]
+		userIDs = userIDs[len(chunk):]
+
+		enrolled, excluded, chunkOperations, err := p.addSegmentToUsersChunk(ctx, slug, chunk, expiresAt)
+		if err != nil {
+			return result, operations, err
+		}
+
+		result.EnrolledCount += enrolled
+		result.ExcludedCount += excluded
+		result.SkippedCount += len(chunk) - enrolled - excluded
+		operations = append(operations, chunkOperations...)
+	}
+
+	return result, operations, nil
+}
+
+// addSegmentToUsersChunk adds the segment to users that don't have it yet in one transaction.
+// Users in another segment of its exclusion group are left out.
+// Returns the number of users that got the segment, the number of users that were left out
+// and the operations that were applied
+func (p *PostgresRepository) addSegmentToUsersChunk(ctx context.Context, slug string, userIDs []int, explicitExpiresAt *time.Time) (int, int, []entity.Operation, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("AddSegmentToUsers() - p.db.BeginTx(): %w", err)
+	}
+	defer tx.Rollback()
+
+	// check if segment actually exists and get its id and status.
+	// The row is locked so that the segment can't be deleted in the middle of the chunk
+	var id int
+	var currentSlug, defaultTTL string
+	var group sql.NullInt64
+	var deletedAt sql.NullTime
+	var composite, dynamic, bucketed bool
+	row := tx.QueryRowContext(ctx, "SELECT id, slug, default_ttl, exclusion_group_id, deleted_at, expression<>'', rule<>'', bucket_salt<>'' FROM segments WHERE "+segmentSlugCondition+" FOR SHARE", slug)
+	if err := row.Scan(&id, &currentSlug, &defaultTTL, &group, &deletedAt, &composite, &dynamic, &bucketed); err != nil {
+		if errors.Is(err, sql.ErrNoRows) { // segment doesn't exist
+			return 0, 0, nil, repository.ErrSegmentNotFound
+		} else {
+			return 0, 0, nil, fmt.Errorf("AddSegmentToUsers() - tx.QueryRowContext(): %w", err)
+		}
+	}
+
+	if deletedAt.Valid { // segment is already deleted
+		return 0, 0, nil, repository.ErrSegmentAlreadyDeleted
+	}
+
+	if composite { // memberships are computed from other segments
+		return 0, 0, nil, repository.ErrSegmentComposite
+	}
+
+	if dynamic { // memberships are changed by the rule
+		return 0, 0, nil, repository.ErrSegmentDynamic
+	}
+
+	if bucketed { // memberships are decided by the hash of user id
+		return 0, 0, nil, repository.ErrSegmentBucketed
+	}
+
+	ids := make([]int64, len(userIDs))
+	for i, userID := range userIDs {
+		ids[i] = int64(userID)
+	}
+
+	now := p.timeProvider.Now()
+	operations, err := closeExpiredMemberships(ctx, tx, id, ids, now)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("AddSegmentToUsers() - %w", err)
+	}
+
+	var expiresAt sql.NullTime
+	expiration, err := repository.MembershipExpiration(explicitExpiresAt, defaultTTL, now)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("AddSegmentToUsers() - repository.MembershipExpiration(): %w", err)
+	}
+	if expiration != nil {
+		expiresAt.Time = *expiration
+		expiresAt.Valid = true
+	}
+
+	// users in another segment of the exclusion group are left out
+	var excluded int
+	if group.Valid {
+		if err := lockExclusionGroups(ctx, tx, []int64{group.Int64}); err != nil {
+			return 0, 0, nil, fmt.Errorf("AddSegmentToUsers() - %w", err)
+		}
+
+		row := tx.QueryRowContext(ctx,
+			`SELECT COUNT(*) FROM unnest($2::INT[]) AS u(user_id) WHERE `+inExclusionGroupCondition("u.user_id", "$1", "$3", "$4"),
+			id, ids, group, now,
+		)
+		if err := row.Scan(&excluded); err != nil {
+			return 0, 0, nil, fmt.Errorf("AddSegmentToUsers() - tx.QueryRowContext(): %w", err)
+		}
+	}
+
+	// add the segment to users that don't have it active and aren't in its exclusion group and log it.
+	// Users that got it from a concurrent transaction are skipped by the unique index of active memberships
+	rows, err := tx.QueryContext(ctx,
+		`WITH added AS (
+			INSERT INTO users_segments(segment_id, user_id, added_at, expires_at)
+			SELECT $1, u.user_id, $3, $5
+			FROM unnest($2::INT[]) AS u(user_id)
+			WHERE NOT `+inExclusionGroupCondition("u.user_id", "$1", "$6", "$3")+`
+			ON CONFLICT (user_id, segment_id) WHERE removed_at IS NULL DO NOTHING
+			RETURNING user_id
+		), logged AS (
+			INSERT INTO operations(user_id, segment_id, type, time, expires_at)
+			SELECT user_id, $1, $4, $3, $5 FROM added
+			RETURNING user_id
+		)
+		SELECT user_id FROM logged ORDER BY user_id`,
+		id, ids, now, entity.AddedOperationType, expiresAt, group,
+	)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("AddSegmentToUsers() - tx.QueryContext(): %w", err)
+	}
+	defer rows.Close()
+
+	enrolled := 0
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return 0, 0, nil, fmt.Errorf("AddSegmentToUsers() - rows.Scan(): %w", err)
+		}
+
+		operations = append(operations, entity.Operation{
+			UserID:      userID,
+			SegmentSlug: currentSlug,
+			Type:        entity.AddedOperationType,
+			Time:        now,
+			ExpiresAt:   expiration,
+		})
+		enrolled++
+	}
+
+	if err := rows.Err(); err != nil {
+		return 0, 0, nil, fmt.Errorf("AddSegmentToUsers() - rows.Err(): %w", err)
+	}
+
+	// commit changes
+	if err := tx.Commit(); err != nil {
+		return 0, 0, nil, fmt.Errorf("AddSegmentToUsers() - tx.Commit(): %w", err)
+	}
+
+	return enrolled, excluded, operations, nil
+}
+
+func (p *PostgresRepository) GetExclusionGroupMembers(ctx context.Context, slug string, userIDs []int) ([]int, error) {
+	var segmentID int
+	var group sql.NullInt64
+	row := p.db.QueryRowContext(ctx, "SELECT id, exclusion_group_id FROM segments WHERE "+segmentSlugCondition, slug)
+	if err := row.Scan(&segmentID, &group); err != nil {
+		if errors.Is(err, sql.ErrNoRows) { // no such segment at all
+			return nil, repository.ErrSegmentNotFound
+		}
+
+		return nil, fmt.Errorf("GetExclusionGroupMembers() - p.db.QueryRowContext(): %w", err)
+	}
+
+	if !group.Valid {
+		return nil, nil
+	}
+
+	ids := make([]int64, len(userIDs))
+	for i, userID := range userIDs {
+		ids[i] = int64(userID)
+	}
+
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT DISTINCT u.user_id FROM unnest($2::INT[]) AS u(user_id)
+		WHERE `+inExclusionGroupCondition("u.user_id", "$1", "$3", "$4")+`
+		ORDER BY u.user_id`,
+		segmentID, ids, group, p.timeProvider.Now(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("GetExclusionGroupMembers() - p.db.QueryContext(): %w", err)
+	}
+	defer rows.Close()
+
+	var members []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, fmt.Errorf("GetExclusionGroupMembers() - rows.Scan(): %w", err)
+		}
+
+		members = append(members, userID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetExclusionGroupMembers() - rows.Err(): %w", err)
+	}
+
+	return members, nil
+}
+
+func (p *PostgresRepository) DeleteSegment(ctx context.Context, slug string, children entity.ChildrenPolicy, force bool) ([]entity.Operation, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("DeleteSegment() - p.db.BeginTx(): %w", err)
+	}
+	defer tx.Rollback()
+
+	// get the id and the deletion time of this segment to check its status.
+	// The row is locked so that no children can be added to it in the meantime
+	var segmentID int
+	var currentSlug string
+	var deletedAt sql.NullTime
+	row := tx.QueryRowContext(ctx, "SELECT id, slug, deleted_at FROM segments WHERE "+segmentSlugCondition+" FOR UPDATE", slug)
+	if err := row.Scan(&segmentID, &currentSlug, &deletedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) { // no such segment at all
+			return nil, repository.ErrSegmentNotFound
+		}
+
+		return nil, fmt.Errorf("DeleteSegment() - tx.QueryRowContext(): %w", err)
+	}
+
+	if deletedAt.Valid { // already deleted
+		return nil, repository.ErrSegmentAlreadyDeleted
+	}
+
+	// deal with active children of the segment
+	segmentIDs := []int64{int64(segmentID)}
+	slugs := []string{currentSlug}
+	switch children {
+	case entity.ChildrenCascade:
+		rows, err := tx.QueryContext(ctx,
+			`WITH RECURSIVE descendants(id, slug) AS (
+				SELECT id, slug FROM segments WHERE parent_id=$1 AND deleted_at IS NULL
+				UNION
+				SELECT s.id, s.slug FROM segments s JOIN descendants d ON s.parent_id=d.id WHERE s.deleted_at IS NULL
+			)
+			SELECT id, slug FROM descendants`,
+			segmentID,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("DeleteSegment() - tx.QueryContext(): %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var id int64
+			var slug string
+			if err := rows.Scan(&id, &slug); err != nil {
+				return nil, fmt.Errorf("DeleteSegment() - rows.Scan(): %w", err)
+			}
+
+			segmentIDs = append(segmentIDs, id)
+			slugs = append(slugs, slug)
+		}
+
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("DeleteSegment() - rows.Err(): %w", err)
+		}
+	case entity.ChildrenDetach:
+		_, err := tx.ExecContext(ctx, "UPDATE segments SET parent_id=NULL WHERE parent_id=$1 AND deleted_at IS NULL", segmentID)
+		if err != nil {
+			return nil, fmt.Errorf("DeleteSegment() - tx.ExecContext(): %w", err)
+		}
+	default:
+		var hasChildren bool
+		row := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM segments WHERE parent_id=$1 AND deleted_at IS NULL)", segmentID)
+		if err := row.Scan(&hasChildren); err != nil {
+			return nil, fmt.Errorf("DeleteSegment() - tx.QueryRowContext(): %w", err)
+		}
+
+		if hasChildren {
+			return nil, repository.ErrSegmentHasChildren
+		}
+	}
+
+	// composite segments that stay active must not lose the segments they reference
+	if !force {
+		composites, err := compositeExpressions(ctx, tx, true)
+		if err != nil {
+			return nil, fmt.Errorf("DeleteSegment() - %w", err)
+		}
+
+		referencing, err := repository.ReferencingComposites(composites, slugs)
+		if err != nil {
+			return nil, fmt.Errorf("DeleteSegment() - repository.ReferencingComposites(): %w", err)
+		}
+
+		if len(referencing) != 0 {
+			return nil, repository.ErrSegmentReferenced
+		}
+	}
+
+	// mark the segments as deleted
+	now := p.timeProvider.Now()
+	_, err = tx.ExecContext(ctx, "UPDATE segments SET deleted_at=$2 WHERE id=ANY($1::INT[])", segmentIDs, now)
+	if err != nil {
+		return nil, fmt.Errorf("DeleteSegment() - tx.ExecContext(): %w", err)
+	}
+
+	// mark open user segments with these segments as removed and log it.
+	// Scheduled ones are removed at their start, so they never become active
+	rows, err := tx.QueryContext(ctx,
+		`WITH removed AS (
+			UPDATE users_segments SET removed_at=GREATEST(added_at, $2)
+			WHERE segment_id=ANY($1::INT[])
+			AND removed_at IS NULL
+			AND (expires_at IS NULL OR expires_at > $2)
+			RETURNING user_id, segment_id, removed_at, expires_at
+		), logged AS (
+			INSERT INTO operations(user_id, segment_id, type, time, expires_at)
+			SELECT user_id, segment_id, $3, removed_at, expires_at FROM removed
+			RETURNING user_id, segment_id, time, expires_at
+		)
+		SELECT logged.user_id, segments.slug, logged.time, logged.expires_at
+		FROM logged
+		JOIN segments ON segments.id=logged.segment_id
+		ORDER BY segments.slug, logged.user_id`,
+		segmentIDs, now, entity.SegmentDeletedOperationType,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("DeleteSegment() - tx.QueryContext(): %w", err)
+	}
+	defer rows.Close()
+
+	var operations []entity.Operation
+	for rows.Next() {
+		operation := entity.Operation{Type: entity.SegmentDeletedOperationType}
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&operation.UserID, &operation.SegmentSlug, &operation.Time, &expiresAt); err != nil {
+			return nil, fmt.Errorf("DeleteSegment() - rows.Scan(): %w", err)
+		}
+
+		if expiresAt.Valid {
+			operation.ExpiresAt = &expiresAt.Time
+		}
+		operations = append(operations, operation)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("DeleteSegment() - rows.Err(): %w", err)
+	}
+
+	// commit changes
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("DeleteSegment() - tx.Commit(): %w", err)
+	}
+
+	return operations, nil
+}
+
+func (p *PostgresRepository) RestoreSegment(ctx context.Context, slug string, restoreMemberships bool) ([]entity.Operation, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("RestoreSegment() - p.db.BeginTx(): %w", err)
+	}
+	defer tx.Rollback()
+
+	// get the id and the deletion time of this segment to check its status
+	var segmentID int
+	var currentSlug string
+	var group sql.NullInt64
+	var deletedAt sql.NullTime
+	row := tx.QueryRowContext(ctx, "SELECT id, slug, exclusion_group_id, deleted_at FROM segments WHERE "+segmentSlugCondition+" FOR UPDATE", slug)
+	if err := row.Scan(&segmentID, &currentSlug, &group, &deletedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) { // no such segment at all
+			return nil, repository.ErrSegmentNotFound
+		}
+
+		return nil, fmt.Errorf("RestoreSegment() - tx.QueryRowContext(): %w", err)
+	}
+
+	if !deletedAt.Valid { // segment is active
+		return nil, repository.ErrSegmentNotDeleted
+	}
+
+	// only memberships whose removal was logged by the deletion are restored. Scheduled memberships are removed
+	// and logged at their start, so the removal time alone can't tell the ones closed by the deletion
+	// from the ones cancelled before it.
+	// The ones that would have expired by now and the ones of users that are now in another segment
+	// of the exclusion group stay removed
+	now := p.timeProvider.Now()
+	var operations []entity.Operation
+	if restoreMemberships {
+		if group.Valid {
+			if err := lockExclusionGroups(ctx, tx, []int64{group.Int64}); err != nil {
+				return nil, fmt.Errorf("RestoreSegment() - %w", err)
+			}
+		}
+
+		rows, err := tx.QueryContext(ctx,
+			`WITH restored AS (
+				UPDATE users_segments SET removed_at=NULL
+				WHERE segment_id=$1
+				AND EXISTS(
+					SELECT 1 FROM operations o
+					WHERE o.user_id=users_segments.user_id
+					AND o.segment_id=users_segments.segment_id
+					AND o.type=$6
+					AND o.time=users_segments.removed_at
+					AND o.time >= $2
+				)
+				AND (expires_at IS NULL OR expires_at > $3)
+				AND NOT `+inExclusionGroupCondition("users_segments.user_id", "$1", "$5", "$3")+`
+				RETURNING user_id, expires_at
+			), logged AS (
+				INSERT INTO operations(user_id, segment_id, type, time, expires_at)
+				SELECT user_id, $1, $4, $3, expires_at FROM restored
+				RETURNING user_id, expires_at
+			)
+			SELECT user_id, expires_at FROM logged ORDER BY user_id`,
+			segmentID, deletedAt.Time, now, entity.SegmentRestoredOperationType, group, entity.SegmentDeletedOperationType,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("RestoreSegment() - tx.QueryContext(): %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			operation := entity.Operation{SegmentSlug: currentSlug, Type: entity.SegmentRestoredOperationType, Time: now}
+			var expiresAt sql.NullTime
+			if err := rows.Scan(&operation.UserID, &expiresAt); err != nil {
+				return nil, fmt.Errorf("RestoreSegment() - rows.Scan(): %w", err)
+			}
+
+			if expiresAt.Valid {
+				operation.ExpiresAt = &expiresAt.Time
+			}
+			operations = append(operations, operation)
+		}
+
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("RestoreSegment() - rows.Err(): %w", err)
+		}
+	}
+
+	// mark the segment as active. If its parent is deleted, it becomes a top-level segment
+	_, err = tx.ExecContext(ctx,
+		`UPDATE segments SET deleted_at=NULL,
+			parent_id=(SELECT p.id FROM segments p WHERE p.id=segments.parent_id AND p.deleted_at IS NULL)
+		WHERE id=$1`,
+		segmentID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("RestoreSegment() - tx.ExecContext(): %w", err)
+	}
+
+	// commit changes
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("RestoreSegment() - tx.Commit(): %w", err)
+	}
+
+	return operations, nil
+}
+
+func (p *PostgresRepository) UpdateUserSegments(ctx context.Context, userID int, addSegments []entity.SegmentExpiration, removeSegments []entity.SegmentExpiration) ([]entity.Operation, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("UpdateUserSegments() - p.db.BeginTx(): %w", err)
+	}
+	defer tx.Rollback()
+
+	now := p.timeProvider.Now()
+	var operations []entity.Operation
+	var groups []int64
+	for _, segment := range addSegments {
+		// check segment existence and status and get its id
+		var segmentID int
+		var currentSlug, defaultTTL string
+		var group sql.NullInt64
+		var deletedAt sql.NullTime
+		var composite, dynamic, bucketed bool
+		row := tx.QueryRowContext(ctx, "SELECT id, slug, default_ttl, exclusion_group_id, deleted_at, expression<>'', rule<>'', bucket_salt<>'' FROM segments WHERE "+segmentSlugCondition, segment.Slug)
+		if err := row.Scan(&segmentID, &currentSlug, &defaultTTL, &group, &deletedAt, &composite, &dynamic, &bucketed); err != nil {
+			if errors.Is(err, sql.ErrNoRows) { // no such segment at all
+				return nil, repository.ErrSegmentNotFound
+			}
+
+			return nil, fmt.Errorf("UpdateUserSegments() - tx.QueryRowContext(): %w", err)
+		}
+
+		if deletedAt.Valid { // already deleted
+			return nil, repository.ErrSegmentAlreadyDeleted
+		}
+
+		if composite { // memberships are computed from other segments
+			return nil, repository.ErrSegmentComposite
+		}
+
+		if dynamic { // memberships are changed by the rule
+			return nil, repository.ErrSegmentDynamic
+		}
+
+		if bucketed { // memberships are decided by the hash of user id
+			return nil, repository.ErrSegmentBucketed
+		}
+
+		if group.Valid {
+			groups = append(groups, group.Int64)
+		}
+
+		expired, err := closeExpiredMemberships(ctx, tx, segmentID, []int64{int64(userID)}, now)
+		if err != nil {
+			return nil, fmt.Errorf("UpdateUserSegments() - %w", err)
+		}
+		operations = append(operations, expired...)
+
+		// add the segment unless user already has it open. A scheduled membership is added at its start
+		addedAt := now
+		if segment.StartsAt != nil && segment.StartsAt.After(now) {
+			addedAt = *segment.StartsAt
+		}
+
+		expiration, err := repository.MembershipExpiration(segment.ExpiresAt, defaultTTL, addedAt)
+		if err != nil {
+			return nil, fmt.Errorf("UpdateUserSegments() - repository.MembershipExpiration(): %w", err)
+		}
+
+		var expiresAt sql.NullTime
+		if expiration != nil {
+			expiresAt.Time = *expiration
+			expiresAt.Valid = true
+		}
+		res, err := tx.ExecContext(ctx,
+			`INSERT INTO users_segments(segment_id, user_id, added_at, expires_at)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (user_id, segment_id) WHERE removed_at IS NULL DO NOTHING`,
+			segmentID, userID, addedAt, expiresAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("UpdateUserSegments() - tx.ExecContext(): %w", err)
+		}
+
+		added, err := res.RowsAffected()
+		if err != nil {
+			return nil, fmt.Errorf("UpdateUserSegments() - res.RowsAffected(): %w", err)
+		}
+
+		if added == 0 { // segment already exists and is open
+			continue
+		}
+
+		if err := recordOperation(ctx, tx, userID, segmentID, entity.AddedOperationType, addedAt, expiresAt); err != nil {
+			return nil, fmt.Errorf("UpdateUserSegments() - %w", err)
+		}
+		operations = append(operations, entity.Operation{
+			UserID:      userID,
+			SegmentSlug: currentSlug,
+			Type:        entity.AddedOperationType,
+			Time:        addedAt,
+			ExpiresAt:   expiration,
+		})
+	}
+
+	for _, segment := range removeSegments {
+		// check segment existence and status and get its id
+		var segmentID int
+		var currentSlug string
+		var deletedAt sql.NullTime
+		var composite, dynamic, bucketed bool
+		row := tx.QueryRowContext(ctx, "SELECT id, slug, deleted_at, expression<>'', rule<>'', bucket_salt<>'' FROM segments WHERE "+segmentSlugCondition, segment.Slug)
+		if err := row.Scan(&segmentID, &currentSlug, &deletedAt, &composite, &dynamic, &bucketed); err != nil {
+			if errors.Is(err, sql.ErrNoRows) { // no such segment at all
+				return nil, repository.ErrSegmentNotFound
+			}
+
+			return nil, fmt.Errorf("UpdateUserSegments() - tx.QueryRowContext(): %w", err)
+		}
+
+		if deletedAt.Valid { // already deleted
+			return nil, repository.ErrSegmentAlreadyDeleted
+		}
+
+		if composite { // memberships are computed from other segments
+			return nil, repository.ErrSegmentComposite
+		}
+
+		if dynamic { // memberships are changed by the rule
+			return nil, repository.ErrSegmentDynamic
+		}
+
+		if bucketed { // memberships are decided by the hash of user id
+			return nil, repository.ErrSegmentBucketed
+		}
+
+		// remove the segment if user has it open, a scheduled membership is removed at its start
+		var removedAt time.Time
+		var expiresAt sql.NullTime
+		row = tx.QueryRowContext(ctx,
+			`UPDATE users_segments
+			SET removed_at=GREATEST(added_at, $3)
+			WHERE user_id=$1
+			AND segment_id=$2
+			AND removed_at IS NULL
+			AND (expires_at IS NULL OR expires_at > $3)
+			RETURNING removed_at, expires_at`,
+			userID, segmentID, now,
+		)
+		if err := row.Scan(&removedAt, &expiresAt); err != nil {
+			if errors.Is(err, sql.ErrNoRows) { // user doesn't have the segment
+				continue
+			}
+
+			return nil, fmt.Errorf("UpdateUserSegments() - tx.QueryRowContext(): %w", err)
+		}
+
+		if err := recordOperation(ctx, tx, userID, segmentID, entity.RemovedOperationType, removedAt, expiresAt); err != nil {
+			return nil, fmt.Errorf("UpdateUserSegments() - %w", err)
+		}
+		operation := entity.Operation{UserID: userID, SegmentSlug: currentSlug, Type: entity.RemovedOperationType, Time: removedAt}
+		if expiresAt.Valid {
+			operation.ExpiresAt = &expiresAt.Time
+		}
+		operations = append(operations, operation)
+	}
+
+	// after the update the user must be in at most one segment of every exclusion group.
+	// Only groups of the added segments can be violated
+	if len(groups) != 0 {
+		if err := lockExclusionGroups(ctx, tx, groups); err != nil {
+			return nil, fmt.Errorf("UpdateUserSegments() - %w", err)
+		}
+
+		var conflict bool
+		row := tx.QueryRowContext(ctx,
+			`SELECT EXISTS(
+				SELECT 1 FROM users_segments us
+				JOIN segments s ON s.id=us.segment_id
+				WHERE us.user_id=$1
+				AND s.exclusion_group_id=ANY($3::INT[])
+				AND us.removed_at IS NULL
+				AND (us.expires_at IS NULL OR us.expires_at > $2)
+				GROUP BY s.exclusion_group_id
+				HAVING COUNT(*) > 1
+			)`,
+			userID, now, groups,
+		)
+		if err := row.Scan(&conflict); err != nil {
+			return nil, fmt.Errorf("UpdateUserSegments() - tx.QueryRowContext(): %w", err)
+		}
+
+		if conflict {
+			return nil, repository.ErrExclusionConflict
+		}
+	}
+
+	// commit changes
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("UpdateUserSegments() - tx.Commit(): %w", err)
+	}
+
+	return operations, nil
+}
+
+func (p *PostgresRepository) UpdateUserSegmentExpirations(ctx context.Context, userID int, segments []entity.SegmentExpiration) ([]entity.Operation, error) {
+	now := p.timeProvider.Now()
+	for _, segment := range segments {
+		if segment.ExpiresAt != nil && !segment.ExpiresAt.After(now) {
+			return nil, repository.ErrExpirationInPast
+		}
+	}
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("UpdateUserSegmentExpirations() - p.db.BeginTx(): %w", err)
+	}
+	defer tx.Rollback()
+
+	var operations []entity.Operation
+	for _, segment := range segments {
+		// check segment existence and status and get its id
+		var segmentID int
+		var currentSlug string
+		var deletedAt sql.NullTime
+		var composite, dynamic, bucketed bool
+		row := tx.QueryRowContext(ctx, "SELECT id, slug, deleted_at, expression<>'', rule<>'', bucket_salt<>'' FROM segments WHERE "+segmentSlugCondition, segment.Slug)
+		if err := row.Scan(&segmentID, &currentSlug, &deletedAt, &composite, &dynamic, &bucketed); err != nil {
+			if errors.Is(err, sql.ErrNoRows) { // no such segment at all
+				return nil, repository.ErrSegmentNotFound
+			}
+
+			return nil, fmt.Errorf("UpdateUserSegmentExpirations() - tx.QueryRowContext(): %w", err)
+		}
+
+		if deletedAt.Valid { // already deleted
+			return nil, repository.ErrSegmentAlreadyDeleted
+		}
+
+		if composite { // memberships are computed from other segments
+			return nil, repository.ErrSegmentComposite
+		}
+
+		if dynamic { // memberships are changed by the rule
+			return nil, repository.ErrSegmentDynamic
+		}
+
+		if bucketed { // memberships are decided by the hash of user id
+			return nil, repository.ErrSegmentBucketed
+		}
+
+		// change the expiration if user has the segment open and it's different
+		var expiresAt sql.NullTime
+		if segment.ExpiresAt != nil {
+			expiresAt.Time = *segment.ExpiresAt
+			expiresAt.Valid = true
+
+			// a scheduled membership can't expire before it starts
+			var beforeStart bool
+			row := tx.QueryRowContext(ctx,
+				`SELECT EXISTS(SELECT 1 FROM users_segments
+					WHERE user_id=$1
+					AND segment_id=$2
+					AND removed_at IS NULL
+					AND added_at >= $3)`,
+				userID, segmentID, expiresAt,
+			)
+			if err := row.Scan(&beforeStart); err != nil {
+				return nil, fmt.Errorf("UpdateUserSegmentExpirations() - tx.QueryRowContext(): %w", err)
+			}
+
+			if beforeStart {
+				return nil, repository.ErrExpirationBeforeStart
+			}
+		}
+
+		res, err := tx.ExecContext(ctx,
+			`UPDATE users_segments
+			SET expires_at=$3
+			WHERE user_id=$1
+			AND segment_id=$2
+			AND removed_at IS NULL
+			AND (expires_at IS NULL OR expires_at > $4)
+			AND expires_at IS DISTINCT FROM $3`,
+			userID, segmentID, expiresAt, now,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("UpdateUserSegmentExpirations() - tx.ExecContext(): %w", err)
+		}
+
+		changed, err := res.RowsAffected()
+		if err != nil {
+			return nil, fmt.Errorf("UpdateUserSegmentExpirations() - res.RowsAffected(): %w", err)
+		}
+
+		if changed == 0 { // user doesn't have the segment or it already expires at this date
+			continue
+		}
+
+		if err := recordOperation(ctx, tx, userID, segmentID, entity.ExpirationChangedOperationType, now, expiresAt); err != nil {
+			return nil, fmt.Errorf("UpdateUserSegmentExpirations() - %w", err)
+		}
+		operations = append(operations, entity.Operation{
+			UserID:      userID,
+			SegmentSlug: currentSlug,
+			Type:        entity.ExpirationChangedOperationType,
+			Time:        now,
+			ExpiresAt:   segment.ExpiresAt,
+		})
+	}
+
+	// commit changes
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("UpdateUserSegmentExpirations() - tx.Commit(): %w", err)
+	}
+
+	return operations, nil
+}
+
+// expirationSweepLockKey is the key of the advisory lock that is held while expired memberships are closed,
+// so that replicas of the service don't sweep at the same time
+const expirationSweepLockKey = 0x65787069
+
+func (p *PostgresRepository) SyncSegmentMembers(ctx context.Context, slug string, userIDs []int) ([]entity.Operation, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("SyncSegmentMembers() - p.db.BeginTx(): %w", err)
+	}
+	defer tx.Rollback()
+
+	// check if segment actually exists and get its id and status.
+	// The row is locked so that the segment can't be deleted in the middle of the sync
+	var segmentID int
+	var currentSlug, defaultTTL string
+	var deletedAt sql.NullTime
+	var dynamic bool
+	row := tx.QueryRowContext(ctx, "SELECT id, slug, default_ttl, deleted_at, rule<>'' FROM segments WHERE "+segmentSlugCondition+" FOR SHARE", slug)
+	if err := row.Scan(&segmentID, &currentSlug, &defaultTTL, &deletedAt, &dynamic); err != nil {
+		if errors.Is(err, sql.ErrNoRows) { // segment doesn't exist
+			return nil, repository.ErrSegmentNotFound
+		}
+
+		return nil, fmt.Errorf("SyncSegmentMembers() - tx.QueryRowContext(): %w", err)
+	}
+
+	if deletedAt.Valid { // segment is already deleted
+		return nil, repository.ErrSegmentAlreadyDeleted
+	}
+
+	if !dynamic {
+		return nil, repository.ErrNotDynamic
+	}
+
+	unique := repository.UniqueUserIDs(userIDs)
+	ids := make([]int64, len(unique))
+	for i, userID := range unique {
+		ids[i] = int64(userID)
+	}
+
+	now := p.timeProvider.Now()
+	operations, err := closeExpiredMemberships(ctx, tx, segmentID, ids, now)
+	if err != nil {
+		return nil, fmt.Errorf("SyncSegmentMembers() - %w", err)
+	}
+
+	var expiresAt sql.NullTime
+	expiration, err := repository.MembershipExpiration(nil, defaultTTL, now)
+	if err != nil {
+		return nil, fmt.Errorf("SyncSegmentMembers() - repository.MembershipExpiration(): %w", err)
+	}
+	if expiration != nil {
+		expiresAt.Time = *expiration
+		expiresAt.Valid = true
+	}
+
+	// add the segment to users that don't have it open and log it
+	rows, err := tx.QueryContext(ctx,
+		`WITH added AS (
+			INSERT INTO users_segments(segment_id, user_id, added_at, expires_at)
+			SELECT $1, u.user_id, $3, $5
+			FROM unnest($2::INT[]) AS u(user_id)
+			ON CONFLICT (user_id, segment_id) WHERE removed_at IS NULL DO NOTHING
+			RETURNING user_id
+		), logged AS (
+			INSERT INTO operations(user_id, segment_id, type, time, expires_at)
+			SELECT user_id, $1, $4, $3, $5 FROM added
+			RETURNING user_id
+		)
+		SELECT user_id FROM logged ORDER BY user_id`,
+		segmentID, ids, now, entity.AddedOperationType, expiresAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("SyncSegmentMembers() - tx.QueryContext(): %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, fmt.Errorf("SyncSegmentMembers() - rows.Scan(): %w", err)
+		}
+
+		operations = append(operations, entity.Operation{
+			UserID:      userID,
+			SegmentSlug: currentSlug,
+			Type:        entity.AddedOperationType,
+			Time:        now,
+			ExpiresAt:   expiration,
+		})
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SyncSegmentMembers() - rows.Err(): %w", err)
+	}
+
+	// remove the segment from the rest of users and log it, a scheduled membership is removed at its start
+	rows, err = tx.QueryContext(ctx,
+		`WITH removed AS (
+			UPDATE users_segments SET removed_at=GREATEST(added_at, $3)
+			WHERE segment_id=$1
+			AND NOT user_id=ANY($2::INT[])
+			AND removed_at IS NULL
+			AND (expires_at IS NULL OR expires_at > $3)
+			RETURNING user_id, removed_at, expires_at
+		), logged AS (
+			INSERT INTO operations(user_id, segment_id, type, time, expires_at)
+			SELECT user_id, $1, $4, removed_at, expires_at FROM removed
+			RETURNING user_id, time, expires_at
+		)
+		SELECT user_id, time, expires_at FROM logged ORDER BY user_id`,
+		segmentID, ids, now, entity.RemovedOperationType,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("SyncSegmentMembers() - tx.QueryContext(): %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID int
+		var removedAt time.Time
+		var removedExpiresAt sql.NullTime
+		if err := rows.Scan(&userID, &removedAt, &removedExpiresAt); err != nil {
+			return nil, fmt.Errorf("SyncSegmentMembers() - rows.Scan(): %w", err)
+		}
+
+		operation := entity.Operation{UserID: userID, SegmentSlug: currentSlug, Type: entity.RemovedOperationType, Time: removedAt}
+		if removedExpiresAt.Valid {
+			operation.ExpiresAt = &removedExpiresAt.Time
+		}
+		operations = append(operations, operation)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SyncSegmentMembers() - rows.Err(): %w", err)
+	}
+
+	// commit changes
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("SyncSegmentMembers() - tx.Commit(): %w", err)
+	}
+
+	return operations, nil
+}
+
+func (p *PostgresRepository) ExpireMemberships(ctx context.Context, limit int) ([]entity.Operation, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("ExpireMemberships() - p.db.BeginTx(): %w", err)
+	}
+	defer tx.Rollback()
+
+	// the lock is released with the end of the transaction
+	var locked bool
+	row := tx.QueryRowContext(ctx, "SELECT pg_try_advisory_xact_lock($1)", expirationSweepLockKey)
+	if err := row.Scan(&locked); err != nil {
+		return nil, fmt.Errorf("ExpireMemberships() - tx.QueryRowContext(): %w", err)
+	}
+
+	if !locked { // another replica is sweeping right now
+		return nil, nil
+	}
+
+	// memberships locked by concurrent changes of users are skipped, they are either closed
+	// by those changes or left for the next sweep
+	rows, err := tx.QueryContext(ctx,
+		`WITH expired AS (
+			SELECT id FROM users_segments
+			WHERE removed_at IS NULL
+			AND expires_at <= $1
+			ORDER BY expires_at, id
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		), closed AS (
+			UPDATE users_segments SET removed_at=expires_at
+			WHERE id IN (SELECT id FROM expired)
+			RETURNING user_id, segment_id, expires_at
+		), logged AS (
+			INSERT INTO operations(user_id, segment_id, type, time, expires_at)
+			SELECT user_id, segment_id, $3, expires_at, expires_at FROM closed
+			RETURNING user_id, segment_id, time
+		)
+		SELECT logged.user_id, segments.slug, logged.time
+		FROM logged
+		JOIN segments ON segments.id=logged.segment_id
+		ORDER BY logged.time, logged.user_id`,
+		p.timeProvider.Now(), limit, entity.ExpiredOperationType,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("ExpireMemberships() - tx.QueryContext(): %w", err)
+	}
+
+	operations, err := scanClosedMemberships(rows)
+	if err != nil {
+		return nil, fmt.Errorf("ExpireMemberships() - %w", err)
+	}
+
+	// commit changes
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("ExpireMemberships() - tx.Commit(): %w", err)
+	}
+
+	return operations, nil
+}
+
+func (p *PostgresRepository) GetActiveUserSegments(ctx context.Context, userID int) ([]entity.UserSegment, error) {
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT (SELECT slug FROM segments WHERE id=segment_id), added_at, expires_at
+		FROM users_segments
+		WHERE user_id=$1
+		AND added_at <= $2
+		AND removed_at IS NULL
+		AND (expires_at IS NULL OR expires_at > $2)`,
+		userID, p.timeProvider.Now(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("GetActiveUserSegments() - p.db.QueryContext(): %w", err)
+	}
+	defer rows.Close()
+
+	userSegments := make([]entity.UserSegment, 0, 30)
+	for rows.Next() {
+		var userSegment entity.UserSegment
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&userSegment.Slug, &userSegment.AddedAt, &expiresAt); err != nil {
+			return nil, fmt.Errorf("GetActiveUserSegments() - rows.Scan(): %w", err)
+		}
+
+		if expiresAt.Valid {
+			userSegment.ExpiresAt = &expiresAt.Time
+		} else {
+			userSegment.ExpiresAt = nil
+		}
+
+		userSegments = append(userSegments, userSegment)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetActiveUserSegments() - rows.Err(): %w", err)
+	}
+
+	return userSegments, nil
+}
+
+func (p *PostgresRepository) GetSegmentParents(ctx context.Context) (map[string]string, error) {
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT s.slug, p.slug
+		FROM segments s
+		JOIN segments p ON p.id=s.parent_id
+		WHERE s.deleted_at IS NULL`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("GetSegmentParents() - p.db.QueryContext(): %w", err)
+	}
+	defer rows.Close()
+
+	parents := make(map[string]string)
+	for rows.Next() {
+		var slug, parent string
+		if err := rows.Scan(&slug, &parent); err != nil {
+			return nil, fmt.Errorf("GetSegmentParents() - rows.Scan(): %w", err)
+		}
+
+		parents[slug] = parent
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetSegmentParents() - rows.Err(): %w", err)
+	}
+
+	return parents, nil
+}
+
+func (p *PostgresRepository) GetCompositeSegments(ctx context.Context) (map[string]string, error) {
+	rows, err := p.db.QueryContext(ctx, "SELECT slug, expression FROM segments WHERE expression<>'' AND deleted_at IS NULL")
+	if err != nil {
+		return nil, fmt.Errorf("GetCompositeSegments() - p.db.QueryContext(): %w", err)
+	}
+	defer rows.Close()
+
+	composites := make(map[string]string)
+	for rows.Next() {
+		var slug, expression string
+		if err := rows.Scan(&slug, &expression); err != nil {
+			return nil, fmt.Errorf("GetCompositeSegments() - rows.Scan(): %w", err)
+		}
+
+		composites[slug] = expression
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetCompositeSegments() - rows.Err(): %w", err)
+	}
+
+	return composites, nil
+}
+
+// querySegmentMembers queries ids of users that were in the segment at `asOf` and have id greater than `afterUserID`,
+// sorted by id. If `limit` is positive, no more than `limit` ids are returned
+func (p *PostgresRepository) querySegmentMembers(ctx context.Context, slug string, asOf time.Time, afterUserID int, limit int) (*sql.Rows, error) {
+	// deleted segments are fine: their memberships were removed at the deletion time
+	var segmentID int
+	row := p.db.QueryRowContext(ctx, "SELECT id FROM segments WHERE "+segmentSlugCondition, slug)
+	if err := row.Scan(&segmentID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, repository.ErrSegmentNotFound
+		}
+
+		return nil, fmt.Errorf("p.db.QueryRowContext(): %w", err)
+	}
+
+	query := `SELECT DISTINCT user_id
+		FROM users_segments
+		WHERE segment_id=$1
+		AND added_at <= $2
+		AND (removed_at IS NULL OR removed_at > $2)
+		AND (expires_at IS NULL OR expires_at > $2)
+		AND user_id > $3
+		ORDER BY user_id`
+	args := []any{segmentID, asOf, afterUserID}
+	if limit > 0 {
+		args = append(args, limit)
+		query += " LIMIT $4"
+	}
+
+	rows, err := p.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("p.db.QueryContext(): %w", err)
+	}
+
+	return rows, nil
+}
+
+func (p *PostgresRepository) GetSegmentMembers(ctx context.Context, slug string, request entity.SegmentMembersRequest) (entity.SegmentMembersPage, error) {
+	cursor, err := repository.DecodeMembersCursor(request)
+	if err != nil {
+		return entity.SegmentMembersPage{}, err
+	}
+
+	afterUserID := 0
+	if cursor != nil {
+		afterUserID = cursor.UserID
+	}
+	asOf := repository.MembersAsOf(request, cursor, p.timeProvider.Now())
+
+	// one more row tells if there is the next page
+	limit := 0
+	if request.Limit > 0 {
+		limit = request.Limit + 1
+	}
+
+	rows, err := p.querySegmentMembers(ctx, slug, asOf, afterUserID, limit)
+	if err != nil {
+		if errors.Is(err, repository.ErrSegmentNotFound) {
+			return entity.SegmentMembersPage{}, err
+		}
+
+		return entity.SegmentMembersPage{}, fmt.Errorf("GetSegmentMembers() - p.querySegmentMembers(): %w", err)
+	}
+	defer rows.Close()
+
+	result := entity.SegmentMembersPage{AsOf: asOf, UserIDs: make([]int, 0, 30)}
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return entity.SegmentMembersPage{}, fmt.Errorf("GetSegmentMembers() - rows.Scan(): %w", err)
+		}
+
+		result.UserIDs = append(result.UserIDs, userID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return entity.SegmentMembersPage{}, fmt.Errorf("GetSegmentMembers() - rows.Err(): %w", err)
+	}
+
+	if request.Limit > 0 && len(result.UserIDs) > request.Limit {
+		result.UserIDs = result.UserIDs[:request.Limit]
+		result.NextCursor, err = repository.EncodeCursor(repository.MembersCursor{AsOf: asOf, UserID: result.UserIDs[request.Limit-1]})
+		if err != nil {
+			return entity.SegmentMembersPage{}, fmt.Errorf("GetSegmentMembers() - repository.EncodeCursor(): %w", err)
+		}
+	}
+
+	return result, nil
+}
+
+func (p *PostgresRepository) StreamSegmentMembers(ctx context.Context, slug string, asOf time.Time, fn func(userID int) error) error {
+	if asOf.IsZero() {
+		asOf = p.timeProvider.Now()
+	}
+
+	rows, err := p.querySegmentMembers(ctx, slug, asOf, 0, 0)
+	if err != nil {
+		if errors.Is(err, repository.ErrSegmentNotFound) {
+			return err
+		}
+
+		return fmt.Errorf("StreamSegmentMembers() - p.querySegmentMembers(): %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return fmt.Errorf("StreamSegmentMembers() - rows.Scan(): %w", err)
+		}
+
+		if err := fn(userID); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("StreamSegmentMembers() - rows.Err(): %w", err)
+	}
+
+	return nil
+}
+
+func (p *PostgresRepository) GetSegmentStats(ctx context.Context, slug string, from time.Time, to time.Time) (entity.SegmentStats, error) {
+	// deleted segments are fine: their stats are still meaningful
+	var segmentID int
+	var currentSlug string
+	row := p.db.QueryRowContext(ctx, "SELECT id, slug FROM segments WHERE "+segmentSlugCondition, slug)
+	if err := row.Scan(&segmentID, &currentSlug); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return entity.SegmentStats{}, repository.ErrSegmentNotFound
+		}
+
+		return entity.SegmentStats{}, fmt.Errorf("GetSegmentStats() - p.db.QueryRowContext(): %w", err)
+	}
+
+	now := p.timeProvider.Now()
+
+	var activeCount int
+	row = p.db.QueryRowContext(ctx,
+		`SELECT COUNT(DISTINCT user_id)
+		FROM users_segments
+		WHERE segment_id=$1
+		AND added_at <= $2
+		AND removed_at IS NULL
+		AND (expires_at IS NULL OR expires_at > $2)`,
+		segmentID, now,
+	)
+	if err := row.Scan(&activeCount); err != nil {
+		return entity.SegmentStats{}, fmt.Errorf("GetSegmentStats() - p.db.QueryRowContext(): %w", err)
+	}
+
+	stats := repository.NewSegmentStats(currentSlug, activeCount, from, to)
+
+	// expirations that aren't logged yet are derived from memberships the same way `DumpHistory` does,
+	// operations of scheduled memberships are left out until they happen
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT day, type, COUNT(*) FROM (
+			SELECT date_trunc('day', time) AS day, type
+			FROM operations
+			WHERE segment_id=$1
+			AND time >= $2 AND time < $3
+			AND time <= $4
+
+			UNION ALL
+
+			SELECT date_trunc('day', expires_at), $5::TEXT
+			FROM users_segments
+			WHERE segment_id=$1
+			AND removed_at IS NULL
+			AND expires_at <= $4
+			AND expires_at >= $2 AND expires_at < $3
+		) events
+		GROUP BY day, type`,
+		segmentID, from, to, now, entity.ExpiredOperationType,
+	)
+	if err != nil {
+		return entity.SegmentStats{}, fmt.Errorf("GetSegmentStats() - p.db.QueryContext(): %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var day time.Time
+		var operationType entity.OperationType
+		var count int
+		if err := rows.Scan(&day, &operationType, &count); err != nil {
+			return entity.SegmentStats{}, fmt.Errorf("GetSegmentStats() - rows.Scan(): %w", err)
+		}
+
+		repository.CountStatsEvents(&stats, day, operationType, count)
+	}
+
+	if err := rows.Err(); err != nil {
+		return entity.SegmentStats{}, fmt.Errorf("GetSegmentStats() - rows.Err(): %w", err)
+	}
+
+	return stats, nil
+}
+
+func (p *PostgresRepository) DumpHistory(ctx context.Context, userID int, timeFrom time.Time, timeTo time.Time) ([]entity.Operation, error) {
+	// expirations aren't mutations, so they are only logged once the expired membership is closed by
+	// the expiration sweep or by adding the segment again. Until then they are derived from memberships
+	// that expired while being active. Operations of scheduled memberships are left out until they happen
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT slug, type, time, expires_at FROM (
+			SELECT o.id, s.slug, o.type, o.time, o.expires_at
+			FROM operations o
+			JOIN segments s ON s.id=o.segment_id
+			WHERE o.user_id=$1
+			AND o.time >= $2 AND o.time < $3
+			AND o.time <= $4
+
+			UNION ALL
+
+			SELECT NULL::INT, s.slug, $5::TEXT, us.expires_at, us.expires_at
+			FROM users_segments us
+			JOIN segments s ON s.id=us.segment_id
+			WHERE us.user_id=$1
+			AND us.removed_at IS NULL
+			AND us.expires_at <= $4
+			AND us.expires_at >= $2 AND us.expires_at < $3
+		) history
+		ORDER BY time, id NULLS LAST`,
+		userID, timeFrom, timeTo, p.timeProvider.Now(), entity.ExpiredOperationType,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("DumpHistory() - p.db.QueryContext(): %w", err)
+	}
+	defer rows.Close()
+
+	operations := make([]entity.Operation, 0, 30)
+	for rows.Next() {
+		operation := entity.Operation{UserID: userID}
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&operation.SegmentSlug, &operation.Type, &operation.Time, &expiresAt); err != nil {
+			return nil, fmt.Errorf("DumpHistory() - rows.Scan(): %w", err)
+		}
+
+		if expiresAt.Valid {
+			operation.ExpiresAt = &expiresAt.Time
+		}
+
+		operations = append(operations, operation)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("DumpHistory() - rows.Err(): %w", err)
+	}
+
+	return operations, nil
+}
+
+func (p *PostgresRepository) EraseUser(ctx context.Context, userID int, filesCount int) (entity.Erasure, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return entity.Erasure{}, fmt.Errorf("EraseUser() - p.db.BeginTx(): %w", err)
+	}
+	defer tx.Rollback()
+
+	erasure := entity.Erasure{UserID: userID, ErasedAt: p.timeProvider.Now(), FilesCount: filesCount}
+
+	// delete the history first
+	res, err := tx.ExecContext(ctx, "DELETE FROM operations WHERE user_id=$1", userID)
+	if err != nil {
+		return entity.Erasure{}, fmt.Errorf("EraseUser() - tx.ExecContext(): %w", err)
+	}
+
+	operations, err := res.RowsAffected()
+	if err != nil {
+		return entity.Erasure{}, fmt.Errorf("EraseUser() - res.RowsAffected(): %w", err)
+	}
+	erasure.OperationsCount = int(operations)
+
+	// delete the memberships
+	res, err = tx.ExecContext(ctx, "DELETE FROM users_segments WHERE user_id=$1", userID)
+	if err != nil {
+		return entity.Erasure{}, fmt.Errorf("EraseUser() - tx.ExecContext(): %w", err)
+	}
+
+	memberships, err := res.RowsAffected()
+	if err != nil {
+		return entity.Erasure{}, fmt.Errorf("EraseUser() - res.RowsAffected(): %w", err)
+	}
+	erasure.MembershipsCount = int(memberships)
+
+	// leave the tombstone
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO erasures(user_id, erased_at, memberships_count, operations_count, files_count)
+		VALUES ($1, $2, $3, $4, $5)`,
+		erasure.UserID, erasure.ErasedAt, erasure.MembershipsCount, erasure.OperationsCount, erasure.FilesCount,
+	)
+	if err != nil {
+		return entity.Erasure{}, fmt.Errorf("EraseUser() - tx.ExecContext(): %w", err)
+	}
+
+	// commit changes
+	if err := tx.Commit(); err != nil {
+		return entity.Erasure{}, fmt.Errorf("EraseUser() - tx.Commit(): %w", err)
+	}
+
+	return erasure, nil
+}
+
+func (p *PostgresRepository) CreateExperiment(ctx context.Context, slug string, variants []entity.ExperimentVariant) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("CreateExperiment() - p.db.BeginTx(): %w", err)
+	}
+	defer tx.Rollback()
+
+	now := p.timeProvider.Now()
+
+	var experimentID int
+	row := tx.QueryRowContext(ctx,
+		"INSERT INTO experiments(slug, created_at) VALUES ($1, $2) ON CONFLICT (slug) DO NOTHING RETURNING id",
+		slug, now,
+	)
+	if err := row.Scan(&experimentID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) { // nothing was inserted
+			return repository.ErrExperimentAlreadyExists
+		}
+
+		return fmt.Errorf("CreateExperiment() - tx.QueryRowContext(): %w", err)
+	}
+
+	groupID, err := exclusionGroupID(ctx, tx, slug, now)
+	if err != nil {
+		return fmt.Errorf("CreateExperiment() - %w", err)
+	}
+
+	for _, variant := range variants {
+		// check if there is a segment under this slug, either current or an alias
+		var cnt int
+		row := tx.QueryRowContext(ctx,
+			"SELECT (SELECT COUNT(*) FROM segments WHERE slug=$1) + (SELECT COUNT(*) FROM segment_aliases WHERE slug=$1)",
+			variant.Slug,
+		)
+		if err := row.Scan(&cnt); err != nil {
+			return fmt.Errorf("CreateExperiment() - tx.QueryRowContext(): %w", err)
+		}
+
+		if cnt != 0 {
+			return repository.ErrSegmentAlreadyExists
+		}
+
+		// variants are plain segments in the exclusion group of the experiment
+		var segmentID int
+		row = tx.QueryRowContext(ctx,
+			"INSERT INTO segments(slug, created_at, exclusion_group_id) VALUES ($1, $2, $3) RETURNING id",
+			variant.Slug, now, groupID,
+		)
+		if err := row.Scan(&segmentID); err != nil {
+			if isUniqueViolation(err) { // created by a concurrent transaction after the check
+				return repository.ErrSegmentAlreadyExists
+			}
+
+			return fmt.Errorf("CreateExperiment() - tx.QueryRowContext(): %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO experiment_variants(experiment_id, segment_id, weight) VALUES ($1, $2, $3)",
+			experimentID, segmentID, variant.Weight,
+		)
+		if err != nil {
+			return fmt.Errorf("CreateExperiment() - tx.ExecContext(): %w", err)
+		}
+	}
+
+	// commit changes
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("CreateExperiment() - tx.Commit(): %w", err)
+	}
+
+	return nil
+}
+
+// queryExperiments returns experiments matching the condition (every one if it's empty) with their variants, oldest first.
+// The condition is applied to `experiments` table aliased as `e`
+func (p *PostgresRepository) queryExperiments(ctx context.Context, condition string, args ...any) ([]entity.Experiment, error) {
+	query := `SELECT e.slug, e.created_at, e.started_at, e.stopped_at, s.slug, v.weight
+		FROM experiments e
+		JOIN experiment_variants v ON v.experiment_id=e.id
+		JOIN segments s ON s.id=v.segment_id`
+	if condition != "" {
+		query += " WHERE " + condition
+	}
+	query += " ORDER BY e.id, v.id"
+
+	rows, err := p.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("queryExperiments() - p.db.QueryContext(): %w", err)
+	}
+	defer rows.Close()
+
+	experiments := make([]entity.Experiment, 0)
+	for rows.Next() {
+		var experiment entity.Experiment
+		var variant entity.ExperimentVariant
+		var startedAt, stoppedAt sql.NullTime
+		if err := rows.Scan(&experiment.Slug, &experiment.CreatedAt, &startedAt, &stoppedAt, &variant.Slug, &variant.Weight); err != nil {
+			return nil, fmt.Errorf("queryExperiments() - rows.Scan(): %w", err)
+		}
+
+		// rows of an experiment go one after another, the first one starts it
+		if len(experiments) == 0 || experiments[len(experiments)-1].Slug != experiment.Slug {
+			if startedAt.Valid {
+				experiment.StartedAt = &startedAt.Time
+			}
+
+			if stoppedAt.Valid {
+				experiment.StoppedAt = &stoppedAt.Time
+			}
+
+			experiments = append(experiments, experiment)
+		}
+
+		last := &experiments[len(experiments)-1]
+		last.Variants = append(last.Variants, variant)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("queryExperiments() - rows.Err(): %w", err)
+	}
+
+	return experiments, nil
+}
+
+func (p *PostgresRepository) GetExperiment(ctx context.Context, slug string) (entity.Experiment, error) {
+	experiments, err := p.queryExperiments(ctx, "e.slug=$1", slug)
+	if err != nil {
+		return entity.Experiment{}, fmt.Errorf("GetExperiment() - %w", err)
+	}
+
+	if len(experiments) == 0 {
+		return entity.Experiment{}, repository.ErrExperimentNotFound
+	}
+
+	return experiments[0], nil
+}
+
+func (p *PostgresRepository) GetAllExperiments(ctx context.Context) ([]entity.Experiment, error) {
+	experiments, err := p.queryExperiments(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("GetAllExperiments() - %w", err)
+	}
+
+	return experiments, nil
+}
+
+// setExperimentTime sets `column` of the experiment, `started_at` or `stopped_at`, to the current time
+// if `check` doesn't return an error for the current start and stop of the experiment.
+// The row is locked, so concurrent starts and stops are checked one after another
+func (p *PostgresRepository) setExperimentTime(ctx context.Context, slug string, column string, check func(startedAt sql.NullTime, stoppedAt sql.NullTime) error) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("setExperimentTime() - p.db.BeginTx(): %w", err)
+	}
+	defer tx.Rollback()
+
+	var id int
+	var startedAt, stoppedAt sql.NullTime
+	row := tx.QueryRowContext(ctx, "SELECT id, started_at, stopped_at FROM experiments WHERE slug=$1 FOR UPDATE", slug)
+	if err := row.Scan(&id, &startedAt, &stoppedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) { // experiment doesn't exist
+			return repository.ErrExperimentNotFound
+		}
+
+		return fmt.Errorf("setExperimentTime() - tx.QueryRowContext(): %w", err)
+	}
+
+	if err := check(startedAt, stoppedAt); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE experiments SET "+column+"=$2 WHERE id=$1", id, p.timeProvider.Now())
+	if err != nil {
+		return fmt.Errorf("setExperimentTime() - tx.ExecContext(): %w", err)
+	}
+
+	// commit changes
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("setExperimentTime() - tx.Commit(): %w", err)
+	}
+
+	return nil
+}
+
+func (p *PostgresRepository) StartExperiment(ctx context.Context, slug string) error {
+	return p.setExperimentTime(ctx, slug, "started_at", func(startedAt sql.NullTime, stoppedAt sql.NullTime) error {
+		if startedAt.Valid {
+			return repository.ErrExperimentAlreadyStarted
+		}
+
+		return nil
+	})
+}
+
+func (p *PostgresRepository) StopExperiment(ctx context.Context, slug string) error {
+	return p.setExperimentTime(ctx, slug, "stopped_at", func(startedAt sql.NullTime, stoppedAt sql.NullTime) error {
+		if !startedAt.Valid {
+			return repository.ErrExperimentNotStarted
+		}
+
+		if stoppedAt.Valid {
+			return repository.ErrExperimentAlreadyStopped
+		}
+
+		return nil
+	})
+}
+
+func (p *PostgresRepository) GetExperimentVariants(ctx context.Context) (map[string]string, error) {
+	rows, err := p.db.QueryContext(ctx,
+		`SELECT s.slug, e.slug
+		FROM experiment_variants v
+		JOIN segments s ON s.id=v.segment_id
+		JOIN experiments e ON e.id=v.experiment_id
+		WHERE s.deleted_at IS NULL`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("GetExperimentVariants() - p.db.QueryContext(): %w", err)
+	}
+	defer rows.Close()
+
+	variants := make(map[string]string)
+	for rows.Next() {
+		var slug, experiment string
+		if err := rows.Scan(&slug, &experiment); err != nil {
+			return nil, fmt.Errorf("GetExperimentVariants() - rows.Scan(): %w", err)
+		}
+
+		variants[slug] = experiment
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetExperimentVariants() - rows.Err(): %w", err)
+	}
+
+	return variants, nil
+}
+
+// segmentFilterConditions translates the filter to SQL conditions. Placeholders are numbered
+// after `args` and the returned slice contains `args` followed by the arguments of the conditions
+func segmentFilterConditions(filter entity.SegmentFilter, args []any) ([]string, []any, error) {
+	conditions := make([]string, 0)
+
+	if filter.Owner != "" {
+		args = append(args, filter.Owner)
+		conditions = append(conditions, fmt.Sprintf("owner = $%d", len(args)))
+	}
+
+	if filter.ExclusionGroup != "" {
+		args = append(args, filter.ExclusionGroup)
+		conditions = append(conditions, fmt.Sprintf("exclusion_group_id = (SELECT id FROM exclusion_groups WHERE name = $%d)", len(args)))
+	}
+
+	if filter.Bucketed {
+		conditions = append(conditions, "bucket_salt <> ''")
+	}
+
+	if len(filter.Tags) != 0 {
+		tags, err := json.Marshal(filter.Tags)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		args = append(args, tags)
+		conditions = append(conditions, fmt.Sprintf("tags @> $%d::JSONB", len(args)))
+	}
+
+	if len(filter.Attributes) != 0 {
+		attributes, err := json.Marshal(filter.Attributes)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// containment lets the GIN index narrow the rows down, but for nested values
+		// it is weaker than equality, so every attribute is compared as well
+		args = append(args, attributes)
+		conditions = append(conditions, fmt.Sprintf("attributes @> $%d::JSONB", len(args)))
+
+		keys := make([]string, 0, len(filter.Attributes))
+		for key := range filter.Attributes {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			value, err := json.Marshal(filter.Attributes[key])
+			if err != nil {
+				return nil, nil, err
+			}
+
+			args = append(args, key, value)
+			conditions = append(conditions, fmt.Sprintf("attributes -> $%d = $%d::JSONB", len(args)-1, len(args)))
+		}
+	}
+
+	if filter.OnlyActive {
+		conditions = append(conditions, "deleted_at IS NULL")
+	}
+
+	if filter.Slug != "" {
+		args = append(args, filter.Slug)
+		conditions = append(conditions, fmt.Sprintf("(slug = $%[1]d OR id = (SELECT segment_id FROM segment_aliases WHERE slug = $%[1]d))", len(args)))
+	}
+
+	if filter.SlugPrefix != "" {
+		args = append(args, filter.SlugPrefix)
+		conditions = append(conditions, fmt.Sprintf("starts_with(slug, $%d)", len(args)))
+	}
+
+	if filter.SlugContains != "" {
+		args = append(args, filter.SlugContains)
+		conditions = append(conditions, fmt.Sprintf("strpos(slug, $%d) > 0", len(args)))
+	}
+
+	timeRanges := []struct {
+		column string
+		bound  *time.Time
+		op     string
+	}{
+		{"created_at", filter.CreatedFrom, ">="},
+		{"created_at", filter.CreatedTo, "<"},
+		{"deleted_at", filter.DeletedFrom, ">="},
+		{"deleted_at", filter.DeletedTo, "<"},
+	}
+	for _, r := range timeRanges {
+		if r.bound == nil {
+			continue
+		}
+
+		args = append(args, *r.bound)
+		conditions = append(conditions, fmt.Sprintf("%s %s $%d", r.column, r.op, len(args)))
+	}
+
+	return conditions, args, nil
+}
+
+// getSegments returns a page of segments matching the filter
+func (p *PostgresRepository) getSegments(ctx context.Context, filter entity.SegmentFilter, page entity.SegmentPageRequest) (entity.SegmentPage, error) {
+	conditions, args, err := segmentFilterConditions(filter, nil)
+	if err != nil {
+		return entity.SegmentPage{}, fmt.Errorf("segmentFilterConditions(): %w", err)
+	}
+
+	var sortColumn string
+	switch repository.SortBy(page) {
+	case entity.SortByCreatedAt:
+		sortColumn = "created_at"
+	case entity.SortBySlug:
+		sortColumn = "slug"
+	default:
+		return entity.SegmentPage{}, fmt.Errorf("unknown sort field %q", page.SortBy)
+	}
+
+	direction, comparison := "ASC", ">"
+	if page.Descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	// keyset pagination: continue right after the last segment of the previous page
+	cursor, err := repository.DecodeSegmentCursor(page)
+	if err != nil {
+		return entity.SegmentPage{}, err
+	}
+
+	if cursor != nil {
+		var value any = cursor.CreatedAt
+		if sortColumn == "slug" {
+			value = cursor.Slug
+		}
+
+		args = append(args, value, cursor.ID)
+		conditions = append(conditions, fmt.Sprintf("(%s, id) %s ($%d, $%d)", sortColumn, comparison, len(args)-1, len(args)))
+	}
+
+	query := `SELECT id, slug, description, owner, tags, attributes, default_ttl,
+		COALESCE((SELECT p.slug FROM segments p WHERE p.id=segments.parent_id), ''), expression, rule, ` + exclusionGroupNameColumn + `, bucket_salt, bucket_percent, created_at, deleted_at,
+		(SELECT COALESCE(json_agg(a.slug ORDER BY a.id), '[]') FROM segment_aliases a WHERE a.segment_id=segments.id)`
+	if page.WithMemberCounts {
+		args = append(args, p.timeProvider.Now())
+		query += fmt.Sprintf(`,
+		(SELECT COUNT(DISTINCT us.user_id) FROM users_segments us
+			WHERE us.segment_id=segments.id
+			AND us.added_at <= $%[1]d
+			AND us.removed_at IS NULL
+			AND (us.expires_at IS NULL OR us.expires_at > $%[1]d))`, len(args))
+	}
+	query += " FROM segments"
+	if len(conditions) != 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY %s %s, id %s", sortColumn, direction, direction)
+
+	// one more row tells if there is the next page
+	if page.Limit > 0 {
+		args = append(args, page.Limit+1)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := p.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return entity.SegmentPage{}, fmt.Errorf("p.db.QueryContext(): %w", err)
+	}
+	defer rows.Close()
+
+	segments := make([]entity.Segment, 0, 30)
+	ids := make([]int, 0, 30)
+	for rows.Next() {
+		var segment entity.Segment
+		var id int
+		var tags, attributes, aliases []byte
+		var deletedAt sql.NullTime
+		var memberCount int
+		dest := []any{&id, &segment.Slug, &segment.Description, &segment.Owner, &tags, &attributes, &segment.DefaultTTL, &segment.Parent, &segment.Expression, &segment.Rule, &segment.ExclusionGroup, &segment.BucketSalt, &segment.BucketPercent, &segment.CreatedAt, &deletedAt, &aliases}
+		if page.WithMemberCounts {
+			dest = append(dest, &memberCount)
+		}
+
+		if err := rows.Scan(dest...); err != nil {
+			return entity.SegmentPage{}, fmt.Errorf("rows.Scan(): %w", err)
+		}
+
+		if err := repository.UnmarshalMetadata(tags, attributes, &segment.SegmentMetadata); err != nil {
+			return entity.SegmentPage{}, fmt.Errorf("repository.UnmarshalMetadata(): %w", err)
+		}
+
+		if err := json.Unmarshal(aliases, &segment.Aliases); err != nil {
+			return entity.SegmentPage{}, fmt.Errorf("json.Unmarshal(): %w", err)
+		}
+
+		if len(segment.Aliases) == 0 {
+			segment.Aliases = nil
+		}
+
+		if deletedAt.Valid {
+			segment.DeletedAt = &deletedAt.Time
+		}
+
+		if page.WithMemberCounts {
+			segment.MemberCount = &memberCount
 		}
 
 		segments = append(segments, segment)
+		ids = append(ids, id)
+	}
+
+	if err := rows.Err(); err != nil {
+		return entity.SegmentPage{}, fmt.Errorf("rows.Err(): %w", err)
+	}
+
+	result := entity.SegmentPage{Segments: segments}
+	if page.Limit > 0 && len(segments) > page.Limit {
+		result.Segments = segments[:page.Limit]
+		result.NextCursor, err = repository.EncodeSegmentCursor(page, segments[page.Limit-1], ids[page.Limit-1])
+		if err != nil {
+			return entity.SegmentPage{}, fmt.Errorf("repository.EncodeSegmentCursor(): %w", err)
+		}
+	}
+
+	return result, nil
+}
+
+func (p *PostgresRepository) ListSegments(ctx context.Context, filter entity.SegmentFilter, page entity.SegmentPageRequest) (entity.SegmentPage, error) {
+	result, err := p.getSegments(ctx, filter, page)
+	if err != nil {
+		if errors.Is(err, repository.ErrInvalidCursor) {
+			return entity.SegmentPage{}, err
+		}
+
+		return entity.SegmentPage{}, fmt.Errorf("ListSegments() - %w", err)
+	}
+
+	return result, nil
+}
+
+func (p *PostgresRepository) GetAllActiveSegments(ctx context.Context, filter entity.SegmentFilter) ([]entity.Segment, error) {
+	filter.OnlyActive = true
+	result, err := p.getSegments(ctx, filter, entity.SegmentPageRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("GetAllActiveSegments() - %w", err)
+	}
+
+	return result.Segments, nil
+}
+
+func (p *PostgresRepository) GetAllSegments(ctx context.Context, filter entity.SegmentFilter) ([]entity.Segment, error) {
+	result, err := p.getSegments(ctx, filter, entity.SegmentPageRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("GetAllSegments() - %w", err)
 	}
 
-	return segments, nil
+	return result.Segments, nil
 }
 
 func New(postgresURL string, timeProvider timeprovider.TimeProvider) (*PostgresRepository, error) {
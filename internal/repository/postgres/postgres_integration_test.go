@@ -0,0 +1,75 @@
+//go:build integration
+
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/repository"
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/repository/repotest"
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/timeprovider"
+)
+
+// postgresTestURLEnv names the environment variable with the URL of the database the conformance suite runs against.
+// Every table of the database is emptied before and after each test
+const postgresTestURLEnv = "POSTGRES_TEST_URL"
+
+// truncateTables empties every table except the one of the migrations and restarts the sequences
+func truncateTables(t *testing.T, db *sql.DB) {
+	rows, err := db.Query("SELECT tablename FROM pg_tables WHERE schemaname=current_schema() AND tablename<>'schema_migrations'")
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when listing tables of the test database", err)
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			t.Fatalf("an error '%s' was not expected when listing tables of the test database", err)
+		}
+
+		tables = append(tables, fmt.Sprintf("%q", table))
+	}
+
+	if err := rows.Err(); err != nil {
+		t.Fatalf("an error '%s' was not expected when listing tables of the test database", err)
+	}
+
+	if _, err := db.Exec("TRUNCATE " + strings.Join(tables, ", ") + " RESTART IDENTITY CASCADE"); err != nil {
+		t.Fatalf("an error '%s' was not expected when truncating the test database", err)
+	}
+}
+
+// newTestRepository connects to the test database, brings it up to date and empties it
+func newTestRepository(t *testing.T, timeProvider timeprovider.TimeProvider) *PostgresRepository {
+	url := os.Getenv(postgresTestURLEnv)
+	if url == "" {
+		t.Skipf("%s is not set", postgresTestURLEnv)
+	}
+
+	repo, err := New(url, timeProvider)
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when connecting to the test database", err)
+	}
+	t.Cleanup(func() { repo.db.Close() })
+
+	if err := repo.Migrate("file://../../../migrations/postgres"); err != nil {
+		t.Fatalf("an error '%s' was not expected when migrating the test database", err)
+	}
+
+	truncateTables(t, repo.db)
+	t.Cleanup(func() { truncateTables(t, repo.db) })
+
+	return repo
+}
+
+func TestRepository(t *testing.T) {
+	repotest.Run(t, func(t *testing.T, timeProvider timeprovider.TimeProvider) repository.Repository {
+		return newTestRepository(t, timeProvider)
+	})
+}
@@ -1,7 +1,10 @@
 package postgres
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"reflect"
 	"testing"
 	"time"
 
@@ -9,6 +12,7 @@ import (
 	"github.com/QiZD90/dynamic-customer-segmentation/internal/entity"
 	"github.com/QiZD90/dynamic-customer-segmentation/internal/repository"
 	"github.com/QiZD90/dynamic-customer-segmentation/internal/timeprovider/fixedtimeprovider"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -17,6 +21,7 @@ func TestCreateSegment(t *testing.T) {
 		name         string
 		expectations func(mock sqlmock.Sqlmock)
 		slug         string
+		metadata     entity.SegmentMetadata
 		expectError  error
 	}{
 		{
@@ -29,11 +34,12 @@ func TestCreateSegment(t *testing.T) {
 					WillReturnRows(sqlmock.NewRows([]string{""}).AddRow(0))
 				mock.
 					ExpectExec("INSERT INTO segments").
-					WithArgs("AVITO_NEW_SEGMENT").
+					WithArgs("AVITO_NEW_SEGMENT", time.Time{}.Add(3*time.Hour), "Test segment", "", []byte(`["test"]`), []byte(`{}`), "P30D", sql.NullInt64{}, "", "", sql.NullInt64{}, "", 0).
 					WillReturnResult(sqlmock.NewResult(1, 1))
 				mock.ExpectCommit()
 			},
 			slug:        "AVITO_NEW_SEGMENT",
+			metadata:    entity.SegmentMetadata{Description: "Test segment", Tags: []string{"test"}, DefaultTTL: "P30D"},
 			expectError: nil,
 		},
 
@@ -50,6 +56,24 @@ func TestCreateSegment(t *testing.T) {
 			slug:        "AVITO_NEW_SEGMENT",
 			expectError: repository.ErrSegmentAlreadyExists,
 		},
+
+		{
+			name: "segment created concurrently",
+			expectations: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.
+					ExpectQuery(`SELECT COUNT(.+) FROM segments`).
+					WithArgs("AVITO_NEW_SEGMENT").
+					WillReturnRows(sqlmock.NewRows([]string{""}).AddRow(0))
+				mock.
+					ExpectExec("INSERT INTO segments").
+					WithArgs("AVITO_NEW_SEGMENT", time.Time{}.Add(3*time.Hour), "", "", []byte(`[]`), []byte(`{}`), "", sql.NullInt64{}, "", "", sql.NullInt64{}, "", 0).
+					WillReturnError(&pgconn.PgError{Code: uniqueViolationCode})
+				mock.ExpectRollback()
+			},
+			slug:        "AVITO_NEW_SEGMENT",
+			expectError: repository.ErrSegmentAlreadyExists,
+		},
 	}
 
 	for _, tt := range testCases {
@@ -67,7 +91,85 @@ func TestCreateSegment(t *testing.T) {
 		tt.expectations(mock)
 
 		// Execute the method
-		err = repo.CreateSegment(tt.slug)
+		err = repo.CreateSegment(context.Background(), tt.slug, tt.metadata)
+		if err != tt.expectError {
+			t.Errorf("wanted error: %s; got error: %s", tt.expectError, err)
+		}
+
+		// we make sure that all expectations were met
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	}
+}
+
+func TestUpdateUserSegmentsRemove(t *testing.T) {
+	testCases := []struct {
+		name         string
+		expectations func(mock sqlmock.Sqlmock)
+		userID       int
+		remove       []entity.SegmentExpiration
+		expectError  error
+	}{
+		{
+			name: "removes only the active membership",
+			expectations: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.
+					ExpectQuery(`SELECT id, slug, deleted_at, (.+) FROM segments`).
+					WithArgs("AVITO_VOICE_MESSAGES").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "slug", "deleted_at", "composite", "dynamic", "bucketed"}).AddRow(1, "AVITO_VOICE_MESSAGES", nil, false, false, false))
+				mock.
+					ExpectQuery(`UPDATE users_segments SET removed_at=GREATEST\(added_at, \$3\) WHERE user_id=\$1 AND segment_id=\$2 AND removed_at IS NULL AND \(expires_at IS NULL OR expires_at > \$3\)`).
+					WithArgs(1000, 1, time.Time{}.Add(3*time.Hour)).
+					WillReturnRows(sqlmock.NewRows([]string{"removed_at", "expires_at"}).AddRow(time.Time{}.Add(3*time.Hour), nil))
+				mock.
+					ExpectExec(`INSERT INTO operations`).
+					WithArgs(1000, 1, entity.RemovedOperationType, time.Time{}.Add(3*time.Hour), sql.NullTime{}).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			},
+			userID:      1000,
+			remove:      []entity.SegmentExpiration{{Slug: "AVITO_VOICE_MESSAGES"}},
+			expectError: nil,
+		},
+
+		{
+			name: "user doesn't have the segment",
+			expectations: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.
+					ExpectQuery(`SELECT id, slug, deleted_at, (.+) FROM segments`).
+					WithArgs("AVITO_VOICE_MESSAGES").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "slug", "deleted_at", "composite", "dynamic", "bucketed"}).AddRow(1, "AVITO_VOICE_MESSAGES", nil, false, false, false))
+				mock.
+					ExpectQuery(`UPDATE users_segments SET removed_at=GREATEST\(added_at, \$3\) WHERE user_id=\$1 AND segment_id=\$2 AND removed_at IS NULL AND \(expires_at IS NULL OR expires_at > \$3\)`).
+					WithArgs(1000, 1, time.Time{}.Add(3*time.Hour)).
+					WillReturnRows(sqlmock.NewRows([]string{"removed_at", "expires_at"}))
+				mock.ExpectCommit()
+			},
+			userID:      1000,
+			remove:      []entity.SegmentExpiration{{Slug: "AVITO_VOICE_MESSAGES"}},
+			expectError: nil,
+		},
+	}
+
+	for _, tt := range testCases {
+		// Open stub DB connection
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		// Create a mock repository
+		repo := &PostgresRepository{db, fixedtimeprovider.New(time.Time{}.Add(3 * time.Hour))}
+
+		// Build the expectations
+		tt.expectations(mock)
+
+		// Execute the method
+		_, err = repo.UpdateUserSegments(context.Background(), tt.userID, nil, tt.remove)
 		if err != tt.expectError {
 			t.Errorf("wanted error: %s; got error: %s", tt.expectError, err)
 		}
@@ -80,9 +182,12 @@ func TestCreateSegment(t *testing.T) {
 }
 
 func TestGetAllSegments(t *testing.T) {
+	columns := []string{"id", "slug", "description", "owner", "tags", "attributes", "default_ttl", "parent", "expression", "rule", "exclusion_group", "bucket_salt", "bucket_percent", "created_at", "deleted_at", "aliases"}
+
 	testCases := []struct {
 		name         string
 		expectations func(mock sqlmock.Sqlmock)
+		filter       entity.SegmentFilter
 		expectResult []entity.Segment
 		expectError  error
 	}{
@@ -90,25 +195,59 @@ func TestGetAllSegments(t *testing.T) {
 			name: "basic usage",
 			expectations: func(mock sqlmock.Sqlmock) {
 				mock.
-					ExpectQuery(`SELECT slug, created_at, deleted_at FROM segments`).
+					ExpectQuery(`SELECT id, slug, description, owner, tags, attributes, default_ttl, .+, created_at, deleted_at, .+ FROM segments ORDER BY created_at ASC, id ASC`).
 					WillReturnRows(sqlmock.
-						NewRows([]string{"slug", "created_at", "deleted_at"}).
-						AddRow("AVITO_TEST_SEGMENT", time.Time{}, sql.NullTime{}).
-						AddRow("AVITO_DELETED_SEGMENT", time.Time{}, sql.NullTime{Valid: true}),
+						NewRows(columns).
+						AddRow(1, "AVITO_TEST_SEGMENT", "Test segment", "growth", []byte(`["test"]`), []byte(`{"priority": 1}`), "P30D", "AVITO_PARENT_SEGMENT", "", "", "", "", 0, time.Time{}, sql.NullTime{}, []byte(`["AVITO_OLD_SEGMENT"]`)).
+						AddRow(2, "AVITO_DELETED_SEGMENT", "", "", []byte(`[]`), []byte(`{}`), "", "", "AVITO_A AND NOT AVITO_B", "", "", "", 0, time.Time{}, sql.NullTime{Valid: true}, []byte(`[]`)),
 					)
 			},
 			expectResult: []entity.Segment{
-				{Slug: "AVITO_TEST_SEGMENT", CreatedAt: time.Time{}, DeletedAt: nil},
-				{Slug: "AVITO_DELETED_SEGMENT", CreatedAt: time.Time{}, DeletedAt: &time.Time{}},
+				{
+					Slug:    "AVITO_TEST_SEGMENT",
+					Aliases: []string{"AVITO_OLD_SEGMENT"},
+					SegmentMetadata: entity.SegmentMetadata{
+						Description: "Test segment",
+						Owner:       "growth",
+						Tags:        []string{"test"},
+						Attributes:  map[string]any{"priority": float64(1)},
+						DefaultTTL:  "P30D",
+						Parent:      "AVITO_PARENT_SEGMENT",
+					},
+					CreatedAt: time.Time{},
+					DeletedAt: nil,
+				},
+				{
+					Slug:            "AVITO_DELETED_SEGMENT",
+					SegmentMetadata: entity.SegmentMetadata{Expression: "AVITO_A AND NOT AVITO_B"},
+					CreatedAt:       time.Time{},
+					DeletedAt:       &time.Time{},
+				},
 			},
 			expectError: nil,
 		},
+		{
+			name: "filter",
+			expectations: func(mock sqlmock.Sqlmock) {
+				mock.
+					ExpectQuery(`SELECT .+ FROM segments WHERE owner = \$1 AND tags @> \$2::JSONB AND attributes @> \$3::JSONB AND attributes -> \$4 = \$5::JSONB ORDER BY created_at ASC, id ASC`).
+					WithArgs("growth", []byte(`["test"]`), []byte(`{"priority":1}`), "priority", []byte(`1`)).
+					WillReturnRows(sqlmock.NewRows(columns))
+			},
+			filter: entity.SegmentFilter{
+				Owner:      "growth",
+				Tags:       []string{"test"},
+				Attributes: map[string]any{"priority": 1},
+			},
+			expectResult: []entity.Segment{},
+			expectError:  nil,
+		},
 		{
 			name: "no rows",
 			expectations: func(mock sqlmock.Sqlmock) {
 				mock.
-					ExpectQuery(`SELECT slug, created_at, deleted_at FROM segments`).
-					WillReturnRows(sqlmock.NewRows([]string{"slug", "created_at", "deleted_at"}))
+					ExpectQuery(`SELECT id, slug, description, owner, tags, attributes, default_ttl, .+, created_at, deleted_at, .+ FROM segments`).
+					WillReturnRows(sqlmock.NewRows(columns))
 			},
 			expectResult: []entity.Segment{},
 			expectError:  nil,
@@ -130,21 +269,23 @@ func TestGetAllSegments(t *testing.T) {
 		tt.expectations(mock)
 
 		// Execute the method
-		segments, err := repo.GetAllSegments()
+		segments, err := repo.GetAllSegments(context.Background(), tt.filter)
 		if err != tt.expectError {
-			t.Errorf("wanted error: %s; got error: %s", tt.expectError, err)
+			t.Errorf("%s: wanted error: %s; got error: %s", tt.name, tt.expectError, err)
 		}
 
-		assert.Equal(t, segments, tt.expectResult)
+		assert.Equal(t, segments, tt.expectResult, tt.name)
 
 		// we make sure that all expectations were met
 		if err := mock.ExpectationsWereMet(); err != nil {
-			t.Errorf("there were unfulfilled expectations: %s", err)
+			t.Errorf("%s: there were unfulfilled expectations: %s", tt.name, err)
 		}
 	}
 }
 
 func TestDumpHistory(t *testing.T) {
+	expiresAt := time.Time{}.Add(2 * time.Hour)
+
 	testCases := []struct {
 		name         string
 		expectations func(mock sqlmock.Sqlmock)
@@ -155,18 +296,19 @@ func TestDumpHistory(t *testing.T) {
 			name: "basic usage",
 			expectations: func(mock sqlmock.Sqlmock) {
 				mock.
-					ExpectQuery(`SELECT .+`).
-					WithArgs(1000).
+					ExpectQuery(`SELECT .+ FROM operations .+ UNION ALL .+ FROM users_segments`).
+					WithArgs(1000, time.Time{}, time.Time{}.Add(24*time.Hour), time.Time{}.Add(3*time.Hour), entity.ExpiredOperationType).
 					WillReturnRows(sqlmock.
-						NewRows([]string{"slug", "user_id", "added_at", "removed_at", "expires_at"}).
-						AddRow("AVITO_TEST_SEGMENT", 1000, time.Time{}, sql.NullTime{}, sql.NullTime{}).
-						AddRow("AVITO_DELETED_SEGMENT", 1000, time.Time{}.Add(time.Minute), sql.NullTime{Valid: true, Time: time.Time{}.Add(time.Hour)}, sql.NullTime{}),
+						NewRows([]string{"slug", "type", "time", "expires_at"}).
+						AddRow("AVITO_TEST_SEGMENT", "added", time.Time{}, sql.NullTime{}).
+						AddRow("AVITO_DELETED_SEGMENT", "added", time.Time{}.Add(time.Minute), sql.NullTime{Valid: true, Time: time.Time{}.Add(2 * time.Hour)}).
+						AddRow("AVITO_DELETED_SEGMENT", "segment_deleted", time.Time{}.Add(time.Hour), sql.NullTime{Valid: true, Time: time.Time{}.Add(2 * time.Hour)}),
 					)
 			},
 			expectResult: []entity.Operation{
 				{UserID: 1000, SegmentSlug: "AVITO_TEST_SEGMENT", Type: entity.AddedOperationType, Time: time.Time{}},
-				{UserID: 1000, SegmentSlug: "AVITO_DELETED_SEGMENT", Type: entity.AddedOperationType, Time: time.Time{}.Add(time.Minute)},
-				{UserID: 1000, SegmentSlug: "AVITO_DELETED_SEGMENT", Type: entity.RemovedOperationType, Time: time.Time{}.Add(time.Hour)},
+				{UserID: 1000, SegmentSlug: "AVITO_DELETED_SEGMENT", Type: entity.AddedOperationType, Time: time.Time{}.Add(time.Minute), ExpiresAt: &expiresAt},
+				{UserID: 1000, SegmentSlug: "AVITO_DELETED_SEGMENT", Type: entity.SegmentDeletedOperationType, Time: time.Time{}.Add(time.Hour), ExpiresAt: &expiresAt},
 			},
 			expectError: nil,
 		},
@@ -175,8 +317,8 @@ func TestDumpHistory(t *testing.T) {
 			expectations: func(mock sqlmock.Sqlmock) {
 				mock.
 					ExpectQuery(`SELECT .+`).
-					WithArgs(1000).
-					WillReturnRows(sqlmock.NewRows([]string{"slug", "user_id", "added_at", "removed_at", "expires_at"}))
+					WithArgs(1000, time.Time{}, time.Time{}.Add(24*time.Hour), time.Time{}.Add(3*time.Hour), entity.ExpiredOperationType).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "type", "time", "expires_at"}))
 			},
 			expectResult: []entity.Operation{},
 			expectError:  nil,
@@ -198,7 +340,7 @@ func TestDumpHistory(t *testing.T) {
 		tt.expectations(mock)
 
 		// Execute the method
-		operations, err := repo.DumpHistory(1000, time.Time{}, time.Time{}.Add(24*time.Hour))
+		operations, err := repo.DumpHistory(context.Background(), 1000, time.Time{}, time.Time{}.Add(24*time.Hour))
 		if err != tt.expectError {
 			t.Errorf("wanted error: %s; got error: %s", tt.expectError, err)
 		}
@@ -211,3 +353,519 @@ func TestDumpHistory(t *testing.T) {
 		}
 	}
 }
+
+func TestGetActiveUserSegments(t *testing.T) {
+	columns := []string{"slug", "added_at", "expires_at"}
+	expiresAt := time.Time{}.Add(5 * time.Hour)
+
+	testCases := []struct {
+		name         string
+		expectations func(mock sqlmock.Sqlmock)
+		expectResult []entity.UserSegment
+		expectError  bool
+	}{
+		{
+			name: "basic usage",
+			expectations: func(mock sqlmock.Sqlmock) {
+				mock.
+					ExpectQuery(`SELECT .+ FROM users_segments`).
+					WithArgs(1000, time.Time{}.Add(3*time.Hour)).
+					WillReturnRows(sqlmock.
+						NewRows(columns).
+						AddRow("AVITO_TEST_SEGMENT", time.Time{}, sql.NullTime{}).
+						AddRow("AVITO_VOICE_MESSAGES", time.Time{}.Add(time.Hour), sql.NullTime{Valid: true, Time: expiresAt}),
+					)
+			},
+			expectResult: []entity.UserSegment{
+				{Slug: "AVITO_TEST_SEGMENT", AddedAt: time.Time{}},
+				{Slug: "AVITO_VOICE_MESSAGES", AddedAt: time.Time{}.Add(time.Hour), ExpiresAt: &expiresAt},
+			},
+			expectError: false,
+		},
+		{
+			name: "scan error",
+			expectations: func(mock sqlmock.Sqlmock) {
+				mock.
+					ExpectQuery(`SELECT .+ FROM users_segments`).
+					WithArgs(1000, time.Time{}.Add(3*time.Hour)).
+					WillReturnRows(sqlmock.
+						NewRows(columns).
+						AddRow("AVITO_TEST_SEGMENT", "not a time", sql.NullTime{}),
+					)
+			},
+			expectResult: nil,
+			expectError:  true,
+		},
+		{
+			name: "row error",
+			expectations: func(mock sqlmock.Sqlmock) {
+				mock.
+					ExpectQuery(`SELECT .+ FROM users_segments`).
+					WithArgs(1000, time.Time{}.Add(3*time.Hour)).
+					WillReturnRows(sqlmock.
+						NewRows(columns).
+						AddRow("AVITO_TEST_SEGMENT", time.Time{}, sql.NullTime{}).
+						RowError(0, driver.ErrBadConn),
+					)
+			},
+			expectResult: nil,
+			expectError:  true,
+		},
+	}
+
+	for _, tt := range testCases {
+		// Open stub DB connection
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		// Create a mock repository
+		repo := &PostgresRepository{db, fixedtimeprovider.New(time.Time{}.Add(3 * time.Hour))}
+
+		// Build the expectations
+		tt.expectations(mock)
+
+		// Execute the method
+		userSegments, err := repo.GetActiveUserSegments(context.Background(), 1000)
+		if (err != nil) != tt.expectError {
+			t.Errorf("%s: wanted error: %t; got error: %s", tt.name, tt.expectError, err)
+		}
+
+		assert.Equal(t, tt.expectResult, userSegments)
+
+		// we make sure that all expectations were met
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	}
+}
+
+func TestListSegments(t *testing.T) {
+	// Open stub DB connection
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	// Create a mock repository
+	repo := &PostgresRepository{db, fixedtimeprovider.New(time.Time{}.Add(3 * time.Hour))}
+
+	page := entity.SegmentPageRequest{SortBy: entity.SortBySlug, Descending: true, Limit: 1}
+	cursor, err := repository.EncodeSegmentCursor(page, entity.Segment{Slug: "AVITO_C"}, 3)
+	assert.NoError(t, err)
+	page.Cursor = cursor
+
+	// Build the expectations
+	columns := []string{"id", "slug", "description", "owner", "tags", "attributes", "default_ttl", "parent", "expression", "rule", "exclusion_group", "bucket_salt", "bucket_percent", "created_at", "deleted_at", "aliases"}
+	mock.
+		ExpectQuery(`SELECT .+ FROM segments WHERE deleted_at IS NULL AND starts_with\(slug, \$1\) AND \(slug, id\) < \(\$2, \$3\) ORDER BY slug DESC, id DESC LIMIT \$4`).
+		WithArgs("AVITO", "AVITO_C", 3, 2).
+		WillReturnRows(sqlmock.
+			NewRows(columns).
+			AddRow(2, "AVITO_B", "", "", []byte(`[]`), []byte(`{}`), "", "", "", "", "", "", 0, time.Time{}, sql.NullTime{}, []byte(`[]`)).
+			AddRow(1, "AVITO_A", "", "", []byte(`[]`), []byte(`{}`), "", "", "", "", "", "", 0, time.Time{}, sql.NullTime{}, []byte(`[]`)),
+		)
+
+	// Execute the method
+	result, err := repo.ListSegments(context.Background(), entity.SegmentFilter{OnlyActive: true, SlugPrefix: "AVITO"}, page)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Segment{{Slug: "AVITO_B"}}, result.Segments)
+
+	// the next page starts after the last returned segment
+	var next repository.SegmentCursor
+	assert.NoError(t, repository.DecodeCursor(result.NextCursor, &next))
+	assert.Equal(t, "AVITO_B", next.Slug)
+	assert.Equal(t, 2, next.ID)
+
+	// we make sure that all expectations were met
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetSegmentStats(t *testing.T) {
+	now := time.Time{}.Add(50 * time.Hour)
+	from := time.Time{}
+	to := time.Time{}.Add(72 * time.Hour)
+
+	testCases := []struct {
+		name         string
+		expectations func(mock sqlmock.Sqlmock)
+		expectResult entity.SegmentStats
+		expectError  error
+	}{
+		{
+			name: "basic usage",
+			expectations: func(mock sqlmock.Sqlmock) {
+				mock.
+					ExpectQuery(`SELECT id, slug FROM segments WHERE`).
+					WithArgs("AVITO_TEST_SEGMENT").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "slug"}).AddRow(1, "AVITO_TEST_SEGMENT"))
+				mock.
+					ExpectQuery(`SELECT COUNT\(DISTINCT user_id\) FROM users_segments`).
+					WithArgs(1, now).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+				mock.
+					ExpectQuery(`SELECT day, type, COUNT\(\*\) FROM .+ FROM operations .+ UNION ALL .+ FROM users_segments .+ GROUP BY day, type`).
+					WithArgs(1, from, to, now, entity.ExpiredOperationType).
+					WillReturnRows(sqlmock.
+						NewRows([]string{"day", "type", "count"}).
+						AddRow(from, "added", 3).
+						AddRow(from.Add(24*time.Hour), "removed", 1).
+						AddRow(from.Add(24*time.Hour), "segment_deleted", 1).
+						AddRow(from.Add(48*time.Hour), "expired", 1),
+					)
+			},
+			expectResult: entity.SegmentStats{
+				Slug:        "AVITO_TEST_SEGMENT",
+				ActiveCount: 2,
+				From:        from,
+				To:          to,
+				Days: []entity.SegmentDayStats{
+					{Date: from, Added: 3},
+					{Date: from.Add(24 * time.Hour), Removed: 2},
+					{Date: from.Add(48 * time.Hour), Expired: 1},
+				},
+			},
+			expectError: nil,
+		},
+		{
+			name: "segment doesn't exist",
+			expectations: func(mock sqlmock.Sqlmock) {
+				mock.
+					ExpectQuery(`SELECT id, slug FROM segments WHERE`).
+					WithArgs("AVITO_TEST_SEGMENT").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "slug"}))
+			},
+			expectResult: entity.SegmentStats{},
+			expectError:  repository.ErrSegmentNotFound,
+		},
+	}
+
+	for _, tt := range testCases {
+		// Open stub DB connection
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		// Create a mock repository
+		repo := &PostgresRepository{db, fixedtimeprovider.New(now)}
+
+		// Build the expectations
+		tt.expectations(mock)
+
+		// Execute the method
+		stats, err := repo.GetSegmentStats(context.Background(), "AVITO_TEST_SEGMENT", from, to)
+		if err != tt.expectError {
+			t.Errorf("%s: wanted error: %s; got error: %s", tt.name, tt.expectError, err)
+		}
+
+		assert.Equal(t, tt.expectResult, stats, tt.name)
+
+		// we make sure that all expectations were met
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: there were unfulfilled expectations: %s", tt.name, err)
+		}
+	}
+}
+
+func TestExpireMemberships(t *testing.T) {
+	now := time.Time{}.Add(50 * time.Hour)
+	expiresAt := time.Time{}.Add(49 * time.Hour)
+
+	testCases := []struct {
+		name         string
+		expectations func(mock sqlmock.Sqlmock)
+		expectResult []entity.Operation
+		expectError  error
+	}{
+		{
+			name: "basic usage",
+			expectations: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.
+					ExpectQuery(`SELECT pg_try_advisory_xact_lock\(\$1\)`).
+					WithArgs(expirationSweepLockKey).
+					WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+				mock.
+					ExpectQuery(`WITH expired AS .+ FOR UPDATE SKIP LOCKED .+ INSERT INTO operations`).
+					WithArgs(now, 10, entity.ExpiredOperationType).
+					WillReturnRows(sqlmock.
+						NewRows([]string{"user_id", "slug", "time"}).
+						AddRow(1000, "AVITO_TEST_SEGMENT", expiresAt),
+					)
+				mock.ExpectCommit()
+			},
+			expectResult: []entity.Operation{
+				{UserID: 1000, SegmentSlug: "AVITO_TEST_SEGMENT", Type: entity.ExpiredOperationType, Time: expiresAt, ExpiresAt: &expiresAt},
+			},
+			expectError: nil,
+		},
+		{
+			name: "another replica is sweeping",
+			expectations: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.
+					ExpectQuery(`SELECT pg_try_advisory_xact_lock\(\$1\)`).
+					WithArgs(expirationSweepLockKey).
+					WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(false))
+				mock.ExpectRollback()
+			},
+			expectResult: nil,
+			expectError:  nil,
+		},
+	}
+
+	for _, tt := range testCases {
+		// Open stub DB connection
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		// Create a mock repository
+		repo := &PostgresRepository{db, fixedtimeprovider.New(now)}
+
+		// Build the expectations
+		tt.expectations(mock)
+
+		// Execute the method
+		operations, err := repo.ExpireMemberships(context.Background(), 10)
+		if err != tt.expectError {
+			t.Errorf("%s: wanted error: %s; got error: %s", tt.name, tt.expectError, err)
+		}
+
+		assert.Equal(t, tt.expectResult, operations, tt.name)
+
+		// we make sure that all expectations were met
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: there were unfulfilled expectations: %s", tt.name, err)
+		}
+	}
+}
+
+// arrayConverter passes slices through as they are, pgx encodes them as arrays
+type arrayConverter struct{}
+
+func (arrayConverter) ConvertValue(v any) (driver.Value, error) {
+	if v != nil && reflect.TypeOf(v).Kind() == reflect.Slice {
+		return v, nil
+	}
+
+	return driver.DefaultParameterConverter.ConvertValue(v)
+}
+
+func TestDeleteSegment(t *testing.T) {
+	testCases := []struct {
+		name             string
+		expectations     func(mock sqlmock.Sqlmock)
+		children         entity.ChildrenPolicy
+		expectOperations []entity.Operation
+		expectError      error
+	}{
+		{
+			name: "basic usage",
+			expectations: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.
+					ExpectQuery(`SELECT id, slug, deleted_at FROM segments WHERE .+ FOR UPDATE`).
+					WithArgs("AVITO_PROMO").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "slug", "deleted_at"}).AddRow(1, "AVITO_PROMO", sql.NullTime{}))
+				mock.
+					ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM segments WHERE parent_id=\$1 AND deleted_at IS NULL\)`).
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.
+					ExpectQuery(`SELECT slug, expression FROM segments WHERE expression<>'' AND deleted_at IS NULL`).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "expression"}))
+				mock.
+					ExpectExec(`UPDATE segments SET deleted_at=\$2 WHERE id=ANY\(\$1::INT\[\]\)`).
+					WithArgs(sqlmock.AnyArg(), time.Time{}.Add(3*time.Hour)).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.
+					ExpectQuery(`WITH removed AS \( UPDATE users_segments SET removed_at=GREATEST\(added_at, \$2\)`).
+					WithArgs(sqlmock.AnyArg(), time.Time{}.Add(3*time.Hour), entity.SegmentDeletedOperationType).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "slug", "time", "expires_at"}).
+						AddRow(1000, "AVITO_PROMO", time.Time{}.Add(3*time.Hour), nil).
+						AddRow(1001, "AVITO_PROMO", time.Time{}.Add(24*time.Hour), nil))
+				mock.ExpectCommit()
+			},
+			children: entity.ChildrenRestrict,
+			expectOperations: []entity.Operation{
+				{UserID: 1000, SegmentSlug: "AVITO_PROMO", Type: entity.SegmentDeletedOperationType, Time: time.Time{}.Add(3 * time.Hour)},
+				{UserID: 1001, SegmentSlug: "AVITO_PROMO", Type: entity.SegmentDeletedOperationType, Time: time.Time{}.Add(24 * time.Hour)},
+			},
+			expectError: nil,
+		},
+		{
+			name: "segment has children",
+			expectations: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.
+					ExpectQuery(`SELECT id, slug, deleted_at FROM segments WHERE .+ FOR UPDATE`).
+					WithArgs("AVITO_PROMO").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "slug", "deleted_at"}).AddRow(1, "AVITO_PROMO", sql.NullTime{}))
+				mock.
+					ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM segments WHERE parent_id=\$1 AND deleted_at IS NULL\)`).
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+				mock.ExpectRollback()
+			},
+			children:    entity.ChildrenRestrict,
+			expectError: repository.ErrSegmentHasChildren,
+		},
+		{
+			name: "segment is referenced by a composite",
+			expectations: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.
+					ExpectQuery(`SELECT id, slug, deleted_at FROM segments WHERE .+ FOR UPDATE`).
+					WithArgs("AVITO_PROMO").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "slug", "deleted_at"}).AddRow(1, "AVITO_PROMO", sql.NullTime{}))
+				mock.
+					ExpectQuery(`SELECT EXISTS\(SELECT 1 FROM segments WHERE parent_id=\$1 AND deleted_at IS NULL\)`).
+					WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+				mock.
+					ExpectQuery(`SELECT slug, expression FROM segments WHERE expression<>'' AND deleted_at IS NULL`).
+					WillReturnRows(sqlmock.NewRows([]string{"slug", "expression"}).AddRow("AVITO_PROMO_NO_VAS", "AVITO_PROMO AND NOT AVITO_VAS"))
+				mock.ExpectRollback()
+			},
+			children:    entity.ChildrenRestrict,
+			expectError: repository.ErrSegmentReferenced,
+		},
+		{
+			name: "segment already deleted",
+			expectations: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.
+					ExpectQuery(`SELECT id, slug, deleted_at FROM segments WHERE .+ FOR UPDATE`).
+					WithArgs("AVITO_PROMO").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "slug", "deleted_at"}).AddRow(1, "AVITO_PROMO", sql.NullTime{Valid: true}))
+				mock.ExpectRollback()
+			},
+			children:    entity.ChildrenCascade,
+			expectError: repository.ErrSegmentAlreadyDeleted,
+		},
+	}
+
+	for _, tt := range testCases {
+		// Open stub DB connection
+		db, mock, err := sqlmock.New(sqlmock.ValueConverterOption(arrayConverter{}))
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		// Create a mock repository
+		repo := &PostgresRepository{db, fixedtimeprovider.New(time.Time{}.Add(3 * time.Hour))}
+
+		// Build the expectations
+		tt.expectations(mock)
+
+		// Execute the method
+		operations, err := repo.DeleteSegment(context.Background(), "AVITO_PROMO", tt.children, false)
+		if err != tt.expectError {
+			t.Errorf("%s: wanted error: %s; got error: %s", tt.name, tt.expectError, err)
+		}
+		assert.Equal(t, tt.expectOperations, operations, tt.name)
+
+		// we make sure that all expectations were met
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: there were unfulfilled expectations: %s", tt.name, err)
+		}
+	}
+}
+
+func TestStopExperiment(t *testing.T) {
+	testCases := []struct {
+		name         string
+		expectations func(mock sqlmock.Sqlmock)
+		expectError  error
+	}{
+		{
+			name: "basic usage",
+			expectations: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.
+					ExpectQuery(`SELECT id, started_at, stopped_at FROM experiments WHERE slug=\$1 FOR UPDATE`).
+					WithArgs("AVITO_EXP").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "started_at", "stopped_at"}).AddRow(1, sql.NullTime{Time: time.Time{}, Valid: true}, sql.NullTime{}))
+				mock.
+					ExpectExec(`UPDATE experiments SET stopped_at=\$2 WHERE id=\$1`).
+					WithArgs(1, time.Time{}.Add(3*time.Hour)).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			expectError: nil,
+		},
+		{
+			name: "experiment doesn't exist",
+			expectations: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.
+					ExpectQuery(`SELECT id, started_at, stopped_at FROM experiments WHERE slug=\$1 FOR UPDATE`).
+					WithArgs("AVITO_EXP").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "started_at", "stopped_at"}))
+				mock.ExpectRollback()
+			},
+			expectError: repository.ErrExperimentNotFound,
+		},
+		{
+			name: "experiment isn't started",
+			expectations: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.
+					ExpectQuery(`SELECT id, started_at, stopped_at FROM experiments WHERE slug=\$1 FOR UPDATE`).
+					WithArgs("AVITO_EXP").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "started_at", "stopped_at"}).AddRow(1, sql.NullTime{}, sql.NullTime{}))
+				mock.ExpectRollback()
+			},
+			expectError: repository.ErrExperimentNotStarted,
+		},
+		{
+			name: "experiment already stopped",
+			expectations: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.
+					ExpectQuery(`SELECT id, started_at, stopped_at FROM experiments WHERE slug=\$1 FOR UPDATE`).
+					WithArgs("AVITO_EXP").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "started_at", "stopped_at"}).AddRow(1, sql.NullTime{Time: time.Time{}, Valid: true}, sql.NullTime{Time: time.Time{}, Valid: true}))
+				mock.ExpectRollback()
+			},
+			expectError: repository.ErrExperimentAlreadyStopped,
+		},
+	}
+
+	for _, tt := range testCases {
+		// Open stub DB connection
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+		defer db.Close()
+
+		// Create a mock repository
+		repo := &PostgresRepository{db, fixedtimeprovider.New(time.Time{}.Add(3 * time.Hour))}
+
+		// Build the expectations
+		tt.expectations(mock)
+
+		// Execute the method
+		err = repo.StopExperiment(context.Background(), "AVITO_EXP")
+		if err != tt.expectError {
+			t.Errorf("%s: wanted error: %s; got error: %s", tt.name, tt.expectError, err)
+		}
+
+		// we make sure that all expectations were met
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: there were unfulfilled expectations: %s", tt.name, err)
+		}
+	}
+}
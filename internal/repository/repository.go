@@ -1,9 +1,13 @@
 package repository
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"slices"
 	"time"
 
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/duration"
 	"github.com/QiZD90/dynamic-customer-segmentation/internal/entity"
 )
 
@@ -13,27 +17,254 @@ var (
 	ErrSegmentAlreadyExists  = errors.New("segment with this slug already exists")
 	ErrSegmentAlreadyDeleted = errors.New("segment with this slug is already deleted")
 	ErrSegmentNotFound       = errors.New("segment with this slug doesn't exist")
+	ErrSegmentNotDeleted     = errors.New("segment with this slug is not deleted")
+	ErrExpirationInPast      = errors.New("expiration date is in the past")
+	ErrExpirationBeforeStart = errors.New("expiration date is before the start of the membership")
+	ErrParentNotFound        = errors.New("parent segment doesn't exist or is deleted")
+	ErrSegmentCycle          = errors.New("segment can't be a descendant of itself")
+	ErrSegmentHasChildren    = errors.New("segment has active children")
+	ErrReferenceNotFound     = errors.New("segment referenced by the expression doesn't exist or is deleted")
+	ErrExpressionCycle       = errors.New("expression of the segment can't depend on the segment itself")
+	ErrSegmentReferenced     = errors.New("segment is referenced by active composite segments")
+	ErrSegmentComposite      = errors.New("memberships of a composite segment can't be changed directly")
+	ErrNotComposite          = errors.New("segment isn't composite")
+	ErrSegmentDynamic        = errors.New("memberships of a dynamic segment are only changed by its rule")
+	ErrNotDynamic            = errors.New("segment isn't dynamic")
+	ErrExclusionConflict     = errors.New("user would be in several segments of the same exclusion group")
+	ErrSegmentBucketed       = errors.New("memberships of a bucketed segment are decided by the hash of user id")
+	ErrNotBucketed           = errors.New("segment isn't bucketed")
+
+	ErrExperimentAlreadyExists  = errors.New("experiment with this slug already exists")
+	ErrExperimentNotFound       = errors.New("experiment with this slug doesn't exist")
+	ErrExperimentAlreadyStarted = errors.New("experiment is already started")
+	ErrExperimentNotStarted     = errors.New("experiment isn't started")
+	ErrExperimentAlreadyStopped = errors.New("experiment is already stopped")
 )
 
+// UniqueUserIDs returns sorted user ids without duplicates
+func UniqueUserIDs(userIDs []int) []int {
+	unique := slices.Clone(userIDs)
+	slices.Sort(unique)
+	return slices.Compact(unique)
+}
+
+// MarshalMetadata encodes segment's tags and attributes to JSON the way they are stored by SQL repositories
+func MarshalMetadata(tags []string, attributes map[string]any) ([]byte, []byte, error) {
+	if tags == nil {
+		tags = []string{}
+	}
+
+	if attributes == nil {
+		attributes = map[string]any{}
+	}
+
+	tagsJSON, err := json.Marshal(tags)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	attributesJSON, err := json.Marshal(attributes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return tagsJSON, attributesJSON, nil
+}
+
+// UnmarshalMetadata decodes segment's tags and attributes stored by SQL repositories.
+// Empty tags and attributes are decoded as nil
+func UnmarshalMetadata(tagsJSON []byte, attributesJSON []byte, metadata *entity.SegmentMetadata) error {
+	if err := json.Unmarshal(tagsJSON, &metadata.Tags); err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(attributesJSON, &metadata.Attributes); err != nil {
+		return err
+	}
+
+	if len(metadata.Tags) == 0 {
+		metadata.Tags = nil
+	}
+
+	if len(metadata.Attributes) == 0 {
+		metadata.Attributes = nil
+	}
+
+	return nil
+}
+
+// MembershipExpiration returns the expiration of a membership added at `now`: the explicit one if set,
+// otherwise `now` plus the default TTL of the segment. Nil means that the membership doesn't expire
+func MembershipExpiration(expiresAt *time.Time, defaultTTL string, now time.Time) (*time.Time, error) {
+	if expiresAt != nil || defaultTTL == "" {
+		return expiresAt, nil
+	}
+
+	ttl, err := duration.Parse(defaultTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	t := now.Add(ttl)
+	return &t, nil
+}
+
 type Repository interface {
-	CreateSegment(slug string) error
+	// CreateSegment creates a segment. If the parent is set but there is no active segment by its slug,
+	// returns `ErrParentNotFound`. The expression of a composite segment is stored with current slugs
+	// of the referenced segments, which are renamed along with them. If any of them isn't an active segment,
+	// returns `ErrReferenceNotFound`, if it's the segment itself, returns `ErrExpressionCycle`.
+	// The rule of a dynamic segment is stored as is, so are the salt and the percent of a bucketed segment
+	CreateSegment(ctx context.Context, slug string, metadata entity.SegmentMetadata) error
+
+	// UpdateSegment changes metadata of an active segment.
+	// If segment doesn't exist, returns `ErrSegmentNotFound` or `ErrSegmentAlreadyDeleted`.
+	// If the new parent isn't an active segment, returns `ErrParentNotFound`,
+	// if it's the segment itself or one of its descendants, returns `ErrSegmentCycle`.
+	// The expression can only be changed for composite segments, otherwise returns `ErrNotComposite`.
+	// It's checked the same way as in `CreateSegment`, and returns `ErrExpressionCycle` if the segment
+	// would depend on itself through other composite segments, active or deleted.
+	// The rule can only be changed for dynamic segments, otherwise returns `ErrNotDynamic`.
+	// The percent can only be changed for bucketed segments, otherwise returns `ErrNotBucketed`.
+	// Composite, dynamic and bucketed segments can't be put in an exclusion group, they return `ErrSegmentComposite`,
+	// `ErrSegmentDynamic` and `ErrSegmentBucketed`. If any user is in the segment and in another segment of the new group,
+	// returns `ErrExclusionConflict`
+	UpdateSegment(ctx context.Context, slug string, update entity.SegmentMetadataUpdate) error
+
+	// RenameSegment changes the slug of an active segment keeping its id and history.
+	// The old slug becomes an alias: every method that takes a slug accepts aliases as well.
+	// If `newSlug` is taken by another segment or alias, returns `ErrSegmentAlreadyExists`
+	RenameSegment(ctx context.Context, slug string, newSlug string) error
 
 	// AddSegmentToUsers adds users to specified segment.
-	// If segment doesn't exist, returns `ErrSegmentNotFound` or `ErrSegmentAlreadyDeleted`
-	// If any of the users already have the segment, ignore them
-	AddSegmentToUsers(slug string, userIDs []int) error
+	// If segment doesn't exist, returns `ErrSegmentNotFound` or `ErrSegmentAlreadyDeleted`,
+	// if it's composite, returns `ErrSegmentComposite`, if it's dynamic, returns `ErrSegmentDynamic`,
+	// if it's bucketed, returns `ErrSegmentBucketed`.
+	// If any of the users already have the segment, ignore them. Users that have an open membership
+	// in another segment of the exclusion group of the segment are ignored as well.
+	// Memberships expire at `expiresAt` if it's set, otherwise after the default TTL of the segment, if it has one.
+	// Returns how many users got the segment, how many were skipped and how many were excluded, and the operations
+	// that were applied, including expirations of memberships that had to be closed to add the segment again.
+	// Large batches may be split into several transactions, so if an error occurs
+	// some of the users may have already got the segment, their operations are returned along with the error
+	AddSegmentToUsers(ctx context.Context, slug string, userIDs []int, expiresAt *time.Time) (entity.EnrollmentResult, []entity.Operation, error)
+
+	// GetExclusionGroupMembers returns sorted ids of those of the users that have an open membership in another segment
+	// of the exclusion group of the segment, that is the ones `AddSegmentToUsers` would exclude right now.
+	// Returns nothing if the segment isn't in a group. If segment doesn't exist, returns `ErrSegmentNotFound`
+	GetExclusionGroupMembers(ctx context.Context, slug string, userIDs []int) ([]int, error)
+
+	// DeleteSegment marks the segment as deleted and removes its open memberships.
+	// Memberships that haven't started yet are removed at their start, so they never become active.
+	// Active children of the segment are handled according to `children`: if they are restricted
+	// (or the policy is unknown), returns `ErrSegmentHasChildren` and deletes nothing.
+	// Unless `force` is set, returns `ErrSegmentReferenced` if any of the deleted segments is referenced
+	// by an active composite segment that isn't deleted too. Returns the removals of memberships
+	DeleteSegment(ctx context.Context, slug string, children entity.ChildrenPolicy, force bool) ([]entity.Operation, error)
+
+	// RestoreSegment clears deletion of the segment. If `restoreMemberships` is set, memberships
+	// that were removed by the deletion and haven't expired since then are re-activated.
+	// Memberships of users that have got an open membership in another segment of the exclusion group
+	// of the segment in the meantime stay removed.
+	// If the parent of the segment is deleted, the segment is restored as a top-level one.
+	// Returns the re-activations of memberships. If segment isn't deleted, returns `ErrSegmentNotDeleted`
+	RestoreSegment(ctx context.Context, slug string, restoreMemberships bool) ([]entity.Operation, error)
+
+	GetAllActiveSegments(ctx context.Context, filter entity.SegmentFilter) ([]entity.Segment, error)
+	GetAllSegments(ctx context.Context, filter entity.SegmentFilter) ([]entity.Segment, error)
 
-	DeleteSegment(slug string) error
-	GetAllActiveSegments() ([]entity.Segment, error)
-	GetAllSegments() ([]entity.Segment, error)
+	// ListSegments returns a page of segments matching the filter, sorted as requested.
+	// If the cursor of the page is malformed or belongs to a list with another order, returns `ErrInvalidCursor`
+	ListSegments(ctx context.Context, filter entity.SegmentFilter, page entity.SegmentPageRequest) (entity.SegmentPage, error)
 
+	// UpdateUserSegments adds and removes segments of the user and returns the operations that were applied,
+	// including expirations of memberships that had to be closed to add the segment again.
+	// A membership with `StartsAt` in the future is added at that time and counts as open from now on,
+	// removing it before the start removes it at the start. Composite segments return `ErrSegmentComposite`,
+	// dynamic ones return `ErrSegmentDynamic`, bucketed ones return `ErrSegmentBucketed`. If the user would end up with open memberships in several
+	// segments of the same exclusion group, returns `ErrExclusionConflict` and changes nothing, so the user
+	// is moved between segments of a group by removing one and adding another in the same call.
 	// !!NOTE!!: behaviour in case of duplicate entries in slices or an entry
 	// being in both slices is intentionally undefined
-	UpdateUserSegments(userID int, addSegments []entity.SegmentExpiration, removeSegments []entity.SegmentExpiration) error
+	UpdateUserSegments(ctx context.Context, userID int, addSegments []entity.SegmentExpiration, removeSegments []entity.SegmentExpiration) ([]entity.Operation, error)
+
+	// UpdateUserSegmentExpirations sets expiration dates of open (active or scheduled) memberships of the user,
+	// nil clears it. Segments the user doesn't have are skipped. Returns the operations that were applied.
+	// If segment doesn't exist, returns `ErrSegmentNotFound` or `ErrSegmentAlreadyDeleted`,
+	// if any of the dates isn't in the future, returns `ErrExpirationInPast`,
+	// if it isn't after the start of a scheduled membership, returns `ErrExpirationBeforeStart`,
+	// if it's composite, returns `ErrSegmentComposite`, if it's dynamic, returns `ErrSegmentDynamic`,
+	// if it's bucketed, returns `ErrSegmentBucketed`
+	UpdateUserSegmentExpirations(ctx context.Context, userID int, segments []entity.SegmentExpiration) ([]entity.Operation, error)
+
+	// SyncSegmentMembers makes `userIDs` the only users with open memberships in the dynamic segment: adds the segment
+	// to the users that don't have it (memberships expire after the default TTL of the segment, if it has one)
+	// and removes it from the rest. Returns the operations that were applied.
+	// If segment doesn't exist, returns `ErrSegmentNotFound` or `ErrSegmentAlreadyDeleted`,
+	// if it isn't dynamic, returns `ErrNotDynamic`
+	SyncSegmentMembers(ctx context.Context, slug string, userIDs []int) ([]entity.Operation, error)
+
+	// ExpireMemberships closes at most `limit` memberships that have expired by now, oldest first:
+	// marks them as removed at their expiration and logs the expirations. Returns the logged expirations,
+	// fewer than `limit` if there are no more of them. Several processes may call it at once: every membership
+	// is closed only once, and a call may return nothing while another process is sweeping
+	ExpireMemberships(ctx context.Context, limit int) ([]entity.Operation, error)
+
+	// GetActiveUserSegments returns memberships of the user that have started and are neither removed nor expired
+	GetActiveUserSegments(ctx context.Context, userID int) ([]entity.UserSegment, error)
+
+	// GetSegmentParents returns the slug of the parent of every active segment that has one, by the slug of the segment
+	GetSegmentParents(ctx context.Context) (map[string]string, error)
 
-	GetActiveUserSegments(userID int) ([]entity.UserSegment, error)
+	// GetCompositeSegments returns the expression of every active composite segment by the slug of the segment
+	GetCompositeSegments(ctx context.Context) (map[string]string, error)
+
+	// GetSegmentMembers returns a page of ids of users that were in the segment at `request.AsOf`, sorted by id.
+	// Composite segments have no stored members, so they are computed by the service instead.
+	// Deleted segments are looked up as well. If segment doesn't exist, returns `ErrSegmentNotFound`.
+	// If the cursor is malformed or was built for another moment, returns `ErrInvalidCursor`
+	GetSegmentMembers(ctx context.Context, slug string, request entity.SegmentMembersRequest) (entity.SegmentMembersPage, error)
+
+	// GetSegmentStats returns the number of users in the segment now and the number of added, removed
+	// and expired memberships for every day from `from` to `to` (midnights in UTC, `to` is excluded).
+	// Deleted segments are looked up as well. If segment doesn't exist, returns `ErrSegmentNotFound`
+	GetSegmentStats(ctx context.Context, slug string, from time.Time, to time.Time) (entity.SegmentStats, error)
+
+	// StreamSegmentMembers calls `fn` with the id of every user that was in the segment at `asOf` (now if zero)
+	// in ascending order without loading the whole list in memory. Stops at the first error returned by `fn`.
+	// If segment doesn't exist, returns `ErrSegmentNotFound` before the first call
+	StreamSegmentMembers(ctx context.Context, slug string, asOf time.Time, fn func(userID int) error) error
 
 	// DumpHistory returns all operations related to a given user that occurred in specified time span
 	// sorted by operation time
-	DumpHistory(userID int, timeFrom time.Time, timeTo time.Time) ([]entity.Operation, error)
+	DumpHistory(ctx context.Context, userID int, timeFrom time.Time, timeTo time.Time) ([]entity.Operation, error)
+
+	// CreateExperiment creates an experiment that isn't started yet along with its variant segments.
+	// Variants are created as plain segments in the exclusion group named after the experiment.
+	// If there is an experiment by this slug, returns `ErrExperimentAlreadyExists`,
+	// if any of the variant slugs is taken by a segment or alias, returns `ErrSegmentAlreadyExists` and creates nothing
+	CreateExperiment(ctx context.Context, slug string, variants []entity.ExperimentVariant) error
+
+	// GetExperiment returns the experiment with current slugs of its variants in the order they were created in.
+	// If there is no experiment by this slug, returns `ErrExperimentNotFound`
+	GetExperiment(ctx context.Context, slug string) (entity.Experiment, error)
+
+	// GetAllExperiments returns every experiment the same way as `GetExperiment`, oldest first
+	GetAllExperiments(ctx context.Context) ([]entity.Experiment, error)
+
+	// StartExperiment records the start of the experiment at the current time.
+	// Returns `ErrExperimentNotFound` if there is no such experiment and `ErrExperimentAlreadyStarted` if it was started before
+	StartExperiment(ctx context.Context, slug string) error
+
+	// StopExperiment records the stop of the experiment at the current time. Returns `ErrExperimentNotFound`
+	// if there is no such experiment, `ErrExperimentNotStarted` if it isn't started and `ErrExperimentAlreadyStopped`
+	// if it was stopped before
+	StopExperiment(ctx context.Context, slug string) error
+
+	// GetExperimentVariants returns the slug of the experiment of every active variant segment, by the slug of the segment
+	GetExperimentVariants(ctx context.Context) (map[string]string, error)
+
+	// EraseUser deletes every membership and operation of the user for good and leaves
+	// a tombstone with the number of deleted records and `filesCount` deleted files
+	EraseUser(ctx context.Context, userID int, filesCount int) (entity.Erasure, error)
 }
@@ -0,0 +1,1542 @@
+// Package repotest is a conformance suite for implementations of `repository.Repository`.
+// Every backend runs it from its own tests, so that all of them behave the same way
+package repotest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/entity"
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/repository"
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/timeprovider"
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/timeprovider/fixedtimeprovider"
+	"github.com/stretchr/testify/assert"
+)
+
+// NewRepository creates an empty repository that gets the current time from `timeProvider`
+type NewRepository func(t *testing.T, timeProvider timeprovider.TimeProvider) repository.Repository
+
+// Run runs the suite against repositories created by `newRepository`, every test gets a new one
+func Run(t *testing.T, newRepository NewRepository) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, newRepository NewRepository)
+	}{
+		{"CreateSegment", testCreateSegment},
+		{"AddSegmentToUsers", testAddSegmentToUsers},
+		{"DeleteSegment", testDeleteSegment},
+		{"UpdateUserSegments", testUpdateUserSegments},
+		{"DumpHistory", testDumpHistory},
+		{"ReAddExpiredMembership", testReAddExpiredMembership},
+		{"ExpireMemberships", testExpireMemberships},
+		{"UpdateUserSegmentExpirations", testUpdateUserSegmentExpirations},
+		{"UpdateSegment", testUpdateSegment},
+		{"GetAllSegmentsFilter", testGetAllSegmentsFilter},
+		{"RenameSegment", testRenameSegment},
+		{"RestoreSegment", testRestoreSegment},
+		{"EraseUser", testEraseUser},
+		{"ListSegments", testListSegments},
+		{"SegmentMembers", testSegmentMembers},
+		{"SegmentStats", testSegmentStats},
+		{"ListSegmentsMemberCounts", testListSegmentsMemberCounts},
+		{"DefaultTTL", testDefaultTTL},
+		{"ScheduledMemberships", testScheduledMemberships},
+		{"CancelScheduledMembership", testCancelScheduledMembership},
+		{"RestoreScheduledMembership", testRestoreScheduledMembership},
+		{"RestoreCancelledScheduledMembership", testRestoreCancelledScheduledMembership},
+		{"SegmentHierarchy", testSegmentHierarchy},
+		{"DeleteSegmentChildren", testDeleteSegmentChildren},
+		{"CompositeSegments", testCompositeSegments},
+		{"DynamicSegments", testDynamicSegments},
+		{"ExclusionGroups", testExclusionGroups},
+		{"BucketedSegments", testBucketedSegments},
+		{"Experiments", testExperiments},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newRepository)
+		})
+	}
+}
+
+var timeBase = time.Date(2000, time.November, 15, 15, 0, 0, 0, time.UTC)
+
+func testCreateSegment(t *testing.T, newRepository NewRepository) {
+	repo := newRepository(t, fixedtimeprovider.New(timeBase))
+
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_NEW_SEGMENT", entity.SegmentMetadata{}))
+	assert.Equal(t, repository.ErrSegmentAlreadyExists, repo.CreateSegment(context.Background(), "AVITO_NEW_SEGMENT", entity.SegmentMetadata{}))
+
+	// deleted segments still occupy the slug
+	_, err := repo.DeleteSegment(context.Background(), "AVITO_NEW_SEGMENT", entity.ChildrenRestrict, false)
+	assert.NoError(t, err)
+	assert.Equal(t, repository.ErrSegmentAlreadyExists, repo.CreateSegment(context.Background(), "AVITO_NEW_SEGMENT", entity.SegmentMetadata{}))
+}
+
+func testAddSegmentToUsers(t *testing.T, newRepository NewRepository) {
+	timeProvider := fixedtimeprovider.New(timeBase)
+	repo := newRepository(t, timeProvider)
+
+	_, _, err := repo.AddSegmentToUsers(context.Background(), "AVITO_NO_SEGMENT", []int{1000}, nil)
+	assert.Equal(t, repository.ErrSegmentNotFound, err)
+
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_SEGMENT", entity.SegmentMetadata{}))
+	_, err = repo.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_SEGMENT"}}, nil)
+	assert.NoError(t, err)
+
+	// duplicates are counted once and users that already have the segment are skipped
+	result, _, err := repo.AddSegmentToUsers(context.Background(), "AVITO_SEGMENT", []int{1002, 1000, 1001, 1002}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, entity.EnrollmentResult{EnrolledCount: 2, SkippedCount: 1}, result)
+
+	for _, userID := range []int{1000, 1001, 1002} {
+		segments, err := repo.GetActiveUserSegments(context.Background(), userID)
+		assert.NoError(t, err)
+		assert.Len(t, segments, 1)
+	}
+
+	operations, err := repo.DumpHistory(context.Background(), 1002, timeBase, timeBase.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Operation{
+		{UserID: 1002, SegmentSlug: "AVITO_SEGMENT", Type: entity.AddedOperationType, Time: timeBase},
+	}, operations)
+
+	_, err = repo.DeleteSegment(context.Background(), "AVITO_SEGMENT", entity.ChildrenRestrict, false)
+	assert.NoError(t, err)
+	_, _, err = repo.AddSegmentToUsers(context.Background(), "AVITO_SEGMENT", []int{1000}, nil)
+	assert.Equal(t, repository.ErrSegmentAlreadyDeleted, err)
+}
+
+func testDeleteSegment(t *testing.T, newRepository NewRepository) {
+	timeProvider := fixedtimeprovider.New(timeBase)
+	repo := newRepository(t, timeProvider)
+
+	_, err := repo.DeleteSegment(context.Background(), "AVITO_NO_SEGMENT", entity.ChildrenRestrict, false)
+	assert.Equal(t, repository.ErrSegmentNotFound, err)
+
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_SEGMENT", entity.SegmentMetadata{}))
+	_, _, err = repo.AddSegmentToUsers(context.Background(), "AVITO_SEGMENT", []int{1000, 1001}, nil)
+	assert.NoError(t, err)
+
+	timeProvider.SetTime(timeBase.Add(time.Hour))
+	operations, err := repo.DeleteSegment(context.Background(), "AVITO_SEGMENT", entity.ChildrenRestrict, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Operation{
+		{UserID: 1000, SegmentSlug: "AVITO_SEGMENT", Type: entity.SegmentDeletedOperationType, Time: timeBase.Add(time.Hour)},
+		{UserID: 1001, SegmentSlug: "AVITO_SEGMENT", Type: entity.SegmentDeletedOperationType, Time: timeBase.Add(time.Hour)},
+	}, operations)
+	_, err = repo.DeleteSegment(context.Background(), "AVITO_SEGMENT", entity.ChildrenRestrict, false)
+	assert.Equal(t, repository.ErrSegmentAlreadyDeleted, err)
+
+	segments, err := repo.GetActiveUserSegments(context.Background(), 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.UserSegment{}, segments)
+
+	activeSegments, err := repo.GetAllActiveSegments(context.Background(), entity.SegmentFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Segment{}, activeSegments)
+
+	deletedAt := timeBase.Add(time.Hour)
+	allSegments, err := repo.GetAllSegments(context.Background(), entity.SegmentFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Segment{{Slug: "AVITO_SEGMENT", CreatedAt: timeBase, DeletedAt: &deletedAt}}, allSegments)
+}
+
+func testUpdateUserSegments(t *testing.T, newRepository NewRepository) {
+	expiresAt := timeBase.Add(2 * time.Hour)
+
+	testCases := []struct {
+		name           string
+		addSegments    []entity.SegmentExpiration
+		removeSegments []entity.SegmentExpiration
+		expectResult   []entity.UserSegment
+		expectError    error
+	}{
+		{
+			name:        "add segments",
+			addSegments: []entity.SegmentExpiration{{Slug: "AVITO_NEW"}, {Slug: "AVITO_OTHER", ExpiresAt: &expiresAt}},
+			expectResult: []entity.UserSegment{
+				{Slug: "AVITO_ACTIVE", AddedAt: timeBase},
+				{Slug: "AVITO_NEW", AddedAt: timeBase.Add(time.Hour)},
+				{Slug: "AVITO_OTHER", AddedAt: timeBase.Add(time.Hour), ExpiresAt: &expiresAt},
+			},
+		},
+		{
+			name:         "already active segment is ignored",
+			addSegments:  []entity.SegmentExpiration{{Slug: "AVITO_ACTIVE", ExpiresAt: &expiresAt}},
+			expectResult: []entity.UserSegment{{Slug: "AVITO_ACTIVE", AddedAt: timeBase}},
+		},
+		{
+			name:           "remove segments",
+			removeSegments: []entity.SegmentExpiration{{Slug: "AVITO_ACTIVE"}, {Slug: "AVITO_NEW"}},
+			expectResult:   []entity.UserSegment{},
+		},
+		{
+			name:         "segment not found",
+			addSegments:  []entity.SegmentExpiration{{Slug: "AVITO_NEW"}, {Slug: "AVITO_NO_SEGMENT"}},
+			expectResult: []entity.UserSegment{{Slug: "AVITO_ACTIVE", AddedAt: timeBase}},
+			expectError:  repository.ErrSegmentNotFound,
+		},
+		{
+			name:           "segment already deleted",
+			removeSegments: []entity.SegmentExpiration{{Slug: "AVITO_ACTIVE"}, {Slug: "AVITO_DELETED"}},
+			expectResult:   []entity.UserSegment{{Slug: "AVITO_ACTIVE", AddedAt: timeBase}},
+			expectError:    repository.ErrSegmentAlreadyDeleted,
+		},
+	}
+
+	for _, tt := range testCases {
+		timeProvider := fixedtimeprovider.New(timeBase)
+		repo := newRepository(t, timeProvider)
+
+		// Prepare the segments
+		for _, slug := range []string{"AVITO_ACTIVE", "AVITO_NEW", "AVITO_OTHER", "AVITO_DELETED"} {
+			assert.NoError(t, repo.CreateSegment(context.Background(), slug, entity.SegmentMetadata{}))
+		}
+		_, err := repo.DeleteSegment(context.Background(), "AVITO_DELETED", entity.ChildrenRestrict, false)
+		assert.NoError(t, err)
+		_, _, err = repo.AddSegmentToUsers(context.Background(), "AVITO_ACTIVE", []int{1000}, nil)
+		assert.NoError(t, err)
+
+		// Execute the method
+		timeProvider.SetTime(timeBase.Add(time.Hour))
+		_, err = repo.UpdateUserSegments(context.Background(), 1000, tt.addSegments, tt.removeSegments)
+		if err != tt.expectError {
+			t.Errorf("%s: wanted error: %s; got error: %s", tt.name, tt.expectError, err)
+		}
+
+		segments, err := repo.GetActiveUserSegments(context.Background(), 1000)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expectResult, segments, tt.name)
+	}
+}
+
+func testDumpHistory(t *testing.T, newRepository NewRepository) {
+	timeProvider := fixedtimeprovider.New(timeBase)
+	repo := newRepository(t, timeProvider)
+
+	expiresAt := timeBase.Add(2 * time.Hour)
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_EXPIRING", entity.SegmentMetadata{}))
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_REMOVED", entity.SegmentMetadata{}))
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_DELETED", entity.SegmentMetadata{}))
+	_, err := repo.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{
+		{Slug: "AVITO_EXPIRING", ExpiresAt: &expiresAt},
+		{Slug: "AVITO_REMOVED"},
+		{Slug: "AVITO_DELETED", ExpiresAt: &expiresAt},
+	}, nil)
+	assert.NoError(t, err)
+
+	timeProvider.SetTime(timeBase.Add(time.Hour))
+	_, err = repo.UpdateUserSegments(context.Background(), 1000, nil, []entity.SegmentExpiration{{Slug: "AVITO_REMOVED"}})
+	assert.NoError(t, err)
+	_, err = repo.DeleteSegment(context.Background(), "AVITO_DELETED", entity.ChildrenRestrict, false)
+	assert.NoError(t, err)
+
+	// expiration is not reported until it actually happens
+	operations, err := repo.DumpHistory(context.Background(), 1000, timeBase, timeBase.Add(24*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Operation{
+		{UserID: 1000, SegmentSlug: "AVITO_EXPIRING", Type: entity.AddedOperationType, Time: timeBase, ExpiresAt: &expiresAt},
+		{UserID: 1000, SegmentSlug: "AVITO_REMOVED", Type: entity.AddedOperationType, Time: timeBase},
+		{UserID: 1000, SegmentSlug: "AVITO_DELETED", Type: entity.AddedOperationType, Time: timeBase, ExpiresAt: &expiresAt},
+		{UserID: 1000, SegmentSlug: "AVITO_REMOVED", Type: entity.RemovedOperationType, Time: timeBase.Add(time.Hour)},
+		{UserID: 1000, SegmentSlug: "AVITO_DELETED", Type: entity.SegmentDeletedOperationType, Time: timeBase.Add(time.Hour), ExpiresAt: &expiresAt},
+	}, operations)
+
+	// removed memberships don't expire
+	timeProvider.SetTime(timeBase.Add(3 * time.Hour))
+	operations, err = repo.DumpHistory(context.Background(), 1000, timeBase.Add(time.Hour), timeBase.Add(24*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Operation{
+		{UserID: 1000, SegmentSlug: "AVITO_REMOVED", Type: entity.RemovedOperationType, Time: timeBase.Add(time.Hour)},
+		{UserID: 1000, SegmentSlug: "AVITO_DELETED", Type: entity.SegmentDeletedOperationType, Time: timeBase.Add(time.Hour), ExpiresAt: &expiresAt},
+		{UserID: 1000, SegmentSlug: "AVITO_EXPIRING", Type: entity.ExpiredOperationType, Time: expiresAt, ExpiresAt: &expiresAt},
+	}, operations)
+
+	// history of other users is empty
+	operations, err = repo.DumpHistory(context.Background(), 1001, timeBase, timeBase.Add(24*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Operation{}, operations)
+}
+
+func testReAddExpiredMembership(t *testing.T, newRepository NewRepository) {
+	timeProvider := fixedtimeprovider.New(timeBase)
+	repo := newRepository(t, timeProvider)
+
+	expiresAt := timeBase.Add(time.Hour)
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_VOICE", entity.SegmentMetadata{}))
+	_, err := repo.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_VOICE", ExpiresAt: &expiresAt}}, nil)
+	assert.NoError(t, err)
+	_, err = repo.UpdateUserSegments(context.Background(), 1001, []entity.SegmentExpiration{{Slug: "AVITO_VOICE", ExpiresAt: &expiresAt}}, nil)
+	assert.NoError(t, err)
+
+	// adding the segment again closes the expired membership and logs its expiration
+	timeProvider.SetTime(timeBase.Add(2 * time.Hour))
+	operations, err := repo.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_VOICE"}}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Operation{
+		{UserID: 1000, SegmentSlug: "AVITO_VOICE", Type: entity.ExpiredOperationType, Time: expiresAt, ExpiresAt: &expiresAt},
+		{UserID: 1000, SegmentSlug: "AVITO_VOICE", Type: entity.AddedOperationType, Time: timeBase.Add(2 * time.Hour)},
+	}, operations)
+	result, operations, err := repo.AddSegmentToUsers(context.Background(), "AVITO_VOICE", []int{1000, 1001}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, entity.EnrollmentResult{EnrolledCount: 1, SkippedCount: 1}, result)
+	assert.Equal(t, []entity.Operation{
+		{UserID: 1001, SegmentSlug: "AVITO_VOICE", Type: entity.ExpiredOperationType, Time: expiresAt, ExpiresAt: &expiresAt},
+		{UserID: 1001, SegmentSlug: "AVITO_VOICE", Type: entity.AddedOperationType, Time: timeBase.Add(2 * time.Hour)},
+	}, operations)
+
+	operations, err = repo.DumpHistory(context.Background(), 1000, timeBase, timeBase.Add(24*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Operation{
+		{UserID: 1000, SegmentSlug: "AVITO_VOICE", Type: entity.AddedOperationType, Time: timeBase, ExpiresAt: &expiresAt},
+		{UserID: 1000, SegmentSlug: "AVITO_VOICE", Type: entity.ExpiredOperationType, Time: expiresAt, ExpiresAt: &expiresAt},
+		{UserID: 1000, SegmentSlug: "AVITO_VOICE", Type: entity.AddedOperationType, Time: timeBase.Add(2 * time.Hour)},
+	}, operations)
+
+	// logged expirations aren't derived once more
+	day := time.Date(2000, time.November, 15, 0, 0, 0, 0, time.UTC)
+	stats, err := repo.GetSegmentStats(context.Background(), "AVITO_VOICE", day, day.AddDate(0, 0, 1))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.ActiveCount)
+	assert.Equal(t, []entity.SegmentDayStats{{Date: day, Added: 4, Expired: 2}}, stats.Days)
+}
+
+func testExpireMemberships(t *testing.T, newRepository NewRepository) {
+	timeProvider := fixedtimeprovider.New(timeBase)
+	repo := newRepository(t, timeProvider)
+
+	expiresSoon := timeBase.Add(time.Hour)
+	expiresLater := timeBase.Add(2 * time.Hour)
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_VOICE", entity.SegmentMetadata{}))
+	for userID, expiresAt := range map[int]*time.Time{1000: &expiresLater, 1001: &expiresSoon, 1002: nil} {
+		_, err := repo.UpdateUserSegments(context.Background(), userID, []entity.SegmentExpiration{{Slug: "AVITO_VOICE", ExpiresAt: expiresAt}}, nil)
+		assert.NoError(t, err)
+	}
+
+	// nothing has expired yet
+	operations, err := repo.ExpireMemberships(context.Background(), 10)
+	assert.NoError(t, err)
+	assert.Empty(t, operations)
+
+	// the oldest expirations are closed first
+	timeProvider.SetTime(timeBase.Add(3 * time.Hour))
+	operations, err = repo.ExpireMemberships(context.Background(), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Operation{
+		{UserID: 1001, SegmentSlug: "AVITO_VOICE", Type: entity.ExpiredOperationType, Time: expiresSoon, ExpiresAt: &expiresSoon},
+	}, operations)
+
+	operations, err = repo.ExpireMemberships(context.Background(), 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Operation{
+		{UserID: 1000, SegmentSlug: "AVITO_VOICE", Type: entity.ExpiredOperationType, Time: expiresLater, ExpiresAt: &expiresLater},
+	}, operations)
+
+	operations, err = repo.ExpireMemberships(context.Background(), 10)
+	assert.NoError(t, err)
+	assert.Empty(t, operations)
+
+	// closed expirations are reported once
+	operations, err = repo.DumpHistory(context.Background(), 1001, timeBase, timeBase.Add(24*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Operation{
+		{UserID: 1001, SegmentSlug: "AVITO_VOICE", Type: entity.AddedOperationType, Time: timeBase, ExpiresAt: &expiresSoon},
+		{UserID: 1001, SegmentSlug: "AVITO_VOICE", Type: entity.ExpiredOperationType, Time: expiresSoon, ExpiresAt: &expiresSoon},
+	}, operations)
+
+	members, err := repo.GetSegmentMembers(context.Background(), "AVITO_VOICE", entity.SegmentMembersRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1002}, members.UserIDs)
+
+	// membership history stays the same
+	members, err = repo.GetSegmentMembers(context.Background(), "AVITO_VOICE", entity.SegmentMembersRequest{AsOf: timeBase.Add(90 * time.Minute)})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1000, 1002}, members.UserIDs)
+}
+
+func testUpdateUserSegmentExpirations(t *testing.T, newRepository NewRepository) {
+	timeProvider := fixedtimeprovider.New(timeBase)
+	repo := newRepository(t, timeProvider)
+
+	expiresAt := timeBase.Add(time.Hour)
+	extended := timeBase.Add(48 * time.Hour)
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_VOICE", entity.SegmentMetadata{}))
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_CHAT", entity.SegmentMetadata{}))
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_OTHER", entity.SegmentMetadata{}))
+	_, err := repo.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{
+		{Slug: "AVITO_VOICE", ExpiresAt: &expiresAt},
+		{Slug: "AVITO_CHAT", ExpiresAt: &expiresAt},
+	}, nil)
+	assert.NoError(t, err)
+
+	// dates in the past and unknown segments change nothing
+	past := timeBase.Add(-time.Hour)
+	_, err = repo.UpdateUserSegmentExpirations(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_VOICE", ExpiresAt: &past}})
+	assert.Equal(t, repository.ErrExpirationInPast, err)
+	_, err = repo.UpdateUserSegmentExpirations(context.Background(), 1000, []entity.SegmentExpiration{
+		{Slug: "AVITO_VOICE", ExpiresAt: &extended},
+		{Slug: "AVITO_NONEXISTENT"},
+	})
+	assert.Equal(t, repository.ErrSegmentNotFound, err)
+
+	// one is extended, another is made permanent, segments the user doesn't have are skipped
+	timeProvider.SetTime(timeBase.Add(30 * time.Minute))
+	operations, err := repo.UpdateUserSegmentExpirations(context.Background(), 1000, []entity.SegmentExpiration{
+		{Slug: "AVITO_VOICE", ExpiresAt: &extended},
+		{Slug: "AVITO_CHAT"},
+		{Slug: "AVITO_OTHER", ExpiresAt: &extended},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Operation{
+		{UserID: 1000, SegmentSlug: "AVITO_VOICE", Type: entity.ExpirationChangedOperationType, Time: timeBase.Add(30 * time.Minute), ExpiresAt: &extended},
+		{UserID: 1000, SegmentSlug: "AVITO_CHAT", Type: entity.ExpirationChangedOperationType, Time: timeBase.Add(30 * time.Minute)},
+	}, operations)
+
+	// setting the same date again is not a change
+	operations, err = repo.UpdateUserSegmentExpirations(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_VOICE", ExpiresAt: &extended}})
+	assert.NoError(t, err)
+	assert.Empty(t, operations)
+
+	// both are still active after the original expiration
+	timeProvider.SetTime(timeBase.Add(2 * time.Hour))
+	segments, err := repo.GetActiveUserSegments(context.Background(), 1000)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []entity.UserSegment{
+		{Slug: "AVITO_VOICE", AddedAt: timeBase, ExpiresAt: &extended},
+		{Slug: "AVITO_CHAT", AddedAt: timeBase},
+	}, segments)
+
+	// the change is in the history
+	operations, err = repo.DumpHistory(context.Background(), 1000, timeBase.Add(time.Minute), timeBase.Add(72*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Operation{
+		{UserID: 1000, SegmentSlug: "AVITO_VOICE", Type: entity.ExpirationChangedOperationType, Time: timeBase.Add(30 * time.Minute), ExpiresAt: &extended},
+		{UserID: 1000, SegmentSlug: "AVITO_CHAT", Type: entity.ExpirationChangedOperationType, Time: timeBase.Add(30 * time.Minute)},
+	}, operations)
+}
+
+func testUpdateSegment(t *testing.T, newRepository NewRepository) {
+	repo := newRepository(t, fixedtimeprovider.New(timeBase))
+
+	assert.Equal(t, repository.ErrSegmentNotFound, repo.UpdateSegment(context.Background(), "AVITO_NO_SEGMENT", entity.SegmentMetadataUpdate{}))
+
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_SEGMENT", entity.SegmentMetadata{
+		Description: "Old description",
+		Owner:       "growth",
+		Tags:        []string{"old"},
+		Attributes:  map[string]any{"priority": 1},
+	}))
+
+	// only passed fields are changed
+	description := "New description"
+	assert.NoError(t, repo.UpdateSegment(context.Background(), "AVITO_SEGMENT", entity.SegmentMetadataUpdate{
+		Description: &description,
+		Tags:        []string{},
+	}))
+
+	segments, err := repo.GetAllSegments(context.Background(), entity.SegmentFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Segment{{
+		Slug: "AVITO_SEGMENT",
+		SegmentMetadata: entity.SegmentMetadata{
+			Description: "New description",
+			Owner:       "growth",
+			Attributes:  map[string]any{"priority": float64(1)},
+		},
+		CreatedAt: timeBase,
+	}}, segments)
+
+	_, err = repo.DeleteSegment(context.Background(), "AVITO_SEGMENT", entity.ChildrenRestrict, false)
+	assert.NoError(t, err)
+	assert.Equal(t, repository.ErrSegmentAlreadyDeleted, repo.UpdateSegment(context.Background(), "AVITO_SEGMENT", entity.SegmentMetadataUpdate{}))
+}
+
+func testGetAllSegmentsFilter(t *testing.T, newRepository NewRepository) {
+	repo := newRepository(t, fixedtimeprovider.New(timeBase))
+
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_VOICE", entity.SegmentMetadata{
+		Owner:      "growth",
+		Tags:       []string{"voice", "beta"},
+		Attributes: map[string]any{"priority": 1, "region": "msk", "limits": map[string]any{"daily": 10}},
+	}))
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_DISCOUNT", entity.SegmentMetadata{
+		Owner:      "marketing",
+		Tags:       []string{"discount"},
+		Attributes: map[string]any{"priority": 2, "region": "msk"},
+	}))
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_DELETED", entity.SegmentMetadata{Owner: "growth", Tags: []string{"beta"}}))
+	_, err := repo.DeleteSegment(context.Background(), "AVITO_DELETED", entity.ChildrenRestrict, false)
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name         string
+		filter       entity.SegmentFilter
+		expectActive []string
+		expectAll    []string
+	}{
+		{
+			name:         "no filter",
+			expectActive: []string{"AVITO_VOICE", "AVITO_DISCOUNT"},
+			expectAll:    []string{"AVITO_VOICE", "AVITO_DISCOUNT", "AVITO_DELETED"},
+		},
+		{
+			name:         "owner",
+			filter:       entity.SegmentFilter{Owner: "growth"},
+			expectActive: []string{"AVITO_VOICE"},
+			expectAll:    []string{"AVITO_VOICE", "AVITO_DELETED"},
+		},
+		{
+			name:         "all tags must match",
+			filter:       entity.SegmentFilter{Tags: []string{"beta", "voice"}},
+			expectActive: []string{"AVITO_VOICE"},
+			expectAll:    []string{"AVITO_VOICE"},
+		},
+		{
+			name:         "attributes",
+			filter:       entity.SegmentFilter{Attributes: map[string]any{"region": "msk", "priority": 2}},
+			expectActive: []string{"AVITO_DISCOUNT"},
+			expectAll:    []string{"AVITO_DISCOUNT"},
+		},
+		{
+			name:         "nested attribute must be equal",
+			filter:       entity.SegmentFilter{Attributes: map[string]any{"limits": map[string]any{}}},
+			expectActive: []string{},
+			expectAll:    []string{},
+		},
+		{
+			name:         "nested attribute",
+			filter:       entity.SegmentFilter{Attributes: map[string]any{"limits": map[string]any{"daily": 10}}},
+			expectActive: []string{"AVITO_VOICE"},
+			expectAll:    []string{"AVITO_VOICE"},
+		},
+	}
+
+	slugs := func(segments []entity.Segment) []string {
+		result := make([]string, 0, len(segments))
+		for _, s := range segments {
+			result = append(result, s.Slug)
+		}
+		return result
+	}
+
+	for _, tt := range testCases {
+		active, err := repo.GetAllActiveSegments(context.Background(), tt.filter)
+		assert.NoError(t, err, tt.name)
+		assert.Equal(t, tt.expectActive, slugs(active), tt.name)
+
+		all, err := repo.GetAllSegments(context.Background(), tt.filter)
+		assert.NoError(t, err, tt.name)
+		assert.Equal(t, tt.expectAll, slugs(all), tt.name)
+	}
+}
+
+func testRenameSegment(t *testing.T, newRepository NewRepository) {
+	timeProvider := fixedtimeprovider.New(timeBase)
+	repo := newRepository(t, timeProvider)
+
+	assert.Equal(t, repository.ErrSegmentNotFound, repo.RenameSegment(context.Background(), "AVITO_NO_SEGMENT", "AVITO_NEW"))
+
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_OLD", entity.SegmentMetadata{}))
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_OTHER", entity.SegmentMetadata{}))
+	_, err := repo.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_OLD"}}, nil)
+	assert.NoError(t, err)
+
+	// slugs of other segments can't be taken
+	assert.Equal(t, repository.ErrSegmentAlreadyExists, repo.RenameSegment(context.Background(), "AVITO_OLD", "AVITO_OTHER"))
+
+	timeProvider.SetTime(timeBase.Add(time.Hour))
+	assert.NoError(t, repo.RenameSegment(context.Background(), "AVITO_OLD", "AVITO_MIDDLE"))
+	assert.NoError(t, repo.RenameSegment(context.Background(), "AVITO_OLD", "AVITO_NEW")) // aliases resolve to the segment
+
+	// aliases occupy the slug
+	assert.Equal(t, repository.ErrSegmentAlreadyExists, repo.CreateSegment(context.Background(), "AVITO_OLD", entity.SegmentMetadata{}))
+	assert.Equal(t, repository.ErrSegmentAlreadyExists, repo.RenameSegment(context.Background(), "AVITO_OTHER", "AVITO_MIDDLE"))
+
+	// membership can be changed through an alias
+	_, err = repo.UpdateUserSegments(context.Background(), 1000, nil, []entity.SegmentExpiration{{Slug: "AVITO_MIDDLE"}})
+	assert.NoError(t, err)
+	_, err = repo.UpdateUserSegments(context.Background(), 1001, []entity.SegmentExpiration{{Slug: "AVITO_OLD"}}, nil)
+	assert.NoError(t, err)
+
+	segments, err := repo.GetActiveUserSegments(context.Background(), 1001)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.UserSegment{{Slug: "AVITO_NEW", AddedAt: timeBase.Add(time.Hour)}}, segments)
+
+	// history is kept and reported under the current slug
+	operations, err := repo.DumpHistory(context.Background(), 1000, timeBase, timeBase.Add(24*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Operation{
+		{UserID: 1000, SegmentSlug: "AVITO_NEW", Type: entity.AddedOperationType, Time: timeBase},
+		{UserID: 1000, SegmentSlug: "AVITO_NEW", Type: entity.RemovedOperationType, Time: timeBase.Add(time.Hour)},
+	}, operations)
+
+	allSegments, err := repo.GetAllSegments(context.Background(), entity.SegmentFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Segment{
+		{Slug: "AVITO_NEW", Aliases: []string{"AVITO_OLD", "AVITO_MIDDLE"}, CreatedAt: timeBase},
+		{Slug: "AVITO_OTHER", CreatedAt: timeBase},
+	}, allSegments)
+
+	// renaming back to an alias of the same segment is allowed
+	assert.NoError(t, repo.RenameSegment(context.Background(), "AVITO_NEW", "AVITO_OLD"))
+	allSegments, err = repo.GetAllSegments(context.Background(), entity.SegmentFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"AVITO_MIDDLE", "AVITO_NEW"}, allSegments[0].Aliases)
+	assert.Equal(t, "AVITO_OLD", allSegments[0].Slug)
+
+	_, err = repo.DeleteSegment(context.Background(), "AVITO_NEW", entity.ChildrenRestrict, false)
+	assert.NoError(t, err)
+	assert.Equal(t, repository.ErrSegmentAlreadyDeleted, repo.RenameSegment(context.Background(), "AVITO_OLD", "AVITO_RESTORED"))
+}
+
+func testRestoreSegment(t *testing.T, newRepository NewRepository) {
+	timeProvider := fixedtimeprovider.New(timeBase)
+	repo := newRepository(t, timeProvider)
+
+	_, err := repo.RestoreSegment(context.Background(), "AVITO_NO_SEGMENT", true)
+	assert.Equal(t, repository.ErrSegmentNotFound, err)
+
+	expiresSoon := timeBase.Add(2 * time.Hour)
+	expiresLater := timeBase.Add(24 * time.Hour)
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_SEGMENT", entity.SegmentMetadata{}))
+	_, err = repo.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_SEGMENT"}}, nil)
+	assert.NoError(t, err)
+	_, err = repo.UpdateUserSegments(context.Background(), 1001, []entity.SegmentExpiration{{Slug: "AVITO_SEGMENT"}}, nil)
+	assert.NoError(t, err)
+	_, err = repo.UpdateUserSegments(context.Background(), 1002, []entity.SegmentExpiration{{Slug: "AVITO_SEGMENT", ExpiresAt: &expiresSoon}}, nil)
+	assert.NoError(t, err)
+	_, err = repo.UpdateUserSegments(context.Background(), 1003, []entity.SegmentExpiration{{Slug: "AVITO_SEGMENT", ExpiresAt: &expiresLater}}, nil)
+	assert.NoError(t, err)
+
+	_, err = repo.RestoreSegment(context.Background(), "AVITO_SEGMENT", true)
+	assert.Equal(t, repository.ErrSegmentNotDeleted, err)
+
+	// user 1001 is removed manually before the deletion
+	timeProvider.SetTime(timeBase.Add(time.Hour))
+	_, err = repo.UpdateUserSegments(context.Background(), 1001, nil, []entity.SegmentExpiration{{Slug: "AVITO_SEGMENT"}})
+	assert.NoError(t, err)
+
+	timeProvider.SetTime(timeBase.Add(90 * time.Minute))
+	_, err = repo.DeleteSegment(context.Background(), "AVITO_SEGMENT", entity.ChildrenRestrict, false)
+	assert.NoError(t, err)
+
+	// membership of user 1002 would have expired by now
+	timeProvider.SetTime(timeBase.Add(3 * time.Hour))
+	restored, err := repo.RestoreSegment(context.Background(), "AVITO_SEGMENT", true)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Operation{
+		{UserID: 1000, SegmentSlug: "AVITO_SEGMENT", Type: entity.SegmentRestoredOperationType, Time: timeBase.Add(3 * time.Hour)},
+		{UserID: 1003, SegmentSlug: "AVITO_SEGMENT", Type: entity.SegmentRestoredOperationType, Time: timeBase.Add(3 * time.Hour), ExpiresAt: &expiresLater},
+	}, restored)
+
+	for userID, expectResult := range map[int][]entity.UserSegment{
+		1000: {{Slug: "AVITO_SEGMENT", AddedAt: timeBase}},
+		1001: {},
+		1002: {},
+		1003: {{Slug: "AVITO_SEGMENT", AddedAt: timeBase, ExpiresAt: &expiresLater}},
+	} {
+		segments, err := repo.GetActiveUserSegments(context.Background(), userID)
+		assert.NoError(t, err)
+		assert.Equal(t, expectResult, segments, userID)
+	}
+
+	operations, err := repo.DumpHistory(context.Background(), 1000, timeBase.Add(time.Hour), timeBase.Add(24*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Operation{
+		{UserID: 1000, SegmentSlug: "AVITO_SEGMENT", Type: entity.SegmentDeletedOperationType, Time: timeBase.Add(90 * time.Minute)},
+		{UserID: 1000, SegmentSlug: "AVITO_SEGMENT", Type: entity.SegmentRestoredOperationType, Time: timeBase.Add(3 * time.Hour)},
+	}, operations)
+
+	activeSegments, err := repo.GetAllActiveSegments(context.Background(), entity.SegmentFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Segment{{Slug: "AVITO_SEGMENT", CreatedAt: timeBase}}, activeSegments)
+
+	// memberships can be left removed
+	_, err = repo.DeleteSegment(context.Background(), "AVITO_SEGMENT", entity.ChildrenRestrict, false)
+	assert.NoError(t, err)
+	restored, err = repo.RestoreSegment(context.Background(), "AVITO_SEGMENT", false)
+	assert.NoError(t, err)
+	assert.Len(t, restored, 0)
+
+	segments, err := repo.GetActiveUserSegments(context.Background(), 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.UserSegment{}, segments)
+}
+
+func testEraseUser(t *testing.T, newRepository NewRepository) {
+	timeProvider := fixedtimeprovider.New(timeBase)
+	repo := newRepository(t, timeProvider)
+
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_SEGMENT", entity.SegmentMetadata{}))
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_OTHER", entity.SegmentMetadata{}))
+	_, _, err := repo.AddSegmentToUsers(context.Background(), "AVITO_SEGMENT", []int{1000, 1001}, nil)
+	assert.NoError(t, err)
+	_, err = repo.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_OTHER"}}, nil)
+	assert.NoError(t, err)
+
+	timeProvider.SetTime(timeBase.Add(time.Hour))
+	_, err = repo.UpdateUserSegments(context.Background(), 1000, nil, []entity.SegmentExpiration{{Slug: "AVITO_OTHER"}})
+	assert.NoError(t, err)
+
+	timeProvider.SetTime(timeBase.Add(2 * time.Hour))
+	erasure, err := repo.EraseUser(context.Background(), 1000, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, entity.Erasure{
+		UserID:           1000,
+		ErasedAt:         timeBase.Add(2 * time.Hour),
+		MembershipsCount: 2,
+		OperationsCount:  3,
+		FilesCount:       3,
+	}, erasure)
+
+	segments, err := repo.GetActiveUserSegments(context.Background(), 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.UserSegment{}, segments)
+
+	operations, err := repo.DumpHistory(context.Background(), 1000, timeBase, timeBase.Add(24*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Operation{}, operations)
+
+	// other users are left intact
+	segments, err = repo.GetActiveUserSegments(context.Background(), 1001)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.UserSegment{{Slug: "AVITO_SEGMENT", AddedAt: timeBase}}, segments)
+
+	// the user can get segments again after the erasure
+	_, err = repo.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_SEGMENT"}}, nil)
+	assert.NoError(t, err)
+	segments, err = repo.GetActiveUserSegments(context.Background(), 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.UserSegment{{Slug: "AVITO_SEGMENT", AddedAt: timeBase.Add(2 * time.Hour)}}, segments)
+}
+
+func testListSegments(t *testing.T, newRepository NewRepository) {
+	timeProvider := fixedtimeprovider.New(timeBase)
+	repo := newRepository(t, timeProvider)
+
+	// segments are created an hour apart
+	slugs := []string{"AVITO_VOICE", "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50", "OTHER_VOICE", "AVITO_DELETED"}
+	for i, slug := range slugs {
+		timeProvider.SetTime(timeBase.Add(time.Duration(i) * time.Hour))
+		assert.NoError(t, repo.CreateSegment(context.Background(), slug, entity.SegmentMetadata{}))
+	}
+	timeProvider.SetTime(timeBase.Add(10 * time.Hour))
+	_, err := repo.DeleteSegment(context.Background(), "AVITO_DELETED", entity.ChildrenRestrict, false)
+	assert.NoError(t, err)
+
+	createdFrom := timeBase.Add(time.Hour)
+	createdTo := timeBase.Add(3 * time.Hour)
+	deletedFrom := timeBase.Add(10 * time.Hour)
+
+	testCases := []struct {
+		name        string
+		filter      entity.SegmentFilter
+		page        entity.SegmentPageRequest
+		expectPages [][]string
+	}{
+		{
+			name:        "creation order",
+			page:        entity.SegmentPageRequest{Limit: 2},
+			expectPages: [][]string{{"AVITO_VOICE", "AVITO_DISCOUNT_30"}, {"AVITO_DISCOUNT_50", "OTHER_VOICE"}, {"AVITO_DELETED"}},
+		},
+		{
+			name:        "slug descending",
+			filter:      entity.SegmentFilter{OnlyActive: true},
+			page:        entity.SegmentPageRequest{SortBy: entity.SortBySlug, Descending: true, Limit: 3},
+			expectPages: [][]string{{"OTHER_VOICE", "AVITO_VOICE", "AVITO_DISCOUNT_50"}, {"AVITO_DISCOUNT_30"}},
+		},
+		{
+			name:        "last page is full",
+			filter:      entity.SegmentFilter{SlugPrefix: "AVITO_DISCOUNT"},
+			page:        entity.SegmentPageRequest{Limit: 2},
+			expectPages: [][]string{{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"}},
+		},
+		{
+			name:        "substring",
+			filter:      entity.SegmentFilter{SlugContains: "VOICE"},
+			expectPages: [][]string{{"AVITO_VOICE", "OTHER_VOICE"}},
+		},
+		{
+			name:        "search is case-sensitive",
+			filter:      entity.SegmentFilter{SlugContains: "voice"},
+			expectPages: [][]string{{}},
+		},
+		{
+			name:        "creation range",
+			filter:      entity.SegmentFilter{CreatedFrom: &createdFrom, CreatedTo: &createdTo},
+			expectPages: [][]string{{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"}},
+		},
+		{
+			name:        "deletion range",
+			filter:      entity.SegmentFilter{DeletedFrom: &deletedFrom},
+			expectPages: [][]string{{"AVITO_DELETED"}},
+		},
+	}
+
+	for _, tt := range testCases {
+		page := tt.page
+		for i, expectPage := range tt.expectPages {
+			result, err := repo.ListSegments(context.Background(), tt.filter, page)
+			assert.NoError(t, err, tt.name)
+
+			got := make([]string, 0, len(result.Segments))
+			for _, s := range result.Segments {
+				got = append(got, s.Slug)
+			}
+			assert.Equal(t, expectPage, got, "%s: page %d", tt.name, i)
+
+			// only the last page has no cursor
+			assert.Equal(t, i == len(tt.expectPages)-1, result.NextCursor == "", "%s: page %d", tt.name, i)
+			page.Cursor = result.NextCursor
+		}
+	}
+
+	// cursors can't be reused with another order
+	result, err := repo.ListSegments(context.Background(), entity.SegmentFilter{}, entity.SegmentPageRequest{Limit: 1})
+	assert.NoError(t, err)
+	_, err = repo.ListSegments(context.Background(), entity.SegmentFilter{}, entity.SegmentPageRequest{Limit: 1, Cursor: result.NextCursor, Descending: true})
+	assert.Equal(t, repository.ErrInvalidCursor, err)
+	_, err = repo.ListSegments(context.Background(), entity.SegmentFilter{}, entity.SegmentPageRequest{Limit: 1, Cursor: "garbage"})
+	assert.Equal(t, repository.ErrInvalidCursor, err)
+}
+
+func testSegmentMembers(t *testing.T, newRepository NewRepository) {
+	timeProvider := fixedtimeprovider.New(timeBase)
+	repo := newRepository(t, timeProvider)
+
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_VOICE", entity.SegmentMetadata{}))
+	_, _, err := repo.AddSegmentToUsers(context.Background(), "AVITO_VOICE", []int{5, 3, 1}, nil)
+	assert.NoError(t, err)
+
+	// user 3 leaves and user 7 joins for two hours an hour later
+	timeProvider.SetTime(timeBase.Add(time.Hour))
+	expiresAt := timeBase.Add(3 * time.Hour)
+	_, err = repo.UpdateUserSegments(context.Background(), 3, nil, []entity.SegmentExpiration{{Slug: "AVITO_VOICE"}})
+	assert.NoError(t, err)
+	_, err = repo.UpdateUserSegments(context.Background(), 7, []entity.SegmentExpiration{{Slug: "AVITO_VOICE", ExpiresAt: &expiresAt}}, nil)
+	assert.NoError(t, err)
+	timeProvider.SetTime(timeBase.Add(2 * time.Hour))
+
+	testCases := []struct {
+		name   string
+		asOf   time.Time
+		expect []int
+	}{
+		{"now", time.Time{}, []int{1, 5, 7}},
+		{"before the changes", timeBase.Add(30 * time.Minute), []int{1, 3, 5}},
+		{"after the expiration", timeBase.Add(4 * time.Hour), []int{1, 5}},
+		{"before the segment", timeBase.Add(-time.Hour), []int{}},
+	}
+
+	for _, tt := range testCases {
+		result, err := repo.GetSegmentMembers(context.Background(), "AVITO_VOICE", entity.SegmentMembersRequest{AsOf: tt.asOf})
+		assert.NoError(t, err, tt.name)
+		assert.Equal(t, tt.expect, result.UserIDs, tt.name)
+		assert.Empty(t, result.NextCursor, tt.name)
+
+		streamed := []int{}
+		err = repo.StreamSegmentMembers(context.Background(), "AVITO_VOICE", tt.asOf, func(userID int) error {
+			streamed = append(streamed, userID)
+			return nil
+		})
+		assert.NoError(t, err, tt.name)
+		assert.Equal(t, tt.expect, streamed, tt.name)
+	}
+
+	// the next page is built for the moment of the first one even if the time has passed
+	first, err := repo.GetSegmentMembers(context.Background(), "AVITO_VOICE", entity.SegmentMembersRequest{Limit: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 5}, first.UserIDs)
+	assert.True(t, timeBase.Add(2*time.Hour).Equal(first.AsOf))
+
+	timeProvider.SetTime(timeBase.Add(5 * time.Hour))
+	_, err = repo.DeleteSegment(context.Background(), "AVITO_VOICE", entity.ChildrenRestrict, false)
+	assert.NoError(t, err)
+
+	second, err := repo.GetSegmentMembers(context.Background(), "AVITO_VOICE", entity.SegmentMembersRequest{Limit: 2, Cursor: first.NextCursor})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{7}, second.UserIDs)
+	assert.Empty(t, second.NextCursor)
+
+	// deleted segment has no members now
+	result, err := repo.GetSegmentMembers(context.Background(), "AVITO_VOICE", entity.SegmentMembersRequest{})
+	assert.NoError(t, err)
+	assert.Empty(t, result.UserIDs)
+
+	// cursor can't be used for another moment
+	_, err = repo.GetSegmentMembers(context.Background(), "AVITO_VOICE", entity.SegmentMembersRequest{AsOf: timeBase, Cursor: first.NextCursor})
+	assert.Equal(t, repository.ErrInvalidCursor, err)
+
+	_, err = repo.GetSegmentMembers(context.Background(), "AVITO_NONEXISTENT", entity.SegmentMembersRequest{})
+	assert.Equal(t, repository.ErrSegmentNotFound, err)
+	err = repo.StreamSegmentMembers(context.Background(), "AVITO_NONEXISTENT", time.Time{}, func(userID int) error { return nil })
+	assert.Equal(t, repository.ErrSegmentNotFound, err)
+
+	// streaming stops at the first error
+	stop := errors.New("stop")
+	calls := 0
+	err = repo.StreamSegmentMembers(context.Background(), "AVITO_VOICE", timeBase, func(userID int) error {
+		calls++
+		return stop
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, 1, calls)
+}
+
+func testSegmentStats(t *testing.T, newRepository NewRepository) {
+	timeProvider := fixedtimeprovider.New(timeBase)
+	repo := newRepository(t, timeProvider)
+
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_VOICE", entity.SegmentMetadata{}))
+	_, _, err := repo.AddSegmentToUsers(context.Background(), "AVITO_VOICE", []int{1, 2, 3}, nil)
+	assert.NoError(t, err)
+
+	// a day later user 1 leaves and user 4 joins for a day
+	timeProvider.SetTime(timeBase.Add(24 * time.Hour))
+	expiresAt := timeBase.Add(48 * time.Hour)
+	_, err = repo.UpdateUserSegments(context.Background(), 1, nil, []entity.SegmentExpiration{{Slug: "AVITO_VOICE"}})
+	assert.NoError(t, err)
+	_, err = repo.UpdateUserSegments(context.Background(), 4, []entity.SegmentExpiration{{Slug: "AVITO_VOICE", ExpiresAt: &expiresAt}}, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, repo.RenameSegment(context.Background(), "AVITO_VOICE", "AVITO_VOICE_MESSAGES"))
+	timeProvider.SetTime(timeBase.Add(72 * time.Hour))
+
+	day := func(d int) time.Time { return time.Date(2000, time.November, d, 0, 0, 0, 0, time.UTC) }
+
+	stats, err := repo.GetSegmentStats(context.Background(), "AVITO_VOICE", day(15), day(19))
+	assert.NoError(t, err)
+	assert.Equal(t, entity.SegmentStats{
+		Slug:        "AVITO_VOICE_MESSAGES",
+		ActiveCount: 2,
+		From:        day(15),
+		To:          day(19),
+		Days: []entity.SegmentDayStats{
+			{Date: day(15), Added: 3},
+			{Date: day(16), Added: 1, Removed: 1},
+			{Date: day(17), Expired: 1},
+			{Date: day(18)},
+		},
+	}, stats)
+
+	// changes outside of the window are left out
+	stats, err = repo.GetSegmentStats(context.Background(), "AVITO_VOICE_MESSAGES", day(16), day(17))
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.SegmentDayStats{{Date: day(16), Added: 1, Removed: 1}}, stats.Days)
+
+	// deletion removes the rest of the users
+	_, err = repo.DeleteSegment(context.Background(), "AVITO_VOICE_MESSAGES", entity.ChildrenRestrict, false)
+	assert.NoError(t, err)
+	stats, err = repo.GetSegmentStats(context.Background(), "AVITO_VOICE_MESSAGES", day(18), day(19))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, stats.ActiveCount)
+	assert.Equal(t, []entity.SegmentDayStats{{Date: day(18), Removed: 2}}, stats.Days)
+
+	_, err = repo.GetSegmentStats(context.Background(), "AVITO_NONEXISTENT", day(15), day(19))
+	assert.Equal(t, repository.ErrSegmentNotFound, err)
+}
+
+func testListSegmentsMemberCounts(t *testing.T, newRepository NewRepository) {
+	timeProvider := fixedtimeprovider.New(timeBase)
+	repo := newRepository(t, timeProvider)
+
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_VOICE", entity.SegmentMetadata{}))
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_EMPTY", entity.SegmentMetadata{}))
+	_, _, err := repo.AddSegmentToUsers(context.Background(), "AVITO_VOICE", []int{1, 2, 3}, nil)
+	assert.NoError(t, err)
+	_, err = repo.UpdateUserSegments(context.Background(), 2, nil, []entity.SegmentExpiration{{Slug: "AVITO_VOICE"}})
+	assert.NoError(t, err)
+
+	result, err := repo.ListSegments(context.Background(), entity.SegmentFilter{}, entity.SegmentPageRequest{SortBy: entity.SortBySlug, WithMemberCounts: true})
+	assert.NoError(t, err)
+
+	counts := make([]int, 0, len(result.Segments))
+	for _, s := range result.Segments {
+		if assert.NotNil(t, s.MemberCount, s.Slug) {
+			counts = append(counts, *s.MemberCount)
+		}
+	}
+	assert.Equal(t, []int{0, 2}, counts)
+
+	// counts are left out unless requested
+	result, err = repo.ListSegments(context.Background(), entity.SegmentFilter{}, entity.SegmentPageRequest{})
+	assert.NoError(t, err)
+	for _, s := range result.Segments {
+		assert.Nil(t, s.MemberCount, s.Slug)
+	}
+}
+
+func testDefaultTTL(t *testing.T, newRepository NewRepository) {
+	timeProvider := fixedtimeprovider.New(timeBase)
+	repo := newRepository(t, timeProvider)
+
+	monthLater := timeBase.Add(30 * 24 * time.Hour)
+	weekLater := timeBase.Add(7 * 24 * time.Hour)
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_PROMO", entity.SegmentMetadata{DefaultTTL: "P30D"}))
+
+	// the default applies unless the expiration is given explicitly
+	operations, err := repo.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_PROMO"}}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Operation{
+		{UserID: 1000, SegmentSlug: "AVITO_PROMO", Type: entity.AddedOperationType, Time: timeBase, ExpiresAt: &monthLater},
+	}, operations)
+
+	_, err = repo.UpdateUserSegments(context.Background(), 1001, []entity.SegmentExpiration{{Slug: "AVITO_PROMO", ExpiresAt: &weekLater}}, nil)
+	assert.NoError(t, err)
+
+	// enrollment applies it as well
+	result, _, err := repo.AddSegmentToUsers(context.Background(), "AVITO_PROMO", []int{1000, 1002}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, entity.EnrollmentResult{EnrolledCount: 1, SkippedCount: 1}, result)
+
+	for userID, expiresAt := range map[int]*time.Time{1000: &monthLater, 1001: &weekLater, 1002: &monthLater} {
+		segments, err := repo.GetActiveUserSegments(context.Background(), userID)
+		assert.NoError(t, err)
+		assert.Equal(t, []entity.UserSegment{{Slug: "AVITO_PROMO", AddedAt: timeBase, ExpiresAt: expiresAt}}, segments, userID)
+	}
+
+	// explicit expiration of the enrollment takes precedence over the default, existing members are skipped
+	result, _, err = repo.AddSegmentToUsers(context.Background(), "AVITO_PROMO", []int{1001, 1004}, &weekLater)
+	assert.NoError(t, err)
+	assert.Equal(t, entity.EnrollmentResult{EnrolledCount: 1, SkippedCount: 1}, result)
+
+	segments, err := repo.GetActiveUserSegments(context.Background(), 1004)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.UserSegment{{Slug: "AVITO_PROMO", AddedAt: timeBase, ExpiresAt: &weekLater}}, segments)
+
+	all, err := repo.GetAllSegments(context.Background(), entity.SegmentFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, "P30D", all[0].DefaultTTL)
+
+	// removing the default leaves existing memberships as they are
+	empty := ""
+	assert.NoError(t, repo.UpdateSegment(context.Background(), "AVITO_PROMO", entity.SegmentMetadataUpdate{DefaultTTL: &empty}))
+	_, err = repo.UpdateUserSegments(context.Background(), 1003, []entity.SegmentExpiration{{Slug: "AVITO_PROMO"}}, nil)
+	assert.NoError(t, err)
+
+	segments, err = repo.GetActiveUserSegments(context.Background(), 1003)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.UserSegment{{Slug: "AVITO_PROMO", AddedAt: timeBase}}, segments)
+
+	segments, err = repo.GetActiveUserSegments(context.Background(), 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.UserSegment{{Slug: "AVITO_PROMO", AddedAt: timeBase, ExpiresAt: &monthLater}}, segments)
+
+	all, err = repo.GetAllSegments(context.Background(), entity.SegmentFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, "", all[0].DefaultTTL)
+}
+
+func testScheduledMemberships(t *testing.T, newRepository NewRepository) {
+	timeProvider := fixedtimeprovider.New(timeBase)
+	repo := newRepository(t, timeProvider)
+
+	dayLater := timeBase.Add(24 * time.Hour)
+	monthAfterStart := dayLater.Add(30 * 24 * time.Hour)
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_PROMO", entity.SegmentMetadata{DefaultTTL: "P30D"}))
+
+	operations, err := repo.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_PROMO", StartsAt: &dayLater}}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Operation{
+		{UserID: 1000, SegmentSlug: "AVITO_PROMO", Type: entity.AddedOperationType, Time: dayLater, ExpiresAt: &monthAfterStart},
+	}, operations)
+
+	// adding the segment again while it's scheduled does nothing
+	operations, err = repo.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_PROMO"}}, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, operations)
+
+	// the membership is neither active nor in history before it starts
+	segments, err := repo.GetActiveUserSegments(context.Background(), 1000)
+	assert.NoError(t, err)
+	assert.Empty(t, segments)
+
+	history, err := repo.DumpHistory(context.Background(), 1000, timeBase, timeBase.Add(48*time.Hour))
+	assert.NoError(t, err)
+	assert.Empty(t, history)
+
+	// it can't expire before it starts
+	_, err = repo.UpdateUserSegmentExpirations(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_PROMO", ExpiresAt: &dayLater}})
+	assert.ErrorIs(t, err, repository.ErrExpirationBeforeStart)
+
+	timeProvider.SetTime(dayLater)
+
+	segments, err = repo.GetActiveUserSegments(context.Background(), 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.UserSegment{{Slug: "AVITO_PROMO", AddedAt: dayLater, ExpiresAt: &monthAfterStart}}, segments)
+
+	history, err = repo.DumpHistory(context.Background(), 1000, timeBase, timeBase.Add(48*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Operation{
+		{UserID: 1000, SegmentSlug: "AVITO_PROMO", Type: entity.AddedOperationType, Time: dayLater, ExpiresAt: &monthAfterStart},
+	}, history)
+}
+
+func testCancelScheduledMembership(t *testing.T, newRepository NewRepository) {
+	timeProvider := fixedtimeprovider.New(timeBase)
+	repo := newRepository(t, timeProvider)
+
+	dayLater := timeBase.Add(24 * time.Hour)
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_PROMO", entity.SegmentMetadata{}))
+
+	_, err := repo.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_PROMO", StartsAt: &dayLater}}, nil)
+	assert.NoError(t, err)
+
+	// removing it before the start closes it right at the start, so it's never active
+	operations, err := repo.UpdateUserSegments(context.Background(), 1000, nil, []entity.SegmentExpiration{{Slug: "AVITO_PROMO"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Operation{
+		{UserID: 1000, SegmentSlug: "AVITO_PROMO", Type: entity.RemovedOperationType, Time: dayLater},
+	}, operations)
+
+	timeProvider.SetTime(dayLater.Add(time.Hour))
+
+	segments, err := repo.GetActiveUserSegments(context.Background(), 1000)
+	assert.NoError(t, err)
+	assert.Empty(t, segments)
+
+	// the segment can be added again right away
+	operations, err = repo.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_PROMO"}}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, operations, 1)
+}
+
+func testRestoreScheduledMembership(t *testing.T, newRepository NewRepository) {
+	timeProvider := fixedtimeprovider.New(timeBase)
+	repo := newRepository(t, timeProvider)
+
+	dayLater := timeBase.Add(24 * time.Hour)
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_PROMO", entity.SegmentMetadata{}))
+
+	_, err := repo.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_PROMO", StartsAt: &dayLater}}, nil)
+	assert.NoError(t, err)
+
+	// the deletion closes the scheduled membership at its start
+	timeProvider.SetTime(timeBase.Add(time.Hour))
+	_, err = repo.DeleteSegment(context.Background(), "AVITO_PROMO", entity.ChildrenRestrict, false)
+	assert.NoError(t, err)
+
+	timeProvider.SetTime(timeBase.Add(2 * time.Hour))
+	restored, err := repo.RestoreSegment(context.Background(), "AVITO_PROMO", true)
+	assert.NoError(t, err)
+	assert.Len(t, restored, 1)
+
+	// it's scheduled again and starts as it was meant to
+	segments, err := repo.GetActiveUserSegments(context.Background(), 1000)
+	assert.NoError(t, err)
+	assert.Empty(t, segments)
+
+	timeProvider.SetTime(dayLater)
+
+	segments, err = repo.GetActiveUserSegments(context.Background(), 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.UserSegment{{Slug: "AVITO_PROMO", AddedAt: dayLater}}, segments)
+}
+
+func testRestoreCancelledScheduledMembership(t *testing.T, newRepository NewRepository) {
+	timeProvider := fixedtimeprovider.New(timeBase)
+	repo := newRepository(t, timeProvider)
+
+	dayLater := timeBase.Add(24 * time.Hour)
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_PROMO", entity.SegmentMetadata{}))
+
+	_, err := repo.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_PROMO", StartsAt: &dayLater}}, nil)
+	assert.NoError(t, err)
+	_, err = repo.UpdateUserSegments(context.Background(), 1001, []entity.SegmentExpiration{{Slug: "AVITO_PROMO", StartsAt: &dayLater}}, nil)
+	assert.NoError(t, err)
+
+	// the user cancels one of them, so it's closed at its start just like the deletion closes the other one
+	_, err = repo.UpdateUserSegments(context.Background(), 1000, nil, []entity.SegmentExpiration{{Slug: "AVITO_PROMO"}})
+	assert.NoError(t, err)
+
+	timeProvider.SetTime(timeBase.Add(time.Hour))
+	operations, err := repo.DeleteSegment(context.Background(), "AVITO_PROMO", entity.ChildrenRestrict, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Operation{
+		{UserID: 1001, SegmentSlug: "AVITO_PROMO", Type: entity.SegmentDeletedOperationType, Time: dayLater},
+	}, operations)
+
+	// only the one closed by the deletion comes back
+	timeProvider.SetTime(timeBase.Add(2 * time.Hour))
+	operations, err = repo.RestoreSegment(context.Background(), "AVITO_PROMO", true)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Operation{
+		{UserID: 1001, SegmentSlug: "AVITO_PROMO", Type: entity.SegmentRestoredOperationType, Time: timeBase.Add(2 * time.Hour)},
+	}, operations)
+
+	timeProvider.SetTime(dayLater)
+
+	segments, err := repo.GetActiveUserSegments(context.Background(), 1000)
+	assert.NoError(t, err)
+	assert.Empty(t, segments)
+
+	segments, err = repo.GetActiveUserSegments(context.Background(), 1001)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.UserSegment{{Slug: "AVITO_PROMO", AddedAt: dayLater}}, segments)
+}
+
+func testSegmentHierarchy(t *testing.T, newRepository NewRepository) {
+	repo := newRepository(t, fixedtimeprovider.New(timeBase))
+
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_PROMO", entity.SegmentMetadata{}))
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_PROMO_SUMMER", entity.SegmentMetadata{Parent: "AVITO_PROMO"}))
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_PROMO_SUMMER_EU", entity.SegmentMetadata{Parent: "AVITO_PROMO_SUMMER"}))
+	assert.ErrorIs(t, repo.CreateSegment(context.Background(), "AVITO_ORPHAN", entity.SegmentMetadata{Parent: "AVITO_NO_SEGMENT"}), repository.ErrParentNotFound)
+
+	parents, err := repo.GetSegmentParents(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"AVITO_PROMO_SUMMER": "AVITO_PROMO", "AVITO_PROMO_SUMMER_EU": "AVITO_PROMO_SUMMER"}, parents)
+
+	// a segment can't be moved under itself or its descendants
+	for _, parent := range []string{"AVITO_PROMO", "AVITO_PROMO_SUMMER_EU"} {
+		err := repo.UpdateSegment(context.Background(), "AVITO_PROMO", entity.SegmentMetadataUpdate{Parent: &parent})
+		assert.ErrorIs(t, err, repository.ErrSegmentCycle, parent)
+	}
+
+	// the parent follows renames and can be cleared
+	assert.NoError(t, repo.RenameSegment(context.Background(), "AVITO_PROMO", "AVITO_PROMOTIONS"))
+	empty := ""
+	assert.NoError(t, repo.UpdateSegment(context.Background(), "AVITO_PROMO_SUMMER_EU", entity.SegmentMetadataUpdate{Parent: &empty}))
+
+	segments, err := repo.GetAllSegments(context.Background(), entity.SegmentFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, "", segments[0].Parent)
+	assert.Equal(t, "AVITO_PROMOTIONS", segments[1].Parent)
+	assert.Equal(t, "", segments[2].Parent)
+}
+
+func testDeleteSegmentChildren(t *testing.T, newRepository NewRepository) {
+	timeProvider := fixedtimeprovider.New(timeBase)
+	repo := newRepository(t, timeProvider)
+
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_PROMO", entity.SegmentMetadata{}))
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_PROMO_SUMMER", entity.SegmentMetadata{Parent: "AVITO_PROMO"}))
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_PROMO_SUMMER_EU", entity.SegmentMetadata{Parent: "AVITO_PROMO_SUMMER"}))
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_PROMO_WINTER", entity.SegmentMetadata{Parent: "AVITO_PROMO"}))
+	_, err := repo.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_PROMO_SUMMER_EU"}}, nil)
+	assert.NoError(t, err)
+
+	// segment with active children isn't deleted unless told what to do with them
+	_, err = repo.DeleteSegment(context.Background(), "AVITO_PROMO", entity.ChildrenRestrict, false)
+	assert.ErrorIs(t, err, repository.ErrSegmentHasChildren)
+
+	// cascade deletes the whole subtree along with its memberships
+	timeProvider.SetTime(timeBase.Add(time.Hour))
+	_, err = repo.DeleteSegment(context.Background(), "AVITO_PROMO_SUMMER", entity.ChildrenCascade, false)
+	assert.NoError(t, err)
+
+	active, err := repo.GetAllActiveSegments(context.Background(), entity.SegmentFilter{})
+	assert.NoError(t, err)
+	assert.Len(t, active, 2)
+
+	history, err := repo.DumpHistory(context.Background(), 1000, timeBase, timeBase.Add(2*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, entity.Operation{
+		UserID: 1000, SegmentSlug: "AVITO_PROMO_SUMMER_EU", Type: entity.SegmentDeletedOperationType, Time: timeBase.Add(time.Hour),
+	}, history[1])
+
+	// active children can be detached instead
+	_, err = repo.DeleteSegment(context.Background(), "AVITO_PROMO", entity.ChildrenDetach, false)
+	assert.NoError(t, err)
+
+	parents, err := repo.GetSegmentParents(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, parents)
+
+	// a segment is restored as a top-level one if its parent is still deleted
+	_, err = repo.RestoreSegment(context.Background(), "AVITO_PROMO_SUMMER_EU", false)
+	assert.NoError(t, err)
+
+	parents, err = repo.GetSegmentParents(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, parents)
+}
+
+func testCompositeSegments(t *testing.T, newRepository NewRepository) {
+	repo := newRepository(t, fixedtimeprovider.New(timeBase))
+
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_VOICE_MESSAGES", entity.SegmentMetadata{}))
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_PERFORMANCE_VAS", entity.SegmentMetadata{}))
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_VOICE_NO_VAS", entity.SegmentMetadata{Expression: "AVITO_VOICE_MESSAGES and not AVITO_PERFORMANCE_VAS"}))
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_VOICE_OR_VAS", entity.SegmentMetadata{Expression: "AVITO_VOICE_NO_VAS OR AVITO_PERFORMANCE_VAS"}))
+	assert.ErrorIs(t, repo.CreateSegment(context.Background(), "AVITO_BROKEN", entity.SegmentMetadata{Expression: "AVITO_NO_SEGMENT"}), repository.ErrReferenceNotFound)
+	assert.ErrorIs(t, repo.CreateSegment(context.Background(), "AVITO_SELF", entity.SegmentMetadata{Expression: "AVITO_SELF"}), repository.ErrExpressionCycle)
+
+	// memberships of composite segments are computed, not stored
+	_, _, err := repo.AddSegmentToUsers(context.Background(), "AVITO_VOICE_NO_VAS", []int{1000}, nil)
+	assert.ErrorIs(t, err, repository.ErrSegmentComposite)
+	_, err = repo.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_VOICE_NO_VAS"}}, nil)
+	assert.ErrorIs(t, err, repository.ErrSegmentComposite)
+
+	// only composite segments have an expression, and it can't depend on the segment itself
+	expression := "AVITO_VOICE_OR_VAS"
+	assert.ErrorIs(t, repo.UpdateSegment(context.Background(), "AVITO_PERFORMANCE_VAS", entity.SegmentMetadataUpdate{Expression: &expression}), repository.ErrNotComposite)
+	assert.ErrorIs(t, repo.UpdateSegment(context.Background(), "AVITO_VOICE_NO_VAS", entity.SegmentMetadataUpdate{Expression: &expression}), repository.ErrExpressionCycle)
+
+	// expressions follow renames of the segments they reference
+	assert.NoError(t, repo.RenameSegment(context.Background(), "AVITO_VOICE_MESSAGES", "AVITO_VOICE"))
+
+	composites, err := repo.GetCompositeSegments(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"AVITO_VOICE_NO_VAS": "AVITO_VOICE AND NOT AVITO_PERFORMANCE_VAS",
+		"AVITO_VOICE_OR_VAS": "AVITO_VOICE_NO_VAS OR AVITO_PERFORMANCE_VAS",
+	}, composites)
+
+	segments, err := repo.GetAllSegments(context.Background(), entity.SegmentFilter{Slug: "AVITO_VOICE_MESSAGES"})
+	assert.NoError(t, err)
+	if assert.Len(t, segments, 1) {
+		assert.Equal(t, "AVITO_VOICE", segments[0].Slug)
+	}
+
+	// referenced segments are only deleted by force or along with the composite segments
+	_, err = repo.DeleteSegment(context.Background(), "AVITO_VOICE_NO_VAS", entity.ChildrenRestrict, false)
+	assert.ErrorIs(t, err, repository.ErrSegmentReferenced)
+	_, err = repo.DeleteSegment(context.Background(), "AVITO_PERFORMANCE_VAS", entity.ChildrenRestrict, true)
+	assert.NoError(t, err)
+	_, err = repo.DeleteSegment(context.Background(), "AVITO_VOICE_OR_VAS", entity.ChildrenRestrict, false)
+	assert.NoError(t, err)
+	_, err = repo.DeleteSegment(context.Background(), "AVITO_VOICE_NO_VAS", entity.ChildrenRestrict, false)
+	assert.NoError(t, err)
+}
+
+func testDynamicSegments(t *testing.T, newRepository NewRepository) {
+	repo := newRepository(t, fixedtimeprovider.New(timeBase))
+
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_STATIC", entity.SegmentMetadata{}))
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_RU", entity.SegmentMetadata{Rule: `country = "RU"`, DefaultTTL: "P30D"}))
+
+	// memberships of dynamic segments are only changed by their rules
+	_, _, err := repo.AddSegmentToUsers(context.Background(), "AVITO_RU", []int{1000}, nil)
+	assert.ErrorIs(t, err, repository.ErrSegmentDynamic)
+	_, err = repo.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_RU"}}, nil)
+	assert.ErrorIs(t, err, repository.ErrSegmentDynamic)
+	_, err = repo.SyncSegmentMembers(context.Background(), "AVITO_STATIC", []int{1000})
+	assert.ErrorIs(t, err, repository.ErrNotDynamic)
+
+	// only dynamic segments have a rule
+	rule := `country = "KZ"`
+	assert.ErrorIs(t, repo.UpdateSegment(context.Background(), "AVITO_STATIC", entity.SegmentMetadataUpdate{Rule: &rule}), repository.ErrNotDynamic)
+	assert.NoError(t, repo.UpdateSegment(context.Background(), "AVITO_RU", entity.SegmentMetadataUpdate{Rule: &rule}))
+
+	segments, err := repo.GetAllSegments(context.Background(), entity.SegmentFilter{Slug: "AVITO_RU"})
+	assert.NoError(t, err)
+	if assert.Len(t, segments, 1) {
+		assert.Equal(t, rule, segments[0].Rule)
+	}
+
+	operations, err := repo.SyncSegmentMembers(context.Background(), "AVITO_RU", []int{1001, 1000})
+	assert.NoError(t, err)
+	expiresAt := timeBase.Add(30 * 24 * time.Hour)
+	assert.Equal(t, []entity.Operation{
+		{UserID: 1000, SegmentSlug: "AVITO_RU", Type: entity.AddedOperationType, Time: timeBase, ExpiresAt: &expiresAt},
+		{UserID: 1001, SegmentSlug: "AVITO_RU", Type: entity.AddedOperationType, Time: timeBase, ExpiresAt: &expiresAt},
+	}, operations)
+
+	// users that are already in the segment are kept, the ones that aren't matched anymore are removed
+	operations, err = repo.SyncSegmentMembers(context.Background(), "AVITO_RU", []int{1001, 1002})
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.Operation{
+		{UserID: 1002, SegmentSlug: "AVITO_RU", Type: entity.AddedOperationType, Time: timeBase, ExpiresAt: &expiresAt},
+		{UserID: 1000, SegmentSlug: "AVITO_RU", Type: entity.RemovedOperationType, Time: timeBase, ExpiresAt: &expiresAt},
+	}, operations)
+
+	userSegments, err := repo.GetActiveUserSegments(context.Background(), 1000)
+	assert.NoError(t, err)
+	assert.Empty(t, userSegments)
+
+	history, err := repo.DumpHistory(context.Background(), 1000, timeBase, timeBase.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Len(t, history, 2)
+
+	_, err = repo.DeleteSegment(context.Background(), "AVITO_RU", entity.ChildrenRestrict, false)
+	assert.NoError(t, err)
+	_, err = repo.SyncSegmentMembers(context.Background(), "AVITO_RU", nil)
+	assert.ErrorIs(t, err, repository.ErrSegmentAlreadyDeleted)
+}
+
+func testExclusionGroups(t *testing.T, newRepository NewRepository) {
+	repo := newRepository(t, fixedtimeprovider.New(timeBase))
+
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_EXP_A", entity.SegmentMetadata{ExclusionGroup: "AVITO_EXP"}))
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_EXP_B", entity.SegmentMetadata{ExclusionGroup: "AVITO_EXP"}))
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_EXP_C", entity.SegmentMetadata{}))
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_RU", entity.SegmentMetadata{Rule: `country = "RU"`}))
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_EXP_AB", entity.SegmentMetadata{Expression: "AVITO_EXP_A OR AVITO_EXP_B"}))
+
+	// user can't be in several segments of the group, not even in one request
+	_, err := repo.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_EXP_A"}, {Slug: "AVITO_EXP_B"}}, nil)
+	assert.ErrorIs(t, err, repository.ErrExclusionConflict)
+	_, err = repo.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_EXP_A"}}, nil)
+	assert.NoError(t, err)
+	_, err = repo.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_EXP_B"}}, nil)
+	assert.ErrorIs(t, err, repository.ErrExclusionConflict)
+
+	// moving to another segment of the group is removing the current one in the same request
+	operations, err := repo.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_EXP_B"}}, []entity.SegmentExpiration{{Slug: "AVITO_EXP_A"}})
+	assert.NoError(t, err)
+	assert.Len(t, operations, 2)
+
+	segments, err := repo.GetActiveUserSegments(context.Background(), 1000)
+	assert.NoError(t, err)
+	if assert.Len(t, segments, 1) {
+		assert.Equal(t, "AVITO_EXP_B", segments[0].Slug)
+	}
+
+	// enrollment skips users that are already in the group
+	result, _, err := repo.AddSegmentToUsers(context.Background(), "AVITO_EXP_A", []int{1000, 1001, 1002}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, entity.EnrollmentResult{EnrolledCount: 2, ExcludedCount: 1}, result)
+
+	// the users that enrollment would exclude can be found beforehand
+	members, err := repo.GetExclusionGroupMembers(context.Background(), "AVITO_EXP_A", []int{1003, 1002, 1000, 1001, 1000})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1000}, members)
+	members, err = repo.GetExclusionGroupMembers(context.Background(), "AVITO_EXP_B", []int{1000, 1001, 1002, 1003})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1001, 1002}, members)
+	members, err = repo.GetExclusionGroupMembers(context.Background(), "AVITO_EXP_C", []int{1000, 1001, 1002})
+	assert.NoError(t, err)
+	assert.Empty(t, members)
+	_, err = repo.GetExclusionGroupMembers(context.Background(), "AVITO_NO_SEGMENT", []int{1000})
+	assert.ErrorIs(t, err, repository.ErrSegmentNotFound)
+
+	// composite and dynamic segments can't be in a group, other segments can't join it while their members conflict
+	group := "AVITO_EXP"
+	assert.ErrorIs(t, repo.UpdateSegment(context.Background(), "AVITO_EXP_AB", entity.SegmentMetadataUpdate{ExclusionGroup: &group}), repository.ErrSegmentComposite)
+	assert.ErrorIs(t, repo.UpdateSegment(context.Background(), "AVITO_RU", entity.SegmentMetadataUpdate{ExclusionGroup: &group}), repository.ErrSegmentDynamic)
+	_, err = repo.UpdateUserSegments(context.Background(), 1001, []entity.SegmentExpiration{{Slug: "AVITO_EXP_C"}}, nil)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, repo.UpdateSegment(context.Background(), "AVITO_EXP_C", entity.SegmentMetadataUpdate{ExclusionGroup: &group}), repository.ErrExclusionConflict)
+
+	// restored memberships that would conflict with the group are left removed
+	_, err = repo.DeleteSegment(context.Background(), "AVITO_EXP_AB", entity.ChildrenRestrict, false)
+	assert.NoError(t, err)
+	_, err = repo.DeleteSegment(context.Background(), "AVITO_EXP_B", entity.ChildrenRestrict, false)
+	assert.NoError(t, err)
+	_, err = repo.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_EXP_A"}}, nil)
+	assert.NoError(t, err)
+	restored, err := repo.RestoreSegment(context.Background(), "AVITO_EXP_B", true)
+	assert.NoError(t, err)
+	assert.Len(t, restored, 0)
+
+	segments, err = repo.GetActiveUserSegments(context.Background(), 1000)
+	assert.NoError(t, err)
+	if assert.Len(t, segments, 1) {
+		assert.Equal(t, "AVITO_EXP_A", segments[0].Slug)
+	}
+
+	empty := ""
+	assert.NoError(t, repo.UpdateSegment(context.Background(), "AVITO_EXP_B", entity.SegmentMetadataUpdate{ExclusionGroup: &empty}))
+	all, err := repo.GetAllSegments(context.Background(), entity.SegmentFilter{ExclusionGroup: "AVITO_EXP"})
+	assert.NoError(t, err)
+	if assert.Len(t, all, 1) {
+		assert.Equal(t, "AVITO_EXP_A", all[0].Slug)
+		assert.Equal(t, "AVITO_EXP", all[0].ExclusionGroup)
+	}
+}
+
+func testBucketedSegments(t *testing.T, newRepository NewRepository) {
+	repo := newRepository(t, fixedtimeprovider.New(timeBase))
+
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_BUCKETED", entity.SegmentMetadata{BucketSalt: "AVITO_SALT", BucketPercent: 10}))
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_STATIC", entity.SegmentMetadata{}))
+
+	// memberships of bucketed segments are decided by the hash of user id
+	_, _, err := repo.AddSegmentToUsers(context.Background(), "AVITO_BUCKETED", []int{1000}, nil)
+	assert.ErrorIs(t, err, repository.ErrSegmentBucketed)
+	_, err = repo.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_BUCKETED"}}, nil)
+	assert.ErrorIs(t, err, repository.ErrSegmentBucketed)
+	_, err = repo.UpdateUserSegmentExpirations(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_BUCKETED"}})
+	assert.ErrorIs(t, err, repository.ErrSegmentBucketed)
+
+	// only bucketed segments have a percent, and they can't be in an exclusion group
+	percent := 30
+	assert.ErrorIs(t, repo.UpdateSegment(context.Background(), "AVITO_STATIC", entity.SegmentMetadataUpdate{BucketPercent: &percent}), repository.ErrNotBucketed)
+	group := "AVITO_EXP"
+	assert.ErrorIs(t, repo.UpdateSegment(context.Background(), "AVITO_BUCKETED", entity.SegmentMetadataUpdate{ExclusionGroup: &group}), repository.ErrSegmentBucketed)
+	assert.NoError(t, repo.UpdateSegment(context.Background(), "AVITO_BUCKETED", entity.SegmentMetadataUpdate{BucketPercent: &percent}))
+
+	segments, err := repo.GetAllSegments(context.Background(), entity.SegmentFilter{Bucketed: true})
+	assert.NoError(t, err)
+	if assert.Len(t, segments, 1) {
+		assert.Equal(t, "AVITO_BUCKETED", segments[0].Slug)
+		assert.Equal(t, "AVITO_SALT", segments[0].BucketSalt)
+		assert.Equal(t, 30, segments[0].BucketPercent)
+	}
+}
+
+func testExperiments(t *testing.T, newRepository NewRepository) {
+	timeProvider := fixedtimeprovider.New(timeBase)
+	repo := newRepository(t, timeProvider)
+
+	variants := []entity.ExperimentVariant{{Slug: "AVITO_EXP_A", Weight: 45}, {Slug: "AVITO_EXP_B", Weight: 45}, {Slug: "AVITO_EXP_CONTROL", Weight: 10}}
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_TAKEN", entity.SegmentMetadata{}))
+
+	// taken variant slugs leave nothing behind
+	err := repo.CreateExperiment(context.Background(), "AVITO_EXP", []entity.ExperimentVariant{{Slug: "AVITO_EXP_A", Weight: 50}, {Slug: "AVITO_TAKEN", Weight: 50}})
+	assert.ErrorIs(t, err, repository.ErrSegmentAlreadyExists)
+	_, err = repo.GetExperiment(context.Background(), "AVITO_EXP")
+	assert.ErrorIs(t, err, repository.ErrExperimentNotFound)
+
+	assert.NoError(t, repo.CreateExperiment(context.Background(), "AVITO_EXP", variants))
+	assert.ErrorIs(t, repo.CreateExperiment(context.Background(), "AVITO_EXP", []entity.ExperimentVariant{{Slug: "AVITO_EXP_D", Weight: 100}}), repository.ErrExperimentAlreadyExists)
+
+	// variants are segments of the exclusion group named after the experiment
+	segments, err := repo.GetAllActiveSegments(context.Background(), entity.SegmentFilter{ExclusionGroup: "AVITO_EXP"})
+	assert.NoError(t, err)
+	assert.Len(t, segments, 3)
+
+	_, err = repo.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_EXP_A"}}, nil)
+	assert.NoError(t, err)
+	result, _, err := repo.AddSegmentToUsers(context.Background(), "AVITO_EXP_B", []int{1000, 1001}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, entity.EnrollmentResult{EnrolledCount: 1, ExcludedCount: 1}, result)
+
+	// the experiment is started and stopped once
+	assert.ErrorIs(t, repo.StopExperiment(context.Background(), "AVITO_EXP"), repository.ErrExperimentNotStarted)
+	assert.ErrorIs(t, repo.StartExperiment(context.Background(), "AVITO_NONE"), repository.ErrExperimentNotFound)
+	assert.NoError(t, repo.StartExperiment(context.Background(), "AVITO_EXP"))
+	assert.ErrorIs(t, repo.StartExperiment(context.Background(), "AVITO_EXP"), repository.ErrExperimentAlreadyStarted)
+
+	stoppedAt := timeBase.Add(24 * time.Hour)
+	timeProvider.SetTime(stoppedAt)
+	assert.NoError(t, repo.StopExperiment(context.Background(), "AVITO_EXP"))
+	assert.ErrorIs(t, repo.StopExperiment(context.Background(), "AVITO_EXP"), repository.ErrExperimentAlreadyStopped)
+
+	// variants are listed by their current slugs
+	assert.NoError(t, repo.RenameSegment(context.Background(), "AVITO_EXP_CONTROL", "AVITO_EXP_C"))
+	experiment, err := repo.GetExperiment(context.Background(), "AVITO_EXP")
+	assert.NoError(t, err)
+	assert.Equal(t, entity.Experiment{
+		Slug:      "AVITO_EXP",
+		Variants:  []entity.ExperimentVariant{{Slug: "AVITO_EXP_A", Weight: 45}, {Slug: "AVITO_EXP_B", Weight: 45}, {Slug: "AVITO_EXP_C", Weight: 10}},
+		CreatedAt: timeBase,
+		StartedAt: &timeBase,
+		StoppedAt: &stoppedAt,
+	}, experiment)
+
+	assert.NoError(t, repo.CreateExperiment(context.Background(), "AVITO_EXP_2", []entity.ExperimentVariant{{Slug: "AVITO_EXP_2_A", Weight: 50}, {Slug: "AVITO_EXP_2_B", Weight: 50}}))
+	experiments, err := repo.GetAllExperiments(context.Background())
+	assert.NoError(t, err)
+	if assert.Len(t, experiments, 2) {
+		assert.Equal(t, experiment, experiments[0])
+		assert.Equal(t, "AVITO_EXP_2", experiments[1].Slug)
+		assert.Nil(t, experiments[1].StartedAt)
+	}
+
+	// deleted variants aren't looked up
+	_, err = repo.DeleteSegment(context.Background(), "AVITO_EXP_2_B", entity.ChildrenRestrict, false)
+	assert.NoError(t, err)
+	variantsBySlug, err := repo.GetExperimentVariants(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"AVITO_EXP_A":   "AVITO_EXP",
+		"AVITO_EXP_B":   "AVITO_EXP",
+		"AVITO_EXP_C":   "AVITO_EXP",
+		"AVITO_EXP_2_A": "AVITO_EXP_2",
+	}, variantsBySlug)
+}
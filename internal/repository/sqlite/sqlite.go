@@ -0,0 +1,2495 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/entity"
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/repository"
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/timeprovider"
+	"github.com/golang-migrate/migrate/v4"
+	sqlitemigrate "github.com/golang-migrate/migrate/v4/database/sqlite"
+	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// dsnParams are appended to the database path.
+// Times are written in a format that is ordered lexicographically (as long as
+// all of them are in UTC) so that they can be compared right in the queries
+const dsnParams = "?_time_format=sqlite&_txlock=immediate&_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)"
+
+// segmentSlugCondition matches the segment by its current slug or by one of its aliases, the slug is `$1`
+const segmentSlugCondition = "(slug=$1 OR id=(SELECT segment_id FROM segment_aliases WHERE slug=$1))"
+
+// isUniqueViolation reports whether the error is a violation of a unique constraint
+func isUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
+
+type SqliteRepository struct {
+	db           *sql.DB
+	timeProvider timeprovider.TimeProvider
+}
+
+// now returns current time in UTC; every time that is written to the database must be in UTC
+func (s *SqliteRepository) now() time.Time {
+	return s.timeProvider.Now().UTC()
+}
+
+// timePtr converts nullable time read from the database to a pointer to it in UTC
+func timePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+
+	utc := t.Time.UTC()
+	return &utc
+}
+
+// Migrate brings the database up to date using migrations from `sourceURL`
+func (s *SqliteRepository) Migrate(sourceURL string) error {
+	driver, err := sqlitemigrate.WithInstance(s.db, &sqlitemigrate.Config{})
+	if err != nil {
+		return fmt.Errorf("Migrate() - sqlitemigrate.WithInstance(): %w", err)
+	}
+
+	// !!NOTE!!: m.Close() is not called since it would close the repository's connection
+	m, err := migrate.NewWithDatabaseInstance(sourceURL, "sqlite", driver)
+	if err != nil {
+		return fmt.Errorf("Migrate() - migrate.NewWithDatabaseInstance(): %w", err)
+	}
+
+	if err := m.Up(); err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return fmt.Errorf("Migrate() - m.Up(): %w", err)
+	}
+
+	return nil
+}
+
+func (s *SqliteRepository) CreateSegment(ctx context.Context, slug string, metadata entity.SegmentMetadata) error {
+	tags, attributes, err := repository.MarshalMetadata(metadata.Tags, metadata.Attributes)
+	if err != nil {
+		return fmt.Errorf("CreateSegment() - repository.MarshalMetadata(): %w", err)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("CreateSegment() - s.db.BeginTx(): %w", err)
+	}
+	defer tx.Rollback()
+
+	// check if there is a segment under this slug, either current or an alias
+	var cnt int
+	row := tx.QueryRowContext(ctx,
+		"SELECT (SELECT COUNT(*) FROM segments WHERE slug=$1) + (SELECT COUNT(*) FROM segment_aliases WHERE slug=$1)",
+		slug,
+	)
+	if err := row.Scan(&cnt); err != nil {
+		return fmt.Errorf("CreateSegment() - tx.QueryRowContext(): %w", err)
+	}
+
+	if cnt != 0 {
+		return repository.ErrSegmentAlreadyExists
+	}
+
+	var parentID sql.NullInt64
+	if metadata.Parent != "" {
+		id, err := parentSegmentID(ctx, tx, metadata.Parent)
+		if err != nil {
+			if errors.Is(err, repository.ErrParentNotFound) {
+				return err
+			}
+
+			return fmt.Errorf("CreateSegment() - %w", err)
+		}
+
+		parentID = sql.NullInt64{Int64: int64(id), Valid: true}
+	}
+
+	expression := ""
+	if metadata.Expression != "" {
+		expression, err = resolveExpression(ctx, tx, slug, metadata.Expression)
+		if err != nil {
+			if errors.Is(err, repository.ErrReferenceNotFound) || errors.Is(err, repository.ErrExpressionCycle) {
+				return err
+			}
+
+			return fmt.Errorf("CreateSegment() - %w", err)
+		}
+	}
+
+	groupID, err := exclusionGroupID(ctx, tx, metadata.ExclusionGroup, s.now())
+	if err != nil {
+		return fmt.Errorf("CreateSegment() - %w", err)
+	}
+
+	// create the segment
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO segments(slug, created_at, description, owner, tags, attributes, default_ttl, parent_id, expression, rule, exclusion_group_id, bucket_salt, bucket_percent)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+		slug, s.now(), metadata.Description, metadata.Owner, string(tags), string(attributes), metadata.DefaultTTL, parentID, expression, metadata.Rule, groupID,
+		metadata.BucketSalt, metadata.BucketPercent,
+	)
+	if err != nil {
+		if isUniqueViolation(err) { // created by a concurrent transaction after the check
+			return repository.ErrSegmentAlreadyExists
+		}
+
+		return fmt.Errorf("CreateSegment() - tx.ExecContext(): %w", err)
+	}
+
+	// commit changes
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("CreateSegment() - tx.Commit(): %w", err)
+	}
+
+	return nil
+}
+
+func (s *SqliteRepository) UpdateSegment(ctx context.Context, slug string, update entity.SegmentMetadataUpdate) error {
+	// nil values are passed as NULL and leave the column unchanged
+	var tags, attributes sql.NullString
+	if update.Tags != nil {
+		b, err := json.Marshal(update.Tags)
+		if err != nil {
+			return fmt.Errorf("UpdateSegment() - json.Marshal(): %w", err)
+		}
+		tags = sql.NullString{String: string(b), Valid: true}
+	}
+
+	if update.Attributes != nil {
+		b, err := json.Marshal(update.Attributes)
+		if err != nil {
+			return fmt.Errorf("UpdateSegment() - json.Marshal(): %w", err)
+		}
+		attributes = sql.NullString{String: string(b), Valid: true}
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("UpdateSegment() - s.db.BeginTx(): %w", err)
+	}
+	defer tx.Rollback()
+
+	segmentID, currentSlug, err := activeSegmentID(ctx, tx, slug)
+	if err != nil {
+		if errors.Is(err, repository.ErrSegmentNotFound) || errors.Is(err, repository.ErrSegmentAlreadyDeleted) {
+			return err
+		}
+
+		return fmt.Errorf("UpdateSegment() - %w", err)
+	}
+
+	var composite, dynamic, bucketed bool
+	if update.Expression != nil || update.Rule != nil || update.ExclusionGroup != nil || update.BucketPercent != nil {
+		row := tx.QueryRowContext(ctx, "SELECT expression<>'', rule<>'', bucket_salt<>'' FROM segments WHERE id=$1", segmentID)
+		if err := row.Scan(&composite, &dynamic, &bucketed); err != nil {
+			return fmt.Errorf("UpdateSegment() - tx.QueryRowContext(): %w", err)
+		}
+	}
+
+	if update.Rule != nil && !dynamic {
+		return repository.ErrNotDynamic
+	}
+
+	if update.BucketPercent != nil && !bucketed {
+		return repository.ErrNotBucketed
+	}
+
+	var groupID sql.NullInt64
+	if update.ExclusionGroup != nil && *update.ExclusionGroup != "" {
+		if composite {
+			return repository.ErrSegmentComposite
+		}
+
+		if dynamic {
+			return repository.ErrSegmentDynamic
+		}
+
+		if bucketed {
+			return repository.ErrSegmentBucketed
+		}
+
+		groupID, err = exclusionGroupID(ctx, tx, *update.ExclusionGroup, s.now())
+		if err != nil {
+			return fmt.Errorf("UpdateSegment() - %w", err)
+		}
+
+		// members of the segment must not be in other segments of the new group
+		var conflict bool
+		row := tx.QueryRowContext(ctx,
+			`SELECT EXISTS(
+				SELECT 1 FROM users_segments us
+				WHERE us.segment_id=$1
+				AND us.removed_at IS NULL
+				AND (us.expires_at IS NULL OR us.expires_at > $3)
+				AND `+inExclusionGroupCondition("us.user_id", "$1", "$2", "$3")+`
+			)`,
+			segmentID, groupID, s.now(),
+		)
+		if err := row.Scan(&conflict); err != nil {
+			return fmt.Errorf("UpdateSegment() - tx.QueryRowContext(): %w", err)
+		}
+
+		if conflict {
+			return repository.ErrExclusionConflict
+		}
+	}
+
+	var expression sql.NullString
+	if update.Expression != nil {
+		if !composite {
+			return repository.ErrNotComposite
+		}
+
+		resolved, err := resolveExpression(ctx, tx, currentSlug, *update.Expression)
+		if err != nil {
+			if errors.Is(err, repository.ErrReferenceNotFound) || errors.Is(err, repository.ErrExpressionCycle) {
+				return err
+			}
+
+			return fmt.Errorf("UpdateSegment() - %w", err)
+		}
+		expression = sql.NullString{String: resolved, Valid: true}
+	}
+
+	// update the metadata
+	_, err = tx.ExecContext(ctx,
+		`UPDATE segments SET
+			description = COALESCE($2, description),
+			owner = COALESCE($3, owner),
+			tags = COALESCE($4, tags),
+			attributes = COALESCE($5, attributes),
+			default_ttl = COALESCE($6, default_ttl),
+			expression = COALESCE($7, expression),
+			rule = COALESCE($8, rule),
+			bucket_percent = COALESCE($9, bucket_percent)
+		WHERE id=$1`,
+		segmentID, update.Description, update.Owner, tags, attributes, update.DefaultTTL, expression, update.Rule, update.BucketPercent,
+	)
+	if err != nil {
+		return fmt.Errorf("UpdateSegment() - tx.ExecContext(): %w", err)
+	}
+
+	// the empty group leaves NULL and takes the segment out of its group
+	if update.ExclusionGroup != nil {
+		_, err = tx.ExecContext(ctx, "UPDATE segments SET exclusion_group_id=$2 WHERE id=$1", segmentID, groupID)
+		if err != nil {
+			return fmt.Errorf("UpdateSegment() - tx.ExecContext(): %w", err)
+		}
+	}
+
+	if update.Parent != nil {
+		if err := setSegmentParent(ctx, tx, segmentID, *update.Parent); err != nil {
+			if errors.Is(err, repository.ErrParentNotFound) || errors.Is(err, repository.ErrSegmentCycle) {
+				return err
+			}
+
+			return fmt.Errorf("UpdateSegment() - %w", err)
+		}
+	}
+
+	// commit changes
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("UpdateSegment() - tx.Commit(): %w", err)
+	}
+
+	return nil
+}
+
+func (s *SqliteRepository) RenameSegment(ctx context.Context, slug string, newSlug string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("RenameSegment() - s.db.BeginTx(): %w", err)
+	}
+	defer tx.Rollback()
+
+	// get the segment by its current slug or an alias
+	var segmentID int
+	var currentSlug string
+	var deletedAt sql.NullTime
+	row := tx.QueryRowContext(ctx, "SELECT id, slug, deleted_at FROM segments WHERE "+segmentSlugCondition, slug)
+	if err := row.Scan(&segmentID, &currentSlug, &deletedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) { // no such segment at all
+			return repository.ErrSegmentNotFound
+		}
+
+		return fmt.Errorf("RenameSegment() - tx.QueryRowContext(): %w", err)
+	}
+
+	if deletedAt.Valid { // deleted segments can't be renamed
+		return repository.ErrSegmentAlreadyDeleted
+	}
+
+	if newSlug == currentSlug { // nothing to do
+		return nil
+	}
+
+	// check if the new slug is free. The only exception is an alias of this very segment,
+	// it stops being an alias and becomes the current slug again
+	var cnt int
+	row = tx.QueryRowContext(ctx,
+		`SELECT (SELECT COUNT(*) FROM segments WHERE slug=$1)
+		+ (SELECT COUNT(*) FROM segment_aliases WHERE slug=$1 AND segment_id<>$2)`,
+		newSlug, segmentID,
+	)
+	if err := row.Scan(&cnt); err != nil {
+		return fmt.Errorf("RenameSegment() - tx.QueryRowContext(): %w", err)
+	}
+
+	if cnt != 0 {
+		return repository.ErrSegmentAlreadyExists
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM segment_aliases WHERE slug=$1", newSlug)
+	if err != nil {
+		return fmt.Errorf("RenameSegment() - tx.ExecContext(): %w", err)
+	}
+
+	// keep the current slug as an alias and rename the segment
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO segment_aliases(slug, segment_id, created_at) VALUES ($1, $2, $3)",
+		currentSlug, segmentID, s.now(),
+	)
+	if err != nil {
+		return fmt.Errorf("RenameSegment() - tx.ExecContext(): %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE segments SET slug=$2 WHERE id=$1", segmentID, newSlug)
+	if err != nil {
+		if isUniqueViolation(err) { // taken by a concurrent transaction after the check
+			return repository.ErrSegmentAlreadyExists
+		}
+
+		return fmt.Errorf("RenameSegment() - tx.ExecContext(): %w", err)
+	}
+
+	// composite segments that reference the segment reference it by the new slug
+	composites, err := compositeExpressions(ctx, tx, false)
+	if err != nil {
+		return fmt.Errorf("RenameSegment() - %w", err)
+	}
+
+	renamed, err := repository.RenameReferences(composites, currentSlug, newSlug)
+	if err != nil {
+		return fmt.Errorf("RenameSegment() - repository.RenameReferences(): %w", err)
+	}
+
+	for composite, expression := range renamed {
+		_, err = tx.ExecContext(ctx, "UPDATE segments SET expression=$2 WHERE slug=$1", composite, expression)
+		if err != nil {
+			return fmt.Errorf("RenameSegment() - tx.ExecContext(): %w", err)
+		}
+	}
+
+	// commit changes
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("RenameSegment() - tx.Commit(): %w", err)
+	}
+
+	return nil
+}
+
+// activeSegmentID returns id and current slug of the segment by this slug or alias, or `ErrSegmentNotFound`
+// and `ErrSegmentAlreadyDeleted` if it doesn't exist or was deleted
+func activeSegmentID(ctx context.Context, tx *sql.Tx, slug string) (int, string, error) {
+	var id int
+	var currentSlug string
+	var deletedAt sql.NullTime
+	row := tx.QueryRowContext(ctx, "SELECT id, slug, deleted_at FROM segments WHERE "+segmentSlugCondition, slug)
+	if err := row.Scan(&id, &currentSlug, &deletedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) { // segment doesn't exist
+			return 0, "", repository.ErrSegmentNotFound
+		}
+
+		return 0, "", fmt.Errorf("tx.QueryRowContext(): %w", err)
+	}
+
+	if deletedAt.Valid { // segment is already deleted
+		return 0, "", repository.ErrSegmentAlreadyDeleted
+	}
+
+	return id, currentSlug, nil
+}
+
+// parentSegmentID returns the id of the active segment that is going to be a parent,
+// or `ErrParentNotFound` if there is no such segment
+func parentSegmentID(ctx context.Context, tx *sql.Tx, slug string) (int, error) {
+	id, _, err := activeSegmentID(ctx, tx, slug)
+	if errors.Is(err, repository.ErrSegmentNotFound) || errors.Is(err, repository.ErrSegmentAlreadyDeleted) {
+		return 0, repository.ErrParentNotFound
+	} else if err != nil {
+		return 0, fmt.Errorf("parentSegmentID() - %w", err)
+	}
+
+	return id, nil
+}
+
+// memberSegmentID is `activeSegmentID` for segments whose memberships can be changed,
+// it returns `ErrSegmentComposite` for composite segments, `ErrSegmentDynamic` for dynamic ones
+// and `ErrSegmentBucketed` for bucketed ones
+func memberSegmentID(ctx context.Context, tx *sql.Tx, slug string) (int, string, error) {
+	id, currentSlug, err := activeSegmentID(ctx, tx, slug)
+	if err != nil {
+		return 0, "", err
+	}
+
+	var composite, dynamic, bucketed bool
+	row := tx.QueryRowContext(ctx, "SELECT expression<>'', rule<>'', bucket_salt<>'' FROM segments WHERE id=$1", id)
+	if err := row.Scan(&composite, &dynamic, &bucketed); err != nil {
+		return 0, "", fmt.Errorf("tx.QueryRowContext(): %w", err)
+	}
+
+	if composite {
+		return 0, "", repository.ErrSegmentComposite
+	}
+
+	if dynamic {
+		return 0, "", repository.ErrSegmentDynamic
+	}
+
+	if bucketed {
+		return 0, "", repository.ErrSegmentBucketed
+	}
+
+	return id, currentSlug, nil
+}
+
+// exclusionGroupNameColumn is an SQL expression that selects the name of the exclusion group of a row of `segments`,
+// empty for segments that aren't in one
+const exclusionGroupNameColumn = "COALESCE((SELECT g.name FROM exclusion_groups g WHERE g.id=segments.exclusion_group_id), '')"
+
+// exclusionGroupID returns the id of the exclusion group with this name, creating the group if there is none yet.
+// Returns NULL for the empty name
+func exclusionGroupID(ctx context.Context, tx *sql.Tx, name string, now time.Time) (sql.NullInt64, error) {
+	if name == "" {
+		return sql.NullInt64{}, nil
+	}
+
+	_, err := tx.ExecContext(ctx, "INSERT INTO exclusion_groups(name, created_at) VALUES ($1, $2) ON CONFLICT (name) DO NOTHING", name, now)
+	if err != nil {
+		return sql.NullInt64{}, fmt.Errorf("exclusionGroupID() - tx.ExecContext(): %w", err)
+	}
+
+	var id sql.NullInt64
+	if err := tx.QueryRowContext(ctx, "SELECT id FROM exclusion_groups WHERE name=$1", name).Scan(&id); err != nil {
+		return sql.NullInt64{}, fmt.Errorf("exclusionGroupID() - tx.QueryRowContext(): %w", err)
+	}
+
+	return id, nil
+}
+
+// inExclusionGroupCondition is an SQL condition that holds if the user has an open membership at `now`
+// in a segment of the exclusion group other than the segment. Arguments are SQL expressions,
+// the condition never holds for a NULL group
+func inExclusionGroupCondition(userID string, segmentID string, groupID string, now string) string {
+	return fmt.Sprintf(`EXISTS(
+		SELECT 1 FROM users_segments g
+		JOIN segments gs ON gs.id=g.segment_id
+		WHERE g.user_id=%[1]s
+		AND gs.id<>%[2]s
+		AND gs.exclusion_group_id=%[3]s
+		AND g.removed_at IS NULL
+		AND (g.expires_at IS NULL OR g.expires_at > %[4]s)
+	)`, userID, segmentID, groupID, now)
+}
+
+// segmentExclusionGroup is an SQL expression for the exclusion group id of the segment `$1`
+const segmentExclusionGroup = "(SELECT exclusion_group_id FROM segments WHERE id=$1)"
+
+// compositeExpressions returns the expressions of composite segments by their slugs,
+// deleted ones too unless `onlyActive` is set
+func compositeExpressions(ctx context.Context, tx *sql.Tx, onlyActive bool) (map[string]string, error) {
+	query := "SELECT slug, expression FROM segments WHERE expression<>''"
+	if onlyActive {
+		query += " AND deleted_at IS NULL"
+	}
+
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("compositeExpressions() - tx.QueryContext(): %w", err)
+	}
+	defer rows.Close()
+
+	composites := make(map[string]string)
+	for rows.Next() {
+		var slug, expression string
+		if err := rows.Scan(&slug, &expression); err != nil {
+			return nil, fmt.Errorf("compositeExpressions() - rows.Scan(): %w", err)
+		}
+
+		composites[slug] = expression
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("compositeExpressions() - rows.Err(): %w", err)
+	}
+
+	return composites, nil
+}
+
+// resolveExpression checks the expression of the composite segment `slug` and rewrites it with current slugs
+// of the referenced segments. Returns `ErrReferenceNotFound` if any of them isn't an active segment
+// and `ErrExpressionCycle` if the segment would depend on itself
+func resolveExpression(ctx context.Context, tx *sql.Tx, slug string, expression string) (string, error) {
+	composites, err := compositeExpressions(ctx, tx, false)
+	if err != nil {
+		return "", fmt.Errorf("resolveExpression() - %w", err)
+	}
+
+	resolved, err := repository.ResolveExpression(slug, expression, composites, func(ref string) (string, error) {
+		_, currentSlug, err := activeSegmentID(ctx, tx, ref)
+		if errors.Is(err, repository.ErrSegmentNotFound) || errors.Is(err, repository.ErrSegmentAlreadyDeleted) {
+			return "", repository.ErrReferenceNotFound
+		}
+
+		return currentSlug, err
+	})
+	if err != nil {
+		if errors.Is(err, repository.ErrReferenceNotFound) || errors.Is(err, repository.ErrExpressionCycle) {
+			return "", err
+		}
+
+		return "", fmt.Errorf("resolveExpression() - repository.ResolveExpression(): %w", err)
+	}
+
+	return resolved, nil
+}
+
+// setSegmentParent moves the segment under the active segment by `parentSlug`, or to the top level if it's empty.
+// Returns `ErrParentNotFound` if there is no such parent and `ErrSegmentCycle` if the parent is
+// the segment itself or one of its descendants
+func setSegmentParent(ctx context.Context, tx *sql.Tx, segmentID int, parentSlug string) error {
+	var parentID sql.NullInt64
+	if parentSlug != "" {
+		id, err := parentSegmentID(ctx, tx, parentSlug)
+		if err != nil {
+			return err
+		}
+
+		// walk up from the new parent, the segment must not be on the way
+		var cycle bool
+		row := tx.QueryRowContext(ctx,
+			`WITH RECURSIVE ancestors(id) AS (
+				SELECT $1
+				UNION
+				SELECT s.parent_id FROM segments s JOIN ancestors a ON s.id=a.id WHERE s.parent_id IS NOT NULL
+			)
+			SELECT EXISTS(SELECT 1 FROM ancestors WHERE id=$2)`,
+			id, segmentID,
+		)
+		if err := row.Scan(&cycle); err != nil {
+			return fmt.Errorf("setSegmentParent() - tx.QueryRowContext(): %w", err)
+		}
+
+		if cycle {
+			return repository.ErrSegmentCycle
+		}
+
+		parentID = sql.NullInt64{Int64: int64(id), Valid: true}
+	}
+
+	_, err := tx.ExecContext(ctx, "UPDATE segments SET parent_id=$2 WHERE id=$1", segmentID, parentID)
+	if err != nil {
+		return fmt.Errorf("setSegmentParent() - tx.ExecContext(): %w", err)
+	}
+
+	return nil
+}
+
+// membershipExpiration returns the expiration of a membership in the segment added at `now`,
+// applying the default TTL of the segment if `expiresAt` is nil
+func membershipExpiration(ctx context.Context, tx *sql.Tx, segmentID int, expiresAt *time.Time, now time.Time) (sql.NullTime, error) {
+	var defaultTTL string
+	row := tx.QueryRowContext(ctx, "SELECT default_ttl FROM segments WHERE id=$1", segmentID)
+	if err := row.Scan(&defaultTTL); err != nil {
+		return sql.NullTime{}, fmt.Errorf("tx.QueryRowContext(): %w", err)
+	}
+
+	expiration, err := repository.MembershipExpiration(expiresAt, defaultTTL, now)
+	if err != nil {
+		return sql.NullTime{}, fmt.Errorf("repository.MembershipExpiration(): %w", err)
+	}
+
+	if expiration == nil {
+		return sql.NullTime{}, nil
+	}
+
+	return sql.NullTime{Time: expiration.UTC(), Valid: true}, nil
+}
+
+// recordOperation appends an operation to the operations log
+func recordOperation(ctx context.Context, tx *sql.Tx, userID int, segmentID int, operationType entity.OperationType, t time.Time, expiresAt sql.NullTime) error {
+	_, err := tx.ExecContext(ctx,
+		`INSERT INTO operations(user_id, segment_id, type, time, expires_at)
+		VALUES ($1, $2, $3, $4, $5)`,
+		userID, segmentID, operationType, t, expiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("recordOperation() - tx.ExecContext(): %w", err)
+	}
+
+	return nil
+}
+
+// closeMemberships marks memberships with ids selected by the query `idsQuery` as removed at their expiration
+// and logs the expirations. Returns the logged expirations
+func closeMemberships(ctx context.Context, tx *sql.Tx, idsQuery string, args ...any) ([]entity.Operation, error) {
+	rows, err := tx.QueryContext(ctx,
+		`SELECT us.id, us.user_id, s.slug, us.expires_at
+		FROM users_segments us
+		JOIN segments s ON s.id=us.segment_id
+		WHERE us.id IN (`+idsQuery+`)
+		ORDER BY us.expires_at, us.id`,
+		args...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("closeMemberships() - tx.QueryContext(): %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int
+	var operations []entity.Operation
+	for rows.Next() {
+		var id int
+		operation := entity.Operation{Type: entity.ExpiredOperationType}
+		var expiresAt time.Time
+		if err := rows.Scan(&id, &operation.UserID, &operation.SegmentSlug, &expiresAt); err != nil {
+			return nil, fmt.Errorf("closeMemberships() - rows.Scan(): %w", err)
+		}
+
+		expiresAt = expiresAt.UTC()
+		operation.Time = expiresAt
+		operation.ExpiresAt = &expiresAt
+		ids = append(ids, id)
+		operations = append(operations, operation)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("closeMemberships() - rows.Err(): %w", err)
+	}
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	idsJSON, err := json.Marshal(ids)
+	if err != nil {
+		return nil, fmt.Errorf("closeMemberships() - json.Marshal(): %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO operations(user_id, segment_id, type, time, expires_at)
+		SELECT user_id, segment_id, $2, expires_at, expires_at
+		FROM users_segments
+		WHERE id IN (SELECT value FROM json_each($1))
+		ORDER BY expires_at, id`,
+		string(idsJSON), entity.ExpiredOperationType,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("closeMemberships() - tx.ExecContext(): %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE users_segments SET removed_at=expires_at WHERE id IN (SELECT value FROM json_each($1))",
+		string(idsJSON),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("closeMemberships() - tx.ExecContext(): %w", err)
+	}
+
+	return operations, nil
+}
+
+// closeExpiredMemberships marks not removed memberships of the users (a JSON array) in the segment that have
+// expired by `now` as removed at their expiration and logs the expirations. Only one not removed membership
+// of a user in a segment is allowed, so expired ones have to be closed before the user is added again.
+// Returns the logged expirations
+func closeExpiredMemberships(ctx context.Context, tx *sql.Tx, segmentID int, userIDs string, now time.Time) ([]entity.Operation, error) {
+	operations, err := closeMemberships(ctx, tx,
+		`SELECT id FROM users_segments
+		WHERE segment_id=$1
+		AND user_id IN (SELECT value FROM json_each($2))
+		AND removed_at IS NULL
+		AND expires_at <= $3`,
+		segmentID, userIDs, now,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("closeExpiredMemberships() - %w", err)
+	}
+
+	return operations, nil
+}
+
+// enrollChunkSize is the maximum number of users that are added to a segment in one transaction
+const enrollChunkSize = 10000
+
+func (s *SqliteRepository) AddSegmentToUsers(ctx context.Context, slug string, userIDs []int, expiresAt *time.Time) (entity.EnrollmentResult, []entity.Operation, error) {
+	var result entity.EnrollmentResult
+	var operations []entity.Operation
+
+	userIDs = repository.UniqueUserIDs(userIDs)
+	for len(userIDs) > 0 {
+		chunk := userIDs[:min(enrollChunkSize, len(userIDs))]
+		userIDs = userIDs[len(chunk):]
+
+		enrolled, excluded, chunkOperations, err := s.addSegmentToUsersChunk(ctx, slug, chunk, expiresAt)
+		if err != nil {
+			return result, operations, err
+		}
+
+		result.EnrolledCount += enrolled
+		result.ExcludedCount += excluded
+		result.SkippedCount += len(chunk) - enrolled - excluded
+		operations = append(operations, chunkOperations...)
+	}
+
+	return result, operations, nil
+}
+
+// addSegmentToUsersChunk adds the segment to users that don't have it yet in one transaction.
+// Users in another segment of its exclusion group are left out.
+// Returns the number of users that got the segment, the number of users that were left out
+// and the operations that were applied
+func (s *SqliteRepository) addSegmentToUsersChunk(ctx context.Context, slug string, userIDs []int, explicitExpiresAt *time.Time) (int, int, []entity.Operation, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("AddSegmentToUsers() - s.db.BeginTx(): %w", err)
+	}
+	defer tx.Rollback()
+
+	// check if segment actually exists and get its id
+	segmentID, currentSlug, err := memberSegmentID(ctx, tx, slug)
+	if err != nil {
+		if errors.Is(err, repository.ErrSegmentNotFound) || errors.Is(err, repository.ErrSegmentAlreadyDeleted) || errors.Is(err, repository.ErrSegmentComposite) || errors.Is(err, repository.ErrSegmentDynamic) || errors.Is(err, repository.ErrSegmentBucketed) {
+			return 0, 0, nil, err
+		}
+
+		return 0, 0, nil, fmt.Errorf("AddSegmentToUsers() - %w", err)
+	}
+
+	// user ids are passed as a JSON array and unpacked with json_each()
+	ids, err := json.Marshal(userIDs)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("AddSegmentToUsers() - json.Marshal(): %w", err)
+	}
+
+	now := s.now()
+	operations, err := closeExpiredMemberships(ctx, tx, segmentID, string(ids), now)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("AddSegmentToUsers() - %w", err)
+	}
+
+	expiresAt, err := membershipExpiration(ctx, tx, segmentID, explicitExpiresAt, now)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("AddSegmentToUsers() - %w", err)
+	}
+
+	var excluded int
+	row := tx.QueryRowContext(ctx,
+		`SELECT COUNT(*) FROM json_each($2) u WHERE `+inExclusionGroupCondition("u.value", "$1", segmentExclusionGroup, "$3"),
+		segmentID, string(ids), now,
+	)
+	if err := row.Scan(&excluded); err != nil {
+		return 0, 0, nil, fmt.Errorf("AddSegmentToUsers() - tx.QueryRowContext(): %w", err)
+	}
+
+	// add the segment to users that don't have it active and aren't in its exclusion group,
+	// the ones that have it are skipped by the unique index of active memberships
+	rows, err := tx.QueryContext(ctx,
+		`INSERT INTO users_segments(segment_id, user_id, added_at, expires_at)
+		SELECT $1, u.value, $3, $4
+		FROM json_each($2) u
+		WHERE NOT `+inExclusionGroupCondition("u.value", "$1", segmentExclusionGroup, "$3")+`
+		ON CONFLICT (user_id, segment_id) WHERE removed_at IS NULL DO NOTHING
+		RETURNING user_id`,
+		segmentID, string(ids), now, expiresAt,
+	)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("AddSegmentToUsers() - tx.QueryContext(): %w", err)
+	}
+	defer rows.Close()
+
+	var added []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return 0, 0, nil, fmt.Errorf("AddSegmentToUsers() - rows.Scan(): %w", err)
+		}
+
+		added = append(added, userID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return 0, 0, nil, fmt.Errorf("AddSegmentToUsers() - rows.Err(): %w", err)
+	}
+	sort.Ints(added)
+
+	// and log it
+	addedIDs, err := json.Marshal(added)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("AddSegmentToUsers() - json.Marshal(): %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO operations(user_id, segment_id, type, time, expires_at)
+		SELECT u.value, $1, $3, $4, $5
+		FROM json_each($2) u`,
+		segmentID, string(addedIDs), entity.AddedOperationType, now, expiresAt,
+	)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("AddSegmentToUsers() - tx.ExecContext(): %w", err)
+	}
+
+	for _, userID := range added {
+		operations = append(operations, entity.Operation{
+			UserID:      userID,
+			SegmentSlug: currentSlug,
+			Type:        entity.AddedOperationType,
+			Time:        now,
+			ExpiresAt:   timePtr(expiresAt),
+		})
+	}
+
+	// commit changes
+	if err := tx.Commit(); err != nil {
+		return 0, 0, nil, fmt.Errorf("AddSegmentToUsers() - tx.Commit(): %w", err)
+	}
+
+	return len(added), excluded, operations, nil
+}
+
+func (s *SqliteRepository) GetExclusionGroupMembers(ctx context.Context, slug string, userIDs []int) ([]int, error) {
+	var segmentID int
+	row := s.db.QueryRowContext(ctx, "SELECT id FROM segments WHERE "+segmentSlugCondition, slug)
+	if err := row.Scan(&segmentID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) { // no such segment at all
+			return nil, repository.ErrSegmentNotFound
+		}
+
+		return nil, fmt.Errorf("GetExclusionGroupMembers() - s.db.QueryRowContext(): %w", err)
+	}
+
+	// user ids are passed as a JSON array and unpacked with json_each()
+	ids, err := json.Marshal(userIDs)
+	if err != nil {
+		return nil, fmt.Errorf("GetExclusionGroupMembers() - json.Marshal(): %w", err)
+	}
+
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT DISTINCT u.value FROM json_each($2) u
+		WHERE `+inExclusionGroupCondition("u.value", "$1", segmentExclusionGroup, "$3")+`
+		ORDER BY u.value`,
+		segmentID, string(ids), s.now(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("GetExclusionGroupMembers() - s.db.QueryContext(): %w", err)
+	}
+	defer rows.Close()
+
+	var members []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, fmt.Errorf("GetExclusionGroupMembers() - rows.Scan(): %w", err)
+		}
+
+		members = append(members, userID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetExclusionGroupMembers() - rows.Err(): %w", err)
+	}
+
+	return members, nil
+}
+
+func (s *SqliteRepository) DeleteSegment(ctx context.Context, slug string, children entity.ChildrenPolicy, force bool) ([]entity.Operation, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("DeleteSegment() - s.db.BeginTx(): %w", err)
+	}
+	defer tx.Rollback()
+
+	// check the status of this segment
+	segmentID, currentSlug, err := activeSegmentID(ctx, tx, slug)
+	if err != nil {
+		if errors.Is(err, repository.ErrSegmentNotFound) || errors.Is(err, repository.ErrSegmentAlreadyDeleted) {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("DeleteSegment() - %w", err)
+	}
+
+	// deal with active children of the segment
+	segmentIDs := []int{segmentID}
+	slugs := []string{currentSlug}
+	switch children {
+	case entity.ChildrenCascade:
+		rows, err := tx.QueryContext(ctx,
+			`WITH RECURSIVE descendants(id, slug) AS (
+				SELECT id, slug FROM segments WHERE parent_id=$1 AND deleted_at IS NULL
+				UNION
+				SELECT s.id, s.slug FROM segments s JOIN descendants d ON s.parent_id=d.id WHERE s.deleted_at IS NULL
+			)
+			SELECT id, slug FROM descendants`,
+			segmentID,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("DeleteSegment() - tx.QueryContext(): %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var id int
+			var slug string
+			if err := rows.Scan(&id, &slug); err != nil {
+				return nil, fmt.Errorf("DeleteSegment() - rows.Scan(): %w", err)
+			}
+
+			segmentIDs = append(segmentIDs, id)
+			slugs = append(slugs, slug)
+		}
+
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("DeleteSegment() - rows.Err(): %w", err)
+		}
+	case entity.ChildrenDetach:
+		_, err := tx.ExecContext(ctx, "UPDATE segments SET parent_id=NULL WHERE parent_id=$1 AND deleted_at IS NULL", segmentID)
+		if err != nil {
+			return nil, fmt.Errorf("DeleteSegment() - tx.ExecContext(): %w", err)
+		}
+	default:
+		var hasChildren bool
+		row := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM segments WHERE parent_id=$1 AND deleted_at IS NULL)", segmentID)
+		if err := row.Scan(&hasChildren); err != nil {
+			return nil, fmt.Errorf("DeleteSegment() - tx.QueryRowContext(): %w", err)
+		}
+
+		if hasChildren {
+			return nil, repository.ErrSegmentHasChildren
+		}
+	}
+
+	// composite segments that stay active must not lose the segments they reference
+	if !force {
+		composites, err := compositeExpressions(ctx, tx, true)
+		if err != nil {
+			return nil, fmt.Errorf("DeleteSegment() - %w", err)
+		}
+
+		referencing, err := repository.ReferencingComposites(composites, slugs)
+		if err != nil {
+			return nil, fmt.Errorf("DeleteSegment() - repository.ReferencingComposites(): %w", err)
+		}
+
+		if len(referencing) != 0 {
+			return nil, repository.ErrSegmentReferenced
+		}
+	}
+
+	ids, err := json.Marshal(segmentIDs)
+	if err != nil {
+		return nil, fmt.Errorf("DeleteSegment() - json.Marshal(): %w", err)
+	}
+
+	// mark the segments as deleted
+	now := s.now()
+	_, err = tx.ExecContext(ctx, "UPDATE segments SET deleted_at=$2 WHERE id IN (SELECT value FROM json_each($1))", string(ids), now)
+	if err != nil {
+		return nil, fmt.Errorf("DeleteSegment() - tx.ExecContext(): %w", err)
+	}
+
+	// collect open user segments with these segments, they are removed and logged below.
+	// Scheduled ones are removed at their start, so they never become active
+	rows, err := tx.QueryContext(ctx,
+		`SELECT us.user_id, s.slug, us.added_at, us.expires_at
+		FROM users_segments us
+		JOIN segments s ON s.id=us.segment_id
+		WHERE us.segment_id IN (SELECT value FROM json_each($1))
+		AND us.removed_at IS NULL
+		AND (us.expires_at IS NULL OR us.expires_at > $2)
+		ORDER BY s.slug, us.user_id`,
+		string(ids), now,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("DeleteSegment() - tx.QueryContext(): %w", err)
+	}
+	defer rows.Close()
+
+	var operations []entity.Operation
+	for rows.Next() {
+		operation := entity.Operation{Type: entity.SegmentDeletedOperationType}
+		var addedAt time.Time
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&operation.UserID, &operation.SegmentSlug, &addedAt, &expiresAt); err != nil {
+			return nil, fmt.Errorf("DeleteSegment() - rows.Scan(): %w", err)
+		}
+
+		operation.Time = now
+		if addedAt.After(now) {
+			operation.Time = addedAt.UTC()
+		}
+		operation.ExpiresAt = timePtr(expiresAt)
+		operations = append(operations, operation)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("DeleteSegment() - rows.Err(): %w", err)
+	}
+
+	// log their removal
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO operations(user_id, segment_id, type, time, expires_at)
+		SELECT user_id, segment_id, $3, MAX(added_at, $2), expires_at
+		FROM users_segments
+		WHERE segment_id IN (SELECT value FROM json_each($1))
+		AND removed_at IS NULL
+		AND (expires_at IS NULL OR expires_at > $2)
+		ORDER BY id`,
+		string(ids), now, entity.SegmentDeletedOperationType,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("DeleteSegment() - tx.ExecContext(): %w", err)
+	}
+
+	// mark them as removed
+	_, err = tx.ExecContext(ctx,
+		`UPDATE users_segments SET removed_at=MAX(added_at, $2)
+		WHERE segment_id IN (SELECT value FROM json_each($1))
+		AND removed_at IS NULL
+		AND (expires_at IS NULL OR expires_at > $2)`, string(ids), now)
+	if err != nil {
+		return nil, fmt.Errorf("DeleteSegment() - tx.ExecContext(): %w", err)
+	}
+
+	// commit changes
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("DeleteSegment() - tx.Commit(): %w", err)
+	}
+
+	return operations, nil
+}
+
+// removedByDeletionCondition matches memberships of segment $1 whose removal was logged by its deletion.
+// Scheduled memberships are removed and logged at their start, so the removal time alone can't tell
+// the ones closed by the deletion from the ones cancelled before it
+const removedByDeletionCondition = `EXISTS(
+	SELECT 1 FROM operations o
+	WHERE o.user_id=users_segments.user_id
+	AND o.segment_id=users_segments.segment_id
+	AND o.type='` + string(entity.SegmentDeletedOperationType) + `'
+	AND o.time=users_segments.removed_at
+	AND o.time >= (SELECT deleted_at FROM segments WHERE id=$1)
+)`
+
+func (s *SqliteRepository) RestoreSegment(ctx context.Context, slug string, restoreMemberships bool) ([]entity.Operation, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("RestoreSegment() - s.db.BeginTx(): %w", err)
+	}
+	defer tx.Rollback()
+
+	// check the status of this segment
+	var segmentID int
+	var currentSlug string
+	var deletedAt sql.NullTime
+	row := tx.QueryRowContext(ctx, "SELECT id, slug, deleted_at FROM segments WHERE "+segmentSlugCondition, slug)
+	if err := row.Scan(&segmentID, &currentSlug, &deletedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) { // no such segment at all
+			return nil, repository.ErrSegmentNotFound
+		}
+
+		return nil, fmt.Errorf("RestoreSegment() - tx.QueryRowContext(): %w", err)
+	}
+
+	if !deletedAt.Valid { // segment is active
+		return nil, repository.ErrSegmentNotDeleted
+	}
+
+	// only memberships whose removal was logged by the deletion are restored.
+	// The ones that would have expired by now and the ones of users that are now in another segment
+	// of the exclusion group stay removed
+	now := s.now()
+	var operations []entity.Operation
+	if restoreMemberships {
+		rows, err := tx.QueryContext(ctx,
+			`UPDATE users_segments SET removed_at=NULL
+			WHERE segment_id=$1
+			AND `+removedByDeletionCondition+`
+			AND (expires_at IS NULL OR expires_at > $2)
+			AND NOT `+inExclusionGroupCondition("users_segments.user_id", "$1", segmentExclusionGroup, "$2")+`
+			RETURNING user_id, expires_at`,
+			segmentID, now,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("RestoreSegment() - tx.QueryContext(): %w", err)
+		}
+		defer rows.Close()
+
+		type restoral struct {
+			userID    int
+			expiresAt sql.NullTime
+		}
+
+		var restored []restoral
+		for rows.Next() {
+			var r restoral
+			if err := rows.Scan(&r.userID, &r.expiresAt); err != nil {
+				return nil, fmt.Errorf("RestoreSegment() - rows.Scan(): %w", err)
+			}
+
+			restored = append(restored, r)
+		}
+
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("RestoreSegment() - rows.Err(): %w", err)
+		}
+		sort.Slice(restored, func(i, j int) bool { return restored[i].userID < restored[j].userID })
+
+		// and log it
+		for _, r := range restored {
+			if err := recordOperation(ctx, tx, r.userID, segmentID, entity.SegmentRestoredOperationType, now, r.expiresAt); err != nil {
+				return nil, fmt.Errorf("RestoreSegment() - %w", err)
+			}
+			operations = append(operations, entity.Operation{
+				UserID:      r.userID,
+				SegmentSlug: currentSlug,
+				Type:        entity.SegmentRestoredOperationType,
+				Time:        now,
+				ExpiresAt:   timePtr(r.expiresAt),
+			})
+		}
+	}
+
+	// mark the segment as active. If its parent is deleted, it becomes a top-level segment
+	_, err = tx.ExecContext(ctx,
+		`UPDATE segments SET deleted_at=NULL,
+			parent_id=(SELECT p.id FROM segments p WHERE p.id=segments.parent_id AND p.deleted_at IS NULL)
+		WHERE id=$1`,
+		segmentID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("RestoreSegment() - tx.ExecContext(): %w", err)
+	}
+
+	// commit changes
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("RestoreSegment() - tx.Commit(): %w", err)
+	}
+
+	return operations, nil
+}
+
+func (s *SqliteRepository) UpdateUserSegments(ctx context.Context, userID int, addSegments []entity.SegmentExpiration, removeSegments []entity.SegmentExpiration) ([]entity.Operation, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("UpdateUserSegments() - s.db.BeginTx(): %w", err)
+	}
+	defer tx.Rollback()
+
+	now := s.now()
+	var operations []entity.Operation
+	for _, segment := range addSegments {
+		// check segment existence and status and get its id
+		segmentID, currentSlug, err := memberSegmentID(ctx, tx, segment.Slug)
+		if err != nil {
+			if errors.Is(err, repository.ErrSegmentNotFound) || errors.Is(err, repository.ErrSegmentAlreadyDeleted) || errors.Is(err, repository.ErrSegmentComposite) || errors.Is(err, repository.ErrSegmentDynamic) || errors.Is(err, repository.ErrSegmentBucketed) {
+				return nil, err
+			}
+
+			return nil, fmt.Errorf("UpdateUserSegments() - %w", err)
+		}
+
+		expired, err := closeExpiredMemberships(ctx, tx, segmentID, fmt.Sprintf("[%d]", userID), now)
+		if err != nil {
+			return nil, fmt.Errorf("UpdateUserSegments() - %w", err)
+		}
+		operations = append(operations, expired...)
+
+		// add the segment unless user already has it open. A scheduled membership is added at its start
+		addedAt := now
+		if segment.StartsAt != nil && segment.StartsAt.After(now) {
+			addedAt = segment.StartsAt.UTC()
+		}
+
+		expiresAt, err := membershipExpiration(ctx, tx, segmentID, segment.ExpiresAt, addedAt)
+		if err != nil {
+			return nil, fmt.Errorf("UpdateUserSegments() - %w", err)
+		}
+
+		res, err := tx.ExecContext(ctx,
+			`INSERT INTO users_segments(segment_id, user_id, added_at, expires_at)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (user_id, segment_id) WHERE removed_at IS NULL DO NOTHING`,
+			segmentID, userID, addedAt, expiresAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("UpdateUserSegments() - tx.ExecContext(): %w", err)
+		}
+
+		added, err := res.RowsAffected()
+		if err != nil {
+			return nil, fmt.Errorf("UpdateUserSegments() - res.RowsAffected(): %w", err)
+		}
+
+		if added == 0 { // segment already exists and is open
+			continue
+		}
+
+		if err := recordOperation(ctx, tx, userID, segmentID, entity.AddedOperationType, addedAt, expiresAt); err != nil {
+			return nil, fmt.Errorf("UpdateUserSegments() - %w", err)
+		}
+		operations = append(operations, entity.Operation{
+			UserID:      userID,
+			SegmentSlug: currentSlug,
+			Type:        entity.AddedOperationType,
+			Time:        addedAt,
+			ExpiresAt:   timePtr(expiresAt),
+		})
+	}
+
+	for _, segment := range removeSegments {
+		// check segment existence and status and get its id
+		segmentID, currentSlug, err := memberSegmentID(ctx, tx, segment.Slug)
+		if err != nil {
+			if errors.Is(err, repository.ErrSegmentNotFound) || errors.Is(err, repository.ErrSegmentAlreadyDeleted) || errors.Is(err, repository.ErrSegmentComposite) || errors.Is(err, repository.ErrSegmentDynamic) || errors.Is(err, repository.ErrSegmentBucketed) {
+				return nil, err
+			}
+
+			return nil, fmt.Errorf("UpdateUserSegments() - %w", err)
+		}
+
+		// remove the segment if user has it open, a scheduled membership is removed at its start
+		var removedAt time.Time
+		var expiresAt sql.NullTime
+		row := tx.QueryRowContext(ctx,
+			`UPDATE users_segments
+			SET removed_at=MAX(added_at, $3)
+			WHERE user_id=$1
+			AND segment_id=$2
+			AND removed_at IS NULL
+			AND (expires_at IS NULL OR expires_at > $3)
+			RETURNING removed_at, expires_at`,
+			userID, segmentID, now,
+		)
+		if err := row.Scan(&removedAt, &expiresAt); err != nil {
+			if errors.Is(err, sql.ErrNoRows) { // user doesn't have the segment
+				continue
+			}
+
+			return nil, fmt.Errorf("UpdateUserSegments() - tx.QueryRowContext(): %w", err)
+		}
+
+		removedAt = removedAt.UTC()
+		if err := recordOperation(ctx, tx, userID, segmentID, entity.RemovedOperationType, removedAt, expiresAt); err != nil {
+			return nil, fmt.Errorf("UpdateUserSegments() - %w", err)
+		}
+		operations = append(operations, entity.Operation{
+			UserID:      userID,
+			SegmentSlug: currentSlug,
+			Type:        entity.RemovedOperationType,
+			Time:        removedAt,
+			ExpiresAt:   timePtr(expiresAt),
+		})
+	}
+
+	// after the update the user must be in at most one segment of every exclusion group
+	var conflict bool
+	row := tx.QueryRowContext(ctx,
+		`SELECT EXISTS(
+			SELECT 1 FROM users_segments us
+			JOIN segments s ON s.id=us.segment_id
+			WHERE us.user_id=$1
+			AND s.exclusion_group_id IS NOT NULL
+			AND us.removed_at IS NULL
+			AND (us.expires_at IS NULL OR us.expires_at > $2)
+			GROUP BY s.exclusion_group_id
+			HAVING COUNT(*) > 1
+		)`,
+		userID, now,
+	)
+	if err := row.Scan(&conflict); err != nil {
+		return nil, fmt.Errorf("UpdateUserSegments() - tx.QueryRowContext(): %w", err)
+	}
+
+	if conflict {
+		return nil, repository.ErrExclusionConflict
+	}
+
+	// commit changes
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("UpdateUserSegments() - tx.Commit(): %w", err)
+	}
+
+	return operations, nil
+}
+
+func (s *SqliteRepository) UpdateUserSegmentExpirations(ctx context.Context, userID int, segments []entity.SegmentExpiration) ([]entity.Operation, error) {
+	now := s.now()
+	for _, segment := range segments {
+		if segment.ExpiresAt != nil && !segment.ExpiresAt.After(now) {
+			return nil, repository.ErrExpirationInPast
+		}
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("UpdateUserSegmentExpirations() - s.db.BeginTx(): %w", err)
+	}
+	defer tx.Rollback()
+
+	var operations []entity.Operation
+	for _, segment := range segments {
+		// check segment existence and status and get its id
+		segmentID, currentSlug, err := memberSegmentID(ctx, tx, segment.Slug)
+		if err != nil {
+			if errors.Is(err, repository.ErrSegmentNotFound) || errors.Is(err, repository.ErrSegmentAlreadyDeleted) || errors.Is(err, repository.ErrSegmentComposite) || errors.Is(err, repository.ErrSegmentDynamic) || errors.Is(err, repository.ErrSegmentBucketed) {
+				return nil, err
+			}
+
+			return nil, fmt.Errorf("UpdateUserSegmentExpirations() - %w", err)
+		}
+
+		// change the expiration if user has the segment open and it's different
+		var expiresAt sql.NullTime
+		if segment.ExpiresAt != nil {
+			expiresAt.Time = segment.ExpiresAt.UTC()
+			expiresAt.Valid = true
+
+			// a scheduled membership can't expire before it starts
+			var beforeStart bool
+			row := tx.QueryRowContext(ctx,
+				`SELECT EXISTS(SELECT 1 FROM users_segments
+					WHERE user_id=$1
+					AND segment_id=$2
+					AND removed_at IS NULL
+					AND added_at >= $3)`,
+				userID, segmentID, expiresAt,
+			)
+			if err := row.Scan(&beforeStart); err != nil {
+				return nil, fmt.Errorf("UpdateUserSegmentExpirations() - tx.QueryRowContext(): %w", err)
+			}
+
+			if beforeStart {
+				return nil, repository.ErrExpirationBeforeStart
+			}
+		}
+
+		res, err := tx.ExecContext(ctx,
+			`UPDATE users_segments
+			SET expires_at=$3
+			WHERE user_id=$1
+			AND segment_id=$2
+			AND removed_at IS NULL
+			AND (expires_at IS NULL OR expires_at > $4)
+			AND expires_at IS NOT $3`,
+			userID, segmentID, expiresAt, now,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("UpdateUserSegmentExpirations() - tx.ExecContext(): %w", err)
+		}
+
+		changed, err := res.RowsAffected()
+		if err != nil {
+			return nil, fmt.Errorf("UpdateUserSegmentExpirations() - res.RowsAffected(): %w", err)
+		}
+
+		if changed == 0 { // user doesn't have the segment or it already expires at this date
+			continue
+		}
+
+		if err := recordOperation(ctx, tx, userID, segmentID, entity.ExpirationChangedOperationType, now, expiresAt); err != nil {
+			return nil, fmt.Errorf("UpdateUserSegmentExpirations() - %w", err)
+		}
+		operations = append(operations, entity.Operation{
+			UserID:      userID,
+			SegmentSlug: currentSlug,
+			Type:        entity.ExpirationChangedOperationType,
+			Time:        now,
+			ExpiresAt:   timePtr(expiresAt),
+		})
+	}
+
+	// commit changes
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("UpdateUserSegmentExpirations() - tx.Commit(): %w", err)
+	}
+
+	return operations, nil
+}
+
+func (s *SqliteRepository) SyncSegmentMembers(ctx context.Context, slug string, userIDs []int) ([]entity.Operation, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("SyncSegmentMembers() - s.db.BeginTx(): %w", err)
+	}
+	defer tx.Rollback()
+
+	segmentID, currentSlug, err := activeSegmentID(ctx, tx, slug)
+	if err != nil {
+		if errors.Is(err, repository.ErrSegmentNotFound) || errors.Is(err, repository.ErrSegmentAlreadyDeleted) {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("SyncSegmentMembers() - %w", err)
+	}
+
+	var dynamic bool
+	row := tx.QueryRowContext(ctx, "SELECT rule<>'' FROM segments WHERE id=$1", segmentID)
+	if err := row.Scan(&dynamic); err != nil {
+		return nil, fmt.Errorf("SyncSegmentMembers() - tx.QueryRowContext(): %w", err)
+	}
+
+	if !dynamic {
+		return nil, repository.ErrNotDynamic
+	}
+
+	// user ids are passed as a JSON array and unpacked with json_each()
+	ids, err := json.Marshal(repository.UniqueUserIDs(userIDs))
+	if err != nil {
+		return nil, fmt.Errorf("SyncSegmentMembers() - json.Marshal(): %w", err)
+	}
+
+	now := s.now()
+	operations, err := closeExpiredMemberships(ctx, tx, segmentID, string(ids), now)
+	if err != nil {
+		return nil, fmt.Errorf("SyncSegmentMembers() - %w", err)
+	}
+
+	expiresAt, err := membershipExpiration(ctx, tx, segmentID, nil, now)
+	if err != nil {
+		return nil, fmt.Errorf("SyncSegmentMembers() - %w", err)
+	}
+
+	// add the segment to users that don't have it open, the rest are skipped
+	// by the unique index of active memberships
+	rows, err := tx.QueryContext(ctx,
+		`INSERT INTO users_segments(segment_id, user_id, added_at, expires_at)
+		SELECT $1, u.value, $3, $4
+		FROM json_each($2) u
+		WHERE true
+		ON CONFLICT (user_id, segment_id) WHERE removed_at IS NULL DO NOTHING
+		RETURNING user_id`,
+		segmentID, string(ids), now, expiresAt,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("SyncSegmentMembers() - tx.QueryContext(): %w", err)
+	}
+	defer rows.Close()
+
+	var added []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, fmt.Errorf("SyncSegmentMembers() - rows.Scan(): %w", err)
+		}
+
+		added = append(added, userID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SyncSegmentMembers() - rows.Err(): %w", err)
+	}
+	sort.Ints(added)
+
+	for _, userID := range added {
+		if err := recordOperation(ctx, tx, userID, segmentID, entity.AddedOperationType, now, expiresAt); err != nil {
+			return nil, fmt.Errorf("SyncSegmentMembers() - %w", err)
+		}
+		operations = append(operations, entity.Operation{
+			UserID:      userID,
+			SegmentSlug: currentSlug,
+			Type:        entity.AddedOperationType,
+			Time:        now,
+			ExpiresAt:   timePtr(expiresAt),
+		})
+	}
+
+	// remove the segment from the rest of users, a scheduled membership is removed at its start
+	rows, err = tx.QueryContext(ctx,
+		`UPDATE users_segments
+		SET removed_at=MAX(added_at, $3)
+		WHERE segment_id=$1
+		AND user_id NOT IN (SELECT value FROM json_each($2))
+		AND removed_at IS NULL
+		AND (expires_at IS NULL OR expires_at > $3)
+		RETURNING user_id, removed_at, expires_at`,
+		segmentID, string(ids), now,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("SyncSegmentMembers() - tx.QueryContext(): %w", err)
+	}
+	defer rows.Close()
+
+	type removal struct {
+		userID    int
+		removedAt time.Time
+		expiresAt sql.NullTime
+	}
+
+	var removed []removal
+	for rows.Next() {
+		var r removal
+		if err := rows.Scan(&r.userID, &r.removedAt, &r.expiresAt); err != nil {
+			return nil, fmt.Errorf("SyncSegmentMembers() - rows.Scan(): %w", err)
+		}
+
+		r.removedAt = r.removedAt.UTC()
+		removed = append(removed, r)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("SyncSegmentMembers() - rows.Err(): %w", err)
+	}
+	sort.Slice(removed, func(i, j int) bool { return removed[i].userID < removed[j].userID })
+
+	for _, r := range removed {
+		if err := recordOperation(ctx, tx, r.userID, segmentID, entity.RemovedOperationType, r.removedAt, r.expiresAt); err != nil {
+			return nil, fmt.Errorf("SyncSegmentMembers() - %w", err)
+		}
+		operations = append(operations, entity.Operation{
+			UserID:      r.userID,
+			SegmentSlug: currentSlug,
+			Type:        entity.RemovedOperationType,
+			Time:        r.removedAt,
+			ExpiresAt:   timePtr(r.expiresAt),
+		})
+	}
+
+	// commit changes
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("SyncSegmentMembers() - tx.Commit(): %w", err)
+	}
+
+	return operations, nil
+}
+
+func (s *SqliteRepository) ExpireMemberships(ctx context.Context, limit int) ([]entity.Operation, error) {
+	// transactions take the write lock right away, so sweeps of several processes don't overlap
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("ExpireMemberships() - s.db.BeginTx(): %w", err)
+	}
+	defer tx.Rollback()
+
+	operations, err := closeMemberships(ctx, tx,
+		`SELECT id FROM users_segments
+		WHERE removed_at IS NULL
+		AND expires_at <= $1
+		ORDER BY expires_at, id
+		LIMIT $2`,
+		s.now(), limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("ExpireMemberships() - %w", err)
+	}
+
+	// commit changes
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("ExpireMemberships() - tx.Commit(): %w", err)
+	}
+
+	return operations, nil
+}
+
+func (s *SqliteRepository) GetActiveUserSegments(ctx context.Context, userID int) ([]entity.UserSegment, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT segments.slug, users_segments.added_at, users_segments.expires_at
+		FROM users_segments
+		JOIN segments ON segments.id=users_segments.segment_id
+		WHERE users_segments.user_id=$1
+		AND users_segments.added_at <= $2
+		AND users_segments.removed_at IS NULL
+		AND (users_segments.expires_at IS NULL OR users_segments.expires_at > $2)
+		ORDER BY users_segments.id`,
+		userID, s.now(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("GetActiveUserSegments() - s.db.QueryContext(): %w", err)
+	}
+	defer rows.Close()
+
+	userSegments := make([]entity.UserSegment, 0, 30)
+	for rows.Next() {
+		var userSegment entity.UserSegment
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&userSegment.Slug, &userSegment.AddedAt, &expiresAt); err != nil {
+			return nil, fmt.Errorf("GetActiveUserSegments() - rows.Scan(): %w", err)
+		}
+
+		userSegment.AddedAt = userSegment.AddedAt.UTC()
+		userSegment.ExpiresAt = timePtr(expiresAt)
+
+		userSegments = append(userSegments, userSegment)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetActiveUserSegments() - rows.Err(): %w", err)
+	}
+
+	return userSegments, nil
+}
+
+func (s *SqliteRepository) GetSegmentParents(ctx context.Context) (map[string]string, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT s.slug, p.slug
+		FROM segments s
+		JOIN segments p ON p.id=s.parent_id
+		WHERE s.deleted_at IS NULL`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("GetSegmentParents() - s.db.QueryContext(): %w", err)
+	}
+	defer rows.Close()
+
+	parents := make(map[string]string)
+	for rows.Next() {
+		var slug, parent string
+		if err := rows.Scan(&slug, &parent); err != nil {
+			return nil, fmt.Errorf("GetSegmentParents() - rows.Scan(): %w", err)
+		}
+
+		parents[slug] = parent
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetSegmentParents() - rows.Err(): %w", err)
+	}
+
+	return parents, nil
+}
+
+func (s *SqliteRepository) GetCompositeSegments(ctx context.Context) (map[string]string, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT slug, expression FROM segments WHERE expression<>'' AND deleted_at IS NULL")
+	if err != nil {
+		return nil, fmt.Errorf("GetCompositeSegments() - s.db.QueryContext(): %w", err)
+	}
+	defer rows.Close()
+
+	composites := make(map[string]string)
+	for rows.Next() {
+		var slug, expression string
+		if err := rows.Scan(&slug, &expression); err != nil {
+			return nil, fmt.Errorf("GetCompositeSegments() - rows.Scan(): %w", err)
+		}
+
+		composites[slug] = expression
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetCompositeSegments() - rows.Err(): %w", err)
+	}
+
+	return composites, nil
+}
+
+// querySegmentMembers queries ids of users that were in the segment at `asOf` and have id greater than `afterUserID`,
+// sorted by id. If `limit` is positive, no more than `limit` ids are returned
+func (s *SqliteRepository) querySegmentMembers(ctx context.Context, slug string, asOf time.Time, afterUserID int, limit int) (*sql.Rows, error) {
+	// deleted segments are fine: their memberships were removed at the deletion time
+	var segmentID int
+	row := s.db.QueryRowContext(ctx, "SELECT id FROM segments WHERE "+segmentSlugCondition, slug)
+	if err := row.Scan(&segmentID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, repository.ErrSegmentNotFound
+		}
+
+		return nil, fmt.Errorf("s.db.QueryRowContext(): %w", err)
+	}
+
+	query := `SELECT DISTINCT user_id
+		FROM users_segments
+		WHERE segment_id=$1
+		AND added_at <= $2
+		AND (removed_at IS NULL OR removed_at > $2)
+		AND (expires_at IS NULL OR expires_at > $2)
+		AND user_id > $3
+		ORDER BY user_id`
+	args := []any{segmentID, asOf, afterUserID}
+	if limit > 0 {
+		args = append(args, limit)
+		query += " LIMIT $4"
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("s.db.QueryContext(): %w", err)
+	}
+
+	return rows, nil
+}
+
+func (s *SqliteRepository) GetSegmentMembers(ctx context.Context, slug string, request entity.SegmentMembersRequest) (entity.SegmentMembersPage, error) {
+	cursor, err := repository.DecodeMembersCursor(request)
+	if err != nil {
+		return entity.SegmentMembersPage{}, err
+	}
+
+	afterUserID := 0
+	if cursor != nil {
+		afterUserID = cursor.UserID
+	}
+	asOf := repository.MembersAsOf(request, cursor, s.now()).UTC()
+
+	// one more row tells if there is the next page
+	limit := 0
+	if request.Limit > 0 {
+		limit = request.Limit + 1
+	}
+
+	rows, err := s.querySegmentMembers(ctx, slug, asOf, afterUserID, limit)
+	if err != nil {
+		if errors.Is(err, repository.ErrSegmentNotFound) {
+			return entity.SegmentMembersPage{}, err
+		}
+
+		return entity.SegmentMembersPage{}, fmt.Errorf("GetSegmentMembers() - s.querySegmentMembers(): %w", err)
+	}
+	defer rows.Close()
+
+	result := entity.SegmentMembersPage{AsOf: asOf, UserIDs: make([]int, 0, 30)}
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return entity.SegmentMembersPage{}, fmt.Errorf("GetSegmentMembers() - rows.Scan(): %w", err)
+		}
+
+		result.UserIDs = append(result.UserIDs, userID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return entity.SegmentMembersPage{}, fmt.Errorf("GetSegmentMembers() - rows.Err(): %w", err)
+	}
+
+	if request.Limit > 0 && len(result.UserIDs) > request.Limit {
+		result.UserIDs = result.UserIDs[:request.Limit]
+		result.NextCursor, err = repository.EncodeCursor(repository.MembersCursor{AsOf: asOf, UserID: result.UserIDs[request.Limit-1]})
+		if err != nil {
+			return entity.SegmentMembersPage{}, fmt.Errorf("GetSegmentMembers() - repository.EncodeCursor(): %w", err)
+		}
+	}
+
+	return result, nil
+}
+
+func (s *SqliteRepository) StreamSegmentMembers(ctx context.Context, slug string, asOf time.Time, fn func(userID int) error) error {
+	if asOf.IsZero() {
+		asOf = s.now()
+	}
+	asOf = asOf.UTC()
+
+	rows, err := s.querySegmentMembers(ctx, slug, asOf, 0, 0)
+	if err != nil {
+		if errors.Is(err, repository.ErrSegmentNotFound) {
+			return err
+		}
+
+		return fmt.Errorf("StreamSegmentMembers() - s.querySegmentMembers(): %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return fmt.Errorf("StreamSegmentMembers() - rows.Scan(): %w", err)
+		}
+
+		if err := fn(userID); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("StreamSegmentMembers() - rows.Err(): %w", err)
+	}
+
+	return nil
+}
+
+func (s *SqliteRepository) GetSegmentStats(ctx context.Context, slug string, from time.Time, to time.Time) (entity.SegmentStats, error) {
+	// deleted segments are fine: their stats are still meaningful
+	var segmentID int
+	var currentSlug string
+	row := s.db.QueryRowContext(ctx, "SELECT id, slug FROM segments WHERE "+segmentSlugCondition, slug)
+	if err := row.Scan(&segmentID, &currentSlug); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return entity.SegmentStats{}, repository.ErrSegmentNotFound
+		}
+
+		return entity.SegmentStats{}, fmt.Errorf("GetSegmentStats() - s.db.QueryRowContext(): %w", err)
+	}
+
+	now := s.now()
+
+	var activeCount int
+	row = s.db.QueryRowContext(ctx,
+		`SELECT COUNT(DISTINCT user_id)
+		FROM users_segments
+		WHERE segment_id=$1
+		AND added_at <= $2
+		AND removed_at IS NULL
+		AND (expires_at IS NULL OR expires_at > $2)`,
+		segmentID, now,
+	)
+	if err := row.Scan(&activeCount); err != nil {
+		return entity.SegmentStats{}, fmt.Errorf("GetSegmentStats() - s.db.QueryRowContext(): %w", err)
+	}
+
+	stats := repository.NewSegmentStats(currentSlug, activeCount, from, to)
+
+	// expirations that aren't logged yet are derived from memberships the same way `DumpHistory` does,
+	// operations of scheduled memberships are left out until they happen.
+	// All times are stored in UTC, so `date()` gives the day in UTC
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT day, type, COUNT(*) FROM (
+			SELECT date(time) AS day, type
+			FROM operations
+			WHERE segment_id=$1
+			AND time >= $2 AND time < $3
+			AND time <= $4
+
+			UNION ALL
+
+			SELECT date(expires_at), $5
+			FROM users_segments
+			WHERE segment_id=$1
+			AND removed_at IS NULL
+			AND expires_at <= $4
+			AND expires_at >= $2 AND expires_at < $3
+		) events
+		GROUP BY day, type`,
+		segmentID, from.UTC(), to.UTC(), now, entity.ExpiredOperationType,
+	)
+	if err != nil {
+		return entity.SegmentStats{}, fmt.Errorf("GetSegmentStats() - s.db.QueryContext(): %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var day string
+		var operationType entity.OperationType
+		var count int
+		if err := rows.Scan(&day, &operationType, &count); err != nil {
+			return entity.SegmentStats{}, fmt.Errorf("GetSegmentStats() - rows.Scan(): %w", err)
+		}
+
+		dayTime, err := time.Parse(time.DateOnly, day)
+		if err != nil {
+			return entity.SegmentStats{}, fmt.Errorf("GetSegmentStats() - time.Parse(): %w", err)
+		}
+
+		repository.CountStatsEvents(&stats, dayTime, operationType, count)
+	}
+
+	if err := rows.Err(); err != nil {
+		return entity.SegmentStats{}, fmt.Errorf("GetSegmentStats() - rows.Err(): %w", err)
+	}
+
+	return stats, nil
+}
+
+func (s *SqliteRepository) DumpHistory(ctx context.Context, userID int, timeFrom time.Time, timeTo time.Time) ([]entity.Operation, error) {
+	// expirations aren't mutations, so they are only logged once the expired membership is closed by
+	// the expiration sweep or by adding the segment again. Until then they are derived from memberships
+	// that expired while being active. Operations of scheduled memberships are left out until they happen
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT slug, type, time, expires_at FROM (
+			SELECT o.id, s.slug, o.type, o.time, o.expires_at
+			FROM operations o
+			JOIN segments s ON s.id=o.segment_id
+			WHERE o.user_id=$1
+			AND o.time >= $2 AND o.time < $3
+			AND o.time <= $4
+
+			UNION ALL
+
+			SELECT NULL, s.slug, $5, us.expires_at, us.expires_at
+			FROM users_segments us
+			JOIN segments s ON s.id=us.segment_id
+			WHERE us.user_id=$1
+			AND us.removed_at IS NULL
+			AND us.expires_at <= $4
+			AND us.expires_at >= $2 AND us.expires_at < $3
+		) history
+		ORDER BY time, id NULLS LAST`,
+		userID, timeFrom.UTC(), timeTo.UTC(), s.now(), entity.ExpiredOperationType,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("DumpHistory() - s.db.QueryContext(): %w", err)
+	}
+	defer rows.Close()
+
+	operations := make([]entity.Operation, 0, 30)
+	for rows.Next() {
+		operation := entity.Operation{UserID: userID}
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&operation.SegmentSlug, &operation.Type, &operation.Time, &expiresAt); err != nil {
+			return nil, fmt.Errorf("DumpHistory() - rows.Scan(): %w", err)
+		}
+
+		operation.Time = operation.Time.UTC()
+		operation.ExpiresAt = timePtr(expiresAt)
+
+		operations = append(operations, operation)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("DumpHistory() - rows.Err(): %w", err)
+	}
+
+	return operations, nil
+}
+
+func (s *SqliteRepository) EraseUser(ctx context.Context, userID int, filesCount int) (entity.Erasure, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return entity.Erasure{}, fmt.Errorf("EraseUser() - s.db.BeginTx(): %w", err)
+	}
+	defer tx.Rollback()
+
+	erasure := entity.Erasure{UserID: userID, ErasedAt: s.now(), FilesCount: filesCount}
+
+	// delete the history first
+	res, err := tx.ExecContext(ctx, "DELETE FROM operations WHERE user_id=$1", userID)
+	if err != nil {
+		return entity.Erasure{}, fmt.Errorf("EraseUser() - tx.ExecContext(): %w", err)
+	}
+
+	operations, err := res.RowsAffected()
+	if err != nil {
+		return entity.Erasure{}, fmt.Errorf("EraseUser() - res.RowsAffected(): %w", err)
+	}
+	erasure.OperationsCount = int(operations)
+
+	// delete the memberships
+	res, err = tx.ExecContext(ctx, "DELETE FROM users_segments WHERE user_id=$1", userID)
+	if err != nil {
+		return entity.Erasure{}, fmt.Errorf("EraseUser() - tx.ExecContext(): %w", err)
+	}
+
+	memberships, err := res.RowsAffected()
+	if err != nil {
+		return entity.Erasure{}, fmt.Errorf("EraseUser() - res.RowsAffected(): %w", err)
+	}
+	erasure.MembershipsCount = int(memberships)
+
+	// leave the tombstone
+	_, err = tx.ExecContext(ctx,
+		`INSERT INTO erasures(user_id, erased_at, memberships_count, operations_count, files_count)
+		VALUES ($1, $2, $3, $4, $5)`,
+		erasure.UserID, erasure.ErasedAt, erasure.MembershipsCount, erasure.OperationsCount, erasure.FilesCount,
+	)
+	if err != nil {
+		return entity.Erasure{}, fmt.Errorf("EraseUser() - tx.ExecContext(): %w", err)
+	}
+
+	// commit changes
+	if err := tx.Commit(); err != nil {
+		return entity.Erasure{}, fmt.Errorf("EraseUser() - tx.Commit(): %w", err)
+	}
+
+	return erasure, nil
+}
+
+func (s *SqliteRepository) CreateExperiment(ctx context.Context, slug string, variants []entity.ExperimentVariant) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("CreateExperiment() - s.db.BeginTx(): %w", err)
+	}
+	defer tx.Rollback()
+
+	now := s.now()
+
+	var experimentID int
+	row := tx.QueryRowContext(ctx,
+		"INSERT INTO experiments(slug, created_at) VALUES ($1, $2) ON CONFLICT (slug) DO NOTHING RETURNING id",
+		slug, now,
+	)
+	if err := row.Scan(&experimentID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) { // nothing was inserted
+			return repository.ErrExperimentAlreadyExists
+		}
+
+		return fmt.Errorf("CreateExperiment() - tx.QueryRowContext(): %w", err)
+	}
+
+	groupID, err := exclusionGroupID(ctx, tx, slug, now)
+	if err != nil {
+		return fmt.Errorf("CreateExperiment() - %w", err)
+	}
+
+	for _, variant := range variants {
+		// check if there is a segment under this slug, either current or an alias
+		var cnt int
+		row := tx.QueryRowContext(ctx,
+			"SELECT (SELECT COUNT(*) FROM segments WHERE slug=$1) + (SELECT COUNT(*) FROM segment_aliases WHERE slug=$1)",
+			variant.Slug,
+		)
+		if err := row.Scan(&cnt); err != nil {
+			return fmt.Errorf("CreateExperiment() - tx.QueryRowContext(): %w", err)
+		}
+
+		if cnt != 0 {
+			return repository.ErrSegmentAlreadyExists
+		}
+
+		// variants are plain segments in the exclusion group of the experiment
+		var segmentID int
+		row = tx.QueryRowContext(ctx,
+			"INSERT INTO segments(slug, created_at, exclusion_group_id) VALUES ($1, $2, $3) RETURNING id",
+			variant.Slug, now, groupID,
+		)
+		if err := row.Scan(&segmentID); err != nil {
+			if isUniqueViolation(err) { // created by a concurrent transaction after the check
+				return repository.ErrSegmentAlreadyExists
+			}
+
+			return fmt.Errorf("CreateExperiment() - tx.QueryRowContext(): %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO experiment_variants(experiment_id, segment_id, weight) VALUES ($1, $2, $3)",
+			experimentID, segmentID, variant.Weight,
+		)
+		if err != nil {
+			return fmt.Errorf("CreateExperiment() - tx.ExecContext(): %w", err)
+		}
+	}
+
+	// commit changes
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("CreateExperiment() - tx.Commit(): %w", err)
+	}
+
+	return nil
+}
+
+// queryExperiments returns experiments matching the condition (every one if it's empty) with their variants, oldest first.
+// The condition is applied to `experiments` table aliased as `e`
+func (s *SqliteRepository) queryExperiments(ctx context.Context, condition string, args ...any) ([]entity.Experiment, error) {
+	query := `SELECT e.slug, e.created_at, e.started_at, e.stopped_at, s.slug, v.weight
+		FROM experiments e
+		JOIN experiment_variants v ON v.experiment_id=e.id
+		JOIN segments s ON s.id=v.segment_id`
+	if condition != "" {
+		query += " WHERE " + condition
+	}
+	query += " ORDER BY e.id, v.id"
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("queryExperiments() - s.db.QueryContext(): %w", err)
+	}
+	defer rows.Close()
+
+	experiments := make([]entity.Experiment, 0)
+	for rows.Next() {
+		var experiment entity.Experiment
+		var variant entity.ExperimentVariant
+		var startedAt, stoppedAt sql.NullTime
+		if err := rows.Scan(&experiment.Slug, &experiment.CreatedAt, &startedAt, &stoppedAt, &variant.Slug, &variant.Weight); err != nil {
+			return nil, fmt.Errorf("queryExperiments() - rows.Scan(): %w", err)
+		}
+
+		// rows of an experiment go one after another, the first one starts it
+		if len(experiments) == 0 || experiments[len(experiments)-1].Slug != experiment.Slug {
+			experiment.CreatedAt = experiment.CreatedAt.UTC()
+			experiment.StartedAt = timePtr(startedAt)
+			experiment.StoppedAt = timePtr(stoppedAt)
+			experiments = append(experiments, experiment)
+		}
+
+		last := &experiments[len(experiments)-1]
+		last.Variants = append(last.Variants, variant)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("queryExperiments() - rows.Err(): %w", err)
+	}
+
+	return experiments, nil
+}
+
+func (s *SqliteRepository) GetExperiment(ctx context.Context, slug string) (entity.Experiment, error) {
+	experiments, err := s.queryExperiments(ctx, "e.slug=$1", slug)
+	if err != nil {
+		return entity.Experiment{}, fmt.Errorf("GetExperiment() - %w", err)
+	}
+
+	if len(experiments) == 0 {
+		return entity.Experiment{}, repository.ErrExperimentNotFound
+	}
+
+	return experiments[0], nil
+}
+
+func (s *SqliteRepository) GetAllExperiments(ctx context.Context) ([]entity.Experiment, error) {
+	experiments, err := s.queryExperiments(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("GetAllExperiments() - %w", err)
+	}
+
+	return experiments, nil
+}
+
+// setExperimentTime sets `column` of the experiment, `started_at` or `stopped_at`, to the current time
+// if `check` doesn't return an error for the current start and stop of the experiment.
+// Transactions take the write lock right away, so concurrent starts and stops are checked one after another
+func (s *SqliteRepository) setExperimentTime(ctx context.Context, slug string, column string, check func(startedAt sql.NullTime, stoppedAt sql.NullTime) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("setExperimentTime() - s.db.BeginTx(): %w", err)
+	}
+	defer tx.Rollback()
+
+	var id int
+	var startedAt, stoppedAt sql.NullTime
+	row := tx.QueryRowContext(ctx, "SELECT id, started_at, stopped_at FROM experiments WHERE slug=$1", slug)
+	if err := row.Scan(&id, &startedAt, &stoppedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) { // experiment doesn't exist
+			return repository.ErrExperimentNotFound
+		}
+
+		return fmt.Errorf("setExperimentTime() - tx.QueryRowContext(): %w", err)
+	}
+
+	if err := check(startedAt, stoppedAt); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE experiments SET "+column+"=$2 WHERE id=$1", id, s.now())
+	if err != nil {
+		return fmt.Errorf("setExperimentTime() - tx.ExecContext(): %w", err)
+	}
+
+	// commit changes
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("setExperimentTime() - tx.Commit(): %w", err)
+	}
+
+	return nil
+}
+
+func (s *SqliteRepository) StartExperiment(ctx context.Context, slug string) error {
+	return s.setExperimentTime(ctx, slug, "started_at", func(startedAt sql.NullTime, stoppedAt sql.NullTime) error {
+		if startedAt.Valid {
+			return repository.ErrExperimentAlreadyStarted
+		}
+
+		return nil
+	})
+}
+
+func (s *SqliteRepository) StopExperiment(ctx context.Context, slug string) error {
+	return s.setExperimentTime(ctx, slug, "stopped_at", func(startedAt sql.NullTime, stoppedAt sql.NullTime) error {
+		if !startedAt.Valid {
+			return repository.ErrExperimentNotStarted
+		}
+
+		if stoppedAt.Valid {
+			return repository.ErrExperimentAlreadyStopped
+		}
+
+		return nil
+	})
+}
+
+func (s *SqliteRepository) GetExperimentVariants(ctx context.Context) (map[string]string, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT s.slug, e.slug
+		FROM experiment_variants v
+		JOIN segments s ON s.id=v.segment_id
+		JOIN experiments e ON e.id=v.experiment_id
+		WHERE s.deleted_at IS NULL`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("GetExperimentVariants() - s.db.QueryContext(): %w", err)
+	}
+	defer rows.Close()
+
+	variants := make(map[string]string)
+	for rows.Next() {
+		var slug, experiment string
+		if err := rows.Scan(&slug, &experiment); err != nil {
+			return nil, fmt.Errorf("GetExperimentVariants() - rows.Scan(): %w", err)
+		}
+
+		variants[slug] = experiment
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetExperimentVariants() - rows.Err(): %w", err)
+	}
+
+	return variants, nil
+}
+
+// segmentFilterConditions translates the filter to SQL conditions. Placeholders are numbered
+// after `args` and the returned slice contains `args` followed by the arguments of the conditions
+func segmentFilterConditions(filter entity.SegmentFilter, args []any) ([]string, []any, error) {
+	conditions := make([]string, 0)
+
+	if filter.Owner != "" {
+		args = append(args, filter.Owner)
+		conditions = append(conditions, fmt.Sprintf("owner = $%d", len(args)))
+	}
+
+	if filter.ExclusionGroup != "" {
+		args = append(args, filter.ExclusionGroup)
+		conditions = append(conditions, fmt.Sprintf("exclusion_group_id = (SELECT id FROM exclusion_groups WHERE name = $%d)", len(args)))
+	}
+
+	if filter.Bucketed {
+		conditions = append(conditions, "bucket_salt <> ''")
+	}
+
+	for _, tag := range filter.Tags {
+		args = append(args, tag)
+		conditions = append(conditions, fmt.Sprintf("EXISTS (SELECT 1 FROM json_each(tags) WHERE value = $%d)", len(args)))
+	}
+
+	keys := make([]string, 0, len(filter.Attributes))
+	for key := range filter.Attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value, err := json.Marshal(filter.Attributes[key])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// json_each() and json_extract() both return scalars as SQL values and
+		// nested objects and arrays as minified JSON, so they can be compared directly
+		args = append(args, key, string(value))
+		conditions = append(conditions, fmt.Sprintf(
+			"EXISTS (SELECT 1 FROM json_each(attributes) WHERE key = $%d AND value IS json_extract($%d, '$'))",
+			len(args)-1, len(args),
+		))
+	}
+
+	if filter.OnlyActive {
+		conditions = append(conditions, "deleted_at IS NULL")
+	}
+
+	if filter.Slug != "" {
+		args = append(args, filter.Slug)
+		conditions = append(conditions, fmt.Sprintf("(slug = $%[1]d OR id = (SELECT segment_id FROM segment_aliases WHERE slug = $%[1]d))", len(args)))
+	}
+
+	// instr() and substr() are case-sensitive unlike LIKE
+	if filter.SlugPrefix != "" {
+		args = append(args, filter.SlugPrefix)
+		conditions = append(conditions, fmt.Sprintf("substr(slug, 1, length($%d)) = $%d", len(args), len(args)))
+	}
+
+	if filter.SlugContains != "" {
+		args = append(args, filter.SlugContains)
+		conditions = append(conditions, fmt.Sprintf("instr(slug, $%d) > 0", len(args)))
+	}
+
+	timeRanges := []struct {
+		column string
+		bound  *time.Time
+		op     string
+	}{
+		{"created_at", filter.CreatedFrom, ">="},
+		{"created_at", filter.CreatedTo, "<"},
+		{"deleted_at", filter.DeletedFrom, ">="},
+		{"deleted_at", filter.DeletedTo, "<"},
+	}
+	for _, r := range timeRanges {
+		if r.bound == nil {
+			continue
+		}
+
+		args = append(args, r.bound.UTC())
+		conditions = append(conditions, fmt.Sprintf("%s %s $%d", r.column, r.op, len(args)))
+	}
+
+	return conditions, args, nil
+}
+
+// getSegments returns a page of segments matching the filter
+func (s *SqliteRepository) getSegments(ctx context.Context, filter entity.SegmentFilter, page entity.SegmentPageRequest) (entity.SegmentPage, error) {
+	conditions, args, err := segmentFilterConditions(filter, nil)
+	if err != nil {
+		return entity.SegmentPage{}, fmt.Errorf("segmentFilterConditions(): %w", err)
+	}
+
+	var sortColumn string
+	switch repository.SortBy(page) {
+	case entity.SortByCreatedAt:
+		sortColumn = "created_at"
+	case entity.SortBySlug:
+		sortColumn = "slug"
+	default:
+		return entity.SegmentPage{}, fmt.Errorf("unknown sort field %q", page.SortBy)
+	}
+
+	direction, comparison := "ASC", ">"
+	if page.Descending {
+		direction, comparison = "DESC", "<"
+	}
+
+	// keyset pagination: continue right after the last segment of the previous page
+	cursor, err := repository.DecodeSegmentCursor(page)
+	if err != nil {
+		return entity.SegmentPage{}, err
+	}
+
+	if cursor != nil {
+		var value any = cursor.CreatedAt.UTC()
+		if sortColumn == "slug" {
+			value = cursor.Slug
+		}
+
+		args = append(args, value, cursor.ID)
+		conditions = append(conditions, fmt.Sprintf("(%s, id) %s ($%d, $%d)", sortColumn, comparison, len(args)-1, len(args)))
+	}
+
+	query := `SELECT id, slug, description, owner, tags, attributes, default_ttl,
+		COALESCE((SELECT p.slug FROM segments p WHERE p.id=segments.parent_id), ''), expression, rule, ` + exclusionGroupNameColumn + `, bucket_salt, bucket_percent, created_at, deleted_at,
+		(SELECT json_group_array(slug) FROM (SELECT a.slug FROM segment_aliases a WHERE a.segment_id=segments.id ORDER BY a.id))`
+	if page.WithMemberCounts {
+		args = append(args, s.now())
+		query += fmt.Sprintf(`,
+		(SELECT COUNT(DISTINCT us.user_id) FROM users_segments us
+			WHERE us.segment_id=segments.id
+			AND us.added_at <= $%[1]d
+			AND us.removed_at IS NULL
+			AND (us.expires_at IS NULL OR us.expires_at > $%[1]d))`, len(args))
+	}
+	query += " FROM segments"
+	if len(conditions) != 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY %s %s, id %s", sortColumn, direction, direction)
+
+	// one more row tells if there is the next page
+	if page.Limit > 0 {
+		args = append(args, page.Limit+1)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return entity.SegmentPage{}, fmt.Errorf("s.db.QueryContext(): %w", err)
+	}
+	defer rows.Close()
+
+	segments := make([]entity.Segment, 0, 30)
+	ids := make([]int, 0, 30)
+	for rows.Next() {
+		var segment entity.Segment
+		var id int
+		var tags, attributes, aliases string
+		var deletedAt sql.NullTime
+		var memberCount int
+		dest := []any{&id, &segment.Slug, &segment.Description, &segment.Owner, &tags, &attributes, &segment.DefaultTTL, &segment.Parent, &segment.Expression, &segment.Rule, &segment.ExclusionGroup, &segment.BucketSalt, &segment.BucketPercent, &segment.CreatedAt, &deletedAt, &aliases}
+		if page.WithMemberCounts {
+			dest = append(dest, &memberCount)
+		}
+
+		if err := rows.Scan(dest...); err != nil {
+			return entity.SegmentPage{}, fmt.Errorf("rows.Scan(): %w", err)
+		}
+
+		if err := repository.UnmarshalMetadata([]byte(tags), []byte(attributes), &segment.SegmentMetadata); err != nil {
+			return entity.SegmentPage{}, fmt.Errorf("repository.UnmarshalMetadata(): %w", err)
+		}
+
+		if err := json.Unmarshal([]byte(aliases), &segment.Aliases); err != nil {
+			return entity.SegmentPage{}, fmt.Errorf("json.Unmarshal(): %w", err)
+		}
+
+		if len(segment.Aliases) == 0 {
+			segment.Aliases = nil
+		}
+
+		segment.CreatedAt = segment.CreatedAt.UTC()
+		segment.DeletedAt = timePtr(deletedAt)
+
+		if page.WithMemberCounts {
+			segment.MemberCount = &memberCount
+		}
+
+		segments = append(segments, segment)
+		ids = append(ids, id)
+	}
+
+	if err := rows.Err(); err != nil {
+		return entity.SegmentPage{}, fmt.Errorf("rows.Err(): %w", err)
+	}
+
+	result := entity.SegmentPage{Segments: segments}
+	if page.Limit > 0 && len(segments) > page.Limit {
+		result.Segments = segments[:page.Limit]
+		result.NextCursor, err = repository.EncodeSegmentCursor(page, segments[page.Limit-1], ids[page.Limit-1])
+		if err != nil {
+			return entity.SegmentPage{}, fmt.Errorf("repository.EncodeSegmentCursor(): %w", err)
+		}
+	}
+
+	return result, nil
+}
+
+func (s *SqliteRepository) ListSegments(ctx context.Context, filter entity.SegmentFilter, page entity.SegmentPageRequest) (entity.SegmentPage, error) {
+	result, err := s.getSegments(ctx, filter, page)
+	if err != nil {
+		if errors.Is(err, repository.ErrInvalidCursor) {
+			return entity.SegmentPage{}, err
+		}
+
+		return entity.SegmentPage{}, fmt.Errorf("ListSegments() - %w", err)
+	}
+
+	return result, nil
+}
+
+func (s *SqliteRepository) GetAllActiveSegments(ctx context.Context, filter entity.SegmentFilter) ([]entity.Segment, error) {
+	filter.OnlyActive = true
+	result, err := s.getSegments(ctx, filter, entity.SegmentPageRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("GetAllActiveSegments() - %w", err)
+	}
+
+	return result.Segments, nil
+}
+
+func (s *SqliteRepository) GetAllSegments(ctx context.Context, filter entity.SegmentFilter) ([]entity.Segment, error) {
+	result, err := s.getSegments(ctx, filter, entity.SegmentPageRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("GetAllSegments() - %w", err)
+	}
+
+	return result.Segments, nil
+}
+
+// New opens (and creates if needed) SQLite database file at `path`
+func New(path string, timeProvider timeprovider.TimeProvider) (*SqliteRepository, error) {
+	db, err := sql.Open("sqlite", path+dsnParams)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Ping()
+	if err != nil {
+		return nil, err
+	}
+
+	return &SqliteRepository{
+		db:           db,
+		timeProvider: timeProvider,
+	}, nil
+}
@@ -0,0 +1,71 @@
+package sqlite
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/entity"
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/repository"
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/repository/repotest"
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/timeprovider"
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/timeprovider/fixedtimeprovider"
+	"github.com/stretchr/testify/assert"
+)
+
+var timeBase = time.Date(2000, time.November, 15, 15, 0, 0, 0, time.UTC)
+
+// newTestRepository creates a repository backed by a fresh database file with all migrations applied
+func newTestRepository(t *testing.T, timeProvider timeprovider.TimeProvider) *SqliteRepository {
+	repo, err := New(filepath.Join(t.TempDir(), "test.db"), timeProvider)
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a test database", err)
+	}
+	t.Cleanup(func() { repo.db.Close() })
+
+	if err := repo.Migrate("file://../../../migrations/sqlite"); err != nil {
+		t.Fatalf("an error '%s' was not expected when migrating a test database", err)
+	}
+
+	return repo
+}
+
+func TestRepository(t *testing.T) {
+	repotest.Run(t, func(t *testing.T, timeProvider timeprovider.TimeProvider) repository.Repository {
+		return newTestRepository(t, timeProvider)
+	})
+}
+
+func TestSingleActiveMembership(t *testing.T) {
+	repo := newTestRepository(t, fixedtimeprovider.New(timeBase))
+
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_VOICE", entity.SegmentMetadata{}))
+	_, err := repo.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "AVITO_VOICE"}}, nil)
+	assert.NoError(t, err)
+
+	// the database itself doesn't let a second active membership in
+	_, err = repo.db.ExecContext(context.Background(),
+		"INSERT INTO users_segments(segment_id, user_id, added_at) SELECT segment_id, user_id, added_at FROM users_segments WHERE user_id=1000",
+	)
+	assert.True(t, isUniqueViolation(err))
+}
+
+func TestCancelledContext(t *testing.T) {
+	repo := newTestRepository(t, fixedtimeprovider.New(timeBase))
+	assert.NoError(t, repo.CreateSegment(context.Background(), "AVITO_VOICE", entity.SegmentMetadata{}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err := repo.AddSegmentToUsers(ctx, "AVITO_VOICE", []int{1, 2, 3}, nil)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	_, err = repo.GetSegmentMembers(ctx, "AVITO_VOICE", entity.SegmentMembersRequest{})
+	assert.ErrorIs(t, err, context.Canceled)
+
+	// nothing was added
+	result, err := repo.GetSegmentMembers(context.Background(), "AVITO_VOICE", entity.SegmentMembersRequest{})
+	assert.NoError(t, err)
+	assert.Empty(t, result.UserIDs)
+}
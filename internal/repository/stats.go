@@ -0,0 +1,43 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/entity"
+)
+
+// StatsDay returns the midnight (UTC) of the day `t` belongs to
+func StatsDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// NewSegmentStats prepares stats with zero counts for every day from `from` to `to` (both are midnights in UTC)
+func NewSegmentStats(slug string, activeCount int, from time.Time, to time.Time) entity.SegmentStats {
+	stats := entity.SegmentStats{Slug: slug, ActiveCount: activeCount, From: from, To: to}
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		stats.Days = append(stats.Days, entity.SegmentDayStats{Date: day})
+	}
+
+	return stats
+}
+
+// CountStatsEvents adds `count` operations of this type to the day `day` of the stats.
+// Days outside of the window are ignored
+func CountStatsEvents(stats *entity.SegmentStats, day time.Time, operationType entity.OperationType, count int) {
+	day = StatsDay(day)
+	if day.Before(stats.From) || !day.Before(stats.To) {
+		return
+	}
+
+	// days are added one by one, so the index is the number of days since the start of the window
+	dayStats := &stats.Days[int(day.Sub(stats.From).Hours())/24]
+	switch operationType {
+	case entity.AddedOperationType, entity.SegmentRestoredOperationType:
+		dayStats.Added += count
+	case entity.RemovedOperationType, entity.SegmentDeletedOperationType:
+		dayStats.Removed += count
+	case entity.ExpiredOperationType:
+		dayStats.Expired += count
+	}
+}
@@ -0,0 +1,410 @@
+package rule
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var errInvalid = errors.New("rule is invalid")
+
+// dateLayout is the layout of date values, both in rules and in attributes
+const dateLayout = "2006-01-02"
+
+// Op is the kind of a node of a rule
+type Op int
+
+const (
+	OpCompare Op = iota // attribute `Attribute` compares to `Value` with `Comparison`
+	OpNot
+	OpAnd
+	OpOr
+)
+
+// Comparison is a comparison operator
+type Comparison string
+
+const (
+	Equal          Comparison = "="
+	NotEqual       Comparison = "!="
+	Less           Comparison = "<"
+	LessOrEqual    Comparison = "<="
+	Greater        Comparison = ">"
+	GreaterOrEqual Comparison = ">="
+)
+
+// Rule is a boolean expression over attributes of a user, such as `country = "RU" AND signup_date > 2023-01-01`.
+// Values are strings in double quotes, numbers, dates (`YYYY-MM-DD`) and `true` or `false`.
+// `NOT` binds tighter than `AND`, which binds tighter than `OR`, keywords are case-insensitive
+type Rule struct {
+	Op         Op
+	Attribute  string     // only set for `OpCompare`
+	Comparison Comparison // only set for `OpCompare`
+	Value      any        // string, float64, time.Time or bool, only set for `OpCompare`
+	Operands   []*Rule    // one for `OpNot`, two or more for `OpAnd` and `OpOr`
+}
+
+// Parse parses a rule
+func Parse(s string) (*Rule, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+
+	p := parser{tokens: tokens}
+	r, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos != len(p.tokens) { // something is left after a complete rule
+		return nil, errInvalid
+	}
+
+	return r, nil
+}
+
+// Eval evaluates the rule for a user with these attributes. A comparison with an attribute the user
+// doesn't have or has of another type than the value (dates are strings in `YYYY-MM-DD` or RFC 3339) is false
+func (r *Rule) Eval(attributes map[string]any) bool {
+	switch r.Op {
+	case OpCompare:
+		return r.compare(attributes[r.Attribute])
+	case OpNot:
+		return !r.Operands[0].Eval(attributes)
+	case OpAnd:
+		for _, operand := range r.Operands {
+			if !operand.Eval(attributes) {
+				return false
+			}
+		}
+		return true
+	default:
+		for _, operand := range r.Operands {
+			if operand.Eval(attributes) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// compare compares the attribute to the value of the rule
+func (r *Rule) compare(attribute any) bool {
+	var c int
+	switch value := r.Value.(type) {
+	case string:
+		s, ok := attribute.(string)
+		if !ok {
+			return false
+		}
+		c = strings.Compare(s, value)
+	case float64:
+		f, ok := number(attribute)
+		if !ok {
+			return false
+		}
+		c = compareFloats(f, value)
+	case time.Time:
+		t, ok := date(attribute)
+		if !ok {
+			return false
+		}
+		c = t.Compare(value)
+	case bool:
+		b, ok := attribute.(bool)
+		if !ok {
+			return false
+		}
+		if b != value {
+			c = 1
+		}
+	}
+
+	switch r.Comparison {
+	case Equal:
+		return c == 0
+	case NotEqual:
+		return c != 0
+	case Less:
+		return c < 0
+	case LessOrEqual:
+		return c <= 0
+	case Greater:
+		return c > 0
+	default:
+		return c >= 0
+	}
+}
+
+// number returns the attribute as a number, JSON numbers are decoded as float64
+func number(attribute any) (float64, bool) {
+	switch n := attribute.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+
+	return 0, false
+}
+
+func compareFloats(a float64, b float64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+
+	return 0
+}
+
+// date returns the attribute as a date, it may be a date or a timestamp in RFC 3339
+func date(attribute any) (time.Time, bool) {
+	s, ok := attribute.(string)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	if t, err := time.Parse(dateLayout, s); err == nil {
+		return t, true
+	}
+
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, true
+	}
+
+	return time.Time{}, false
+}
+
+// Attributes returns every attribute the rule compares once, in order of appearance
+func (r *Rule) Attributes() []string {
+	var attributes []string
+	seen := make(map[string]struct{})
+	r.walk(func(attribute string) {
+		if _, ok := seen[attribute]; !ok {
+			seen[attribute] = struct{}{}
+			attributes = append(attributes, attribute)
+		}
+	})
+
+	return attributes
+}
+
+func (r *Rule) walk(fn func(attribute string)) {
+	if r.Op == OpCompare {
+		fn(r.Attribute)
+		return
+	}
+
+	for _, operand := range r.Operands {
+		operand.walk(fn)
+	}
+}
+
+// token is a word, a quoted string, a parenthesis or a comparison operator
+type token struct {
+	text   string
+	quoted bool // the text is the unquoted content of a string
+}
+
+// tokenize splits the rule into tokens
+func tokenize(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		r := rune(s[i])
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			tokens = append(tokens, token{text: string(r)})
+			i++
+		case r == '"':
+			end := i + 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+
+			if end >= len(s) {
+				return nil, errInvalid
+			}
+
+			text, err := strconv.Unquote(s[i : end+1])
+			if err != nil {
+				return nil, errInvalid
+			}
+
+			tokens = append(tokens, token{text: text, quoted: true})
+			i = end + 1
+		case strings.ContainsRune("=!<>", r):
+			end := i + 1
+			if end < len(s) && s[end] == '=' {
+				end++
+			}
+
+			tokens = append(tokens, token{text: s[i:end]})
+			i = end
+		default:
+			end := i
+			for end < len(s) && !strings.ContainsRune(" \t\n\r()\"=!<>", rune(s[end])) {
+				end++
+			}
+
+			tokens = append(tokens, token{text: s[i:end]})
+			i = end
+		}
+	}
+
+	return tokens, nil
+}
+
+// parser is a recursive descent parser over the tokens
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// accept skips the next token if it's the keyword or parenthesis `text`
+func (p *parser) accept(text string) bool {
+	if p.pos < len(p.tokens) && !p.tokens[p.pos].quoted && strings.EqualFold(p.tokens[p.pos].text, text) {
+		p.pos++
+		return true
+	}
+
+	return false
+}
+
+// next returns the next token and skips it
+func (p *parser) next() (token, bool) {
+	if p.pos == len(p.tokens) {
+		return token{}, false
+	}
+
+	p.pos++
+	return p.tokens[p.pos-1], true
+}
+
+func (p *parser) parseOr() (*Rule, error) {
+	return p.parseBinary(OpOr, "OR", p.parseAnd)
+}
+
+func (p *parser) parseAnd() (*Rule, error) {
+	return p.parseBinary(OpAnd, "AND", p.parseNot)
+}
+
+// parseBinary parses operands of `op` separated by `keyword`, a single operand is returned as is
+func (p *parser) parseBinary(op Op, keyword string, parseOperand func() (*Rule, error)) (*Rule, error) {
+	operand, err := parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	operands := []*Rule{operand}
+	for p.accept(keyword) {
+		operand, err := parseOperand()
+		if err != nil {
+			return nil, err
+		}
+
+		operands = append(operands, operand)
+	}
+
+	if len(operands) == 1 {
+		return operand, nil
+	}
+
+	return &Rule{Op: op, Operands: operands}, nil
+}
+
+func (p *parser) parseNot() (*Rule, error) {
+	if !p.accept("NOT") {
+		return p.parseOperand()
+	}
+
+	operand, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Rule{Op: OpNot, Operands: []*Rule{operand}}, nil
+}
+
+// parseOperand parses a comparison or a rule in parentheses
+func (p *parser) parseOperand() (*Rule, error) {
+	if p.accept("(") {
+		r, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if !p.accept(")") {
+			return nil, errInvalid
+		}
+
+		return r, nil
+	}
+
+	attribute, ok := p.next()
+	if !ok || attribute.quoted || !isWord(attribute.text) {
+		return nil, errInvalid
+	}
+
+	comparison, ok := p.next()
+	if !ok || comparison.quoted {
+		return nil, errInvalid
+	}
+
+	switch Comparison(comparison.text) {
+	case Equal, NotEqual, Less, LessOrEqual, Greater, GreaterOrEqual:
+	default:
+		return nil, errInvalid
+	}
+
+	value, ok := p.next()
+	if !ok {
+		return nil, errInvalid
+	}
+
+	r := &Rule{Op: OpCompare, Attribute: attribute.text, Comparison: Comparison(comparison.text)}
+	if value.quoted {
+		r.Value = value.text
+		return r, nil
+	}
+
+	if !isWord(value.text) {
+		return nil, errInvalid
+	}
+
+	if t, err := time.Parse(dateLayout, value.text); err == nil {
+		r.Value = t
+	} else if f, err := strconv.ParseFloat(value.text, 64); err == nil {
+		r.Value = f
+	} else if strings.EqualFold(value.text, "true") || strings.EqualFold(value.text, "false") {
+		if r.Comparison != Equal && r.Comparison != NotEqual { // booleans aren't ordered
+			return nil, errInvalid
+		}
+		r.Value = strings.EqualFold(value.text, "true")
+	} else {
+		return nil, errInvalid
+	}
+
+	return r, nil
+}
+
+// isWord reports whether the token is neither a keyword, a parenthesis nor a comparison operator
+func isWord(text string) bool {
+	for _, keyword := range []string{"AND", "OR", "NOT", "(", ")"} {
+		if strings.EqualFold(text, keyword) {
+			return false
+		}
+	}
+
+	return !strings.ContainsAny(text[:1], "=!<>")
+}
@@ -0,0 +1,88 @@
+package rule
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		testName       string
+		input          string
+		wantAttributes []string
+		wantError      bool
+	}{
+		{testName: "string and date", input: `country = "RU" AND signup_date > 2023-01-01`, wantAttributes: []string{"country", "signup_date"}},
+		{testName: "no spaces", input: `age>=18 and(premium=true or country!="RU")`, wantAttributes: []string{"age", "premium", "country"}},
+		{testName: "escaped quote", input: `name = "say \"hi\""`, wantAttributes: []string{"name"}},
+		{testName: "repeated attribute", input: `age > 18 AND NOT age > 65`, wantAttributes: []string{"age"}},
+		{testName: "empty", input: " ", wantError: true},
+		{testName: "missing value", input: "age >", wantError: true},
+		{testName: "missing comparison", input: "age 18", wantError: true},
+		{testName: "unknown comparison", input: "age => 18", wantError: true},
+		{testName: "unquoted string", input: "country = RU", wantError: true},
+		{testName: "unclosed string", input: `country = "RU`, wantError: true},
+		{testName: "ordered boolean", input: "premium > false", wantError: true},
+		{testName: "quoted attribute", input: `"country" = "RU"`, wantError: true},
+		{testName: "keyword as attribute", input: `AND = "RU"`, wantError: true},
+		{testName: "unclosed parenthesis", input: "(age > 18", wantError: true},
+		{testName: "missing operator", input: "age > 18 age < 65", wantError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			got, err := Parse(tc.input)
+			if tc.wantError {
+				assert.Error(t, err)
+				return
+			}
+
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.wantAttributes, got.Attributes())
+			}
+		})
+	}
+}
+
+func TestEval(t *testing.T) {
+	attributes := map[string]any{
+		"country":     "RU",
+		"signup_date": "2023-03-08",
+		"last_seen":   "2023-08-28T18:03:08Z",
+		"age":         float64(30),
+		"premium":     true,
+	}
+
+	testCases := []struct {
+		testName string
+		input    string
+		want     bool
+	}{
+		{testName: "string equal", input: `country = "RU"`, want: true},
+		{testName: "string not equal", input: `country != "RU"`, want: false},
+		{testName: "date after", input: `signup_date > 2023-01-01`, want: true},
+		{testName: "date before", input: `signup_date < 2023-01-01`, want: false},
+		{testName: "timestamp as date", input: `last_seen >= 2023-08-28`, want: true},
+		{testName: "number", input: `age <= 30`, want: true},
+		{testName: "boolean", input: `premium = true`, want: true},
+		{testName: "and", input: `country = "RU" AND signup_date > 2023-01-01`, want: true},
+		{testName: "or", input: `country = "KZ" OR age > 18`, want: true},
+		{testName: "not", input: `NOT premium = true`, want: false},
+		{testName: "missing attribute", input: `city = "Moscow"`, want: false},
+		{testName: "missing attribute not equal", input: `city != "Moscow"`, want: false},
+		{testName: "another type", input: `country > 10`, want: false},
+		{testName: "not a date", input: `country > 2023-01-01`, want: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			r, err := Parse(tc.input)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			assert.Equal(t, tc.want, r.Eval(attributes))
+		})
+	}
+}
@@ -1,14 +1,21 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"slices"
 	"strings"
 	"time"
 
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/bucket"
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/duration"
 	"github.com/QiZD90/dynamic-customer-segmentation/internal/entity"
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/expression"
 	"github.com/QiZD90/dynamic-customer-segmentation/internal/filestorage"
 	"github.com/QiZD90/dynamic-customer-segmentation/internal/repository"
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/rule"
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/timeprovider"
 	"github.com/QiZD90/dynamic-customer-segmentation/internal/userservice"
 )
 
@@ -16,135 +23,1414 @@ var (
 	ErrSegmentAlreadyExists  = errors.New("segment with this slug already exists")
 	ErrSegmentNotFound       = errors.New("segment with this slug wasn't found")
 	ErrSegmentAlreadyDeleted = errors.New("segment with this slug is already deleted")
+	ErrSegmentNotDeleted     = errors.New("segment with this slug is not deleted")
 	ErrInvalidSegmentList    = errors.New("segment list is invalid")
+	ErrInvalidCursor         = errors.New("cursor is invalid")
+	ErrExpirationInPast      = errors.New("expiration date is in the past")
+	ErrExpirationBeforeStart = errors.New("expiration date is before the start of the membership")
+	ErrInvalidExpiration     = errors.New("expiration is invalid")
+	ErrInvalidDefaultTTL     = errors.New("default TTL is invalid")
+	ErrParentNotFound        = errors.New("parent segment wasn't found")
+	ErrSegmentCycle          = errors.New("segment can't be a descendant of itself")
+	ErrSegmentHasChildren    = errors.New("segment has active children")
+	ErrInvalidChildrenPolicy = errors.New("children policy is invalid")
+	ErrInvalidExpression     = errors.New("expression is invalid")
+	ErrReferenceNotFound     = errors.New("segment referenced by the expression wasn't found")
+	ErrExpressionCycle       = errors.New("expression of the segment can't depend on the segment itself")
+	ErrSegmentReferenced     = errors.New("segment is referenced by composite segments")
+	ErrSegmentComposite      = errors.New("memberships of a composite segment can't be changed directly")
+	ErrNotComposite          = errors.New("segment isn't composite")
+	ErrInvalidRule           = errors.New("rule is invalid")
+	ErrSegmentDynamic        = errors.New("memberships of a dynamic segment are only changed by its rule")
+	ErrNotDynamic            = errors.New("segment isn't dynamic")
+	ErrInvalidExclusionGroup = errors.New("composite, dynamic and bucketed segments can't be in an exclusion group")
+	ErrExclusionConflict     = errors.New("user would be in several segments of the same exclusion group")
+	ErrInvalidBucket         = errors.New("bucket is invalid")
+	ErrSegmentBucketed       = errors.New("memberships of a bucketed segment are decided by the hash of user id")
+	ErrNotBucketed           = errors.New("segment isn't bucketed")
+
+	ErrExperimentAlreadyExists  = errors.New("experiment with this slug already exists")
+	ErrExperimentNotFound       = errors.New("experiment with this slug wasn't found")
+	ErrExperimentAlreadyStarted = errors.New("experiment is already started")
+	ErrExperimentNotStarted     = errors.New("experiment isn't started")
+	ErrExperimentAlreadyStopped = errors.New("experiment is already stopped")
+	ErrInvalidVariants          = errors.New("experiment variants are invalid")
+	ErrSegmentInExperiment      = errors.New("variant of an experiment can't leave its exclusion group")
 )
 
 type Service interface {
 	// CreateSegment creates a segment with specified slug.
-	// If there is a segment (active or deleted) with this slug already, returns `ErrSegmentAlreadyExists`
-	CreateSegment(slug string) error
+	// If there is a segment (active or deleted) with this slug already, returns `ErrSegmentAlreadyExists`,
+	// if the default TTL isn't a positive duration returns `ErrInvalidDefaultTTL`,
+	// if the parent is set but isn't an active segment returns `ErrParentNotFound`.
+	// If the expression is set, the segment is composite. Returns `ErrInvalidExpression` if the expression is malformed
+	// or matches users that are in none of its segments (like `NOT VOICE_MESSAGES`), `ErrReferenceNotFound`
+	// if any of its segments isn't active and `ErrExpressionCycle` if it references the segment itself.
+	// If the rule is set, the segment is dynamic and users matching the rule are added to it right away.
+	// Returns `ErrInvalidRule` if the rule is malformed or the segment is composite as well.
+	// Composite and dynamic segments can't be in an exclusion group, `ErrInvalidExclusionGroup` is returned if it's set.
+	// If the bucket salt or percent is set, the segment is bucketed, and the salt defaults to the slug. Returns `ErrInvalidBucket`
+	// if the percent isn't from 0 to 100 or the segment is composite, dynamic or in an exclusion group as well
+	CreateSegment(ctx context.Context, slug string, metadata entity.SegmentMetadata) error
+
+	// UpdateSegment changes metadata of an active segment. Only non-nil fields of `update` are changed
+	// Returns `ErrSegmentNotFound` or `ErrSegmentAlreadyDeleted` if there is no active segment by this slug
+	// and `ErrInvalidDefaultTTL` if the new default TTL isn't a positive duration.
+	// Changing the default TTL doesn't affect existing memberships.
+	// Returns `ErrParentNotFound` if the new parent isn't an active segment and `ErrSegmentCycle`
+	// if it's the segment itself or one of its descendants.
+	// The expression can only be changed for composite segments (otherwise `ErrNotComposite` is returned),
+	// and it's checked the same way as in `CreateSegment`. Returns `ErrExpressionCycle` if the segment
+	// would depend on itself, directly or through other composite segments.
+	// The rule can only be changed for dynamic segments (otherwise `ErrNotDynamic` is returned),
+	// `ErrInvalidRule` is returned if it's malformed. The segment is refreshed with the new rule right away.
+	// The bucket percent can only be changed for bucketed segments (otherwise `ErrNotBucketed` is returned),
+	// `ErrInvalidBucket` is returned if it isn't from 0 to 100. Raising it only adds users, lowering it only removes them.
+	// Putting a composite, dynamic or bucketed segment in an exclusion group returns `ErrInvalidExclusionGroup`, and if any
+	// member of the segment is in another segment of the new group, `ErrExclusionConflict` is returned.
+	// Variants of experiments can't change their exclusion group, `ErrSegmentInExperiment` is returned
+	UpdateSegment(ctx context.Context, slug string, update entity.SegmentMetadataUpdate) error
+
+	// RenameSegment changes the slug of an active segment, keeping its memberships and history.
+	// The old slug stays as an alias that can be used everywhere instead of the new one.
+	// Returns `ErrSegmentAlreadyExists` if the new slug is taken by another segment or alias
+	// and `ErrSegmentNotFound` or `ErrSegmentAlreadyDeleted` if there is no active segment by this slug
+	RenameSegment(ctx context.Context, slug string, newSlug string) error
 
 	// CreateSegmentAndEnrollPercent creates segment using CreateSegment, gets random users
 	// through UserService and then tries to add the segment to them.
 	// Returns ids of selected users (they may or may not have got the segment added)
-	// May return `ErrSegmentNotFound` or `ErrSegmentAlreadyExists`
-	CreateSegmentAndEnrollPercent(slug string, percent int) ([]int, error)
+	// and how many of them actually got the segment. If the segment is put in an exclusion group, sampled users
+	// that are in another segment of the group are replaced with other users, so that they don't take up the percent.
+	// Users that have joined the group in the meantime don't get the segment and are counted as excluded.
+	// Memberships expire after the default TTL of the segment, if it's set.
+	// May return `ErrSegmentNotFound`, `ErrSegmentAlreadyExists`, `ErrInvalidDefaultTTL` or `ErrParentNotFound`.
+	// Composite segments can't be enrolled into, so `ErrSegmentComposite` is returned if the expression is set,
+	// and neither can dynamic ones, `ErrSegmentDynamic` is returned if the rule is set,
+	// or bucketed ones, `ErrSegmentBucketed` is returned if the bucket salt or percent is set
+	CreateSegmentAndEnrollPercent(ctx context.Context, slug string, metadata entity.SegmentMetadata, percent int) ([]int, entity.EnrollmentResult, error)
+
+	// EnrollPercent gets random users through UserService and tries to add the active segment to them.
+	// Users are sampled regardless of who is in the segment already, so members are topped up by the selected users
+	// that didn't have it. Sampled users in another segment of its exclusion group are replaced with other users.
+	// Returns ids of selected users and how many of them got the segment, already had it
+	// or have joined another segment of its exclusion group in the meantime. Memberships expire at `expiresAt` if it's set,
+	// otherwise after the default TTL of the segment. Returns `ErrExpirationInPast` if `expiresAt` isn't in the future,
+	// `ErrSegmentNotFound` or `ErrSegmentAlreadyDeleted` if there is no active segment by this slug
+	// and `ErrSegmentComposite`, `ErrSegmentDynamic` or `ErrSegmentBucketed` if it's composite, dynamic or bucketed
+	EnrollPercent(ctx context.Context, slug string, percent int, expiresAt *time.Time) ([]int, entity.EnrollmentResult, error)
 
 	// DeleteSegment marks segment as deleted and marks all records with it as removed
-	// Returns `ErrSegmentNotFound` if there is no segment by this slug
-	DeleteSegment(slug string) error
+	// Active children are deleted along with it if `children` is `ChildrenCascade` or become top-level segments
+	// if it's `ChildrenDetach`. Otherwise (empty means `ChildrenRestrict`) segment with active children isn't deleted
+	// and `ErrSegmentHasChildren` is returned. Returns `ErrInvalidChildrenPolicy` if the policy is unknown and
+	// `ErrSegmentNotFound` if there is no segment by this slug.
+	// Unless `force` is set, segments referenced by active composite segments aren't deleted and `ErrSegmentReferenced`
+	// is returned. Forced deletion leaves the composites as they are, and the deleted segments have no members in them
+	DeleteSegment(ctx context.Context, slug string, children entity.ChildrenPolicy, force bool) error
 
-	// GetAllActiveSegments returns all active segments
-	GetAllActiveSegments() ([]entity.Segment, error)
+	// RestoreSegment clears deletion of the segment. If `restoreMemberships` is set, also re-activates
+	// memberships that were removed by the deletion and haven't expired since then, and returns their number.
+	// Memberships of users that are now in another segment of the exclusion group of the segment stay removed.
+	// Children deleted along with the segment are restored separately. If the parent is deleted, the segment
+	// is restored as a top-level one.
+	// Returns `ErrSegmentNotFound` if there is no segment by this slug and `ErrSegmentNotDeleted` if it isn't deleted
+	RestoreSegment(ctx context.Context, slug string, restoreMemberships bool) (int, error)
 
-	// GetAllActiveSegments returns all segments, active or not
-	GetAllSegments() ([]entity.Segment, error)
+	// GetAllActiveSegments returns all active segments matching the filter
+	GetAllActiveSegments(ctx context.Context, filter entity.SegmentFilter) ([]entity.Segment, error)
+
+	// GetAllActiveSegments returns all segments, active or not, matching the filter
+	GetAllSegments(ctx context.Context, filter entity.SegmentFilter) ([]entity.Segment, error)
+
+	// ListSegments returns a page of segments matching the filter, sorted as requested.
+	// Returns `ErrInvalidCursor` if the cursor of the page is malformed or belongs to a list with another order
+	ListSegments(ctx context.Context, filter entity.SegmentFilter, page entity.SegmentPageRequest) (entity.SegmentPage, error)
 
 	// UpdateUserSegments adds and removes segments to/from user with expiration date
 	// If user is already in the segment that you want to add, ignores it.
 	// If user doesn't have the segment that you want to remove, ignores it.
-	// If segment any of the segments don't exist or was deleted returns `ErrSegmentNotFound` and `ErrSegmentAlreadyDeleted`
-	UpdateUserSegments(userID int, addSegments []entity.SegmentExpiration, removeSegments []entity.SegmentExpiration) error
+	// Relative expirations are resolved against the current time, the add list is returned with them resolved.
+	// Segments added without an expiration expire after the default TTL of the segment, if it's set.
+	// Memberships with `StartsAt` in the future are scheduled: they are active and recorded as added
+	// from that time on, and relative expirations and the default TTL count from it.
+	// Removing a scheduled membership cancels it.
+	// If segment any of the segments don't exist or was deleted returns `ErrSegmentNotFound` and `ErrSegmentAlreadyDeleted`,
+	// if any of the expirations is invalid returns `ErrInvalidExpiration`, if any of the segments is composite
+	// returns `ErrSegmentComposite`, if any of them is dynamic returns `ErrSegmentDynamic`,
+	// if any of them is bucketed returns `ErrSegmentBucketed`.
+	// If user would end up in several segments of the same exclusion group returns `ErrExclusionConflict`
+	// and changes nothing. To move user to another segment of the group remove the current one in the same call
+	UpdateUserSegments(ctx context.Context, userID int, addSegments []entity.SegmentExpiration, removeSegments []entity.SegmentExpiration) ([]entity.SegmentExpiration, error)
+
+	// UpdateUserSegmentExpirations extends, shortens or clears (if nil) expiration dates of segments that user has.
+	// Segments that user doesn't have are skipped, scheduled memberships can be changed too. `StartsAt` is ignored.
+	// Every change is recorded in user's history.
+	// Relative expirations are resolved the same way as in `UpdateUserSegments`, the list is returned with them resolved.
+	// Returns `ErrInvalidSegmentList` if the list contains the same segment twice, `ErrInvalidExpiration`
+	// or `ErrExpirationInPast` if any of the expirations is invalid or isn't in the future,
+	// `ErrExpirationBeforeStart` if a scheduled membership would expire before it starts and
+	// `ErrSegmentNotFound` or `ErrSegmentAlreadyDeleted` if any of the segments doesn't exist or was deleted
+	// and `ErrSegmentComposite`, `ErrSegmentDynamic` or `ErrSegmentBucketed` if any of them is composite, dynamic or bucketed
+	UpdateUserSegmentExpirations(ctx context.Context, userID int, segments []entity.SegmentExpiration) ([]entity.SegmentExpiration, error)
+
+	// GetActiveUserSegments returns active (not removed and not expired) segments that user is in,
+	// including bucketed segments whose percent user's bucket is in, flagged as bucketed, and composite segments
+	// whose expressions hold for all of these memberships, flagged as composite.
+	// Variants of experiments are returned with the slug of their experiment.
+	// If `withInherited` is set, ancestors of these segments are returned as well, flagged as inherited
+	// unless user is in them explicitly
+	GetActiveUserSegments(ctx context.Context, userID int, withInherited bool) ([]entity.UserSegment, error)
 
-	// GetActiveUserSegments returns active (not removed and not expired) segments that user is in
-	GetActiveUserSegments(userID int) ([]entity.UserSegment, error)
+	// GetSegmentMembers returns a page of ids of users that were in the segment at `request.AsOf` (now if zero).
+	// Deleted segments can be looked up too. Every page is built for the moment of the first one.
+	// Members of composite segments are computed from the members of the segments they reference at that moment.
+	// Members of bucketed segments are the users of the user service whose buckets are in the current percent.
+	// Returns `ErrSegmentNotFound` if there is no segment by this slug and `ErrInvalidCursor`
+	// if the cursor is malformed or was built for another moment
+	GetSegmentMembers(ctx context.Context, slug string, request entity.SegmentMembersRequest) (entity.SegmentMembersPage, error)
+
+	// GetSegmentStats returns the number of users in the segment now and the number of memberships
+	// added, removed and expired on every day from `from` to `to` (midnights in UTC, `to` is excluded).
+	// Deleted segments can be looked up too. Returns `ErrSegmentNotFound` if there is no segment by this slug
+	GetSegmentStats(ctx context.Context, slug string, from time.Time, to time.Time) (entity.SegmentStats, error)
+
+	// StreamSegmentMembers calls `fn` with the id of every user that was in the segment at `asOf` (now if zero)
+	// in ascending order, stopping at the first error of `fn`. Meant for segments too large for a single page.
+	// Members of composite and bucketed segments are computed the same way as in `GetSegmentMembers`.
+	// Returns `ErrSegmentNotFound` before the first call if there is no segment by this slug
+	StreamSegmentMembers(ctx context.Context, slug string, asOf time.Time, fn func(userID int) error) error
 
 	// DumpHistory returns all operations related to given users that occurred in specified time span
 	// Returns a download link for a CSV file with this data
-	DumpHistoryCSV(userID int, timeFrom time.Time, timeTo time.Time) (string, error)
+	DumpHistoryCSV(ctx context.Context, userID int, timeFrom time.Time, timeTo time.Time) (string, error)
+
+	// EraseUser deletes everything about the user: memberships, history and stored CSV reports.
+	// Only a tombstone with the time of the erasure and the number of deleted records is left
+	EraseUser(ctx context.Context, userID int) (entity.Erasure, error)
+
+	// ExpireMemberships records every membership that has expired by now as expired and passes
+	// the expirations to the change hooks. Returns the number of recorded expirations
+	ExpireMemberships(ctx context.Context) (int, error)
+
+	// RefreshDynamicSegments evaluates the rule of every active dynamic segment for every user of the user service,
+	// adds the segment to the users that match it and removes it from the ones that don't anymore.
+	// The changes are recorded in the history and passed to the change hooks like any other ones.
+	// Returns what has been changed in every segment, sorted by slug
+	RefreshDynamicSegments(ctx context.Context) ([]entity.RefreshResult, error)
+
+	// CreateExperiment creates an experiment along with its variant segments. The experiment isn't started,
+	// so it doesn't enroll users yet. Variants are plain segments in the exclusion group named after the experiment.
+	// Returns `ErrInvalidVariants` unless there are at least two variants with distinct slugs and positive weights
+	// that sum up to 100, `ErrExperimentAlreadyExists` if there is an experiment by this slug already
+	// and `ErrSegmentAlreadyExists` if any of the variant slugs is taken by a segment or alias
+	CreateExperiment(ctx context.Context, slug string, variants []entity.ExperimentVariant) error
+
+	// GetExperiment returns the experiment with its variants. Returns `ErrExperimentNotFound` if there is no such experiment
+	GetExperiment(ctx context.Context, slug string) (entity.Experiment, error)
+
+	// GetAllExperiments returns every experiment with its variants, oldest first
+	GetAllExperiments(ctx context.Context) ([]entity.Experiment, error)
+
+	// StartExperiment records the start of the experiment, after that it enrolls users.
+	// Returns `ErrExperimentNotFound` if there is no such experiment and `ErrExperimentAlreadyStarted` if it was started before
+	StartExperiment(ctx context.Context, slug string) error
+
+	// StopExperiment records the stop of the experiment, after that it doesn't enroll users anymore.
+	// Users keep the variants they got. Returns `ErrExperimentNotFound` if there is no such experiment,
+	// `ErrExperimentNotStarted` if it isn't started and `ErrExperimentAlreadyStopped` if it was stopped before
+	StopExperiment(ctx context.Context, slug string) error
+
+	// EnrollExperiment gets random users through UserService and adds every one of them to the variant
+	// their bucket in the experiment falls into, so the users are split by the weights of the variants
+	// and the same user always gets the same variant. Users that are in a variant already are skipped.
+	// Returns ids of selected users and how many of them got, already had or couldn't get every variant.
+	// Memberships expire at `expiresAt` if it's set. Returns `ErrExpirationInPast` if `expiresAt` isn't in the future,
+	// `ErrExperimentNotFound` if there is no such experiment, `ErrExperimentNotStarted` or `ErrExperimentAlreadyStopped`
+	// if it isn't running and `ErrSegmentAlreadyDeleted` if any of its variants was deleted
+	EnrollExperiment(ctx context.Context, slug string, percent int, expiresAt *time.Time) ([]int, []entity.VariantEnrollment, error)
 }
 
+// ChangeHook is called with the operations of every committed change of user memberships,
+// after the change has been made. It can't fail the change, so errors have to be handled by the hook itself
+type ChangeHook func(ctx context.Context, operations []entity.Operation)
+
 type SegmentationService struct {
-	Repository  repository.Repository
-	FileStorage filestorage.FileStorage
-	UserService userservice.UserService
+	Repository   repository.Repository
+	FileStorage  filestorage.FileStorage
+	UserService  userservice.UserService
+	TimeProvider timeprovider.TimeProvider
+
+	changeHooks []ChangeHook
+}
+
+// AddChangeHook registers a hook that is called on changes of user memberships.
+// Hooks must be added before the service is used
+func (s *SegmentationService) AddChangeHook(hook ChangeHook) {
+	s.changeHooks = append(s.changeHooks, hook)
 }
 
-func (s *SegmentationService) CreateSegment(slug string) error {
-	err := s.Repository.CreateSegment(slug)
+// notifyChange passes the operations to every change hook
+func (s *SegmentationService) notifyChange(ctx context.Context, operations []entity.Operation) {
+	if len(operations) == 0 {
+		return
+	}
+
+	for _, hook := range s.changeHooks {
+		hook(ctx, operations)
+	}
+}
+
+// validDefaultTTL reports whether the default TTL is either empty or a positive duration
+func validDefaultTTL(ttl string) bool {
+	if ttl == "" {
+		return true
+	}
+
+	d, err := duration.Parse(ttl)
+	return err == nil && d > 0
+}
+
+// validExpression reports whether the expression is well-formed and never matches users that are in none
+// of its segments. Members of such segments can be computed from the members of the referenced segments,
+// without going through every user there is
+func validExpression(expr string) bool {
+	e, err := expression.Parse(expr)
+	return err == nil && e.Bounded()
+}
+
+// validBucketPercent reports whether the percent is a number of buckets
+func validBucketPercent(percent int) bool {
+	return percent >= 0 && percent <= bucket.Count
+}
+
+// validRule reports whether the rule is well-formed
+func validRule(r string) bool {
+	_, err := rule.Parse(r)
+	return err == nil
+}
+
+func (s *SegmentationService) CreateSegment(ctx context.Context, slug string, metadata entity.SegmentMetadata) error {
+	if !validDefaultTTL(metadata.DefaultTTL) {
+		return ErrInvalidDefaultTTL
+	}
+
+	if metadata.Expression != "" && !validExpression(metadata.Expression) {
+		return ErrInvalidExpression
+	}
+
+	if metadata.Rule != "" && (metadata.Expression != "" || !validRule(metadata.Rule)) {
+		return ErrInvalidRule
+	}
+
+	if metadata.ExclusionGroup != "" && (metadata.Expression != "" || metadata.Rule != "") {
+		return ErrInvalidExclusionGroup
+	}
+
+	if metadata.BucketSalt != "" || metadata.BucketPercent != 0 {
+		if !validBucketPercent(metadata.BucketPercent) || metadata.Expression != "" || metadata.Rule != "" || metadata.ExclusionGroup != "" {
+			return ErrInvalidBucket
+		}
+
+		// the slug may be renamed later, the salt never changes
+		if metadata.BucketSalt == "" {
+			metadata.BucketSalt = slug
+		}
+	}
+
+	err := s.Repository.CreateSegment(ctx, slug, metadata)
 	if errors.Is(err, repository.ErrSegmentAlreadyExists) {
 		return ErrSegmentAlreadyExists
+	} else if errors.Is(err, repository.ErrParentNotFound) {
+		return ErrParentNotFound
+	} else if errors.Is(err, repository.ErrReferenceNotFound) {
+		return ErrReferenceNotFound
+	} else if errors.Is(err, repository.ErrExpressionCycle) {
+		return ErrExpressionCycle
+	} else if err != nil {
+		return err
+	}
+
+	if metadata.Rule != "" {
+		_, err = s.refreshSegments(ctx, []entity.Segment{{Slug: slug, SegmentMetadata: metadata}})
 	}
 
 	return err
 }
 
-func (s *SegmentationService) DeleteSegment(slug string) error {
-	err := s.Repository.DeleteSegment(slug)
+func (s *SegmentationService) UpdateSegment(ctx context.Context, slug string, update entity.SegmentMetadataUpdate) error {
+	if update.DefaultTTL != nil && !validDefaultTTL(*update.DefaultTTL) {
+		return ErrInvalidDefaultTTL
+	}
+
+	if update.Expression != nil && !validExpression(*update.Expression) {
+		return ErrInvalidExpression
+	}
+
+	if update.Rule != nil && !validRule(*update.Rule) {
+		return ErrInvalidRule
+	}
+
+	if update.BucketPercent != nil && !validBucketPercent(*update.BucketPercent) {
+		return ErrInvalidBucket
+	}
+
+	// the exclusion group keeps users in one variant of an experiment at a time
+	if update.ExclusionGroup != nil {
+		variant, err := s.isVariant(ctx, slug)
+		if err != nil {
+			return err
+		}
+
+		if variant {
+			return ErrSegmentInExperiment
+		}
+	}
+
+	err := s.Repository.UpdateSegment(ctx, slug, update)
+	if errors.Is(err, repository.ErrSegmentNotFound) {
+		return ErrSegmentNotFound
+	} else if errors.Is(err, repository.ErrSegmentAlreadyDeleted) {
+		return ErrSegmentAlreadyDeleted
+	} else if errors.Is(err, repository.ErrParentNotFound) {
+		return ErrParentNotFound
+	} else if errors.Is(err, repository.ErrSegmentCycle) {
+		return ErrSegmentCycle
+	} else if errors.Is(err, repository.ErrNotComposite) {
+		return ErrNotComposite
+	} else if errors.Is(err, repository.ErrReferenceNotFound) {
+		return ErrReferenceNotFound
+	} else if errors.Is(err, repository.ErrExpressionCycle) {
+		return ErrExpressionCycle
+	} else if errors.Is(err, repository.ErrNotDynamic) {
+		return ErrNotDynamic
+	} else if errors.Is(err, repository.ErrNotBucketed) {
+		return ErrNotBucketed
+	} else if errors.Is(err, repository.ErrSegmentComposite) || errors.Is(err, repository.ErrSegmentDynamic) || errors.Is(err, repository.ErrSegmentBucketed) {
+		return ErrInvalidExclusionGroup
+	} else if errors.Is(err, repository.ErrExclusionConflict) {
+		return ErrExclusionConflict
+	} else if err != nil {
+		return err
+	}
+
+	if update.Rule != nil {
+		segment, err := s.findSegment(ctx, slug)
+		if err != nil {
+			return err
+		}
+
+		_, err = s.refreshSegments(ctx, []entity.Segment{segment})
+		return err
+	}
+
+	return nil
+}
+
+func (s *SegmentationService) RenameSegment(ctx context.Context, slug string, newSlug string) error {
+	err := s.Repository.RenameSegment(ctx, slug, newSlug)
 	if errors.Is(err, repository.ErrSegmentNotFound) {
 		return ErrSegmentNotFound
 	} else if errors.Is(err, repository.ErrSegmentAlreadyDeleted) {
 		return ErrSegmentAlreadyDeleted
+	} else if errors.Is(err, repository.ErrSegmentAlreadyExists) {
+		return ErrSegmentAlreadyExists
 	}
 
 	return err
 }
 
-func (s *SegmentationService) CreateSegmentAndEnrollPercent(slug string, percent int) ([]int, error) {
-	if err := s.CreateSegment(slug); err != nil {
+func (s *SegmentationService) DeleteSegment(ctx context.Context, slug string, children entity.ChildrenPolicy, force bool) error {
+	switch children {
+	case "":
+		children = entity.ChildrenRestrict
+	case entity.ChildrenRestrict, entity.ChildrenCascade, entity.ChildrenDetach:
+	default:
+		return ErrInvalidChildrenPolicy
+	}
+
+	operations, err := s.Repository.DeleteSegment(ctx, slug, children, force)
+	if errors.Is(err, repository.ErrSegmentNotFound) {
+		return ErrSegmentNotFound
+	} else if errors.Is(err, repository.ErrSegmentAlreadyDeleted) {
+		return ErrSegmentAlreadyDeleted
+	} else if errors.Is(err, repository.ErrSegmentHasChildren) {
+		return ErrSegmentHasChildren
+	} else if errors.Is(err, repository.ErrSegmentReferenced) {
+		return ErrSegmentReferenced
+	} else if err != nil {
+		return err
+	}
+
+	s.notifyChange(ctx, operations)
+	return nil
+}
+
+func (s *SegmentationService) RestoreSegment(ctx context.Context, slug string, restoreMemberships bool) (int, error) {
+	operations, err := s.Repository.RestoreSegment(ctx, slug, restoreMemberships)
+	if errors.Is(err, repository.ErrSegmentNotFound) {
+		return 0, ErrSegmentNotFound
+	} else if errors.Is(err, repository.ErrSegmentNotDeleted) {
+		return 0, ErrSegmentNotDeleted
+	} else if err != nil {
+		return 0, err
+	}
+
+	s.notifyChange(ctx, operations)
+	return len(operations), nil
+}
+
+// maxSampleRounds limits how many times users are sampled to replace the ones in another segment of the exclusion group
+const maxSampleRounds = 10
+
+// sampleUsers returns random `percent` of the users of the user service to enroll into the segment.
+// Users in another segment of its exclusion group can't get it, so they are replaced with new users of further
+// samples until there are as many users as in the first one. Every sample is of the same size, so the cost depends
+// on the percent and on how much of it the group takes up, not on the number of users. Gives up with fewer users
+// after `maxSampleRounds` samples or once a sample has no new users
+func (s *SegmentationService) sampleUsers(ctx context.Context, slug string, percent int) ([]int, error) {
+	userIDs, err := s.UserService.GetRandomUsers(ctx, percent)
+	if err != nil {
+		return nil, err
+	}
+
+	target := len(userIDs)
+	seen := make(map[int]struct{}, target)
+	sample := make([]int, 0, target)
+	for round := 1; ; round++ {
+		var fresh []int
+		for _, userID := range userIDs {
+			if _, ok := seen[userID]; !ok {
+				seen[userID] = struct{}{}
+				fresh = append(fresh, userID)
+			}
+		}
+
+		members, err := s.Repository.GetExclusionGroupMembers(ctx, slug, fresh)
+		if errors.Is(err, repository.ErrSegmentNotFound) {
+			return nil, ErrSegmentNotFound
+		} else if err != nil {
+			return nil, err
+		}
+
+		if round == 1 && len(members) == 0 { // nobody to replace
+			return userIDs, nil
+		}
+
+		for _, userID := range fresh {
+			if _, found := slices.BinarySearch(members, userID); !found && len(sample) < target {
+				sample = append(sample, userID)
+			}
+		}
+
+		if len(sample) == target || len(fresh) == 0 || round == maxSampleRounds {
+			return sample, nil
+		}
+
+		userIDs, err = s.UserService.GetRandomUsers(ctx, percent)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (s *SegmentationService) CreateSegmentAndEnrollPercent(ctx context.Context, slug string, metadata entity.SegmentMetadata, percent int) ([]int, entity.EnrollmentResult, error) {
+	// checked before the segment is created, so that a failed call leaves nothing behind
+	if metadata.Expression != "" {
+		return nil, entity.EnrollmentResult{}, ErrSegmentComposite
+	}
+
+	if metadata.Rule != "" {
+		return nil, entity.EnrollmentResult{}, ErrSegmentDynamic
+	}
+
+	if metadata.BucketSalt != "" || metadata.BucketPercent != 0 {
+		return nil, entity.EnrollmentResult{}, ErrSegmentBucketed
+	}
+
+	if err := s.CreateSegment(ctx, slug, metadata); err != nil {
 		if errors.Is(err, repository.ErrSegmentAlreadyExists) {
-			return nil, ErrSegmentAlreadyExists
+			return nil, entity.EnrollmentResult{}, ErrSegmentAlreadyExists
 		}
 
-		return nil, err
+		return nil, entity.EnrollmentResult{}, err
 	}
 
-	userIDs, err := s.UserService.GetRandomUsers(percent)
+	userIDs, err := s.sampleUsers(ctx, slug, percent)
 	if err != nil {
-		return nil, err
+		return nil, entity.EnrollmentResult{}, err
 	}
 
-	if err := s.Repository.AddSegmentToUsers(slug, userIDs); err != nil {
+	// chunks committed before an error are notified as well
+	result, operations, err := s.Repository.AddSegmentToUsers(ctx, slug, userIDs, nil)
+	s.notifyChange(ctx, operations)
+	if err != nil {
 		if errors.Is(err, repository.ErrSegmentAlreadyExists) {
-			return nil, ErrSegmentAlreadyExists
+			return nil, entity.EnrollmentResult{}, ErrSegmentAlreadyExists
 		} else if errors.Is(err, repository.ErrSegmentNotFound) {
-			return nil, ErrSegmentNotFound
+			return nil, entity.EnrollmentResult{}, ErrSegmentNotFound
+		} else if errors.Is(err, repository.ErrSegmentAlreadyDeleted) { // deleted right after creation
+			return nil, entity.EnrollmentResult{}, ErrSegmentAlreadyDeleted
 		}
 
-		return nil, err
+		return nil, entity.EnrollmentResult{}, err
 	}
 
-	return userIDs, nil
+	return userIDs, result, nil
 }
 
-func (s *SegmentationService) GetAllActiveSegments() ([]entity.Segment, error) {
-	return s.Repository.GetAllActiveSegments()
+func (s *SegmentationService) EnrollPercent(ctx context.Context, slug string, percent int, expiresAt *time.Time) ([]int, entity.EnrollmentResult, error) {
+	if expiresAt != nil && !expiresAt.After(s.TimeProvider.Now()) {
+		return nil, entity.EnrollmentResult{}, ErrExpirationInPast
+	}
+
+	// checked before users are sampled, repositories don't look at the segment when there is nobody to add
+	segment, err := s.findSegment(ctx, slug)
+	if err != nil {
+		return nil, entity.EnrollmentResult{}, err
+	}
+
+	if segment.DeletedAt != nil {
+		return nil, entity.EnrollmentResult{}, ErrSegmentAlreadyDeleted
+	} else if segment.Expression != "" {
+		return nil, entity.EnrollmentResult{}, ErrSegmentComposite
+	} else if segment.Rule != "" {
+		return nil, entity.EnrollmentResult{}, ErrSegmentDynamic
+	} else if segment.BucketSalt != "" {
+		return nil, entity.EnrollmentResult{}, ErrSegmentBucketed
+	}
+
+	userIDs, err := s.sampleUsers(ctx, slug, percent)
+	if err != nil {
+		return nil, entity.EnrollmentResult{}, err
+	}
+
+	// the segment may have been changed or deleted in the meantime,
+	// chunks committed before an error are notified as well
+	result, operations, err := s.Repository.AddSegmentToUsers(ctx, slug, userIDs, expiresAt)
+	s.notifyChange(ctx, operations)
+	if errors.Is(err, repository.ErrSegmentNotFound) {
+		return nil, entity.EnrollmentResult{}, ErrSegmentNotFound
+	} else if errors.Is(err, repository.ErrSegmentAlreadyDeleted) {
+		return nil, entity.EnrollmentResult{}, ErrSegmentAlreadyDeleted
+	} else if errors.Is(err, repository.ErrSegmentComposite) {
+		return nil, entity.EnrollmentResult{}, ErrSegmentComposite
+	} else if errors.Is(err, repository.ErrSegmentDynamic) {
+		return nil, entity.EnrollmentResult{}, ErrSegmentDynamic
+	} else if errors.Is(err, repository.ErrSegmentBucketed) {
+		return nil, entity.EnrollmentResult{}, ErrSegmentBucketed
+	} else if err != nil {
+		return nil, entity.EnrollmentResult{}, err
+	}
+
+	return userIDs, result, nil
 }
 
-func (s *SegmentationService) GetAllSegments() ([]entity.Segment, error) {
-	return s.Repository.GetAllSegments()
+func (s *SegmentationService) GetAllActiveSegments(ctx context.Context, filter entity.SegmentFilter) ([]entity.Segment, error) {
+	return s.Repository.GetAllActiveSegments(ctx, filter)
 }
 
-func (s *SegmentationService) UpdateUserSegments(userID int, addSegments []entity.SegmentExpiration, removeSegments []entity.SegmentExpiration) error {
+func (s *SegmentationService) GetAllSegments(ctx context.Context, filter entity.SegmentFilter) ([]entity.Segment, error) {
+	return s.Repository.GetAllSegments(ctx, filter)
+}
+
+func (s *SegmentationService) ListSegments(ctx context.Context, filter entity.SegmentFilter, page entity.SegmentPageRequest) (entity.SegmentPage, error) {
+	result, err := s.Repository.ListSegments(ctx, filter, page)
+	if errors.Is(err, repository.ErrInvalidCursor) {
+		return entity.SegmentPage{}, ErrInvalidCursor
+	}
+
+	return result, err
+}
+
+// resolveExpirations returns a copy of the segments with relative expirations resolved against the start
+// of the membership, which is the current time unless it's scheduled for later.
+// Returns `ErrInvalidExpiration` if both expirations are set, the duration is malformed or not positive
+// or the membership would expire before it starts
+func (s *SegmentationService) resolveExpirations(segments []entity.SegmentExpiration) ([]entity.SegmentExpiration, error) {
+	now := s.TimeProvider.Now()
+	resolved := make([]entity.SegmentExpiration, len(segments))
+	for i, segment := range segments {
+		resolved[i] = segment
+
+		start := now
+		if segment.StartsAt != nil && segment.StartsAt.After(now) {
+			start = *segment.StartsAt
+		}
+
+		if segment.ExpiresIn != "" {
+			if segment.ExpiresAt != nil { // only one of them may be set
+				return nil, ErrInvalidExpiration
+			}
+
+			d, err := duration.Parse(segment.ExpiresIn)
+			if err != nil || d <= 0 {
+				return nil, ErrInvalidExpiration
+			}
+
+			expiresAt := start.Add(d)
+			resolved[i].ExpiresAt = &expiresAt
+		}
+
+		if segment.StartsAt != nil && resolved[i].ExpiresAt != nil && !resolved[i].ExpiresAt.After(start) {
+			return nil, ErrInvalidExpiration
+		}
+	}
+
+	return resolved, nil
+}
+
+func (s *SegmentationService) UpdateUserSegments(ctx context.Context, userID int, addSegments []entity.SegmentExpiration, removeSegments []entity.SegmentExpiration) ([]entity.SegmentExpiration, error) {
 	if !ValidateSegmentLists(addSegments, removeSegments) {
-		return ErrInvalidSegmentList
+		return nil, ErrInvalidSegmentList
 	}
 
-	err := s.Repository.UpdateUserSegments(userID, addSegments, removeSegments)
+	addSegments, err := s.resolveExpirations(addSegments)
+	if err != nil {
+		return nil, err
+	}
+
+	operations, err := s.Repository.UpdateUserSegments(ctx, userID, addSegments, removeSegments)
 	if errors.Is(err, repository.ErrSegmentNotFound) {
-		return ErrSegmentNotFound
+		return nil, ErrSegmentNotFound
 	} else if errors.Is(err, repository.ErrSegmentAlreadyDeleted) {
-		return ErrSegmentAlreadyDeleted
+		return nil, ErrSegmentAlreadyDeleted
+	} else if errors.Is(err, repository.ErrSegmentComposite) {
+		return nil, ErrSegmentComposite
+	} else if errors.Is(err, repository.ErrSegmentDynamic) {
+		return nil, ErrSegmentDynamic
+	} else if errors.Is(err, repository.ErrSegmentBucketed) {
+		return nil, ErrSegmentBucketed
+	} else if errors.Is(err, repository.ErrExclusionConflict) {
+		return nil, ErrExclusionConflict
+	} else if err != nil {
+		return nil, err
 	}
 
-	return err
+	s.notifyChange(ctx, operations)
+	return addSegments, nil
+}
+
+func (s *SegmentationService) UpdateUserSegmentExpirations(ctx context.Context, userID int, segments []entity.SegmentExpiration) ([]entity.SegmentExpiration, error) {
+	if !ValidateSegmentLists(segments, nil) {
+		return nil, ErrInvalidSegmentList
+	}
+
+	// memberships have already started or been scheduled, so the start can't be changed here
+	segments = slices.Clone(segments)
+	for i := range segments {
+		segments[i].StartsAt = nil
+	}
+
+	segments, err := s.resolveExpirations(segments)
+	if err != nil {
+		return nil, err
+	}
+
+	operations, err := s.Repository.UpdateUserSegmentExpirations(ctx, userID, segments)
+	if errors.Is(err, repository.ErrSegmentNotFound) {
+		return nil, ErrSegmentNotFound
+	} else if errors.Is(err, repository.ErrSegmentAlreadyDeleted) {
+		return nil, ErrSegmentAlreadyDeleted
+	} else if errors.Is(err, repository.ErrExpirationInPast) {
+		return nil, ErrExpirationInPast
+	} else if errors.Is(err, repository.ErrExpirationBeforeStart) {
+		return nil, ErrExpirationBeforeStart
+	} else if errors.Is(err, repository.ErrSegmentComposite) {
+		return nil, ErrSegmentComposite
+	} else if errors.Is(err, repository.ErrSegmentDynamic) {
+		return nil, ErrSegmentDynamic
+	} else if errors.Is(err, repository.ErrSegmentBucketed) {
+		return nil, ErrSegmentBucketed
+	} else if err != nil {
+		return nil, err
+	}
+
+	s.notifyChange(ctx, operations)
+	return segments, nil
+}
+
+// inheritSegments appends ancestors of the segments that user isn't in explicitly, flagged as inherited.
+// An inherited segment starts with the earliest and expires with the latest of the memberships it's inherited from
+func inheritSegments(segments []entity.UserSegment, parents map[string]string) []entity.UserSegment {
+	result := slices.Clone(segments)
+	indices := make(map[string]int, len(segments)) // index of every segment in the result
+	for i, segment := range segments {
+		indices[segment.Slug] = i
+	}
+
+	for _, segment := range segments {
+		// repositories don't let the hierarchy have cycles, this only keeps a broken one from hanging the request
+		visited := map[string]struct{}{segment.Slug: {}}
+		for slug, ok := parents[segment.Slug]; ok; slug, ok = parents[slug] {
+			if _, seen := visited[slug]; seen {
+				break
+			}
+			visited[slug] = struct{}{}
+
+			i, found := indices[slug]
+			if !found {
+				inherited := segment
+				inherited.Slug = slug
+				inherited.Inherited = true
+				inherited.Composite = false
+				inherited.Bucketed = false
+				inherited.Experiment = ""
+
+				indices[slug] = len(result)
+				result = append(result, inherited)
+				continue
+			}
+
+			if !result[i].Inherited { // user is in it explicitly
+				continue
+			}
+
+			if segment.AddedAt.Before(result[i].AddedAt) {
+				result[i].AddedAt = segment.AddedAt
+			}
+
+			if result[i].ExpiresAt != nil && (segment.ExpiresAt == nil || segment.ExpiresAt.After(*result[i].ExpiresAt)) {
+				result[i].ExpiresAt = segment.ExpiresAt
+			}
+		}
+	}
+
+	return result
+}
+
+// bucketSegments appends bucketed segments whose percent user's bucket is in, flagged as bucketed.
+// A bucketed segment starts with its creation
+func bucketSegments(segments []entity.UserSegment, bucketed []entity.Segment, userID int) []entity.UserSegment {
+	result := slices.Clone(segments)
+	for _, segment := range bucketed {
+		if bucket.Contains(segment.BucketSalt, segment.BucketPercent, userID) {
+			result = append(result, entity.UserSegment{Slug: segment.Slug, AddedAt: segment.CreatedAt, Bucketed: true})
+		}
+	}
+
+	return result
+}
+
+// composeSegments appends composite segments whose expressions hold for the memberships, flagged as composite.
+// A composite segment starts with the latest of the memberships in the segments its expression references
+func composeSegments(segments []entity.UserSegment, composites map[string]*expression.Expr) []entity.UserSegment {
+	memberships := make(map[string]entity.UserSegment, len(segments))
+	for _, segment := range segments {
+		memberships[segment.Slug] = segment
+	}
+
+	// composites may reference other composites, so every one is evaluated once, when it's needed first.
+	// Repositories don't let expressions depend on themselves, `evaluating` only keeps a broken one from hanging the request
+	evaluated := make(map[string]struct{})
+	evaluating := make(map[string]struct{})
+	var member func(slug string) bool
+	member = func(slug string) bool {
+		e, composite := composites[slug]
+		if _, done := evaluated[slug]; done || !composite {
+			_, ok := memberships[slug]
+			return ok
+		}
+
+		if _, ok := evaluating[slug]; ok {
+			return false
+		}
+
+		evaluating[slug] = struct{}{}
+		holds := e.Eval(member)
+		delete(evaluating, slug)
+		evaluated[slug] = struct{}{}
+
+		if holds {
+			membership := entity.UserSegment{Slug: slug, Composite: true}
+			for _, ref := range e.Slugs() {
+				if m, ok := memberships[ref]; ok && m.AddedAt.After(membership.AddedAt) {
+					membership.AddedAt = m.AddedAt
+				}
+			}
+			memberships[slug] = membership
+		}
+
+		return holds
+	}
+
+	slugs := make([]string, 0, len(composites))
+	for slug := range composites {
+		slugs = append(slugs, slug)
+	}
+	slices.Sort(slugs)
+
+	result := slices.Clone(segments)
+	for _, slug := range slugs {
+		member(slug)
+	}
+
+	for _, slug := range slugs {
+		if membership, ok := memberships[slug]; ok {
+			result = append(result, membership)
+		}
+	}
+
+	return result
+}
+
+func (s *SegmentationService) GetActiveUserSegments(ctx context.Context, userID int, withInherited bool) ([]entity.UserSegment, error) {
+	segments, err := s.Repository.GetActiveUserSegments(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	variants, err := s.Repository.GetExperimentVariants(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range segments {
+		segments[i].Experiment = variants[segments[i].Slug]
+	}
+
+	// bucketed memberships go first, composite segments may reference them
+	bucketed, err := s.Repository.GetAllActiveSegments(ctx, entity.SegmentFilter{Bucketed: true})
+	if err != nil {
+		return nil, err
+	}
+	segments = bucketSegments(segments, bucketed, userID)
+
+	expressions, err := s.Repository.GetCompositeSegments(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(expressions) != 0 {
+		composites := make(map[string]*expression.Expr, len(expressions))
+		for slug, expr := range expressions {
+			e, err := expression.Parse(expr)
+			if err != nil {
+				return nil, fmt.Errorf("GetActiveUserSegments() - expression.Parse(): %w", err)
+			}
+			composites[slug] = e
+		}
+
+		segments = composeSegments(segments, composites)
+	}
+
+	if !withInherited {
+		return segments, nil
+	}
+
+	parents, err := s.Repository.GetSegmentParents(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return inheritSegments(segments, parents), nil
+}
+
+// findSegment returns the segment, active or deleted, by its slug or alias
+func (s *SegmentationService) findSegment(ctx context.Context, slug string) (entity.Segment, error) {
+	segments, err := s.Repository.GetAllSegments(ctx, entity.SegmentFilter{Slug: slug})
+	if err != nil {
+		return entity.Segment{}, err
+	}
+
+	if len(segments) == 0 {
+		return entity.Segment{}, ErrSegmentNotFound
+	}
+
+	return segments[0], nil
+}
+
+// segmentMembers returns sorted ids of users that were in the segment at `asOf`
+func (s *SegmentationService) segmentMembers(ctx context.Context, slug string, asOf time.Time, evaluating map[string]struct{}) ([]int, error) {
+	segment, err := s.findSegment(ctx, slug)
+	if err != nil {
+		return nil, err
+	}
+
+	if segment.Expression != "" || segment.BucketSalt != "" {
+		return s.computedMembers(ctx, segment, asOf, evaluating)
+	}
+
+	var userIDs []int
+	err = s.Repository.StreamSegmentMembers(ctx, slug, asOf, func(userID int) error {
+		userIDs = append(userIDs, userID)
+		return nil
+	})
+	if errors.Is(err, repository.ErrSegmentNotFound) {
+		return nil, ErrSegmentNotFound
+	}
+
+	return userIDs, err
+}
+
+// computedMembers returns sorted ids of users that were in the composite or bucketed segment at `asOf`
+func (s *SegmentationService) computedMembers(ctx context.Context, segment entity.Segment, asOf time.Time, evaluating map[string]struct{}) ([]int, error) {
+	if segment.BucketSalt != "" {
+		return s.bucketedMembers(ctx, segment, asOf)
+	}
+
+	return s.compositeMembers(ctx, segment, asOf, evaluating)
+}
+
+// bucketedMembers returns sorted ids of users of the user service that were in the bucketed segment at `asOf`.
+// Changes of the percent aren't recorded, so the current one is used for any moment the segment existed at
+func (s *SegmentationService) bucketedMembers(ctx context.Context, segment entity.Segment, asOf time.Time) ([]int, error) {
+	// the segment had no members before it was created and has none since it was deleted
+	if segment.CreatedAt.After(asOf) || (segment.DeletedAt != nil && !segment.DeletedAt.After(asOf)) {
+		return nil, nil
+	}
+
+	var userIDs []int
+	for afterUserID := 0; segment.BucketPercent > 0; {
+		users, err := s.UserService.GetUserAttributes(ctx, afterUserID, userAttributesPageSize)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, user := range users {
+			if bucket.Contains(segment.BucketSalt, segment.BucketPercent, user.UserID) {
+				userIDs = append(userIDs, user.UserID)
+			}
+		}
+
+		if len(users) < userAttributesPageSize { // no more users
+			break
+		}
+		afterUserID = users[len(users)-1].UserID
+	}
+
+	return userIDs, nil
+}
+
+// compositeMembers returns sorted ids of users that were in the composite segment at `asOf`. Only members
+// of the referenced segments are checked: valid expressions don't match anyone else.
+// `evaluating` holds the composites whose members are being computed, it keeps a broken expression
+// that depends on itself from recursing forever
+func (s *SegmentationService) compositeMembers(ctx context.Context, segment entity.Segment, asOf time.Time, evaluating map[string]struct{}) ([]int, error) {
+	// the segment had no members before it was created and has none since it was deleted
+	if segment.CreatedAt.After(asOf) || (segment.DeletedAt != nil && !segment.DeletedAt.After(asOf)) {
+		return nil, nil
+	}
+
+	if _, ok := evaluating[segment.Slug]; ok {
+		return nil, nil
+	}
+	evaluating[segment.Slug] = struct{}{}
+	defer delete(evaluating, segment.Slug)
+
+	e, err := expression.Parse(segment.Expression)
+	if err != nil {
+		return nil, fmt.Errorf("compositeMembers() - expression.Parse(): %w", err)
+	}
+
+	var candidates []int
+	members := make(map[string]map[int]struct{})
+	for _, ref := range e.Slugs() {
+		userIDs, err := s.segmentMembers(ctx, ref, asOf, evaluating)
+		if err != nil {
+			return nil, err
+		}
+
+		members[ref] = make(map[int]struct{}, len(userIDs))
+		for _, userID := range userIDs {
+			members[ref][userID] = struct{}{}
+		}
+		candidates = append(candidates, userIDs...)
+	}
+
+	var userIDs []int
+	for _, userID := range repository.UniqueUserIDs(candidates) {
+		if e.Eval(func(ref string) bool { _, ok := members[ref][userID]; return ok }) {
+			userIDs = append(userIDs, userID)
+		}
+	}
+
+	return userIDs, nil
 }
 
-func (s *SegmentationService) GetActiveUserSegments(userID int) ([]entity.UserSegment, error) {
-	return s.Repository.GetActiveUserSegments(userID)
+func (s *SegmentationService) GetSegmentMembers(ctx context.Context, slug string, request entity.SegmentMembersRequest) (entity.SegmentMembersPage, error) {
+	segment, err := s.findSegment(ctx, slug)
+	if err != nil {
+		return entity.SegmentMembersPage{}, err
+	}
+
+	if segment.Expression != "" || segment.BucketSalt != "" {
+		return s.getComputedMembers(ctx, segment, request)
+	}
+
+	result, err := s.Repository.GetSegmentMembers(ctx, slug, request)
+	if errors.Is(err, repository.ErrSegmentNotFound) {
+		return entity.SegmentMembersPage{}, ErrSegmentNotFound
+	} else if errors.Is(err, repository.ErrInvalidCursor) {
+		return entity.SegmentMembersPage{}, ErrInvalidCursor
+	}
+
+	return result, err
+}
+
+// getComputedMembers builds a page of members of the composite or bucketed segment the same way repositories do for stored members
+func (s *SegmentationService) getComputedMembers(ctx context.Context, segment entity.Segment, request entity.SegmentMembersRequest) (entity.SegmentMembersPage, error) {
+	cursor, err := repository.DecodeMembersCursor(request)
+	if err != nil {
+		return entity.SegmentMembersPage{}, ErrInvalidCursor
+	}
+
+	afterUserID := 0
+	if cursor != nil {
+		afterUserID = cursor.UserID
+	}
+	asOf := repository.MembersAsOf(request, cursor, s.TimeProvider.Now())
+
+	userIDs, err := s.computedMembers(ctx, segment, asOf, make(map[string]struct{}))
+	if err != nil {
+		return entity.SegmentMembersPage{}, err
+	}
+
+	// ids are sorted, so the ones before the cursor are at the start
+	start, _ := slices.BinarySearch(userIDs, afterUserID+1)
+	userIDs = userIDs[start:]
+
+	result := entity.SegmentMembersPage{AsOf: asOf, UserIDs: userIDs}
+	if result.UserIDs == nil {
+		result.UserIDs = []int{}
+	}
+
+	if request.Limit > 0 && len(userIDs) > request.Limit {
+		result.UserIDs = userIDs[:request.Limit]
+		result.NextCursor, err = repository.EncodeCursor(repository.MembersCursor{AsOf: asOf, UserID: userIDs[request.Limit-1]})
+		if err != nil {
+			return entity.SegmentMembersPage{}, fmt.Errorf("getComputedMembers() - repository.EncodeCursor(): %w", err)
+		}
+	}
+
+	return result, nil
+}
+
+func (s *SegmentationService) GetSegmentStats(ctx context.Context, slug string, from time.Time, to time.Time) (entity.SegmentStats, error) {
+	stats, err := s.Repository.GetSegmentStats(ctx, slug, repository.StatsDay(from), repository.StatsDay(to))
+	if errors.Is(err, repository.ErrSegmentNotFound) {
+		return entity.SegmentStats{}, ErrSegmentNotFound
+	}
+
+	return stats, err
+}
+
+func (s *SegmentationService) StreamSegmentMembers(ctx context.Context, slug string, asOf time.Time, fn func(userID int) error) error {
+	segment, err := s.findSegment(ctx, slug)
+	if err != nil {
+		return err
+	}
+
+	if segment.Expression != "" || segment.BucketSalt != "" {
+		if asOf.IsZero() {
+			asOf = s.TimeProvider.Now()
+		}
+
+		userIDs, err := s.computedMembers(ctx, segment, asOf, make(map[string]struct{}))
+		if err != nil {
+			return err
+		}
+
+		for _, userID := range userIDs {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			if err := fn(userID); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	err = s.Repository.StreamSegmentMembers(ctx, slug, asOf, fn)
+	if errors.Is(err, repository.ErrSegmentNotFound) {
+		return ErrSegmentNotFound
+	}
+
+	return err
 }
 
-func (s *SegmentationService) DumpHistoryCSV(userID int, timeFrom time.Time, timeTo time.Time) (string, error) {
-	operations, err := s.Repository.DumpHistory(userID, timeFrom, timeTo)
+func (s *SegmentationService) DumpHistoryCSV(ctx context.Context, userID int, timeFrom time.Time, timeTo time.Time) (string, error) {
+	operations, err := s.Repository.DumpHistory(ctx, userID, timeFrom, timeTo)
 	if err != nil {
 		return "", err
 	}
 
 	csv := s.generateCSVString(userID, operations)
-	csvURL, err := s.FileStorage.StoreCSV(csv, userID, timeFrom, timeTo)
+	csvURL, err := s.FileStorage.StoreCSV(ctx, csv, userID, timeFrom, timeTo)
 	return csvURL, err
 }
 
+func (s *SegmentationService) EraseUser(ctx context.Context, userID int) (entity.Erasure, error) {
+	// files go first: if erasure of the records fails afterwards, it can be simply retried
+	filesCount, err := s.FileStorage.DeleteUserCSVs(ctx, userID)
+	if err != nil {
+		return entity.Erasure{}, err
+	}
+
+	return s.Repository.EraseUser(ctx, userID, filesCount)
+}
+
+// expireBatchSize is the maximum number of memberships that are expired in one transaction
+const expireBatchSize = 1000
+
+func (s *SegmentationService) ExpireMemberships(ctx context.Context) (int, error) {
+	count := 0
+	for {
+		operations, err := s.Repository.ExpireMemberships(ctx, expireBatchSize)
+		if err != nil {
+			return count, err
+		}
+
+		count += len(operations)
+		s.notifyChange(ctx, operations)
+
+		if len(operations) < expireBatchSize { // no more expired memberships
+			return count, nil
+		}
+	}
+}
+
+// userAttributesPageSize is the number of users that are requested from the user service at once
+const userAttributesPageSize = 1000
+
+func (s *SegmentationService) RefreshDynamicSegments(ctx context.Context) ([]entity.RefreshResult, error) {
+	segments, err := s.Repository.GetAllActiveSegments(ctx, entity.SegmentFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	segments = slices.DeleteFunc(segments, func(segment entity.Segment) bool { return segment.Rule == "" })
+	return s.refreshSegments(ctx, segments)
+}
+
+// refreshSegments evaluates the rules of the dynamic segments for every user of the user service in one pass
+// and syncs the members of every segment with the users that match its rule. Segments that have been deleted
+// or changed in the meantime are skipped
+func (s *SegmentationService) refreshSegments(ctx context.Context, segments []entity.Segment) ([]entity.RefreshResult, error) {
+	rules := make([]*rule.Rule, len(segments))
+	for i, segment := range segments {
+		r, err := rule.Parse(segment.Rule)
+		if err != nil {
+			return nil, fmt.Errorf("refreshSegments() - rule.Parse(): %w", err)
+		}
+		rules[i] = r
+	}
+
+	members := make([][]int, len(segments))
+	for afterUserID := 0; len(segments) != 0; {
+		users, err := s.UserService.GetUserAttributes(ctx, afterUserID, userAttributesPageSize)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, user := range users {
+			for i, r := range rules {
+				if r.Eval(user.Attributes) {
+					members[i] = append(members[i], user.UserID)
+				}
+			}
+		}
+
+		if len(users) < userAttributesPageSize { // no more users
+			break
+		}
+		afterUserID = users[len(users)-1].UserID
+	}
+
+	results := make([]entity.RefreshResult, 0, len(segments))
+	for i, segment := range segments {
+		operations, err := s.Repository.SyncSegmentMembers(ctx, segment.Slug, members[i])
+		if errors.Is(err, repository.ErrSegmentNotFound) || errors.Is(err, repository.ErrSegmentAlreadyDeleted) || errors.Is(err, repository.ErrNotDynamic) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		s.notifyChange(ctx, operations)
+
+		result := entity.RefreshResult{Slug: segment.Slug}
+		for _, o := range operations {
+			switch o.Type {
+			case entity.AddedOperationType:
+				result.AddedCount++
+			case entity.RemovedOperationType:
+				result.RemovedCount++
+			}
+		}
+		results = append(results, result)
+	}
+
+	slices.SortFunc(results, func(a, b entity.RefreshResult) int { return strings.Compare(a.Slug, b.Slug) })
+	return results, nil
+}
+
+// validVariants reports whether there are at least two variants with distinct slugs and positive weights
+// that sum up to the number of buckets, so that every bucket of the experiment belongs to a variant
+func validVariants(variants []entity.ExperimentVariant) bool {
+	if len(variants) < 2 {
+		return false
+	}
+
+	slugs := make(map[string]struct{}, len(variants))
+	total := 0
+	for _, variant := range variants {
+		if _, ok := slugs[variant.Slug]; ok || variant.Slug == "" || variant.Weight <= 0 {
+			return false
+		}
+
+		slugs[variant.Slug] = struct{}{}
+		total += variant.Weight
+	}
+
+	return total == bucket.Count
+}
+
+// experimentSalt is the bucket salt of the experiment. It's kept apart from the salts of bucketed segments,
+// which default to their slugs, so that an experiment doesn't split users the same way as a segment named like it
+func experimentSalt(slug string) string {
+	return "experiment:" + slug
+}
+
+// variantOf returns the index of the variant whose share of the buckets contains the bucket,
+// variants take consecutive buckets in their order
+func variantOf(variants []entity.ExperimentVariant, b int) int {
+	for i, variant := range variants {
+		if b < variant.Weight {
+			return i
+		}
+		b -= variant.Weight
+	}
+
+	return len(variants) - 1
+}
+
+// isVariant reports whether the active segment by this slug or alias is a variant of an experiment
+func (s *SegmentationService) isVariant(ctx context.Context, slug string) (bool, error) {
+	segments, err := s.Repository.GetAllActiveSegments(ctx, entity.SegmentFilter{Slug: slug})
+	if err != nil || len(segments) == 0 {
+		return false, err
+	}
+
+	variants, err := s.Repository.GetExperimentVariants(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	_, ok := variants[segments[0].Slug]
+	return ok, nil
+}
+
+func (s *SegmentationService) CreateExperiment(ctx context.Context, slug string, variants []entity.ExperimentVariant) error {
+	if !validVariants(variants) {
+		return ErrInvalidVariants
+	}
+
+	err := s.Repository.CreateExperiment(ctx, slug, variants)
+	if errors.Is(err, repository.ErrExperimentAlreadyExists) {
+		return ErrExperimentAlreadyExists
+	} else if errors.Is(err, repository.ErrSegmentAlreadyExists) {
+		return ErrSegmentAlreadyExists
+	}
+
+	return err
+}
+
+func (s *SegmentationService) GetExperiment(ctx context.Context, slug string) (entity.Experiment, error) {
+	experiment, err := s.Repository.GetExperiment(ctx, slug)
+	if errors.Is(err, repository.ErrExperimentNotFound) {
+		return entity.Experiment{}, ErrExperimentNotFound
+	}
+
+	return experiment, err
+}
+
+func (s *SegmentationService) GetAllExperiments(ctx context.Context) ([]entity.Experiment, error) {
+	return s.Repository.GetAllExperiments(ctx)
+}
+
+func (s *SegmentationService) StartExperiment(ctx context.Context, slug string) error {
+	err := s.Repository.StartExperiment(ctx, slug)
+	if errors.Is(err, repository.ErrExperimentNotFound) {
+		return ErrExperimentNotFound
+	} else if errors.Is(err, repository.ErrExperimentAlreadyStarted) {
+		return ErrExperimentAlreadyStarted
+	}
+
+	return err
+}
+
+func (s *SegmentationService) StopExperiment(ctx context.Context, slug string) error {
+	err := s.Repository.StopExperiment(ctx, slug)
+	if errors.Is(err, repository.ErrExperimentNotFound) {
+		return ErrExperimentNotFound
+	} else if errors.Is(err, repository.ErrExperimentNotStarted) {
+		return ErrExperimentNotStarted
+	} else if errors.Is(err, repository.ErrExperimentAlreadyStopped) {
+		return ErrExperimentAlreadyStopped
+	}
+
+	return err
+}
+
+func (s *SegmentationService) EnrollExperiment(ctx context.Context, slug string, percent int, expiresAt *time.Time) ([]int, []entity.VariantEnrollment, error) {
+	if expiresAt != nil && !expiresAt.After(s.TimeProvider.Now()) {
+		return nil, nil, ErrExpirationInPast
+	}
+
+	experiment, err := s.GetExperiment(ctx, slug)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if experiment.StartedAt == nil {
+		return nil, nil, ErrExperimentNotStarted
+	} else if experiment.StoppedAt != nil {
+		return nil, nil, ErrExperimentAlreadyStopped
+	}
+
+	// checked before users are sampled, so that a deleted variant doesn't leave the rest enrolled
+	variants, err := s.Repository.GetExperimentVariants(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, variant := range experiment.Variants {
+		if _, ok := variants[variant.Slug]; !ok {
+			return nil, nil, ErrSegmentAlreadyDeleted
+		}
+	}
+
+	userIDs, err := s.UserService.GetRandomUsers(ctx, percent)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	variantUsers := make([][]int, len(experiment.Variants))
+	for _, userID := range userIDs {
+		i := variantOf(experiment.Variants, bucket.Of(experimentSalt(experiment.Slug), userID))
+		variantUsers[i] = append(variantUsers[i], userID)
+	}
+
+	// users that are in another variant already are counted as excluded by the exclusion group
+	results := make([]entity.VariantEnrollment, 0, len(experiment.Variants))
+	for i, variant := range experiment.Variants {
+		result, operations, err := s.Repository.AddSegmentToUsers(ctx, variant.Slug, variantUsers[i], expiresAt)
+		s.notifyChange(ctx, operations)
+		if errors.Is(err, repository.ErrSegmentNotFound) || errors.Is(err, repository.ErrSegmentAlreadyDeleted) {
+			return nil, nil, ErrSegmentAlreadyDeleted
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		results = append(results, entity.VariantEnrollment{Slug: variant.Slug, EnrollmentResult: result})
+	}
+
+	return userIDs, results, nil
+}
+
 func (s *SegmentationService) generateCSVString(userID int, operations []entity.Operation) string {
 	sb := strings.Builder{}
 
@@ -155,6 +1441,6 @@ func (s *SegmentationService) generateCSVString(userID int, operations []entity.
 	return sb.String()
 }
 
-func New(repo repository.Repository, fstorage filestorage.FileStorage, userService userservice.UserService) *SegmentationService {
-	return &SegmentationService{Repository: repo, FileStorage: fstorage, UserService: userService}
+func New(repo repository.Repository, fstorage filestorage.FileStorage, userService userservice.UserService, timeProvider timeprovider.TimeProvider) *SegmentationService {
+	return &SegmentationService{Repository: repo, FileStorage: fstorage, UserService: userService, TimeProvider: timeProvider}
 }
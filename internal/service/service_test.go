@@ -0,0 +1,503 @@
+package service
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/bucket"
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/entity"
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/expression"
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/repository/memory"
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/timeprovider/fixedtimeprovider"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInheritSegments(t *testing.T) {
+	hour := time.Time{}.Add(time.Hour)
+	day := time.Time{}.Add(24 * time.Hour)
+	parents := map[string]string{
+		"PROMO_SUMMER":    "PROMO",
+		"PROMO_SUMMER_EU": "PROMO_SUMMER",
+		"PROMO_SUMMER_US": "PROMO_SUMMER",
+		"PROMO_WINTER":    "PROMO",
+	}
+
+	testCases := []struct {
+		testName string
+		segments []entity.UserSegment
+		want     []entity.UserSegment
+	}{
+		{
+			testName: "no parents",
+			segments: []entity.UserSegment{{Slug: "PROMO"}, {Slug: "VOICE_MESSAGES"}},
+			want:     []entity.UserSegment{{Slug: "PROMO"}, {Slug: "VOICE_MESSAGES"}},
+		},
+		{
+			testName: "all ancestors are inherited",
+			segments: []entity.UserSegment{{Slug: "PROMO_SUMMER_EU", AddedAt: hour, ExpiresAt: &day}},
+			want: []entity.UserSegment{
+				{Slug: "PROMO_SUMMER_EU", AddedAt: hour, ExpiresAt: &day},
+				{Slug: "PROMO_SUMMER", AddedAt: hour, ExpiresAt: &day, Inherited: true},
+				{Slug: "PROMO", AddedAt: hour, ExpiresAt: &day, Inherited: true},
+			},
+		},
+		{
+			testName: "explicit membership wins",
+			segments: []entity.UserSegment{{Slug: "PROMO_SUMMER_EU", AddedAt: hour}, {Slug: "PROMO", AddedAt: day}},
+			want: []entity.UserSegment{
+				{Slug: "PROMO_SUMMER_EU", AddedAt: hour},
+				{Slug: "PROMO", AddedAt: day},
+				{Slug: "PROMO_SUMMER", AddedAt: hour, Inherited: true},
+			},
+		},
+		{
+			testName: "inherited from several children",
+			segments: []entity.UserSegment{
+				{Slug: "PROMO_SUMMER_EU", AddedAt: day, ExpiresAt: &day},
+				{Slug: "PROMO_SUMMER_US", AddedAt: hour, ExpiresAt: &hour},
+				{Slug: "PROMO_WINTER", AddedAt: day},
+			},
+			want: []entity.UserSegment{
+				{Slug: "PROMO_SUMMER_EU", AddedAt: day, ExpiresAt: &day},
+				{Slug: "PROMO_SUMMER_US", AddedAt: hour, ExpiresAt: &hour},
+				{Slug: "PROMO_WINTER", AddedAt: day},
+				{Slug: "PROMO_SUMMER", AddedAt: hour, ExpiresAt: &day, Inherited: true},
+				{Slug: "PROMO", AddedAt: hour, Inherited: true},
+			},
+		},
+		{
+			testName: "child flags aren't inherited",
+			segments: []entity.UserSegment{
+				{Slug: "PROMO_SUMMER_EU", AddedAt: hour, Bucketed: true},
+				{Slug: "PROMO_WINTER", AddedAt: hour, Composite: true, Experiment: "WINTER_TEST"},
+			},
+			want: []entity.UserSegment{
+				{Slug: "PROMO_SUMMER_EU", AddedAt: hour, Bucketed: true},
+				{Slug: "PROMO_WINTER", AddedAt: hour, Composite: true, Experiment: "WINTER_TEST"},
+				{Slug: "PROMO_SUMMER", AddedAt: hour, Inherited: true},
+				{Slug: "PROMO", AddedAt: hour, Inherited: true},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			assert.Equal(t, tc.want, inheritSegments(tc.segments, parents))
+		})
+	}
+}
+
+func TestComposeSegments(t *testing.T) {
+	hour := time.Time{}.Add(time.Hour)
+	day := time.Time{}.Add(24 * time.Hour)
+	composites := make(map[string]*expression.Expr)
+	for slug, def := range map[string]string{
+		"VOICE_NO_VAS":    "VOICE_MESSAGES AND NOT PERFORMANCE_VAS",
+		"VOICE_OR_VAS":    "VOICE_NO_VAS OR PERFORMANCE_VAS",
+		"VOICE_AND_PROMO": "VOICE_MESSAGES AND PROMO",
+	} {
+		e, err := expression.Parse(def)
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when parsing an expression", err)
+		}
+		composites[slug] = e
+	}
+
+	testCases := []struct {
+		testName string
+		segments []entity.UserSegment
+		want     []entity.UserSegment
+	}{
+		{
+			testName: "no memberships",
+			segments: nil,
+			want:     nil,
+		},
+		{
+			testName: "composite of a composite",
+			segments: []entity.UserSegment{{Slug: "VOICE_MESSAGES", AddedAt: hour, ExpiresAt: &day}},
+			want: []entity.UserSegment{
+				{Slug: "VOICE_MESSAGES", AddedAt: hour, ExpiresAt: &day},
+				{Slug: "VOICE_NO_VAS", AddedAt: hour, Composite: true},
+				{Slug: "VOICE_OR_VAS", AddedAt: hour, Composite: true},
+			},
+		},
+		{
+			testName: "excluded segment",
+			segments: []entity.UserSegment{{Slug: "VOICE_MESSAGES", AddedAt: hour}, {Slug: "PERFORMANCE_VAS", AddedAt: day}},
+			want: []entity.UserSegment{
+				{Slug: "VOICE_MESSAGES", AddedAt: hour},
+				{Slug: "PERFORMANCE_VAS", AddedAt: day},
+				{Slug: "VOICE_OR_VAS", AddedAt: day, Composite: true},
+			},
+		},
+		{
+			testName: "starts with the latest membership",
+			segments: []entity.UserSegment{{Slug: "PROMO", AddedAt: day}, {Slug: "VOICE_MESSAGES", AddedAt: hour}},
+			want: []entity.UserSegment{
+				{Slug: "PROMO", AddedAt: day},
+				{Slug: "VOICE_MESSAGES", AddedAt: hour},
+				{Slug: "VOICE_AND_PROMO", AddedAt: day, Composite: true},
+				{Slug: "VOICE_NO_VAS", AddedAt: hour, Composite: true},
+				{Slug: "VOICE_OR_VAS", AddedAt: hour, Composite: true},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.testName, func(t *testing.T) {
+			assert.Equal(t, tc.want, composeSegments(tc.segments, composites))
+		})
+	}
+}
+
+// fakeUserService serves attributes of a fixed set of users
+type fakeUserService struct {
+	users    []entity.UserAttributes // sorted by id
+	onSample func()                  // if set, called on every sampling, e.g. to change segments concurrently
+	rotate   bool                    // if set, every sampling continues where the previous one ended
+	next     int                     // index of the user the next sampling starts with
+}
+
+// GetRandomUsers isn't random, it returns `percent` of the users in a row starting with the `next` one
+func (f *fakeUserService) GetRandomUsers(ctx context.Context, percent int) ([]int, error) {
+	if f.onSample != nil {
+		f.onSample()
+	}
+
+	n := len(f.users) * percent / 100
+	var userIDs []int
+	for i := 0; i < n; i++ {
+		userIDs = append(userIDs, f.users[(f.next+i)%len(f.users)].UserID)
+	}
+
+	if f.rotate {
+		f.next = (f.next + n) % len(f.users)
+	}
+	return userIDs, nil
+}
+
+func (f *fakeUserService) GetUserAttributes(ctx context.Context, afterUserID int, limit int) ([]entity.UserAttributes, error) {
+	i := sort.Search(len(f.users), func(i int) bool { return f.users[i].UserID > afterUserID })
+	return f.users[i:min(i+limit, len(f.users))], nil
+}
+
+func TestRefreshDynamicSegments(t *testing.T) {
+	// more users than fit in a page
+	users := &fakeUserService{}
+	for id := 1000; id < 1000+userAttributesPageSize+500; id++ {
+		country := "RU"
+		if id%2 == 1 {
+			country = "KZ"
+		}
+		users.users = append(users.users, entity.UserAttributes{UserID: id, Attributes: map[string]any{"country": country, "age": float64(id % 100)}})
+	}
+
+	s := New(memory.New(fixedtimeprovider.New(time.Time{})), nil, users, fixedtimeprovider.New(time.Time{}))
+
+	var changes []entity.Operation
+	s.AddChangeHook(func(ctx context.Context, operations []entity.Operation) { changes = append(changes, operations...) })
+
+	assert.ErrorIs(t, s.CreateSegment(context.Background(), "RU", entity.SegmentMetadata{Rule: `country = "RU" AND`}), ErrInvalidRule)
+	assert.ErrorIs(t, s.CreateSegment(context.Background(), "RU", entity.SegmentMetadata{Rule: `country = "RU"`, Expression: "KZ"}), ErrInvalidRule)
+
+	// users matching the rule are added on creation
+	assert.NoError(t, s.CreateSegment(context.Background(), "RU", entity.SegmentMetadata{Rule: `country = "RU"`}))
+	assert.NoError(t, s.CreateSegment(context.Background(), "ADULTS", entity.SegmentMetadata{Rule: "age >= 18"}))
+	assert.NoError(t, s.CreateSegment(context.Background(), "STATIC", entity.SegmentMetadata{}))
+	assert.Len(t, changes, 750+1500-18*15)
+
+	_, err := s.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "RU"}}, nil)
+	assert.ErrorIs(t, err, ErrSegmentDynamic)
+
+	rule := `country = "KZ"`
+	assert.ErrorIs(t, s.UpdateSegment(context.Background(), "STATIC", entity.SegmentMetadataUpdate{Rule: &rule}), ErrNotDynamic)
+
+	// nothing changes until the attributes do
+	results, err := s.RefreshDynamicSegments(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.RefreshResult{{Slug: "ADULTS"}, {Slug: "RU"}}, results)
+
+	users.users[0].Attributes["country"] = "KZ"
+	users.users[1].Attributes["country"] = "RU"
+	results, err = s.RefreshDynamicSegments(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.RefreshResult{{Slug: "ADULTS"}, {Slug: "RU", AddedCount: 1, RemovedCount: 1}}, results)
+
+	segments, err := s.GetActiveUserSegments(context.Background(), 1001, false)
+	assert.NoError(t, err)
+	if assert.Len(t, segments, 1) {
+		assert.Equal(t, "RU", segments[0].Slug)
+	}
+}
+
+func TestBucketedSegments(t *testing.T) {
+	users := &fakeUserService{}
+	for id := 1000; id < 1000+userAttributesPageSize+500; id++ {
+		users.users = append(users.users, entity.UserAttributes{UserID: id, Attributes: map[string]any{}})
+	}
+
+	s := New(memory.New(fixedtimeprovider.New(time.Time{})), nil, users, fixedtimeprovider.New(time.Time{}))
+
+	assert.ErrorIs(t, s.CreateSegment(context.Background(), "BUCKETED", entity.SegmentMetadata{BucketPercent: 101}), ErrInvalidBucket)
+	assert.ErrorIs(t, s.CreateSegment(context.Background(), "BUCKETED", entity.SegmentMetadata{BucketPercent: 10, ExclusionGroup: "EXP"}), ErrInvalidBucket)
+	_, _, err := s.CreateSegmentAndEnrollPercent(context.Background(), "BUCKETED", entity.SegmentMetadata{BucketPercent: 10}, 10)
+	assert.ErrorIs(t, err, ErrSegmentBucketed)
+
+	// the salt defaults to the slug and stays when the segment is renamed
+	assert.NoError(t, s.CreateSegment(context.Background(), "BUCKETED", entity.SegmentMetadata{BucketPercent: 10}))
+	assert.NoError(t, s.RenameSegment(context.Background(), "BUCKETED", "BUCKETED_10"))
+	assert.NoError(t, s.CreateSegment(context.Background(), "STATIC", entity.SegmentMetadata{}))
+
+	_, err = s.UpdateUserSegments(context.Background(), 1000, []entity.SegmentExpiration{{Slug: "BUCKETED_10"}}, nil)
+	assert.ErrorIs(t, err, ErrSegmentBucketed)
+
+	percent := 30
+	assert.ErrorIs(t, s.UpdateSegment(context.Background(), "STATIC", entity.SegmentMetadataUpdate{BucketPercent: &percent}), ErrNotBucketed)
+
+	// any user id gets an answer, including ones the user service doesn't know yet
+	for _, userID := range []int{1, 1000, 5000} {
+		segments, err := s.GetActiveUserSegments(context.Background(), userID, false)
+		assert.NoError(t, err)
+
+		if bucket.Contains("BUCKETED", 10, userID) {
+			assert.Equal(t, []entity.UserSegment{{Slug: "BUCKETED_10", Bucketed: true}}, segments)
+		} else {
+			assert.Empty(t, segments)
+		}
+	}
+
+	members := func() []int {
+		var userIDs []int
+		assert.NoError(t, s.StreamSegmentMembers(context.Background(), "BUCKETED_10", time.Time{}, func(userID int) error {
+			userIDs = append(userIDs, userID)
+			return nil
+		}))
+		return userIDs
+	}
+
+	before := members()
+	assert.InDelta(t, 150, len(before), 50)
+
+	// raising the percent only adds users
+	assert.NoError(t, s.UpdateSegment(context.Background(), "BUCKETED_10", entity.SegmentMetadataUpdate{BucketPercent: &percent}))
+	after := members()
+	assert.Greater(t, len(after), len(before))
+	assert.Subset(t, after, before)
+
+	page, err := s.GetSegmentMembers(context.Background(), "BUCKETED_10", entity.SegmentMembersRequest{Limit: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, after[:10], page.UserIDs)
+	assert.NotEmpty(t, page.NextCursor)
+}
+
+func TestEnrollPercent(t *testing.T) {
+	users := &fakeUserService{}
+	for id := 1000; id < 1100; id++ {
+		users.users = append(users.users, entity.UserAttributes{UserID: id, Attributes: map[string]any{}})
+	}
+
+	now := time.Date(2023, 8, 31, 0, 0, 0, 0, time.UTC)
+	timeProvider := fixedtimeprovider.New(now)
+	s := New(memory.New(timeProvider), nil, users, timeProvider)
+
+	changes := make(map[entity.OperationType]int)
+	s.AddChangeHook(func(ctx context.Context, operations []entity.Operation) {
+		for _, o := range operations {
+			changes[o.Type]++
+		}
+	})
+
+	_, _, err := s.EnrollPercent(context.Background(), "AVITO_PROMO", 10, nil)
+	assert.ErrorIs(t, err, ErrSegmentNotFound)
+
+	assert.NoError(t, s.CreateSegment(context.Background(), "AVITO_PROMO", entity.SegmentMetadata{}))
+	assert.NoError(t, s.CreateSegment(context.Background(), "BUCKETED", entity.SegmentMetadata{BucketPercent: 10}))
+
+	_, _, err = s.EnrollPercent(context.Background(), "BUCKETED", 10, nil)
+	assert.ErrorIs(t, err, ErrSegmentBucketed)
+	_, _, err = s.EnrollPercent(context.Background(), "AVITO_PROMO", 10, &now)
+	assert.ErrorIs(t, err, ErrExpirationInPast)
+
+	userIDs, result, err := s.EnrollPercent(context.Background(), "AVITO_PROMO", 10, nil)
+	assert.NoError(t, err)
+	assert.Len(t, userIDs, 10)
+	assert.Equal(t, entity.EnrollmentResult{EnrolledCount: 10}, result)
+
+	// topping up skips users that are already in the segment
+	weekLater := now.Add(7 * 24 * time.Hour)
+	userIDs, result, err = s.EnrollPercent(context.Background(), "AVITO_PROMO", 30, &weekLater)
+	assert.NoError(t, err)
+	assert.Len(t, userIDs, 30)
+	assert.Equal(t, entity.EnrollmentResult{EnrolledCount: 20, SkippedCount: 10}, result)
+
+	segments, err := s.GetActiveUserSegments(context.Background(), 1000, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.UserSegment{{Slug: "AVITO_PROMO", AddedAt: now}}, segments)
+
+	segments, err = s.GetActiveUserSegments(context.Background(), 1020, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []entity.UserSegment{{Slug: "AVITO_PROMO", AddedAt: now, ExpiresAt: &weekLater}}, segments)
+	assert.Equal(t, map[entity.OperationType]int{entity.AddedOperationType: 30}, changes)
+
+	// expired memberships are closed before users get the segment again, hooks hear about both
+	timeProvider.SetTime(weekLater.Add(time.Hour))
+	_, result, err = s.EnrollPercent(context.Background(), "AVITO_PROMO", 30, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, entity.EnrollmentResult{EnrolledCount: 20, SkippedCount: 10}, result)
+	assert.Equal(t, map[entity.OperationType]int{entity.AddedOperationType: 50, entity.ExpiredOperationType: 20}, changes)
+
+	assert.NoError(t, s.DeleteSegment(context.Background(), "AVITO_PROMO", "", false))
+	_, _, err = s.EnrollPercent(context.Background(), "AVITO_PROMO", 10, nil)
+	assert.ErrorIs(t, err, ErrSegmentAlreadyDeleted)
+
+	restored, err := s.RestoreSegment(context.Background(), "AVITO_PROMO", true)
+	assert.NoError(t, err)
+	assert.Equal(t, 30, restored)
+	assert.Equal(t, map[entity.OperationType]int{
+		entity.AddedOperationType:           50,
+		entity.ExpiredOperationType:         20,
+		entity.SegmentDeletedOperationType:  30,
+		entity.SegmentRestoredOperationType: 30,
+	}, changes)
+}
+
+func TestCreateSegmentAndEnrollPercentDeletedConcurrently(t *testing.T) {
+	users := &fakeUserService{}
+	for id := 1000; id < 1100; id++ {
+		users.users = append(users.users, entity.UserAttributes{UserID: id, Attributes: map[string]any{}})
+	}
+
+	now := time.Date(2023, 8, 31, 0, 0, 0, 0, time.UTC)
+	s := New(memory.New(fixedtimeprovider.New(now)), nil, users, fixedtimeprovider.New(now))
+
+	// the segment is deleted after it's created but before users are enrolled
+	users.onSample = func() {
+		assert.NoError(t, s.DeleteSegment(context.Background(), "AVITO_PROMO", "", false))
+	}
+
+	_, _, err := s.CreateSegmentAndEnrollPercent(context.Background(), "AVITO_PROMO", entity.SegmentMetadata{}, 10)
+	assert.ErrorIs(t, err, ErrSegmentAlreadyDeleted)
+}
+
+func TestEnrollPercentExclusionGroup(t *testing.T) {
+	users := &fakeUserService{rotate: true}
+	for id := 1000; id < 1100; id++ {
+		users.users = append(users.users, entity.UserAttributes{UserID: id, Attributes: map[string]any{}})
+	}
+
+	now := time.Date(2023, 8, 31, 0, 0, 0, 0, time.UTC)
+	s := New(memory.New(fixedtimeprovider.New(now)), nil, users, fixedtimeprovider.New(now))
+
+	samples := 0
+	users.onSample = func() { samples++ }
+
+	group := entity.SegmentMetadata{ExclusionGroup: "AVITO_CHECKOUT"}
+	taken := make(map[int]struct{})
+	enroll := func(userIDs []int) {
+		for _, userID := range userIDs {
+			_, ok := taken[userID]
+			assert.False(t, ok, "user %d is in two segments of the group", userID)
+			taken[userID] = struct{}{}
+		}
+	}
+
+	userIDs, result, err := s.CreateSegmentAndEnrollPercent(context.Background(), "AVITO_CHECKOUT_A", group, 30)
+	assert.NoError(t, err)
+	assert.Equal(t, entity.EnrollmentResult{EnrolledCount: 30}, result)
+	assert.Equal(t, 1, samples)
+	enroll(userIDs)
+
+	// members of the group are replaced by sampling again, so they don't take up the percent
+	users.next = 0
+	userIDs, result, err = s.CreateSegmentAndEnrollPercent(context.Background(), "AVITO_CHECKOUT_B", group, 50)
+	assert.NoError(t, err)
+	assert.Len(t, userIDs, 50)
+	assert.Equal(t, entity.EnrollmentResult{EnrolledCount: 50}, result)
+	assert.Equal(t, 3, samples)
+	enroll(userIDs)
+
+	// there are fewer users left than the percent, sampling stops once it finds nobody new
+	assert.NoError(t, s.CreateSegment(context.Background(), "AVITO_CHECKOUT_C", group))
+	userIDs, result, err = s.EnrollPercent(context.Background(), "AVITO_CHECKOUT_C", 30, nil)
+	assert.NoError(t, err)
+	assert.Len(t, userIDs, 20)
+	assert.Equal(t, entity.EnrollmentResult{EnrolledCount: 20}, result)
+	assert.Equal(t, 8, samples)
+	enroll(userIDs)
+
+	// topping up a segment of the group samples its own members again, but nobody from the other segments
+	userIDs, result, err = s.EnrollPercent(context.Background(), "AVITO_CHECKOUT_A", 10, nil)
+	assert.NoError(t, err)
+	assert.Len(t, userIDs, 10)
+	assert.Equal(t, entity.EnrollmentResult{SkippedCount: 10}, result)
+}
+
+func TestExperiments(t *testing.T) {
+	users := &fakeUserService{}
+	for id := 1000; id < 2000; id++ {
+		users.users = append(users.users, entity.UserAttributes{UserID: id, Attributes: map[string]any{}})
+	}
+
+	now := time.Date(2023, 8, 31, 0, 0, 0, 0, time.UTC)
+	s := New(memory.New(fixedtimeprovider.New(now)), nil, users, fixedtimeprovider.New(now))
+
+	for _, variants := range [][]entity.ExperimentVariant{
+		{{Slug: "EXP_A", Weight: 100}},
+		{{Slug: "EXP_A", Weight: 50}, {Slug: "EXP_A", Weight: 50}},
+		{{Slug: "EXP_A", Weight: 50}, {Slug: "EXP_B", Weight: 40}},
+		{{Slug: "EXP_A", Weight: 110}, {Slug: "EXP_B", Weight: -10}},
+	} {
+		assert.ErrorIs(t, s.CreateExperiment(context.Background(), "EXP", variants), ErrInvalidVariants)
+	}
+
+	variants := []entity.ExperimentVariant{{Slug: "EXP_A", Weight: 45}, {Slug: "EXP_B", Weight: 45}, {Slug: "EXP_CONTROL", Weight: 10}}
+	assert.NoError(t, s.CreateExperiment(context.Background(), "EXP", variants))
+
+	_, _, err := s.EnrollExperiment(context.Background(), "NONE", 50, nil)
+	assert.ErrorIs(t, err, ErrExperimentNotFound)
+	_, _, err = s.EnrollExperiment(context.Background(), "EXP", 50, nil)
+	assert.ErrorIs(t, err, ErrExperimentNotStarted)
+
+	// variants can't leave the group that keeps users in one of them
+	empty := ""
+	assert.ErrorIs(t, s.UpdateSegment(context.Background(), "EXP_A", entity.SegmentMetadataUpdate{ExclusionGroup: &empty}), ErrSegmentInExperiment)
+
+	assert.NoError(t, s.StartExperiment(context.Background(), "EXP"))
+	userIDs, results, err := s.EnrollExperiment(context.Background(), "EXP", 50, nil)
+	assert.NoError(t, err)
+	assert.Len(t, userIDs, 500)
+	if assert.Len(t, results, 3) {
+		assert.InDelta(t, 225, results[0].EnrolledCount, 50)
+		assert.InDelta(t, 225, results[1].EnrolledCount, 50)
+		assert.InDelta(t, 50, results[2].EnrolledCount, 25)
+		assert.Equal(t, 500, results[0].EnrolledCount+results[1].EnrolledCount+results[2].EnrolledCount)
+	}
+
+	// lookups tell the variant and its experiment
+	segments, err := s.GetActiveUserSegments(context.Background(), userIDs[0], false)
+	assert.NoError(t, err)
+	if assert.Len(t, segments, 1) {
+		assert.Equal(t, variants[variantOf(variants, bucket.Of(experimentSalt("EXP"), userIDs[0]))].Slug, segments[0].Slug)
+		assert.Equal(t, "EXP", segments[0].Experiment)
+	}
+
+	// the same users get the same variants again
+	_, results, err = s.EnrollExperiment(context.Background(), "EXP", 50, nil)
+	assert.NoError(t, err)
+	for _, result := range results {
+		assert.Zero(t, result.EnrolledCount)
+		assert.Zero(t, result.ExcludedCount)
+	}
+
+	assert.NoError(t, s.StopExperiment(context.Background(), "EXP"))
+	_, _, err = s.EnrollExperiment(context.Background(), "EXP", 50, nil)
+	assert.ErrorIs(t, err, ErrExperimentAlreadyStopped)
+
+	experiment, err := s.GetExperiment(context.Background(), "EXP")
+	assert.NoError(t, err)
+	assert.Equal(t, &now, experiment.StartedAt)
+	assert.Equal(t, &now, experiment.StoppedAt)
+}
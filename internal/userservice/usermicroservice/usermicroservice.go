@@ -2,10 +2,13 @@ package usermicroservice
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
+
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/entity"
 )
 
 type UserMicroservice struct {
@@ -20,7 +23,17 @@ type JsonUsersRandomResponse struct {
 	UserIDs []int `json:"user_ids"`
 }
 
-func (u *UserMicroservice) GetRandomUsers(percent int) ([]int, error) {
+type JsonUsersAttributesRequest struct {
+	AfterUserID int `json:"after_user_id"`
+	Limit       int `json:"limit"`
+}
+
+type JsonUsersAttributesResponse struct {
+	Users []entity.UserAttributes `json:"users"`
+}
+
+// GetRandomUsers asks the user service for random users. The request is cancelled along with `ctx`
+func (u *UserMicroservice) GetRandomUsers(ctx context.Context, percent int) ([]int, error) {
 	apiUrl, err := url.JoinPath(u.BaseURL, "/api/v1/users/random")
 	if err != nil {
 		return nil, fmt.Errorf("usermicroservice.GetRandomUsers() - url.JoinPath(): %w", err)
@@ -31,9 +44,9 @@ func (u *UserMicroservice) GetRandomUsers(percent int) ([]int, error) {
 		return nil, fmt.Errorf("usermicroservice.GetRandomUsers() - json.Encoder.Encode(): %w", err)
 	}
 
-	request, err := http.NewRequest(http.MethodGet, apiUrl, &b)
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, apiUrl, &b)
 	if err != nil {
-		return nil, fmt.Errorf("usermicroservice.GetRandomUsers() - http.NewRequest(): %w", err)
+		return nil, fmt.Errorf("usermicroservice.GetRandomUsers() - http.NewRequestWithContext(): %w", err)
 	}
 
 	resp, err := http.DefaultClient.Do(request)
@@ -41,12 +54,12 @@ func (u *UserMicroservice) GetRandomUsers(percent int) ([]int, error) {
 		return nil, fmt.Errorf("usermicroservice.GetRandomUsers() - http.DefaultClient.Do(): %w", err)
 	}
 
+	defer resp.Body.Close()
+
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("usermicroservice.GetRandomUsers - http.Get(): status code: %d", resp.StatusCode)
 	}
 
-	defer resp.Body.Close()
-
 	var j JsonUsersRandomResponse
 	if err := json.NewDecoder(resp.Body).Decode(&j); err != nil {
 		return nil, fmt.Errorf("usermicroservice.GetRandomUsers - unmarshall response error: %w", err)
@@ -55,6 +68,42 @@ func (u *UserMicroservice) GetRandomUsers(percent int) ([]int, error) {
 	return j.UserIDs, nil
 }
 
+// GetUserAttributes asks the user service for a page of users with their attributes. The request is cancelled along with `ctx`
+func (u *UserMicroservice) GetUserAttributes(ctx context.Context, afterUserID int, limit int) ([]entity.UserAttributes, error) {
+	apiUrl, err := url.JoinPath(u.BaseURL, "/api/v1/users/attributes")
+	if err != nil {
+		return nil, fmt.Errorf("usermicroservice.GetUserAttributes() - url.JoinPath(): %w", err)
+	}
+
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(JsonUsersAttributesRequest{afterUserID, limit}); err != nil {
+		return nil, fmt.Errorf("usermicroservice.GetUserAttributes() - json.Encoder.Encode(): %w", err)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, apiUrl, &b)
+	if err != nil {
+		return nil, fmt.Errorf("usermicroservice.GetUserAttributes() - http.NewRequestWithContext(): %w", err)
+	}
+
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("usermicroservice.GetUserAttributes() - http.DefaultClient.Do(): %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("usermicroservice.GetUserAttributes - http.Get(): status code: %d", resp.StatusCode)
+	}
+
+	var j JsonUsersAttributesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&j); err != nil {
+		return nil, fmt.Errorf("usermicroservice.GetUserAttributes - unmarshall response error: %w", err)
+	}
+
+	return j.Users, nil
+}
+
 func New(baseURL string) (*UserMicroservice, error) {
 	userService := &UserMicroservice{BaseURL: baseURL}
 
@@ -1,5 +1,15 @@
 package userservice
 
+import (
+	"context"
+
+	"github.com/QiZD90/dynamic-customer-segmentation/internal/entity"
+)
+
 type UserService interface {
-	GetRandomUsers(percent int) ([]int, error)
+	GetRandomUsers(ctx context.Context, percent int) ([]int, error)
+
+	// GetUserAttributes returns at most `limit` users with ids greater than `afterUserID` along with their attributes,
+	// sorted by id. Fewer than `limit` users means that there are no more of them
+	GetUserAttributes(ctx context.Context, afterUserID int, limit int) ([]entity.UserAttributes, error)
 }
@@ -0,0 +1,30 @@
+CREATE TABLE operations (
+    id SERIAL PRIMARY KEY NOT NULL UNIQUE,
+    user_id INT NOT NULL,
+    segment_id INT NOT NULL,
+    FOREIGN KEY (segment_id) REFERENCES segments(id),
+
+    type TEXT NOT NULL, -- one of `entity.OperationType` values
+    time TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP -- expiration date that the membership had at the time of the operation
+);
+
+CREATE INDEX operations_user_id_time_idx ON operations(user_id, time);
+
+-- backfill the log from existing memberships. Removals that happened at the exact time
+-- of segment deletion are considered to be caused by it
+INSERT INTO operations(user_id, segment_id, type, time, expires_at)
+SELECT user_id, segment_id, type, time, expires_at FROM (
+    SELECT us.id, us.user_id, us.segment_id, 'added' AS type, us.added_at AS time, us.expires_at
+    FROM users_segments us
+
+    UNION ALL
+
+    SELECT us.id, us.user_id, us.segment_id,
+        CASE WHEN us.removed_at = s.deleted_at THEN 'segment_deleted' ELSE 'removed' END,
+        us.removed_at, us.expires_at
+    FROM users_segments us
+    JOIN segments s ON s.id=us.segment_id
+    WHERE us.removed_at IS NOT NULL
+) history
+ORDER BY time, id;
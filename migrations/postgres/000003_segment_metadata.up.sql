@@ -0,0 +1,9 @@
+ALTER TABLE segments
+    ADD COLUMN description TEXT NOT NULL DEFAULT '',
+    ADD COLUMN owner TEXT NOT NULL DEFAULT '',
+    ADD COLUMN tags JSONB NOT NULL DEFAULT '[]', -- JSON array of strings
+    ADD COLUMN attributes JSONB NOT NULL DEFAULT '{}'; -- JSON object with arbitrary values
+
+CREATE INDEX segments_owner_idx ON segments(owner);
+CREATE INDEX segments_tags_idx ON segments USING GIN (tags);
+CREATE INDEX segments_attributes_idx ON segments USING GIN (attributes);
@@ -0,0 +1,11 @@
+-- previous slugs of renamed segments. A slug is unique among both current slugs and aliases
+CREATE TABLE segment_aliases (
+    id SERIAL PRIMARY KEY NOT NULL UNIQUE,
+    slug TEXT NOT NULL UNIQUE,
+    segment_id INT NOT NULL,
+    FOREIGN KEY (segment_id) REFERENCES segments(id),
+
+    created_at TIMESTAMP NOT NULL DEFAULT NOW() -- time of the rename
+);
+
+CREATE INDEX segment_aliases_segment_id_idx ON segment_aliases(segment_id);
@@ -0,0 +1,13 @@
+-- tombstones of erased users. Everything else about the user is deleted for good
+CREATE TABLE erasures (
+    id SERIAL PRIMARY KEY NOT NULL UNIQUE,
+    user_id INT NOT NULL,
+    erased_at TIMESTAMP NOT NULL,
+
+    memberships_count INT NOT NULL, -- number of deleted `users_segments` rows
+    operations_count INT NOT NULL, -- number of deleted `operations` rows
+    files_count INT NOT NULL -- number of deleted CSV reports
+);
+
+CREATE INDEX erasures_user_id_idx ON erasures(user_id);
+CREATE INDEX users_segments_user_id_idx ON users_segments(user_id);
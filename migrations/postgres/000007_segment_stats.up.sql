@@ -0,0 +1,2 @@
+-- per-day statistics of a segment
+CREATE INDEX operations_segment_id_time_idx ON operations(segment_id, time);
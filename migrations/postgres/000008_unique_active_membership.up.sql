@@ -0,0 +1,27 @@
+-- only the newest not removed membership of a user in a segment is kept open. Older ones that had
+-- expired by the time it was added are closed at their expiration and logged as expired, the rest
+-- are duplicates left by concurrent requests and are merged into the newest one
+CREATE TEMPORARY TABLE newest_memberships AS
+SELECT DISTINCT ON (user_id, segment_id) id, user_id, segment_id, added_at
+FROM users_segments
+WHERE removed_at IS NULL
+ORDER BY user_id, segment_id, id DESC;
+
+INSERT INTO operations(user_id, segment_id, type, time, expires_at)
+SELECT us.user_id, us.segment_id, 'expired', us.expires_at, us.expires_at
+FROM users_segments us
+JOIN newest_memberships n ON n.user_id=us.user_id AND n.segment_id=us.segment_id AND n.id<>us.id
+WHERE us.removed_at IS NULL
+AND us.expires_at <= n.added_at
+ORDER BY us.expires_at, us.id;
+
+UPDATE users_segments us
+SET removed_at=LEAST(us.expires_at, n.added_at)
+FROM newest_memberships n
+WHERE n.user_id=us.user_id AND n.segment_id=us.segment_id AND n.id<>us.id
+AND us.removed_at IS NULL;
+
+DROP TABLE newest_memberships;
+
+-- at most one not removed membership of a user in a segment
+CREATE UNIQUE INDEX users_segments_active_idx ON users_segments(user_id, segment_id) WHERE removed_at IS NULL;
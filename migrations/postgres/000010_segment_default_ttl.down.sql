@@ -0,0 +1 @@
+ALTER TABLE segments DROP COLUMN IF EXISTS default_ttl;
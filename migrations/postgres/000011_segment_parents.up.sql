@@ -0,0 +1,4 @@
+-- parent of the segment, members of the segment are inherited members of the parent and its ancestors
+ALTER TABLE segments ADD COLUMN parent_id INT REFERENCES segments(id);
+
+CREATE INDEX segments_parent_id_idx ON segments(parent_id);
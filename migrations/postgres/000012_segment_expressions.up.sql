@@ -0,0 +1,2 @@
+-- boolean expression over other segments, empty for segments that aren't composite
+ALTER TABLE segments ADD COLUMN expression TEXT NOT NULL DEFAULT '';
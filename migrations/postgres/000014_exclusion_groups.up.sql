@@ -0,0 +1,10 @@
+-- segments of the same exclusion group are mutually exclusive. A group is created along with its first segment
+CREATE TABLE exclusion_groups (
+    id SERIAL PRIMARY KEY NOT NULL UNIQUE,
+    name TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE segments ADD COLUMN exclusion_group_id INT REFERENCES exclusion_groups(id); -- null for segments that aren't in a group
+
+CREATE INDEX segments_exclusion_group_id_idx ON segments(exclusion_group_id) WHERE exclusion_group_id IS NOT NULL;
@@ -0,0 +1,2 @@
+ALTER TABLE segments DROP COLUMN IF EXISTS bucket_percent;
+ALTER TABLE segments DROP COLUMN IF EXISTS bucket_salt;
@@ -0,0 +1,21 @@
+-- experiments split enrolled users between their variant segments by weight. Variants are segments
+-- in the exclusion group named after the experiment, so a user is in at most one of them
+CREATE TABLE experiments (
+    id SERIAL PRIMARY KEY NOT NULL UNIQUE,
+    slug TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    started_at TIMESTAMP, -- if this column is null, the experiment hasn't been started yet
+    stopped_at TIMESTAMP -- if this column is not null, the experiment was stopped and doesn't enroll users anymore
+);
+
+CREATE TABLE experiment_variants (
+    id SERIAL PRIMARY KEY NOT NULL UNIQUE,
+    experiment_id INT NOT NULL,
+    FOREIGN KEY (experiment_id) REFERENCES experiments(id),
+    segment_id INT NOT NULL UNIQUE,
+    FOREIGN KEY (segment_id) REFERENCES segments(id),
+
+    weight INT NOT NULL -- percent of enrolled users, weights of an experiment sum up to 100
+);
+
+CREATE INDEX experiment_variants_experiment_id_idx ON experiment_variants(experiment_id);
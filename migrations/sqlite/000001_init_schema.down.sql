@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS users_segments;
+
+DROP TABLE IF EXISTS segments;
\ No newline at end of file
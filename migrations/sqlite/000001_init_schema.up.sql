@@ -0,0 +1,16 @@
+CREATE TABLE segments (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    slug TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL, -- times are always written by the application in UTC, see `sqlite.dsnParams`
+    deleted_at TIMESTAMP
+);
+
+CREATE TABLE users_segments (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    segment_id INTEGER NOT NULL REFERENCES segments(id),
+    user_id INTEGER NOT NULL,
+
+    added_at TIMESTAMP NOT NULL,
+    removed_at TIMESTAMP, -- if this column is not null, this record was removed, either manually or by deleting associated segment
+    expires_at TIMESTAMP -- if this column is not null, this record has an expiration date. if the timestamp is in the past, it has already expired
+);
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS segments_owner_idx;
+
+ALTER TABLE segments DROP COLUMN attributes;
+ALTER TABLE segments DROP COLUMN tags;
+ALTER TABLE segments DROP COLUMN owner;
+ALTER TABLE segments DROP COLUMN description;
@@ -0,0 +1,6 @@
+ALTER TABLE segments ADD COLUMN description TEXT NOT NULL DEFAULT '';
+ALTER TABLE segments ADD COLUMN owner TEXT NOT NULL DEFAULT '';
+ALTER TABLE segments ADD COLUMN tags TEXT NOT NULL DEFAULT '[]'; -- JSON array of strings
+ALTER TABLE segments ADD COLUMN attributes TEXT NOT NULL DEFAULT '{}'; -- JSON object with arbitrary values
+
+CREATE INDEX segments_owner_idx ON segments(owner);
@@ -0,0 +1,10 @@
+-- previous slugs of renamed segments. A slug is unique among both current slugs and aliases
+CREATE TABLE segment_aliases (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    slug TEXT NOT NULL UNIQUE,
+    segment_id INTEGER NOT NULL REFERENCES segments(id),
+
+    created_at TIMESTAMP NOT NULL -- time of the rename
+);
+
+CREATE INDEX segment_aliases_segment_id_idx ON segment_aliases(segment_id);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS users_segments_user_id_idx;
+DROP TABLE IF EXISTS erasures;
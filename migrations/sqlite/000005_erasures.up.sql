@@ -0,0 +1,13 @@
+-- tombstones of erased users. Everything else about the user is deleted for good
+CREATE TABLE erasures (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    user_id INTEGER NOT NULL,
+    erased_at TIMESTAMP NOT NULL,
+
+    memberships_count INTEGER NOT NULL, -- number of deleted `users_segments` rows
+    operations_count INTEGER NOT NULL, -- number of deleted `operations` rows
+    files_count INTEGER NOT NULL -- number of deleted CSV reports
+);
+
+CREATE INDEX erasures_user_id_idx ON erasures(user_id);
+CREATE INDEX users_segments_user_id_idx ON users_segments(user_id);
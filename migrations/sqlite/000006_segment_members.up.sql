@@ -0,0 +1,2 @@
+-- reverse lookup of the members of a segment
+CREATE INDEX users_segments_segment_id_user_id_idx ON users_segments(segment_id, user_id);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS operations_segment_id_time_idx;
@@ -0,0 +1,31 @@
+-- only the newest not removed membership of a user in a segment is kept open. Older ones that had
+-- expired by the time it was added are closed at their expiration and logged as expired, the rest
+-- are duplicates left by concurrent requests and are merged into the newest one
+CREATE TEMPORARY TABLE newest_memberships AS
+SELECT us.id, us.user_id, us.segment_id, us.added_at
+FROM users_segments us
+JOIN (
+    SELECT MAX(id) AS id
+    FROM users_segments
+    WHERE removed_at IS NULL
+    GROUP BY user_id, segment_id
+) newest ON newest.id=us.id;
+
+INSERT INTO operations(user_id, segment_id, type, time, expires_at)
+SELECT us.user_id, us.segment_id, 'expired', us.expires_at, us.expires_at
+FROM users_segments us
+JOIN newest_memberships n ON n.user_id=us.user_id AND n.segment_id=us.segment_id AND n.id<>us.id
+WHERE us.removed_at IS NULL
+AND us.expires_at <= n.added_at
+ORDER BY us.expires_at, us.id;
+
+UPDATE users_segments
+SET removed_at=CASE WHEN expires_at < n.added_at THEN expires_at ELSE n.added_at END
+FROM newest_memberships n
+WHERE n.user_id=users_segments.user_id AND n.segment_id=users_segments.segment_id AND n.id<>users_segments.id
+AND users_segments.removed_at IS NULL;
+
+DROP TABLE newest_memberships;
+
+-- at most one not removed membership of a user in a segment
+CREATE UNIQUE INDEX users_segments_active_idx ON users_segments(user_id, segment_id) WHERE removed_at IS NULL;
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS users_segments_expires_at_idx;
@@ -0,0 +1,2 @@
+-- lookup of expired memberships that are still open
+CREATE INDEX users_segments_expires_at_idx ON users_segments(expires_at) WHERE removed_at IS NULL AND expires_at IS NOT NULL;
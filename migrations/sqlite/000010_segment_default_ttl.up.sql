@@ -0,0 +1,2 @@
+-- ISO-8601 or Go duration of memberships added without an expiration, empty if they don't expire
+ALTER TABLE segments ADD COLUMN default_ttl TEXT NOT NULL DEFAULT '';
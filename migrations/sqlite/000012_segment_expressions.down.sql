@@ -0,0 +1 @@
+ALTER TABLE segments DROP COLUMN expression;
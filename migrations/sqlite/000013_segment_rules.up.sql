@@ -0,0 +1,2 @@
+-- rule over user attributes, empty for segments that aren't dynamic
+ALTER TABLE segments ADD COLUMN rule TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS segments_exclusion_group_id_idx;
+ALTER TABLE segments DROP COLUMN exclusion_group_id;
+DROP TABLE IF EXISTS exclusion_groups;
@@ -0,0 +1,10 @@
+-- segments of the same exclusion group are mutually exclusive. A group is created along with its first segment
+CREATE TABLE exclusion_groups (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    name TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL
+);
+
+ALTER TABLE segments ADD COLUMN exclusion_group_id INTEGER REFERENCES exclusion_groups(id); -- null for segments that aren't in a group
+
+CREATE INDEX segments_exclusion_group_id_idx ON segments(exclusion_group_id) WHERE exclusion_group_id IS NOT NULL;
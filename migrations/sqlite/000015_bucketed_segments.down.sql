@@ -0,0 +1,2 @@
+ALTER TABLE segments DROP COLUMN bucket_percent;
+ALTER TABLE segments DROP COLUMN bucket_salt;
@@ -0,0 +1,3 @@
+-- bucketed segments decide memberships by the hash of the salt and user id, empty salt for segments that aren't bucketed
+ALTER TABLE segments ADD COLUMN bucket_salt TEXT NOT NULL DEFAULT '';
+ALTER TABLE segments ADD COLUMN bucket_percent INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS experiment_variants_experiment_id_idx;
+DROP TABLE IF EXISTS experiment_variants;
+DROP TABLE IF EXISTS experiments;
@@ -0,0 +1,19 @@
+-- experiments split enrolled users between their variant segments by weight. Variants are segments
+-- in the exclusion group named after the experiment, so a user is in at most one of them
+CREATE TABLE experiments (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    slug TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL,
+    started_at TIMESTAMP, -- if this column is null, the experiment hasn't been started yet
+    stopped_at TIMESTAMP -- if this column is not null, the experiment was stopped and doesn't enroll users anymore
+);
+
+CREATE TABLE experiment_variants (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    experiment_id INTEGER NOT NULL REFERENCES experiments(id),
+    segment_id INTEGER NOT NULL UNIQUE REFERENCES segments(id),
+
+    weight INTEGER NOT NULL -- percent of enrolled users, weights of an experiment sum up to 100
+);
+
+CREATE INDEX experiment_variants_experiment_id_idx ON experiment_variants(experiment_id);